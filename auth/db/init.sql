@@ -6,15 +6,96 @@ ALTER USER postgres WITH PASSWORD 'password';
 
 CREATE EXTENSION IF NOT EXISTS "pgcrypto"; -- uuid extension
 
+DROP TABLE IF EXISTS email_tokens CASCADE;
+DROP TABLE IF EXISTS login_challenges CASCADE;
+DROP TABLE IF EXISTS recovery_codes CASCADE;
+DROP TABLE IF EXISTS refresh_tokens CASCADE;
+DROP TABLE IF EXISTS sessions CASCADE;
 DROP TABLE IF EXISTS users CASCADE;
 
 CREATE TABLE IF NOT EXISTS users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     username TEXT UNIQUE NOT NULL,
     password_hash TEXT NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    -- Base32 TOTP secret of two-factor authentication, NULL when disabled.
+    totp_secret TEXT,
+    -- Secret being enrolled, it replaces totp_secret once a code is confirmed.
+    totp_pending_secret TEXT,
+    -- Time step of the last accepted code, codes can't be used twice.
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    -- Wrong codes in a row across login challenges, and the end of the
+    -- lockout they caused.
+    totp_failed_attempts INTEGER NOT NULL DEFAULT 0,
+    totp_locked_until TIMESTAMP WITH TIME ZONE,
+    -- Optional, passwords can only be reset through a verified address.
+    email TEXT,
+    email_verified_at TIMESTAMP WITH TIME ZONE
 );
 
+-- An address belongs to the user verifying it first, unverified ones don't
+-- keep its owner from using it.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (lower(email)) WHERE email_verified_at IS NOT NULL;
+
+-- A session is started by a login, refresh tokens of the session are rotated
+-- on every refresh. Only hashes of the tokens are stored.
+CREATE TABLE IF NOT EXISTS sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    -- Client of the last login or refresh, shown in the list of sessions.
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sessions (expires_at);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_session_id_idx ON refresh_tokens (session_id);
+
+-- One-time codes for logging in without the authenticator, hashed.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- Second step of logins with two-factor authentication, hashed.
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS login_challenges_expires_at_idx ON login_challenges (expires_at);
+
+-- Single-use tokens of email verification and password reset links, hashed.
+-- email is the address a verification token was sent to.
+CREATE TABLE IF NOT EXISTS email_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL CHECK (purpose IN ('verify_email', 'reset_password')),
+    email TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_tokens_user_id_idx ON email_tokens (user_id, purpose);
+CREATE INDEX IF NOT EXISTS email_tokens_expires_at_idx ON email_tokens (expires_at);
+
 INSERT INTO users (username, password_hash)
 VALUES ('admin', '$2a$10$KsMkClK0bvgBZVSGTh76E.iEwg9VWFEpFTbPuwKCZZG3822DHiiSa') -- bcrypt hash for 'password'
 ON CONFLICT (username) DO NOTHING;
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Email verification and password reset links carry a single-use token.
+// Like refresh tokens, only their SHA-256 hashes are stored, and a new token
+// replaces the unused ones of the user for the same purpose.
+const (
+	EMAIL_VERIFICATION_TTL = 24 * time.Hour
+	PASSWORD_RESET_TTL     = time.Hour
+	MAX_EMAIL_LEN          = 254
+	MIN_PASSWORD_LEN       = 6
+
+	PURPOSE_VERIFY_EMAIL   = "verify_email"
+	PURPOSE_RESET_PASSWORD = "reset_password"
+
+	// EMAIL_INDEX makes addresses unique, case-insensitively.
+	EMAIL_INDEX = "users_email_idx"
+	// PG_UNIQUE_VIOLATION is the SQLSTATE of unique constraint violations.
+	PG_UNIQUE_VIOLATION = "23505"
+)
+
+var (
+	ErrInvalidEmail      = errors.New("invalid email address")
+	ErrEmailTaken        = errors.New("email address is used by another user")
+	ErrEmailVerified     = errors.New("email address is already verified")
+	ErrNoEmail           = errors.New("user has no verified email address")
+	ErrInvalidEmailToken = errors.New("token is invalid or expired")
+	ErrEmailTokenExpired = fmt.Errorf("%w: expired", ErrInvalidEmailToken)
+)
+
+// normalizeEmail trims the address and checks it is a bare address, without
+// display name. Addresses are compared case-insensitively.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" || len(email) > MAX_EMAIL_LEN {
+		return "", ErrInvalidEmail
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return email, nil
+}
+
+// checkEmailFree returns ErrEmailTaken if another user than userId verified
+// the address. Unverified addresses are free: anyone could claim someone
+// else's, only verification makes it theirs.
+func checkEmailFree(ctx context.Context, tx pgx.Tx, email string, userId uuid.UUID) error {
+	var taken bool
+	err := tx.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM users WHERE lower(email) = lower($1) AND id <> $2 AND email_verified_at IS NOT NULL)",
+		email, userId).
+		Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// emailTakenErr returns ErrEmailTaken if err violates the unique index of
+// verified addresses, so concurrent verifications can't give two users the
+// same one, and err otherwise.
+func emailTakenErr(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == PG_UNIQUE_VIOLATION && pgErr.ConstraintName == EMAIL_INDEX {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// insertEmailToken replaces the unused tokens of the user for purpose with a
+// new one for email.
+func insertEmailToken(ctx context.Context, tx pgx.Tx, userId uuid.UUID, purpose string, email string, ttl time.Duration) (string, error) {
+	// Tokens are random like refresh tokens.
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM email_tokens WHERE user_id = $1 AND purpose = $2", userId, purpose)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(ctx,
+		`INSERT INTO email_tokens (token_hash, user_id, purpose, email, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		hashToken(token), userId, purpose, email, now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeEmailToken deletes the token and returns its user and email. Expired
+// tokens are deleted too, but rejected with ErrEmailTokenExpired; callers
+// commit the deletion then.
+func consumeEmailToken(ctx context.Context, tx pgx.Tx, token string, purpose string) (uuid.UUID, string, error) {
+	var (
+		userId    uuid.UUID
+		email     string
+		expiresAt time.Time
+	)
+	err := tx.QueryRow(ctx,
+		"DELETE FROM email_tokens WHERE token_hash = $1 AND purpose = $2 RETURNING user_id, email, expires_at",
+		hashToken(token), purpose).
+		Scan(&userId, &email, &expiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, "", ErrInvalidEmailToken
+	}
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if time.Now().After(expiresAt) {
+		return uuid.Nil, "", ErrEmailTokenExpired
+	}
+
+	return userId, email, nil
+}
+
+// createUser adds a user and, with an email, returns a token to verify it.
+// ErrEmailTaken is returned if another user verified the email.
+func (a *App) createUser(ctx context.Context, username string, passwordHash string, email string) (string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var emailValue *string
+	if email != "" {
+		if err := checkEmailFree(ctx, tx, email, uuid.Nil); err != nil {
+			return "", err
+		}
+		emailValue = &email
+	}
+
+	var userId uuid.UUID
+	err = tx.QueryRow(ctx,
+		"INSERT INTO users (username, password_hash, email, created_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		username, passwordHash, emailValue, time.Now()).
+		Scan(&userId)
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	if email != "" {
+		if token, err = insertEmailToken(ctx, tx, userId, PURPOSE_VERIFY_EMAIL, email, EMAIL_VERIFICATION_TTL); err != nil {
+			return "", err
+		}
+	}
+
+	return token, tx.Commit(ctx)
+}
+
+// emailStatus returns the email of the user, empty without one, and whether
+// it is verified.
+func (a *App) emailStatus(ctx context.Context, userId uuid.UUID) (string, bool, error) {
+	var (
+		email    *string
+		verified bool
+	)
+	err := a.DB.QueryRow(ctx, "SELECT email, email_verified_at IS NOT NULL FROM users WHERE id = $1", userId).
+		Scan(&email, &verified)
+	if err != nil || email == nil {
+		return "", false, err
+	}
+
+	return *email, verified, nil
+}
+
+// setEmail gives the user a new, unverified address, or keeps the current
+// one unverified, and returns a token to verify it. ErrEmailTaken is
+// returned if another user verified the address.
+func (a *App) setEmail(ctx context.Context, userId uuid.UUID, email string) (string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		current    *string
+		verifiedAt *time.Time
+	)
+	err = tx.QueryRow(ctx, "SELECT email, email_verified_at FROM users WHERE id = $1 FOR UPDATE", userId).
+		Scan(&current, &verifiedAt)
+	if err != nil {
+		return "", err
+	}
+	if current != nil && strings.EqualFold(*current, email) && verifiedAt != nil {
+		return "", ErrEmailVerified
+	}
+
+	if err := checkEmailFree(ctx, tx, email, userId); err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE users SET email = $2, email_verified_at = NULL WHERE id = $1", userId, email)
+	if err != nil {
+		return "", err
+	}
+	token, err := insertEmailToken(ctx, tx, userId, PURPOSE_VERIFY_EMAIL, email, EMAIL_VERIFICATION_TTL)
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit(ctx)
+}
+
+// verifyEmail marks the address of the token verified, unless the user
+// changed it since. The first verification wins: other users claiming the
+// address without verifying it lose it, and ErrEmailTaken is returned if
+// another user verified it already.
+func (a *App) verifyEmail(ctx context.Context, token string) error {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	userId, email, err := consumeEmailToken(ctx, tx, token, PURPOSE_VERIFY_EMAIL)
+	if errors.Is(err, ErrEmailTokenExpired) {
+		return commitExpiredToken(ctx, tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx,
+		"UPDATE users SET email_verified_at = $3 WHERE id = $1 AND lower(email) = lower($2)",
+		userId, email, time.Now())
+	if err != nil {
+		return emailTakenErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidEmailToken
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE users SET email = NULL WHERE lower(email) = lower($2) AND id <> $1 AND email_verified_at IS NULL",
+		userId, email)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		"DELETE FROM email_tokens WHERE lower(email) = lower($2) AND user_id <> $1 AND purpose = $3",
+		userId, email, PURPOSE_VERIFY_EMAIL)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// createPasswordReset returns a reset token for the user with the verified
+// address, and the username.
+func (a *App) createPasswordReset(ctx context.Context, email string) (string, string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		userId   uuid.UUID
+		username string
+	)
+	err = tx.QueryRow(ctx,
+		"SELECT id, username, email FROM users WHERE lower(email) = lower($1) AND email_verified_at IS NOT NULL",
+		email).
+		Scan(&userId, &username, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", ErrNoEmail
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err := insertEmailToken(ctx, tx, userId, PURPOSE_RESET_PASSWORD, email, PASSWORD_RESET_TTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return token, username, tx.Commit(ctx)
+}
+
+// resetPassword sets the password of the token's user. All sessions of the
+// user are revoked, whoever knew the old password is logged out.
+func (a *App) resetPassword(ctx context.Context, token string, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	userId, _, err := consumeEmailToken(ctx, tx, token, PURPOSE_RESET_PASSWORD)
+	if errors.Is(err, ErrEmailTokenExpired) {
+		return commitExpiredToken(ctx, tx)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(ctx, "UPDATE users SET password_hash = $2 WHERE id = $1", userId, string(hashed)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		"UPDATE sessions SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2",
+		userId, now)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM login_challenges WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// commitExpiredToken commits the deletion of an expired token by
+// consumeEmailToken, nothing else happened in tx, and rejects the token.
+func commitExpiredToken(ctx context.Context, tx pgx.Tx) error {
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return ErrInvalidEmailToken
+}
+
+// deleteExpiredEmailTokens deletes verification and reset tokens nobody can
+// use anymore.
+func (a *App) deleteExpiredEmailTokens(ctx context.Context) (int64, error) {
+	tag, err := a.DB.Exec(ctx, "DELETE FROM email_tokens WHERE expires_at < $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// emailLink returns the link of the frontend page at path handling the token.
+func (a *App) emailLink(path string, token string) string {
+	return strings.TrimSuffix(a.AppURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+func (a *App) verificationMail(username string, email string, token string) Mail {
+	return Mail{
+		To:      email,
+		Subject: "Confirm your email for Markdown-editor",
+		Body: fmt.Sprintf("Hello, %s!\n\n"+
+			"Open the link to confirm your email address:\n%s\n\n"+
+			"The link expires in %d hours. If you didn't sign up for Markdown-editor, ignore this email.\n",
+			username, a.emailLink("/verify-email", token), int(EMAIL_VERIFICATION_TTL.Hours())),
+	}
+}
+
+func (a *App) passwordResetMail(username string, email string, token string) Mail {
+	return Mail{
+		To:      email,
+		Subject: "Reset your Markdown-editor password",
+		Body: fmt.Sprintf("Hello, %s!\n\n"+
+			"Open the link to choose a new password:\n%s\n\n"+
+			"The link expires in %d minutes and works once. If you didn't ask to reset your password, ignore this email.\n",
+			username, a.emailLink("/reset-password", token), int(PASSWORD_RESET_TTL.Minutes())),
+	}
+}
+
+// emailInUseMail tells the owner of the address that someone tried to use it
+// for another account. Responses don't tell whether an address is used, so
+// only its owner learns it.
+func (a *App) emailInUseMail(email string) Mail {
+	return Mail{
+		To:      email,
+		Subject: "Your email is already used on Markdown-editor",
+		Body: "Hello!\n\n" +
+			"Someone tried to use this email address for a Markdown-editor account, but it belongs to your account already.\n\n" +
+			"If it was you, sign in to your account instead, or reset your password if you forgot it:\n" +
+			strings.TrimSuffix(a.AppURL, "/") + "/login\n\n" +
+			"If it wasn't you, ignore this email, your account is unchanged.\n",
+	}
+}
+
+// sendMail sends the mail in the background, so responses don't wait for
+// the mail server or reveal by their timing whether a mail was sent.
+func (a *App) sendMail(m Mail) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), MAIL_TIMEOUT)
+		defer cancel()
+
+		if err := a.Mailer.Send(ctx, m); err != nil {
+			Logger.Error("Failed to send mail", slog.String("subject", m.Subject), slog.String("error", err.Error()))
+		}
+	}()
+}
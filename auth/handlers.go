@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"log"
 	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -19,6 +25,8 @@ const (
 	UUID                      = "123e4567-e89b-12d3-a456-426614174000"
 	ACCESS_TOKEN_COOKIE_NAME  = "access_token"
 	REFRESH_TOKEN_COOKIE_NAME = "refresh_token"
+	// The refresh token is sent to refresh and logout only.
+	REFRESH_TOKEN_COOKIE_PATH = "/v1"
 )
 
 // @Summary Check auth health
@@ -34,6 +42,30 @@ func healthHandler(c *gin.Context) {
 	})
 }
 
+// JWKS_MAX_AGE is how long clients may cache the key set. Verifiers look
+// for unknown keys sooner, and new keys are published KEY_OVERLAP before
+// they sign.
+const JWKS_MAX_AGE = 10 * time.Minute
+
+// @Summary Signing keys
+// @Tags auth
+// @Description Public keys access tokens are signed with, as a JSON Web Key Set. Tokens name their key with the kid header
+// @Produce json
+// @Success 200 {object} jwks.Set "Key set"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /.well-known/jwks.json [get]
+func (a *App) jwksHandler(c *gin.Context) {
+	set, err := a.Keys.Set()
+	if err != nil {
+		Logger.Error("Failed to publish keys", slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to publish keys"})
+		return
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JWKS_MAX_AGE.Seconds())))
+	c.JSON(http.StatusOK, set)
+}
+
 func logMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
@@ -70,7 +102,7 @@ func setCookieTokens(c *gin.Context, accessToken string, refreshToken string) {
 	http.SetCookie(c.Writer, &http.Cookie{
 		Name:     REFRESH_TOKEN_COOKIE_NAME,
 		Value:    refreshToken,
-		Path:     "/v1/refresh",
+		Path:     REFRESH_TOKEN_COOKIE_PATH,
 		Domain:   "",
 		Expires:  time.Now().Add(REFRESH_TOKEN_TTL),
 		Secure:   true,
@@ -87,6 +119,7 @@ func setCookieTokens(c *gin.Context, accessToken string, refreshToken string) {
 // @Success 200 {object} LoginResponse "Login response"
 // @Failure 400 {object} ErrorResponse "Error response"
 // @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 429 {object} ErrorResponse "Error response"
 // @Failure 500 {object} ErrorResponse "Error response"
 // @Router /v1/login [post]
 func (a *App) loginHandler(c *gin.Context) {
@@ -99,11 +132,12 @@ func (a *App) loginHandler(c *gin.Context) {
 	var (
 		id           uuid.UUID
 		passwordHash string
+		twoFactor    bool
 	)
 
 	err := a.DB.QueryRow(context.Background(),
-		"SELECT id, password_hash FROM users WHERE username=$1", req.Username).
-		Scan(&id, &passwordHash)
+		"SELECT id, password_hash, totp_secret IS NOT NULL FROM users WHERE username=$1", req.Username).
+		Scan(&id, &passwordHash, &twoFactor)
 
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid username or password"})
@@ -115,42 +149,185 @@ func (a *App) loginHandler(c *gin.Context) {
 		return
 	}
 
-	accessToken, refreshToken, err := generateTokens(id)
+	if twoFactor {
+		challenge, expiresAt, err := a.createLoginChallenge(c.Request.Context(), id)
+		var locked *TwoFactorLockedError
+		if errors.As(err, &locked) {
+			abortTwoFactorLocked(c, locked)
+			return
+		}
+		if err != nil {
+			Logger.Error("Failed to create login challenge", slog.String("error", err.Error()))
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create login challenge"})
+			return
+		}
+		c.JSON(http.StatusOK, LoginResponse{
+			Message:            "Two-factor code required",
+			TwoFactorRequired:  true,
+			Challenge:          challenge,
+			ChallengeExpiresAt: &expiresAt,
+		})
+		return
+	}
+
+	if !a.startSession(c, id) {
+		return
+	}
+	c.JSON(http.StatusOK, LoginResponse{Message: "Login successful"})
+}
+
+// abortTwoFactorLocked tells a user locked out for wrong two-factor codes
+// when to try again.
+func abortTwoFactorLocked(c *gin.Context, locked *TwoFactorLockedError) {
+	retryAfter := int(math.Ceil(time.Until(locked.Until).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	c.JSON(http.StatusTooManyRequests, ErrorResponse{Error: "Too many invalid two-factor codes, try again later"})
+}
+
+// startSession creates a session of the user and sets its token cookies. It
+// responds with an error and returns false otherwise.
+func (a *App) startSession(c *gin.Context, userId uuid.UUID) bool {
+	session, refreshToken, err := a.createSession(c.Request.Context(), userId, newClient(c))
+	if err != nil {
+		Logger.Error("Failed to create session", slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create session"})
+		return false
+	}
+	accessToken, err := a.generateAccessToken(session)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token"})
-		return
+		return false
 	}
 
 	setCookieTokens(c, accessToken, refreshToken)
+	return true
+}
+
+// @Summary Sign in with a two-factor code
+// @Tags auth
+// @Description Second login step for users with two-factor authentication: complete the challenge returned by /v1/login with a TOTP code or a recovery code. Each recovery code works once, a challenge accepts 5 wrong codes. After 10 wrong codes in a row the user is locked out for a minute, doubling with every further one
+// @Accept json
+// @Produce json
+// @Param login body TwoFactorLoginRequest true "Challenge and code"
+// @Success 200 {object} LoginResponse "Login response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 429 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/login/2fa [post]
+func (a *App) twoFactorLoginHandler(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Challenge == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Challenge and either code or recovery code are required"})
+		return
+	}
+
+	userId, err := a.completeLoginChallenge(c.Request.Context(), req.Challenge, req.Code, req.RecoveryCode)
+	var locked *TwoFactorLockedError
+	switch {
+	case errors.As(err, &locked):
+		abortTwoFactorLocked(c, locked)
+		return
+	case errors.Is(err, ErrInvalidChallenge):
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Login challenge is invalid or expired"})
+		return
+	case errors.Is(err, ErrInvalidCode):
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid two-factor code"})
+		return
+	case err != nil:
+		Logger.Error("Failed to complete login challenge", slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	if !a.startSession(c, userId) {
+		return
+	}
 	c.JSON(http.StatusOK, LoginResponse{Message: "Login successful"})
 }
 
+// @Summary Sign out
+// @Tags auth
+// @Description Revoke the session of the refresh token and clear the token cookies
+// @Produce json
+// @Success 200 {object} LogoutResponse "Logout response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/logout [post]
 func (a *App) logoutHandler(c *gin.Context) {
+	if refreshToken, err := c.Cookie(REFRESH_TOKEN_COOKIE_NAME); err == nil && refreshToken != "" {
+		if err := a.revokeSessionByToken(c.Request.Context(), refreshToken); err != nil {
+			Logger.Error("Failed to revoke session", slog.String("error", err.Error()))
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to revoke session"})
+			return
+		}
+	}
+
 	setCookieTokens(c, "", "")
 	c.JSON(http.StatusOK, LogoutResponse{Message: "logout successful"})
 }
 
-// @Summary Check auth
-// @Tags auth
-// @Description Check if user authenticated
-// @Produce json
-// @Success 200 {object} CheckAuthResponse "Login response"
-// @Failure 401 {object} ErrorResponse "Error response"
-// @Router /v1/check_auth [get]
-func (a *App) checkAuthHandler(c *gin.Context) {
+// authenticate checks the access token of the request and that its session
+// is still active. It responds with an error and returns false otherwise.
+func (a *App) authenticate(c *gin.Context) (Session, bool) {
 	tokenStr, err := c.Cookie(ACCESS_TOKEN_COOKIE_NAME)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Missing access token"})
-		return
+	if err != nil || tokenStr == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Missing access token"})
+		return Session{}, false
 	}
 
-	_, err = parseToken(tokenStr)
+	claims, err := a.parseToken(c.Request.Context(), tokenStr)
 	if err != nil {
 		if errors.Is(err, ErrExpiredToken) {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Token has expired"})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Token has expired"})
+			return Session{}, false
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token"})
+		return Session{}, false
+	}
+
+	claimed, err := tokenSession(claims)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
+		return Session{}, false
+	}
+
+	session, err := a.getSession(c.Request.Context(), claimed.Id)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return Session{}, false
+	}
+	if err != nil || session.UserId != claimed.UserId || !session.Active(time.Now()) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Session has been revoked"})
+		return Session{}, false
+	}
+
+	return session, true
+}
+
+// sessionMiddleware lets through requests of active sessions and sets
+// "session" to the session of the request.
+func (a *App) sessionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := a.authenticate(c)
+		if !ok {
 			return
 		}
-		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token"})
+
+		c.Set("session", session)
+		c.Next()
+	}
+}
+
+// @Summary Check auth
+// @Tags auth
+// @Description Check if user authenticated and the session is not revoked
+// @Produce json
+// @Success 200 {object} CheckAuthResponse "Login response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/check_auth [get]
+func (a *App) checkAuthHandler(c *gin.Context) {
+	if _, ok := a.authenticate(c); !ok {
 		return
 	}
 
@@ -159,7 +336,7 @@ func (a *App) checkAuthHandler(c *gin.Context) {
 
 // @Summary Register
 // @Tags auth
-// @Description Register new user
+// @Description Register new user. With an email a verification link is sent to it, passwords can only be reset through a verified email. The response doesn't tell whether the email is used by another account, its owner is told by email instead and the user is registered without it
 // @Accept json
 // @Produce json
 // @Param register body RegisterRequest true "Register fields"
@@ -174,6 +351,19 @@ func (a *App) registerHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
 		return
 	}
+	if len(req.Password) < MIN_PASSWORD_LEN {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Password must have at least %d characters", MIN_PASSWORD_LEN)})
+		return
+	}
+
+	if req.Email != "" {
+		email, err := normalizeEmail(req.Email)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid email"})
+			return
+		}
+		req.Email = email
+	}
 
 	var exists bool
 	err := a.DB.QueryRow(context.Background(),
@@ -194,60 +384,630 @@ func (a *App) registerHandler(c *gin.Context) {
 		return
 	}
 
-	_, err = a.DB.Exec(context.Background(),
-		"INSERT INTO users (username, password_hash, created_at) VALUES ($1, $2, $3)",
-		req.Username, string(hashed), time.Now())
+	token, err := a.createUser(c.Request.Context(), req.Username, string(hashed), req.Email)
+	if errors.Is(err, ErrEmailTaken) {
+		// The user is registered without the email, it can be added once
+		// the other account gives it up.
+		a.sendMail(a.emailInUseMail(req.Email))
+		token, err = a.createUser(c.Request.Context(), req.Username, string(hashed), "")
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create user"})
 		return
 	}
 
+	if req.Email != "" {
+		if token != "" {
+			a.sendMail(a.verificationMail(req.Username, req.Email, token))
+		}
+		c.JSON(http.StatusCreated, RegisterResponse{Message: "User registered successfully, check your email to verify it"})
+		return
+	}
 	c.JSON(http.StatusCreated, RegisterResponse{Message: "User registered successfully"})
 }
 
 // @Summary Refresh tokens
 // @Tags auth
-// @Description Refresh access and refresh tokens
+// @Description Exchange the refresh token for new access and refresh tokens. Each refresh token is accepted once, using it again revokes its session
 // @Produce json
-// @Success 200 {object} LoginResponse "Login response"
+// @Success 200 {object} RefreshResponse "Refresh response"
 // @Failure 401 {object} ErrorResponse "Error response"
 // @Failure 500 {object} ErrorResponse "Error response"
 // @Router /v1/refresh [post]
 func (a *App) refreshHandler(c *gin.Context) {
 	refreshTokenStr, err := c.Cookie(REFRESH_TOKEN_COOKIE_NAME)
-	if err != nil {
+	if err != nil || refreshTokenStr == "" {
 		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Missing refresh token"})
 		return
 	}
 
-	claims, err := parseToken(refreshTokenStr)
+	session, refreshToken, err := a.rotateRefreshToken(c.Request.Context(), refreshTokenStr, newClient(c))
 	if err != nil {
+		switch {
+		case errors.Is(err, ErrRefreshTokenReused):
+			Logger.Warn("Refresh token reused, session revoked",
+				slog.String("user_id", session.UserId.String()),
+				slog.String("session_id", session.Id.String()),
+				slog.String("client_ip", c.ClientIP()),
+			)
+		case errors.Is(err, ErrInvalidRefreshToken), errors.Is(err, ErrSessionRevoked), errors.Is(err, ErrExpiredToken):
+		default:
+			Logger.Error("Failed to refresh session", slog.String("error", err.Error()))
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to refresh session"})
+			return
+		}
+		setCookieTokens(c, "", "")
 		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid or expired refresh token"})
 		return
 	}
 
-	userIdObj, exists := claims["user_id"]
-	if !exists {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
+	accessToken, err := a.generateAccessToken(session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	setCookieTokens(c, accessToken, refreshToken)
+	c.JSON(http.StatusOK, RefreshResponse{Message: "Refresh success"})
+}
+
+func sessionResponse(session Session, current uuid.UUID) SessionResponse {
+	return SessionResponse{
+		Id:         session.Id.String(),
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		Current:    session.Id == current,
+	}
+}
+
+// @Summary List sessions
+// @Tags sessions
+// @Description Active sessions of the user, most recently used first. The session of the request is marked current
+// @Produce json
+// @Success 200 {object} SessionsResponse "Sessions"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/sessions [get]
+func (a *App) listSessionsHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	sessions, err := a.listSessions(c.Request.Context(), current.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	resp := SessionsResponse{Sessions: make([]SessionResponse, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, sessionResponse(session, current.Id))
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// @Summary Revoke session
+// @Tags sessions
+// @Description Sign out a session of the user. Revoking the current session also clears the token cookies
+// @Produce json
+// @Param id path string true "Session id"
+// @Success 200 {object} RevokeSessionsResponse "Revoke response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/sessions/{id} [delete]
+func (a *App) revokeSessionHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid session id"})
+		return
+	}
+
+	err = a.revokeSession(c.Request.Context(), current.UserId, id)
+	if errors.Is(err, ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	if id == current.Id {
+		setCookieTokens(c, "", "")
+	}
+	c.JSON(http.StatusOK, RevokeSessionsResponse{Message: "Session revoked", Revoked: 1})
+}
+
+// @Summary Revoke other sessions
+// @Tags sessions
+// @Description Sign out all sessions of the user except the current one
+// @Produce json
+// @Success 200 {object} RevokeSessionsResponse "Revoke response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/sessions [delete]
+func (a *App) revokeOtherSessionsHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	revoked, err := a.revokeOtherSessions(c.Request.Context(), current.UserId, current.Id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
 		return
 	}
-	userIdStr, ok := userIdObj.(string)
+
+	c.JSON(http.StatusOK, RevokeSessionsResponse{Message: "Other sessions revoked", Revoked: revoked})
+}
+
+// @Summary Two-factor status
+// @Tags 2fa
+// @Description Whether two-factor authentication is enabled or an enrollment is pending, and how many recovery codes are left
+// @Produce json
+// @Success 200 {object} TwoFactorStatusResponse "Two-factor status"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/2fa [get]
+func (a *App) twoFactorStatusHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	status, err := a.twoFactorStatus(c.Request.Context(), current.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, TwoFactorStatusResponse{
+		Enabled:           status.Enabled,
+		Pending:           status.Pending,
+		RecoveryCodesLeft: status.RecoveryCodesLeft,
+	})
+}
+
+// bindPassword checks the current password sent in the request body and
+// returns the username. It responds with an error and returns false
+// otherwise.
+func (a *App) bindPassword(c *gin.Context, userId uuid.UUID) (string, bool) {
+	var req PasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Current password is required"})
+		return "", false
+	}
+
+	username, err := a.checkPassword(c.Request.Context(), userId, req.Password)
+	if errors.Is(err, ErrWrongPassword) {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Wrong password"})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return "", false
+	}
+
+	return username, true
+}
+
+// @Summary Set up two-factor authentication
+// @Tags 2fa
+// @Description Start enrolling an authenticator app, or replacing the enrolled one, with a new TOTP secret. The secret is used once a code of it is confirmed with /v1/2fa/confirm
+// @Accept json
+// @Produce json
+// @Param request body PasswordRequest true "Current password"
+// @Success 200 {object} TwoFactorSetupResponse "Secret and otpauth URI"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/2fa/setup [post]
+func (a *App) twoFactorSetupHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	username, ok := a.bindPassword(c, current.UserId)
 	if !ok {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
 		return
 	}
-	userId, err := uuid.Parse(userIdStr)
+
+	secret, err := a.startTOTPEnrollment(c.Request.Context(), current.UserId)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
 		return
 	}
 
-	accessToken, refreshToken, err := generateTokens(userId)
+	c.JSON(http.StatusOK, TwoFactorSetupResponse{Secret: secret, OtpauthURI: otpauthURI(username, secret)})
+}
+
+// @Summary Confirm two-factor authentication
+// @Tags 2fa
+// @Description Enable the pending TOTP secret with a code of it. Returns new recovery codes, replacing the old ones; they are shown only once
+// @Accept json
+// @Produce json
+// @Param request body TwoFactorCodeRequest true "TOTP code"
+// @Success 200 {object} RecoveryCodesResponse "Recovery codes"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/2fa/confirm [post]
+func (a *App) twoFactorConfirmHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Code is required"})
+		return
+	}
+
+	codes, err := a.confirmTOTPEnrollment(c.Request.Context(), current.UserId, req.Code)
+	switch {
+	case errors.Is(err, ErrTwoFactorNotPending):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "No two-factor setup is pending"})
+		return
+	case errors.Is(err, ErrInvalidCode):
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid two-factor code"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{Message: "Two-factor authentication enabled", RecoveryCodes: codes})
+}
+
+// @Summary Reset recovery codes
+// @Tags 2fa
+// @Description Replace the recovery codes with new ones, e.g. when they are used up or exposed
+// @Accept json
+// @Produce json
+// @Param request body PasswordRequest true "Current password"
+// @Success 200 {object} RecoveryCodesResponse "Recovery codes"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/2fa/recovery-codes [post]
+func (a *App) recoveryCodesHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	if _, ok := a.bindPassword(c, current.UserId); !ok {
+		return
+	}
+
+	codes, err := a.regenerateRecoveryCodes(c.Request.Context(), current.UserId)
+	if errors.Is(err, ErrTwoFactorDisabled) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Two-factor authentication is not enabled"})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token"})
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
 		return
 	}
 
-	setCookieTokens(c, accessToken, refreshToken)
-	c.JSON(http.StatusOK, RefreshResponse{Message: "Refresh success"})
+	c.JSON(http.StatusOK, RecoveryCodesResponse{Message: "Recovery codes replaced", RecoveryCodes: codes})
+}
+
+// @Summary Disable two-factor authentication
+// @Tags 2fa
+// @Description Turn off two-factor authentication, or cancel a pending setup, and delete the recovery codes
+// @Accept json
+// @Produce json
+// @Param request body PasswordRequest true "Current password"
+// @Success 200 {object} LogoutResponse "Disable response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/2fa/disable [post]
+func (a *App) twoFactorDisableHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	if _, ok := a.bindPassword(c, current.UserId); !ok {
+		return
+	}
+
+	err := a.disableTwoFactor(c.Request.Context(), current.UserId)
+	if errors.Is(err, ErrTwoFactorDisabled) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Two-factor authentication is not enabled"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, LogoutResponse{Message: "Two-factor authentication disabled"})
+}
+
+// @Summary Email status
+// @Tags email
+// @Description The email of the user and whether it is verified. Email is empty when none is set
+// @Produce json
+// @Success 200 {object} EmailStatusResponse "Email status"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/email [get]
+func (a *App) emailStatusHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	email, verified, err := a.emailStatus(c.Request.Context(), current.UserId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, EmailStatusResponse{Email: email, Verified: verified})
+}
+
+// @Summary Set email
+// @Tags email
+// @Description Set or change the email of the user and send a verification link to it. Setting the current unverified email again sends a new link. The response doesn't tell whether the email is used by another account, its owner is told by email instead and the email of the user is unchanged
+// @Accept json
+// @Produce json
+// @Param request body EmailRequest true "Email and current password"
+// @Success 200 {object} MessageResponse "Verification sent"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/email [post]
+func (a *App) setEmailHandler(c *gin.Context) {
+	current := c.MustGet("session").(Session)
+
+	var req EmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Password == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Email and current password are required"})
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid email"})
+		return
+	}
+
+	username, err := a.checkPassword(c.Request.Context(), current.UserId, req.Password)
+	if errors.Is(err, ErrWrongPassword) {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Wrong password"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	token, err := a.setEmail(c.Request.Context(), current.UserId, email)
+	switch {
+	case errors.Is(err, ErrEmailTaken):
+		a.sendMail(a.emailInUseMail(email))
+		c.JSON(http.StatusOK, MessageResponse{Message: "Verification email sent"})
+		return
+	case errors.Is(err, ErrEmailVerified):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Email is already verified"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	a.sendMail(a.verificationMail(username, email, token))
+	c.JSON(http.StatusOK, MessageResponse{Message: "Verification email sent"})
+}
+
+// @Summary Verify email
+// @Tags email
+// @Description Verify the email with the token of the link sent to it. Each token works once
+// @Accept json
+// @Produce json
+// @Param request body TokenRequest true "Verification token"
+// @Success 200 {object} MessageResponse "Email verified"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/email/verify [post]
+func (a *App) verifyEmailHandler(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Token is required"})
+		return
+	}
+
+	err := a.verifyEmail(c.Request.Context(), req.Token)
+	if errors.Is(err, ErrInvalidEmailToken) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Link is invalid or expired"})
+		return
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Email already in use"})
+		return
+	}
+	if err != nil {
+		Logger.Error("Failed to verify email", slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "Email verified"})
+}
+
+// @Summary Forgot password
+// @Tags auth
+// @Description Send a password reset link to the email if it is the verified email of a user. The response is the same either way
+// @Accept json
+// @Produce json
+// @Param request body ForgotPasswordRequest true "Email"
+// @Success 202 {object} MessageResponse "Reset requested"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/password/forgot [post]
+func (a *App) forgotPasswordHandler(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request body"})
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid email"})
+		return
+	}
+
+	token, username, err := a.createPasswordReset(c.Request.Context(), email)
+	switch {
+	case errors.Is(err, ErrNoEmail):
+	case err != nil:
+		Logger.Error("Failed to create password reset", slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	default:
+		a.sendMail(a.passwordResetMail(username, email, token))
+	}
+
+	// Unknown emails get the same response, it doesn't tell who has an account.
+	c.JSON(http.StatusAccepted, MessageResponse{Message: "If the email belongs to an account, a reset link was sent to it"})
+}
+
+// @Summary Reset password
+// @Tags auth
+// @Description Set a new password with the token of a reset link. Each token works once, and all sessions of the user are revoked
+// @Accept json
+// @Produce json
+// @Param request body ResetPasswordRequest true "Reset token and new password"
+// @Success 200 {object} MessageResponse "Password reset"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/password/reset [post]
+func (a *App) resetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Token and password are required"})
+		return
+	}
+	if len(req.Password) < MIN_PASSWORD_LEN {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("Password must have at least %d characters", MIN_PASSWORD_LEN)})
+		return
+	}
+
+	err := a.resetPassword(c.Request.Context(), req.Token, req.Password)
+	if errors.Is(err, ErrInvalidEmailToken) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Link is invalid or expired"})
+		return
+	}
+	if err != nil {
+		Logger.Error("Failed to reset password", slog.String("error", err.Error()))
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	setCookieTokens(c, "", "")
+	c.JSON(http.StatusOK, MessageResponse{Message: "Password reset, log in with the new password"})
+}
+
+// internalMiddleware lets through requests of other services, authenticated
+// with the shared INTERNAL_API_TOKEN. Internal routes are disabled when the
+// token is not set.
+func internalMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "Not found"})
+			return
+		}
+
+		header := c.GetHeader("Authorization")
+		provided, found := strings.CutPrefix(header, "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid internal token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// @Summary Look up user
+// @Tags internal
+// @Description Find a user by username or id, for other services
+// @Produce json
+// @Param Authorization header string true "Bearer INTERNAL_API_TOKEN"
+// @Param username query string false "Username"
+// @Param id query string false "User id"
+// @Success 200 {object} UserResponse "User"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/internal/users [get]
+func (a *App) lookupUserHandler(c *gin.Context) {
+	username, idStr := c.Query("username"), c.Query("id")
+
+	var query, arg string
+	switch {
+	case username != "" && idStr == "":
+		query, arg = "SELECT id, username FROM users WHERE username=$1", username
+	case idStr != "" && username == "":
+		if _, err := uuid.Parse(idStr); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid user id"})
+			return
+		}
+		query, arg = "SELECT id, username FROM users WHERE id=$1", idStr
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Either username or id is required"})
+		return
+	}
+
+	var (
+		id   uuid.UUID
+		name string
+	)
+	err := a.DB.QueryRow(context.Background(), query, arg).Scan(&id, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, UserResponse{Id: id.String(), Username: name})
+}
+
+// @Summary Check session
+// @Tags internal
+// @Description Whether a session can still be used, for services accepting access tokens
+// @Produce json
+// @Param Authorization header string true "Bearer INTERNAL_API_TOKEN"
+// @Param id path string true "Session id"
+// @Success 200 {object} SessionStatusResponse "Session status"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /v1/internal/sessions/{id} [get]
+func (a *App) sessionStatusHandler(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid session id"})
+		return
+	}
+
+	session, err := a.getSession(c.Request.Context(), id)
+	if errors.Is(err, ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Internal server error (DB)"})
+		return
+	}
+
+	c.JSON(http.StatusOK, SessionStatusResponse{
+		Id:     session.Id.String(),
+		UserId: session.UserId.String(),
+		Active: session.Active(time.Now()),
+	})
 }
@@ -1,64 +1,56 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
 var (
-	JWT_SECRET        = []byte(os.Getenv("JWT_SECRET"))
 	ACCESS_TOKEN_TTL  = time.Minute * 15
 	REFRESH_TOKEN_TTL = time.Hour * 24
 )
 
 var ErrExpiredToken = errors.New("token has expired")
 
-func generateToken(userID uuid.UUID, TTL time.Duration) (string, error) {
+// generateAccessToken issues an access token of the session. Refresh tokens
+// are opaque, see createSession.
+func (a *App) generateAccessToken(session Session) (string, error) {
 	claims := jwt.MapClaims{
-		"user_id": userID.String(),
-		"exp":     time.Now().Add(TTL).Unix(),
+		"user_id": session.UserId.String(),
+		"sid":     session.Id.String(),
+		"exp":     time.Now().Add(ACCESS_TOKEN_TTL).Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(JWT_SECRET)
+	return a.Keys.Sign(claims)
 }
 
-func generateTokens(userID uuid.UUID) (string, string, error) {
-	accessToken, err := generateToken(userID, ACCESS_TOKEN_TTL)
-	if err != nil {
-		return "", "", err
+func (a *App) parseToken(ctx context.Context, tokenStr string) (jwt.MapClaims, error) {
+	claims, err := jwks.Parse(ctx, a.Keys, tokenStr)
+	if errors.Is(err, jwks.ErrTokenExpired) {
+		return nil, ErrExpiredToken
 	}
+	return claims, err
+}
 
-	refreshToken, err := generateToken(userID, REFRESH_TOKEN_TTL)
+// tokenSession returns the session an access token was issued for.
+func tokenSession(claims jwt.MapClaims) (Session, error) {
+	userIdStr, _ := claims["user_id"].(string)
+	sessionIdStr, _ := claims["sid"].(string)
+
+	userId, err := uuid.Parse(userIdStr)
 	if err != nil {
-		return "", "", err
+		return Session{}, fmt.Errorf("invalid token claims")
 	}
-
-	return accessToken, refreshToken, nil
-}
-
-func parseToken(tokenStr string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		return JWT_SECRET, nil
-	})
-	if err != nil || !token.Valid {
-		var ve *jwt.ValidationError
-		if errors.As(err, &ve) {
-			if ve.Errors&jwt.ValidationErrorExpired != 0 {
-				return nil, ErrExpiredToken
-			}
-		}
-		return nil, err
+	sessionId, err := uuid.Parse(sessionIdStr)
+	if err != nil {
+		return Session{}, fmt.Errorf("invalid token claims")
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid token claims")
-	}
-	return claims, nil
+	return Session{Id: sessionId, UserId: userId}, nil
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Access tokens are signed with private keys kept as PKCS#8 PEM files in a
+// key directory, named after their key id. The public keys are published at
+// /.well-known/jwks.json. Every rotation interval a new key is made and
+// published right away, but it only signs tokens KEY_OVERLAP later, when
+// verifiers have had time to see it. The keys it replaced are deleted another
+// KEY_OVERLAP later, when the tokens they signed have expired.
+const (
+	DEFAULT_KEY_DIR      = "keys"
+	DEFAULT_KEY_ROTATION = 30 * 24 * time.Hour
+	// KEY_OVERLAP must be longer than ACCESS_TOKEN_TTL.
+	KEY_OVERLAP = time.Hour
+	// KEY_CHECK_INTERVAL is how often keys are checked for rotation.
+	KEY_CHECK_INTERVAL = 10 * time.Minute
+	RSA_KEY_BITS       = 2048
+	KEY_FILE_EXT       = ".pem"
+)
+
+type signingKey struct {
+	jwks.Key
+	private crypto.Signer
+	created time.Time
+}
+
+// KeyRing holds the signing keys of the key directory.
+type KeyRing struct {
+	dir      string
+	alg      string
+	rotation time.Duration
+	mu       sync.RWMutex
+	// keys are sorted by creation, oldest first.
+	keys []signingKey
+}
+
+// NewKeyRing loads the keys in dir, creating it if needed, and makes a key
+// of the algorithm alg if there is none or the newest one is older than
+// rotation. Loaded keys keep the algorithm they were made for.
+func NewKeyRing(dir, alg string, rotation time.Duration) (*KeyRing, error) {
+	if alg != jwks.ALG_EDDSA && alg != jwks.ALG_RS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	if rotation < 2*KEY_OVERLAP {
+		return nil, fmt.Errorf("key rotation interval must be at least %s", 2*KEY_OVERLAP)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	k := &KeyRing{dir: dir, alg: alg, rotation: rotation}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	if err := k.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func (k *KeyRing) load() error {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != KEY_FILE_EXT {
+			continue
+		}
+		path := filepath.Join(k.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		private, alg, err := parsePrivateKey(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		k.keys = append(k.keys, signingKey{
+			Key:     jwks.Key{Id: strings.TrimSuffix(entry.Name(), KEY_FILE_EXT), Alg: alg, Public: private.Public()},
+			private: private,
+			created: info.ModTime(),
+		})
+	}
+	sort.Slice(k.keys, func(i, j int) bool { return k.keys[i].created.Before(k.keys[j].created) })
+
+	return nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, "", errors.New("no PKCS#8 private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, jwks.ALG_RS256, nil
+	case ed25519.PrivateKey:
+		return key, jwks.ALG_EDDSA, nil
+	}
+	return nil, "", fmt.Errorf("unsupported key type %T", key)
+}
+
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	if alg == jwks.ALG_RS256 {
+		return rsa.GenerateKey(rand.Reader, RSA_KEY_BITS)
+	}
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	return private, err
+}
+
+// activation returns when the i-th key starts signing. The oldest key signs
+// right away, e.g. the first key ever made.
+func (k *KeyRing) activation(i int) time.Time {
+	if i == 0 {
+		return k.keys[i].created
+	}
+	return k.keys[i].created.Add(KEY_OVERLAP)
+}
+
+// signing returns the index of the key signing at now, the newest active
+// one. Must be called with the lock held.
+func (k *KeyRing) signing(now time.Time) int {
+	i := len(k.keys) - 1
+	for i > 0 && now.Before(k.activation(i)) {
+		i--
+	}
+	return i
+}
+
+// Rotate makes a new key if the newest one is older than the rotation
+// interval and deletes keys replaced for more than KEY_OVERLAP.
+func (k *KeyRing) Rotate(now time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.keys) == 0 || now.Sub(k.keys[len(k.keys)-1].created) >= k.rotation {
+		if err := k.add(now); err != nil {
+			return err
+		}
+	}
+
+	s := k.signing(now)
+	if s == 0 || now.Before(k.activation(s).Add(KEY_OVERLAP)) {
+		return nil
+	}
+	for _, key := range k.keys[:s] {
+		err := os.Remove(filepath.Join(k.dir, key.Id+KEY_FILE_EXT))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	k.keys = k.keys[s:]
+
+	return nil
+}
+
+// add makes a key created at now and stores it. Must be called with the
+// lock held.
+func (k *KeyRing) add(now time.Time) error {
+	private, err := generatePrivateKey(k.alg)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+
+	id := uuid.NewString()
+	path := filepath.Join(k.dir, id+KEY_FILE_EXT)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// The modification time is the creation time when loading.
+		err = os.Chtimes(path, now, now)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	k.keys = append(k.keys, signingKey{
+		Key:     jwks.Key{Id: id, Alg: k.alg, Public: private.Public()},
+		private: private,
+		created: now,
+	})
+
+	return nil
+}
+
+// Sign signs the claims with the current key, named by the kid header.
+func (k *KeyRing) Sign(claims jwt.MapClaims) (string, error) {
+	k.mu.RLock()
+	key := k.keys[k.signing(time.Now())]
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Alg), claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.private)
+}
+
+// Lookup returns a published key, so the auth service verifies its own
+// tokens like the other services do.
+func (k *KeyRing) Lookup(_ context.Context, kid string) (jwks.Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.Id == kid {
+			return key.Key, nil
+		}
+	}
+	return jwks.Key{}, jwks.ErrUnknownKey
+}
+
+// Set returns the published keys.
+func (k *KeyRing) Set() (jwks.Set, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := jwks.Set{Keys: []jwks.JWK{}}
+	for _, key := range k.keys {
+		jwk, err := jwks.NewJWK(key.Key)
+		if err != nil {
+			return jwks.Set{}, err
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_MAIL_FROM = "Markdown-editor <no-reply@localhost>"
+	// MAIL_TIMEOUT limits sending a mail.
+	MAIL_TIMEOUT = 30 * time.Second
+)
+
+// Mail is a plain text message to one recipient.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mails, e.g. email verification and password reset links.
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+// newMailer sends mails through the SMTP server at SMTP_ADDR (host:port),
+// authenticated with SMTP_USERNAME and SMTP_PASSWORD if set, from MAIL_FROM.
+// Without SMTP_ADDR mails are only logged, and written to MAIL_DIR if set.
+func newMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = DEFAULT_MAIL_FROM
+	}
+
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return &LogMailer{Dir: os.Getenv("MAIL_DIR"), From: from}, nil
+	}
+
+	return NewSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+}
+
+// message returns the mail in the Internet Message Format. Addresses and
+// subjects with line breaks are rejected, they could add headers.
+func (m Mail) message(from string, now time.Time) ([]byte, error) {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, errors.New("line break in mail header")
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender: %w", err)
+	}
+	if _, err := mail.ParseAddress(m.To); err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := sender.Address[strings.LastIndex(sender.Address, "@")+1:]
+
+	var buf bytes.Buffer
+	headers := [][2]string{
+		{"From", sender.String()},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=UTF-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// SMTPMailer sends mails through an SMTP server, with STARTTLS when the
+// server offers it.
+type SMTPMailer struct {
+	addr string
+	host string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer for the server at addr. Without username no
+// authentication is done. The password is only sent over TLS, or to
+// localhost.
+func NewSMTPMailer(addr, from, username, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+
+	m := &SMTPMailer{addr: addr, host: host, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m Mail) error {
+	msg, err := m.message(s.from, time.Now())
+	if err != nil {
+		return err
+	}
+	sender, _ := mail.ParseAddress(s.from)
+	recipient, _ := mail.ParseAddress(m.To)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if err := client.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// LogMailer logs mails instead of sending them, for development. With Dir
+// set every mail is also written there as an .eml file.
+type LogMailer struct {
+	Dir  string
+	From string
+}
+
+func (l *LogMailer) Send(_ context.Context, m Mail) error {
+	now := time.Now()
+	if l.Dir != "" {
+		msg, err := m.message(l.From, now)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(l.Dir, 0700); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000Z"), strings.NewReplacer("@", "_at_", "/", "_").Replace(m.To))
+		if err := os.WriteFile(filepath.Join(l.Dir, name), msg, 0600); err != nil {
+			return err
+		}
+	}
+
+	Logger.Info("Mail not sent, SMTP_ADDR not set",
+		slog.String("to", m.To),
+		slog.String("subject", m.Subject),
+		slog.String("body", m.Body),
+	)
+	return nil
+}
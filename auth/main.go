@@ -12,6 +12,7 @@ import (
 
 	_ "auth/docs"
 
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -25,7 +26,79 @@ const (
 )
 
 type App struct {
-	DB *pgxpool.Pool
+	DB     *pgxpool.Pool
+	Keys   *KeyRing
+	Mailer Mailer
+	// AppURL is the frontend, links in mails point there.
+	AppURL string
+}
+
+// runSessionSweeper deletes expired sessions, login challenges and email
+// tokens, right away and then every interval until ctx is done.
+func runSessionSweeper(ctx context.Context, app *App, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := app.deleteExpiredSessions(ctx)
+		if err != nil {
+			Logger.Error("Failed to delete expired sessions", slog.String("error", err.Error()))
+		} else if deleted > 0 {
+			Logger.Info("Expired sessions deleted", slog.Int64("sessions", deleted))
+		}
+		if _, err := app.deleteExpiredChallenges(ctx); err != nil {
+			Logger.Error("Failed to delete expired login challenges", slog.String("error", err.Error()))
+		}
+		if _, err := app.deleteExpiredEmailTokens(ctx); err != nil {
+			Logger.Error("Failed to delete expired email tokens", slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runKeyRotation rotates the signing keys every interval until ctx is done.
+func runKeyRotation(ctx context.Context, keys *KeyRing, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := keys.Rotate(time.Now()); err != nil {
+			Logger.Error("Failed to rotate signing keys", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// newKeyRing loads the signing keys from JWT_KEY_DIR. New keys are made with
+// JWT_ALG, EdDSA or RS256, every JWT_KEY_ROTATION.
+func newKeyRing() (*KeyRing, error) {
+	dir := os.Getenv("JWT_KEY_DIR")
+	if dir == "" {
+		dir = DEFAULT_KEY_DIR
+	}
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = jwks.ALG_EDDSA
+	}
+	rotation := DEFAULT_KEY_ROTATION
+	if s := os.Getenv("JWT_KEY_ROTATION"); s != "" {
+		var err error
+		if rotation, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("invalid JWT_KEY_ROTATION: %w", err)
+		}
+	}
+
+	return NewKeyRing(dir, alg, rotation)
 }
 
 // @title           Markdown auth
@@ -55,12 +128,26 @@ func main() {
 	}
 	defer db.Close()
 
-	app := &App{DB: db}
+	keys, err := newKeyRing()
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+
+	mailer, err := newMailer()
+	if err != nil {
+		log.Fatalf("Failed to configure mailer: %v", err)
+	}
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = fmt.Sprintf("https://%s:%s", os.Getenv("REMOTE_HOST"), os.Getenv("FRONTEND_PORT"))
+	}
+
+	app := &App{DB: db, Keys: keys, Mailer: mailer, AppURL: appURL}
 
 	r := gin.New()
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"https://localhost:5173", "http://localhost:5173", fmt.Sprintf("https://%s:%s", os.Getenv("REMOTE_HOST"), os.Getenv("FRONTEND_PORT"))},
-		AllowMethods:     []string{"POST", "GET", "OPTIONS"},
+		AllowMethods:     []string{"POST", "GET", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length", "Content-Disposition"},
 		AllowCredentials: true,
@@ -71,16 +158,49 @@ func main() {
 	r.Static("/docs", "./docs")
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("/docs/swagger.json")))
 	r.GET("/health", healthHandler)
+	r.GET("/.well-known/jwks.json", app.jwksHandler)
 	r.GET("/v1/check_auth", app.checkAuthHandler)
 	r.POST("/v1/register", app.registerHandler)
 	r.POST("/v1/login", app.loginHandler)
+	r.POST("/v1/login/2fa", app.twoFactorLoginHandler)
 	r.POST("/v1/refresh", app.refreshHandler)
 	r.POST("/v1/logout", app.logoutHandler)
+	r.POST("/v1/email/verify", app.verifyEmailHandler)
+	r.POST("/v1/password/forgot", app.forgotPasswordHandler)
+	r.POST("/v1/password/reset", app.resetPasswordHandler)
+
+	email := r.Group("/v1/email")
+	email.Use(app.sessionMiddleware())
+	email.GET("", app.emailStatusHandler)
+	email.POST("", app.setEmailHandler)
+
+	sessions := r.Group("/v1/sessions")
+	sessions.Use(app.sessionMiddleware())
+	sessions.GET("", app.listSessionsHandler)
+	sessions.DELETE("", app.revokeOtherSessionsHandler)
+	sessions.DELETE("/:id", app.revokeSessionHandler)
+
+	twoFactor := r.Group("/v1/2fa")
+	twoFactor.Use(app.sessionMiddleware())
+	twoFactor.GET("", app.twoFactorStatusHandler)
+	twoFactor.POST("/setup", app.twoFactorSetupHandler)
+	twoFactor.POST("/confirm", app.twoFactorConfirmHandler)
+	twoFactor.POST("/recovery-codes", app.recoveryCodesHandler)
+	twoFactor.POST("/disable", app.twoFactorDisableHandler)
+
+	// Internal routes are called by the backend, e.g. to resolve usernames
+	// when sharing documents.
+	internal := r.Group("/v1/internal")
+	internal.Use(internalMiddleware(os.Getenv("INTERNAL_API_TOKEN")))
+	internal.GET("/users", app.lookupUserHandler)
+	internal.GET("/sessions/:id", app.sessionStatusHandler)
 
 	err = app.DB.Ping(context.Background())
 	if err != nil {
 		log.Fatalf("DB ping failed: %v", err)
 	}
+	go runSessionSweeper(context.Background(), app, SESSION_SWEEP_INTERVAL)
+	go runKeyRotation(context.Background(), keys, KEY_CHECK_INTERVAL)
 
 	serverAddr := fmt.Sprintf("%s:%s", host, port)
 	Logger.Info("Server started on", slog.String("address", serverAddr))
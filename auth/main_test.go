@@ -2,17 +2,41 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+func newTestKeyRing(t *testing.T) *KeyRing {
+	keys, err := NewKeyRing(t.TempDir(), jwks.ALG_EDDSA, DEFAULT_KEY_ROTATION)
+	require.NoError(t, err)
+	return keys
+}
+
 type mockApp struct {
 	loginFunc    func(req LoginRequest, c *gin.Context)
 	registerFunc func(req RegisterRequest, c *gin.Context)
@@ -186,3 +210,636 @@ func TestRegisterHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestInternalMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name         string
+		token        string
+		header       string
+		expectedCode int
+	}{
+		{"Valid token", "secret", "Bearer secret", http.StatusOK},
+		{"Invalid token", "secret", "Bearer other", http.StatusUnauthorized},
+		{"Missing token", "secret", "", http.StatusUnauthorized},
+		{"Not bearer", "secret", "secret", http.StatusUnauthorized},
+		{"Disabled", "", "Bearer ", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(internalMiddleware(tt.token))
+			r.GET("/v1/internal/users", func(c *gin.Context) {
+				c.JSON(http.StatusOK, UserResponse{Id: UUID, Username: USERNAME})
+			})
+
+			req, _ := http.NewRequest(http.MethodGet, "/v1/internal/users?username="+USERNAME, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code, "status code mismatch")
+		})
+	}
+}
+
+func TestRefreshTokenHashing(t *testing.T) {
+	first, err := newRefreshToken()
+	assert.NoError(t, err)
+	second, err := newRefreshToken()
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, first, second)
+	assert.Len(t, first, 43)
+	assert.Equal(t, hashToken(first), hashToken(first))
+	assert.NotEqual(t, hashToken(first), hashToken(second))
+	assert.NotContains(t, hashToken(first), first)
+}
+
+func TestGenerateAccessToken(t *testing.T) {
+	app := &App{Keys: newTestKeyRing(t)}
+	session := Session{Id: uuid.New(), UserId: uuid.MustParse(UUID)}
+
+	token, err := app.generateAccessToken(session)
+	assert.NoError(t, err)
+
+	claims, err := app.parseToken(context.Background(), token)
+	assert.NoError(t, err)
+	assert.Equal(t, UUID, claims["user_id"])
+	assert.Equal(t, session.Id.String(), claims["sid"])
+}
+
+func TestRefreshAndLogoutWithoutToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Requests without a refresh token never reach the database.
+	app := &App{}
+	r := gin.New()
+	r.POST("/v1/refresh", app.refreshHandler)
+	r.POST("/v1/logout", app.logoutHandler)
+
+	req, _ := http.NewRequest(http.MethodPost, "/v1/refresh", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Missing refresh token")
+
+	req, _ = http.NewRequest(http.MethodPost, "/v1/logout", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 2)
+	for _, cookie := range cookies {
+		assert.Empty(t, cookie.Value)
+		if cookie.Name == REFRESH_TOKEN_COOKIE_NAME {
+			assert.Equal(t, REFRESH_TOKEN_COOKIE_PATH, cookie.Path)
+		}
+	}
+}
+
+func TestSessionActive(t *testing.T) {
+	now := time.Now()
+	revoked := now.Add(-time.Minute)
+
+	assert.True(t, (&Session{ExpiresAt: now.Add(time.Hour)}).Active(now))
+	assert.False(t, (&Session{ExpiresAt: now.Add(-time.Second)}).Active(now))
+	assert.False(t, (&Session{ExpiresAt: now.Add(time.Hour), RevokedAt: &revoked}).Active(now))
+}
+
+func TestSessionMiddlewareRejectsTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Tokens failing before the session lookup never reach the database.
+	app := &App{Keys: newTestKeyRing(t)}
+	r := gin.New()
+	sessions := r.Group("/v1/sessions")
+	sessions.Use(app.sessionMiddleware())
+	sessions.GET("", app.listSessionsHandler)
+
+	withoutSession, err := app.Keys.Sign(jwt.MapClaims{
+		"user_id": UUID,
+		"exp":     time.Now().Add(time.Minute).Unix(),
+	})
+	assert.NoError(t, err)
+	expired, err := app.Keys.Sign(jwt.MapClaims{
+		"user_id": UUID,
+		"sid":     uuid.NewString(),
+		"exp":     time.Now().Add(-time.Minute).Unix(),
+	})
+	assert.NoError(t, err)
+	symmetric := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": UUID,
+		"sid":     uuid.NewString(),
+		"exp":     time.Now().Add(time.Minute).Unix(),
+	})
+	symmetric.Header["kid"] = app.Keys.keys[0].Id
+	forged, err := symmetric.SignedString([]byte("secret"))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		token       string
+		expectedMsg string
+	}{
+		{"Missing token", "", "Missing access token"},
+		{"Malformed token", "garbage", "Invalid token"},
+		{"Expired token", expired, "Token has expired"},
+		{"Symmetric token", forged, "Invalid token"},
+		{"Token without session", withoutSession, "Invalid token claims"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/v1/sessions", nil)
+			if tt.token != "" {
+				req.AddCookie(&http.Cookie{Name: ACCESS_TOKEN_COOKIE_NAME, Value: tt.token})
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedMsg)
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest(http.MethodPost, "/v1/login", nil)
+	c.Request.RemoteAddr = "192.0.2.1:1234"
+	c.Request.Header.Set("User-Agent", strings.Repeat("a", MAX_USER_AGENT_LEN+10))
+
+	client := newClient(c)
+	assert.Equal(t, "192.0.2.1", client.IP)
+	assert.Len(t, client.UserAgent, MAX_USER_AGENT_LEN)
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewKeyRing(dir, jwks.ALG_EDDSA, 24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, keys.keys, 1)
+	first := keys.keys[0]
+
+	// Nothing changes before the rotation interval.
+	start := first.created
+	require.NoError(t, keys.Rotate(start.Add(23*time.Hour)))
+	assert.Len(t, keys.keys, 1)
+
+	// The new key is published right away but signs only after the overlap.
+	rotated := start.Add(24 * time.Hour)
+	require.NoError(t, keys.Rotate(rotated))
+	require.Len(t, keys.keys, 2)
+	second := keys.keys[1]
+	assert.Equal(t, 0, keys.signing(rotated.Add(KEY_OVERLAP-time.Second)))
+	assert.Equal(t, 1, keys.signing(rotated.Add(KEY_OVERLAP)))
+	set, err := keys.Set()
+	require.NoError(t, err)
+	assert.Len(t, set.Keys, 2)
+
+	// The old key stays until the tokens it signed have expired.
+	require.NoError(t, keys.Rotate(rotated.Add(2*KEY_OVERLAP-time.Second)))
+	assert.Len(t, keys.keys, 2)
+	require.NoError(t, keys.Rotate(rotated.Add(2*KEY_OVERLAP)))
+	require.Len(t, keys.keys, 1)
+	assert.Equal(t, second.Id, keys.keys[0].Id)
+	_, err = os.Stat(filepath.Join(dir, first.Id+KEY_FILE_EXT))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = keys.Lookup(context.Background(), first.Id)
+	assert.ErrorIs(t, err, jwks.ErrUnknownKey)
+
+	// Stored keys are loaded with their algorithm and creation time.
+	reloaded, err := NewKeyRing(dir, jwks.ALG_RS256, 24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, reloaded.keys, 1)
+	assert.Equal(t, second.Key, reloaded.keys[0].Key)
+	assert.True(t, second.created.Equal(reloaded.keys[0].created))
+
+	_, err = NewKeyRing(dir, "HS256", 24*time.Hour)
+	assert.Error(t, err)
+	_, err = NewKeyRing(dir, jwks.ALG_EDDSA, KEY_OVERLAP)
+	assert.Error(t, err)
+}
+
+func TestJWKSHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys, err := NewKeyRing(t.TempDir(), jwks.ALG_RS256, DEFAULT_KEY_ROTATION)
+	require.NoError(t, err)
+	app := &App{Keys: keys}
+	r := gin.New()
+	r.GET("/.well-known/jwks.json", app.jwksHandler)
+
+	req, _ := http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=600", w.Header().Get("Cache-Control"))
+
+	var set jwks.Set
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+	require.Len(t, set.Keys, 1)
+	assert.Equal(t, "RSA", set.Keys[0].Kty)
+	assert.Empty(t, set.Keys[0].X)
+
+	// Other services verify tokens with the published keys only.
+	key, err := set.Keys[0].Key()
+	require.NoError(t, err)
+	token, err := app.generateAccessToken(Session{Id: uuid.New(), UserId: uuid.MustParse(UUID)})
+	require.NoError(t, err)
+	claims, err := jwks.Parse(context.Background(), jwks.NewStaticKeys(key), token)
+	require.NoError(t, err)
+	assert.Equal(t, UUID, claims["user_id"])
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 test vectors for SHA-1, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, code := range vectors {
+		assert.Equal(t, code, totpCode(secret, totpStep(time.Unix(unix, 0))), unix)
+	}
+
+	encoded := b32.EncodeToString(secret)
+	now := time.Unix(1111111109, 0)
+	step := totpStep(now)
+
+	matched, ok := verifyTOTP(encoded, "081804", now, 0)
+	assert.True(t, ok)
+	assert.Equal(t, step, matched)
+
+	// Codes of the neighbouring steps are accepted for clock drift.
+	_, ok = verifyTOTP(encoded, totpCode(secret, step-1), now, 0)
+	assert.True(t, ok)
+	_, ok = verifyTOTP(encoded, totpCode(secret, step+1), now, 0)
+	assert.True(t, ok)
+	_, ok = verifyTOTP(encoded, totpCode(secret, step+2), now, 0)
+	assert.False(t, ok)
+
+	// Used steps are rejected.
+	_, ok = verifyTOTP(encoded, "081804", now, step)
+	assert.False(t, ok)
+	_, ok = verifyTOTP(encoded, "81804", now, 0)
+	assert.False(t, ok)
+	_, ok = verifyTOTP("not base32!", "081804", now, 0)
+	assert.False(t, ok)
+}
+
+func TestOtpauthURI(t *testing.T) {
+	secret, err := newTOTPSecret()
+	require.NoError(t, err)
+	assert.Len(t, secret, 32)
+
+	uri, err := url.Parse(otpauthURI("john doe", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Markdown-editor:john doe", uri.Path)
+	assert.Equal(t, secret, uri.Query().Get("secret"))
+	assert.Equal(t, TOTP_ISSUER, uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+	assert.Equal(t, "30", uri.Query().Get("period"))
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	code, err := newRecoveryCode()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[A-Z2-7]{4}(-[A-Z2-7]{4}){3}$`, code)
+
+	other, err := newRecoveryCode()
+	require.NoError(t, err)
+	assert.NotEqual(t, code, other)
+
+	normalized := normalizeRecoveryCode(code)
+	assert.Len(t, normalized, RECOVERY_CODE_LEN)
+	assert.Equal(t, normalized, normalizeRecoveryCode(strings.ToLower(strings.ReplaceAll(code, "-", " "))))
+}
+
+func TestTwoFactorLoginValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Incomplete requests never reach the database.
+	app := &App{}
+	r := gin.New()
+	r.POST("/v1/login/2fa", app.twoFactorLoginHandler)
+
+	for _, body := range []string{
+		`{}`,
+		`{"challenge": "c"}`,
+		`{"code": "123456"}`,
+		`{"challenge": "c", "code": "123456", "recoveryCode": "AAAA-BBBB"}`,
+		`not json`,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, "/v1/login/2fa", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		assert.Empty(t, w.Result().Cookies(), body)
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+	now := time.Now()
+	var lockout totpLockout
+
+	// A guesser gets new challenges with the password, but wrong codes add
+	// up across them.
+	challenges := 0
+	for lockout.locked(now) == nil {
+		challenges++
+		for range MAX_CHALLENGE_ATTEMPTS {
+			lockout.fail(now)
+			if lockout.locked(now) != nil {
+				break
+			}
+		}
+	}
+	assert.Equal(t, TOTP_LOCKOUT_FAILURES/MAX_CHALLENGE_ATTEMPTS, challenges)
+
+	var locked *TwoFactorLockedError
+	require.ErrorAs(t, lockout.locked(now), &locked)
+	assert.Equal(t, now.Add(TOTP_LOCKOUT), locked.Until)
+	assert.NoError(t, lockout.locked(locked.Until), "the lockout ends")
+
+	// Every further wrong code doubles the lockout, up to the maximum.
+	lockout.fail(now)
+	assert.Equal(t, now.Add(2*TOTP_LOCKOUT), *lockout.lockedUntil)
+	for range 20 {
+		lockout.fail(now)
+	}
+	assert.Equal(t, now.Add(MAX_TOTP_LOCKOUT), *lockout.lockedUntil)
+}
+
+func TestTwoFactorLocked(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		abortTwoFactorLocked(c, &TwoFactorLockedError{Until: time.Now().Add(90 * time.Second)})
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "90", w.Header().Get("Retry-After"))
+}
+
+// smtpSink accepts one SMTP session on a local port and records the
+// envelope and message.
+type smtpSink struct {
+	addr string
+	from string
+	to   []string
+	data string
+	done chan struct{}
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	sink := &smtpSink{addr: ln.Addr().String(), done: make(chan struct{})}
+	go func() {
+		defer close(sink.done)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				tp.PrintfLine("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				sink.from = line[len("MAIL FROM:"):]
+				tp.PrintfLine("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				sink.to = append(sink.to, line[len("RCPT TO:"):])
+				tp.PrintfLine("250 OK")
+			case cmd == "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				sink.data = string(data)
+				tp.PrintfLine("250 OK")
+			case cmd == "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+
+	return sink
+}
+
+func TestSMTPMailer(t *testing.T) {
+	sink := newSMTPSink(t)
+
+	mailer, err := NewSMTPMailer(sink.addr, "Markdown-editor <no-reply@example.com>", "", "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = mailer.Send(ctx, Mail{To: "alice@example.com", Subject: "Привет", Body: "Open the link:\nhttps://localhost/verify-email?token=abc\n"})
+	require.NoError(t, err)
+	<-sink.done
+
+	assert.Equal(t, "<no-reply@example.com>", sink.from)
+	assert.Equal(t, []string{"<alice@example.com>"}, sink.to)
+
+	msg, err := mail.ReadMessage(strings.NewReader(sink.data))
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", msg.Header.Get("To"))
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "Привет", subject)
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	require.NoError(t, err)
+	// The sink reads the message with bare line feeds.
+	assert.Equal(t, "Open the link:\nhttps://localhost/verify-email?token=abc\n", string(body))
+}
+
+func TestMailHeaderInjection(t *testing.T) {
+	for _, m := range []Mail{
+		{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hi"},
+		{To: "alice@example.com", Subject: "Hi\nBcc: eve@example.com"},
+		{To: "not an address", Subject: "Hi"},
+	} {
+		_, err := m.message(DEFAULT_MAIL_FROM, time.Now())
+		assert.Error(t, err, m.To+m.Subject)
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := &LogMailer{Dir: dir, From: DEFAULT_MAIL_FROM}
+
+	app := &App{AppURL: "https://localhost:5173/"}
+	m := app.passwordResetMail("alice", "alice@example.com", "a+b")
+	require.NoError(t, mailer.Send(context.Background(), m))
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	require.NoError(t, err)
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "https://localhost:5173/reset-password?token=a%2Bb")
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	email, err := normalizeEmail("  Alice@Example.com ")
+	require.NoError(t, err)
+	assert.Equal(t, "Alice@Example.com", email)
+
+	for _, invalid := range []string{"", "alice", "Alice <alice@example.com>", "a@b.c, d@e.f", strings.Repeat("a", MAX_EMAIL_LEN) + "@example.com"} {
+		_, err := normalizeEmail(invalid)
+		assert.ErrorIs(t, err, ErrInvalidEmail, invalid)
+	}
+}
+
+func TestEmailTakenErr(t *testing.T) {
+	taken := &pgconn.PgError{Code: PG_UNIQUE_VIOLATION, ConstraintName: EMAIL_INDEX}
+	assert.ErrorIs(t, emailTakenErr(fmt.Errorf("insert: %w", taken)), ErrEmailTaken)
+
+	username := &pgconn.PgError{Code: PG_UNIQUE_VIOLATION, ConstraintName: "users_username_key"}
+	assert.Equal(t, username, emailTakenErr(username))
+	assert.Nil(t, emailTakenErr(nil))
+
+	// Expired tokens are rejected like invalid ones.
+	assert.ErrorIs(t, ErrEmailTokenExpired, ErrInvalidEmailToken)
+}
+
+func TestEmailInUseMail(t *testing.T) {
+	app := &App{AppURL: "https://editor.example.com/"}
+	m := app.emailInUseMail("alice@example.com")
+	assert.Equal(t, "alice@example.com", m.To)
+	assert.Contains(t, m.Body, "https://editor.example.com/login")
+
+	_, err := m.message(DEFAULT_MAIL_FROM, time.Now())
+	assert.NoError(t, err)
+}
+
+// newTestDB returns a database with the schema of db/init.sql. Tests using
+// it are skipped unless TEST_DATABASE_URL is set, the schema is recreated.
+func newTestDB(t *testing.T) *pgxpool.Pool {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	schema, err := os.ReadFile(filepath.Join("db", "init.sql"))
+	require.NoError(t, err)
+	// Skip setting up the server, only the statements for auth_db are run.
+	_, tables, found := strings.Cut(string(schema), "\\connect auth_db;")
+	require.True(t, found)
+
+	db, err := pgxpool.New(context.Background(), url)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	_, err = db.Exec(context.Background(), tables)
+	require.NoError(t, err)
+
+	return db
+}
+
+func TestEmailSquatting(t *testing.T) {
+	ctx := context.Background()
+	app := &App{DB: newTestDB(t)}
+
+	// Mallory claims the address of Alice and never verifies it.
+	_, err := app.createUser(ctx, "mallory", "hash", "")
+	require.NoError(t, err)
+	var mallory uuid.UUID
+	require.NoError(t, app.DB.QueryRow(ctx, "SELECT id FROM users WHERE username = 'mallory'").Scan(&mallory))
+	_, err = app.setEmail(ctx, mallory, "alice@example.com")
+	require.NoError(t, err)
+
+	// Alice still registers with it and verifying makes it hers.
+	token, err := app.createUser(ctx, "alice", "hash", "Alice@example.com")
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+	require.NoError(t, app.verifyEmail(ctx, token))
+
+	email, _, err := app.emailStatus(ctx, mallory)
+	require.NoError(t, err)
+	assert.Empty(t, email, "unverified claims are dropped")
+
+	_, username, err := app.createPasswordReset(ctx, "alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	// Verified addresses can't be claimed anymore.
+	_, err = app.setEmail(ctx, mallory, "ALICE@example.com")
+	assert.ErrorIs(t, err, ErrEmailTaken)
+	_, err = app.createUser(ctx, "eve", "hash", "alice@example.com")
+	assert.ErrorIs(t, err, ErrEmailTaken)
+}
+
+func TestEmailRequestValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Invalid requests never reach the database.
+	app := &App{}
+	r := gin.New()
+	r.POST("/v1/register", app.registerHandler)
+	r.POST("/v1/email/verify", app.verifyEmailHandler)
+	r.POST("/v1/password/forgot", app.forgotPasswordHandler)
+	r.POST("/v1/password/reset", app.resetPasswordHandler)
+
+	for _, tt := range []struct {
+		path string
+		body string
+	}{
+		{"/v1/register", `{"username": "alice", "password": "secret", "email": "alice"}`},
+		{"/v1/register", `{"username": "alice", "password": "short", "email": "alice@example.com"}`},
+		{"/v1/email/verify", `{}`},
+		{"/v1/password/forgot", `{"email": ""}`},
+		{"/v1/password/forgot", `{"email": "Alice <alice@example.com>"}`},
+		{"/v1/password/reset", `{"password": "secret"}`},
+		{"/v1/password/reset", `{"token": "t", "password": "short"}`},
+		{"/v1/password/reset", `not json`},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, tt.path+" "+tt.body)
+	}
+}
@@ -12,8 +12,21 @@ type HealthResponse struct {
 	Time   time.Time `json:"time"`
 }
 
+// LoginResponse of users with two-factor authentication has no tokens but
+// a challenge to complete with /v1/login/2fa.
 type LoginResponse struct {
-	Message string `json:"message"`
+	Message            string     `json:"message"`
+	TwoFactorRequired  bool       `json:"twoFactorRequired,omitempty"`
+	Challenge          string     `json:"challenge,omitempty"`
+	ChallengeExpiresAt *time.Time `json:"challengeExpiresAt,omitempty"`
+}
+
+// TwoFactorLoginRequest completes a login challenge with a TOTP code or, if
+// the authenticator is lost, a recovery code.
+type TwoFactorLoginRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
 }
 
 type LogoutResponse struct {
@@ -28,9 +41,11 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// RegisterRequest may have an email, a verification link is sent to it.
 type RegisterRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email"`
 }
 
 type RegisterResponse struct {
@@ -40,3 +55,89 @@ type RegisterResponse struct {
 type RefreshResponse struct {
 	Message string `json:"message"`
 }
+
+type UserResponse struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// SessionResponse is a session of the user, Current is the one of the request.
+type SessionResponse struct {
+	Id         string    `json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+type RevokeSessionsResponse struct {
+	Message string `json:"message"`
+	Revoked int64  `json:"revoked"`
+}
+
+type SessionStatusResponse struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+	Active bool   `json:"active"`
+}
+
+type PasswordRequest struct {
+	Password string `json:"password"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorStatusResponse struct {
+	Enabled           bool `json:"enabled"`
+	Pending           bool `json:"pending"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+}
+
+// TwoFactorSetupResponse has the secret to add to an authenticator app,
+// usually by showing OtpauthURI as a QR code.
+type TwoFactorSetupResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauthUri"`
+}
+
+// RecoveryCodesResponse has the recovery codes, they are shown only once.
+type RecoveryCodesResponse struct {
+	Message       string   `json:"message"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// EmailRequest sets the email of the user, the current password confirms it.
+type EmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type EmailStatusResponse struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
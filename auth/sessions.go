@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// A session is started by every login. Its refresh tokens are opaque random
+// strings, only their SHA-256 hashes are stored. Every refresh exchanges the
+// token for a new one of the same session, so each token is used once. A
+// token used again means it was stolen, either by the one presenting it or
+// by the one who used it first, so the whole session is revoked.
+const (
+	REFRESH_TOKEN_BYTES = 32
+	// SESSION_SWEEP_INTERVAL is how often expired sessions are deleted.
+	SESSION_SWEEP_INTERVAL = time.Hour
+	// MAX_USER_AGENT_LEN limits the user agent kept for the list of sessions.
+	MAX_USER_AGENT_LEN = 512
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+	ErrSessionRevoked      = errors.New("session was revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// Session is a login of a user. UserAgent and IP are those of the client that
+// logged in or refreshed last.
+type Session struct {
+	Id         uuid.UUID
+	UserId     uuid.UUID
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+	UserAgent  string
+	IP         string
+}
+
+// Client describes who logs in or refreshes a session.
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+func newClient(c *gin.Context) Client {
+	userAgent := strings.ToValidUTF8(c.Request.UserAgent(), "")
+	if len(userAgent) > MAX_USER_AGENT_LEN {
+		userAgent = strings.ToValidUTF8(userAgent[:MAX_USER_AGENT_LEN], "")
+	}
+
+	return Client{UserAgent: userAgent, IP: c.ClientIP()}
+}
+
+// Active reports whether the session can still be used.
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, REFRESH_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// insertRefreshToken stores a new refresh token of the session and returns it.
+func insertRefreshToken(ctx context.Context, tx pgx.Tx, sessionId uuid.UUID, now time.Time) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx,
+		"INSERT INTO refresh_tokens (token_hash, session_id, created_at, expires_at) VALUES ($1, $2, $3, $4)",
+		hashToken(token), sessionId, now, now.Add(REFRESH_TOKEN_TTL))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// createSession starts a session of the user and returns it with its first
+// refresh token.
+func (a *App) createSession(ctx context.Context, userId uuid.UUID, client Client) (Session, string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return Session{}, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now()
+	session := Session{
+		UserId:     userId,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(REFRESH_TOKEN_TTL),
+		UserAgent:  client.UserAgent,
+		IP:         client.IP,
+	}
+	err = tx.QueryRow(ctx,
+		`INSERT INTO sessions (user_id, created_at, last_used_at, expires_at, user_agent, ip)
+		VALUES ($1, $2, $2, $3, $4, $5) RETURNING id`,
+		userId, now, session.ExpiresAt, client.UserAgent, client.IP).Scan(&session.Id)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	token, err := insertRefreshToken(ctx, tx, session.Id, now)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	return session, token, tx.Commit(ctx)
+}
+
+// rotateRefreshToken marks the refresh token used and returns its session
+// with the next token. A token used before revokes its session, the session
+// is returned along with ErrRefreshTokenReused.
+func (a *App) rotateRefreshToken(ctx context.Context, token string, client Client) (Session, string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return Session{}, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		session   Session
+		expiresAt time.Time
+		usedAt    *time.Time
+		revokedAt *time.Time
+	)
+	// Concurrent refreshes with the same token wait here, all but the first
+	// see it used.
+	err = tx.QueryRow(ctx,
+		`SELECT s.id, s.user_id, t.expires_at, t.used_at, s.revoked_at
+		FROM refresh_tokens t JOIN sessions s ON s.id = t.session_id
+		WHERE t.token_hash = $1 FOR UPDATE`, hashToken(token)).
+		Scan(&session.Id, &session.UserId, &expiresAt, &usedAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Session{}, "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	now := time.Now()
+	switch {
+	case revokedAt != nil:
+		return session, "", ErrSessionRevoked
+	case usedAt != nil:
+		if _, err := tx.Exec(ctx, "UPDATE sessions SET revoked_at = $2 WHERE id = $1", session.Id, now); err != nil {
+			return Session{}, "", err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return Session{}, "", err
+		}
+		return session, "", ErrRefreshTokenReused
+	case now.After(expiresAt):
+		return session, "", ErrExpiredToken
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE refresh_tokens SET used_at = $2 WHERE token_hash = $1", hashToken(token), now); err != nil {
+		return Session{}, "", err
+	}
+	next, err := insertRefreshToken(ctx, tx, session.Id, now)
+	if err != nil {
+		return Session{}, "", err
+	}
+	_, err = tx.Exec(ctx,
+		"UPDATE sessions SET last_used_at = $2, expires_at = $3, user_agent = $4, ip = $5 WHERE id = $1",
+		session.Id, now, now.Add(REFRESH_TOKEN_TTL), client.UserAgent, client.IP)
+	if err != nil {
+		return Session{}, "", err
+	}
+
+	return session, next, tx.Commit(ctx)
+}
+
+// revokeSessionByToken revokes the session of the refresh token. Unknown
+// tokens are ignored.
+func (a *App) revokeSessionByToken(ctx context.Context, token string) error {
+	_, err := a.DB.Exec(ctx,
+		`UPDATE sessions SET revoked_at = $2
+		WHERE id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1) AND revoked_at IS NULL`,
+		hashToken(token), time.Now())
+
+	return err
+}
+
+const sessionColumns = "id, user_id, created_at, last_used_at, expires_at, revoked_at, user_agent, ip"
+
+func scanSession(row pgx.Row) (Session, error) {
+	var s Session
+	err := row.Scan(&s.Id, &s.UserId, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.RevokedAt, &s.UserAgent, &s.IP)
+	return s, err
+}
+
+// getSession returns the session, revoked and expired ones too.
+func (a *App) getSession(ctx context.Context, id uuid.UUID) (Session, error) {
+	session, err := scanSession(a.DB.QueryRow(ctx, "SELECT "+sessionColumns+" FROM sessions WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Session{}, ErrSessionNotFound
+	}
+
+	return session, err
+}
+
+// listSessions returns active sessions of the user, most recently used first.
+func (a *App) listSessions(ctx context.Context, userId uuid.UUID) ([]Session, error) {
+	rows, err := a.DB.Query(ctx,
+		"SELECT "+sessionColumns+` FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_used_at DESC, created_at DESC`, userId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// revokeSession revokes an active session of the user.
+func (a *App) revokeSession(ctx context.Context, userId uuid.UUID, id uuid.UUID) error {
+	now := time.Now()
+	tag, err := a.DB.Exec(ctx,
+		`UPDATE sessions SET revoked_at = $3
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > $3`,
+		id, userId, now)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// revokeOtherSessions revokes all active sessions of the user but keep and
+// returns their number.
+func (a *App) revokeOtherSessions(ctx context.Context, userId uuid.UUID, keep uuid.UUID) (int64, error) {
+	now := time.Now()
+	tag, err := a.DB.Exec(ctx,
+		`UPDATE sessions SET revoked_at = $3
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL AND expires_at > $3`,
+		userId, keep, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// deleteExpiredSessions deletes sessions whose last refresh token expired,
+// revoked or not, with their tokens.
+func (a *App) deleteExpiredSessions(ctx context.Context) (int64, error) {
+	tag, err := a.DB.Exec(ctx, "DELETE FROM sessions WHERE expires_at < $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Codes are RFC 6238 time-based one-time passwords with the parameters
+// authenticator apps assume: HMAC-SHA1, 6 digits, 30 second steps. Codes of
+// the previous and the next step are accepted for clock drift.
+const (
+	TOTP_ISSUER       = "Markdown-editor"
+	TOTP_SECRET_BYTES = 20
+	TOTP_DIGITS       = 6
+	TOTP_PERIOD       = 30 * time.Second
+	TOTP_SKEW         = 1
+)
+
+// Recovery codes are RECOVERY_CODE_LEN base32 characters, shown in groups of
+// four and accepted with any grouping and case.
+const (
+	RECOVERY_CODES    = 10
+	RECOVERY_CODE_LEN = 16
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, TOTP_SECRET_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return b32.EncodeToString(b), nil
+}
+
+// totpStep returns the number of the time step at t.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD/time.Second)
+}
+
+// totpCode returns the code of the secret for the time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range TOTP_DIGITS {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%mod)
+}
+
+// verifyTOTP checks the code against the steps around now and returns the
+// step it matched. Steps up to lastStep were used already and are rejected,
+// so a code can't be replayed.
+func verifyTOTP(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := b32.DecodeString(secret)
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// otpauthURI returns the key URI authenticator apps import, usually from a
+// QR code.
+func otpauthURI(account string, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTP_ISSUER)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	params.Set("period", fmt.Sprint(int(TOTP_PERIOD/time.Second)))
+
+	label := url.PathEscape(TOTP_ISSUER + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, RECOVERY_CODE_LEN*5/8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := b32.EncodeToString(b)
+	groups := make([]string, 0, len(code)/4)
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryCode strips the grouping and case of a recovery code, the
+// stored hashes are of normalized codes.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
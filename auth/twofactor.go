@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users with two-factor authentication log in in two steps: the password
+// gets a login challenge, a short-lived opaque token, and the challenge with a
+// TOTP code or an unused recovery code gets the session. Like refresh tokens,
+// challenges and recovery codes are only stored as SHA-256 hashes.
+const (
+	LOGIN_CHALLENGE_TTL = 5 * time.Minute
+	// MAX_CHALLENGE_ATTEMPTS limits wrong codes per challenge, the password
+	// has to be entered again after that.
+	MAX_CHALLENGE_ATTEMPTS = 5
+	// After TOTP_LOCKOUT_FAILURES wrong codes in a row, across challenges,
+	// the user gets no challenges for TOTP_LOCKOUT, doubling with every
+	// further wrong code up to MAX_TOTP_LOCKOUT.
+	TOTP_LOCKOUT_FAILURES = 10
+	TOTP_LOCKOUT          = time.Minute
+	MAX_TOTP_LOCKOUT      = 24 * time.Hour
+)
+
+var (
+	ErrWrongPassword       = errors.New("wrong password")
+	ErrInvalidChallenge    = errors.New("login challenge is invalid or expired")
+	ErrInvalidCode         = errors.New("two-factor code is invalid")
+	ErrTwoFactorNotPending = errors.New("no two-factor enrollment is pending")
+	ErrTwoFactorDisabled   = errors.New("two-factor authentication is not enabled")
+)
+
+// TwoFactorLockedError is returned while the user is locked out of the
+// second login step for too many wrong codes.
+type TwoFactorLockedError struct {
+	Until time.Time
+}
+
+func (e *TwoFactorLockedError) Error() string {
+	return "two-factor login is locked until " + e.Until.Format(time.RFC3339)
+}
+
+// totpLockout counts the wrong codes of a user in a row, so guessing can't
+// go on with new challenges.
+type totpLockout struct {
+	failures    int
+	lockedUntil *time.Time
+}
+
+// locked returns an error while the lockout lasts.
+func (l totpLockout) locked(now time.Time) error {
+	if l.lockedUntil != nil && now.Before(*l.lockedUntil) {
+		return &TwoFactorLockedError{Until: *l.lockedUntil}
+	}
+	return nil
+}
+
+// fail counts a wrong code and locks the user once there are too many.
+func (l *totpLockout) fail(now time.Time) {
+	l.failures++
+	if l.failures < TOTP_LOCKOUT_FAILURES {
+		return
+	}
+
+	lock := TOTP_LOCKOUT
+	for range l.failures - TOTP_LOCKOUT_FAILURES {
+		if lock >= MAX_TOTP_LOCKOUT {
+			break
+		}
+		lock *= 2
+	}
+	until := now.Add(min(lock, MAX_TOTP_LOCKOUT))
+	l.lockedUntil = &until
+}
+
+// TwoFactor is the two-factor state of a user. Pending is set between the
+// start of an enrollment and its confirmation.
+type TwoFactor struct {
+	Enabled           bool
+	Pending           bool
+	RecoveryCodesLeft int
+}
+
+// checkPassword compares the password with the one of the user and returns
+// the username.
+func (a *App) checkPassword(ctx context.Context, userId uuid.UUID, password string) (string, error) {
+	var username, passwordHash string
+	err := a.DB.QueryRow(ctx, "SELECT username, password_hash FROM users WHERE id = $1", userId).
+		Scan(&username, &passwordHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrWrongPassword
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)) != nil {
+		return "", ErrWrongPassword
+	}
+	return username, nil
+}
+
+func (a *App) twoFactorStatus(ctx context.Context, userId uuid.UUID) (TwoFactor, error) {
+	var status TwoFactor
+	err := a.DB.QueryRow(ctx,
+		`SELECT u.totp_secret IS NOT NULL, u.totp_pending_secret IS NOT NULL,
+			(SELECT COUNT(*) FROM recovery_codes r WHERE r.user_id = u.id AND r.used_at IS NULL)
+		FROM users u WHERE u.id = $1`, userId).
+		Scan(&status.Enabled, &status.Pending, &status.RecoveryCodesLeft)
+
+	return status, err
+}
+
+// startTOTPEnrollment makes a new secret for the user. It replaces the
+// current one only once a code of it is confirmed, so enrolling a new device
+// doesn't lock the user out halfway.
+func (a *App) startTOTPEnrollment(ctx context.Context, userId uuid.UUID) (string, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = a.DB.Exec(ctx, "UPDATE users SET totp_pending_secret = $2 WHERE id = $1", userId, secret)
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// confirmTOTPEnrollment enables the pending secret if the code matches it and
+// returns new recovery codes, replacing any old ones.
+func (a *App) confirmTOTPEnrollment(ctx context.Context, userId uuid.UUID, code string) ([]string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var pending *string
+	err = tx.QueryRow(ctx, "SELECT totp_pending_secret FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&pending)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, ErrTwoFactorNotPending
+	}
+
+	step, ok := verifyTOTP(*pending, code, time.Now(), 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	_, err = tx.Exec(ctx,
+		"UPDATE users SET totp_secret = $2, totp_pending_secret = NULL, totp_last_step = $3 WHERE id = $1",
+		userId, *pending, step)
+	if err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userId uuid.UUID) ([]string, error) {
+	if _, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, RECOVERY_CODES)
+	for range RECOVERY_CODES {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(ctx,
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userId, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// regenerateRecoveryCodes replaces the recovery codes of a user with
+// two-factor authentication enabled.
+func (a *App) regenerateRecoveryCodes(ctx context.Context, userId uuid.UUID) ([]string, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var enabled bool
+	err = tx.QueryRow(ctx, "SELECT totp_secret IS NOT NULL FROM users WHERE id = $1 FOR UPDATE", userId).Scan(&enabled)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrTwoFactorDisabled
+	}
+
+	codes, err := replaceRecoveryCodes(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit(ctx)
+}
+
+// disableTwoFactor forgets the secrets, recovery codes and open login
+// challenges of the user.
+func (a *App) disableTwoFactor(ctx context.Context, userId uuid.UUID) error {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE users SET totp_secret = NULL, totp_pending_secret = NULL, totp_last_step = 0
+		WHERE id = $1 AND (totp_secret IS NOT NULL OR totp_pending_secret IS NOT NULL)`, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTwoFactorDisabled
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM login_challenges WHERE user_id = $1", userId); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// createLoginChallenge returns a challenge for the second login step of the
+// user and its expiration, or a TwoFactorLockedError while the user is locked
+// out.
+func (a *App) createLoginChallenge(ctx context.Context, userId uuid.UUID) (string, time.Time, error) {
+	var lockout totpLockout
+	err := a.DB.QueryRow(ctx, "SELECT totp_locked_until FROM users WHERE id = $1", userId).Scan(&lockout.lockedUntil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := lockout.locked(time.Now()); err != nil {
+		return "", time.Time{}, err
+	}
+
+	// Challenges are random like refresh tokens.
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(LOGIN_CHALLENGE_TTL)
+	_, err = a.DB.Exec(ctx,
+		"INSERT INTO login_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashToken(token), userId, expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// completeLoginChallenge checks the TOTP code or, if code is empty, the
+// recovery code for the challenge and returns the user logging in. The
+// challenge is used up on success, wrong codes count against its attempts
+// and the lockout of the user.
+func (a *App) completeLoginChallenge(ctx context.Context, token string, code string, recoveryCode string) (uuid.UUID, error) {
+	tx, err := a.DB.Begin(ctx)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		userId    uuid.UUID
+		expiresAt time.Time
+		attempts  int
+		secret    *string
+		lastStep  int64
+		lockout   totpLockout
+	)
+	// Locks the user too, concurrent logins can't accept the same code.
+	err = tx.QueryRow(ctx,
+		`SELECT c.user_id, c.expires_at, c.attempts, u.totp_secret, u.totp_last_step,
+			u.totp_failed_attempts, u.totp_locked_until
+		FROM login_challenges c JOIN users u ON u.id = c.user_id
+		WHERE c.token_hash = $1 FOR UPDATE`, hashToken(token)).
+		Scan(&userId, &expiresAt, &attempts, &secret, &lastStep, &lockout.failures, &lockout.lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, ErrInvalidChallenge
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	now := time.Now()
+	if secret == nil || now.After(expiresAt) || attempts >= MAX_CHALLENGE_ATTEMPTS {
+		if _, err := tx.Exec(ctx, "DELETE FROM login_challenges WHERE token_hash = $1", hashToken(token)); err != nil {
+			return uuid.Nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return uuid.Nil, err
+		}
+		return uuid.Nil, ErrInvalidChallenge
+	}
+	// Challenges created before the lockout don't get around it.
+	if err := lockout.locked(now); err != nil {
+		return uuid.Nil, err
+	}
+
+	var ok bool
+	if code != "" {
+		var step int64
+		if step, ok = verifyTOTP(*secret, code, now, lastStep); ok {
+			if _, err := tx.Exec(ctx, "UPDATE users SET totp_last_step = $2 WHERE id = $1", userId, step); err != nil {
+				return uuid.Nil, err
+			}
+		}
+	} else if recoveryCode != "" {
+		tag, err := tx.Exec(ctx,
+			"UPDATE recovery_codes SET used_at = $3 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+			userId, hashToken(normalizeRecoveryCode(recoveryCode)), now)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		ok = tag.RowsAffected() == 1
+	}
+
+	if !ok {
+		if _, err := tx.Exec(ctx, "UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = $1", hashToken(token)); err != nil {
+			return uuid.Nil, err
+		}
+		lockout.fail(now)
+		_, err = tx.Exec(ctx,
+			"UPDATE users SET totp_failed_attempts = $2, totp_locked_until = $3 WHERE id = $1",
+			userId, lockout.failures, lockout.lockedUntil)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return uuid.Nil, err
+		}
+		return uuid.Nil, ErrInvalidCode
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM login_challenges WHERE token_hash = $1", hashToken(token)); err != nil {
+		return uuid.Nil, err
+	}
+	_, err = tx.Exec(ctx, "UPDATE users SET totp_failed_attempts = 0, totp_locked_until = NULL WHERE id = $1", userId)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return userId, tx.Commit(ctx)
+}
+
+// deleteExpiredChallenges deletes login challenges nobody can complete
+// anymore.
+func (a *App) deleteExpiredChallenges(ctx context.Context) (int64, error) {
+	tag, err := a.DB.Exec(ctx, "DELETE FROM login_challenges WHERE expires_at < $1", time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,203 @@
+package collab
+
+import (
+	"errors"
+	"sync"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+)
+
+// MAX_HISTORY is the number of recent operations a document keeps to
+// transform late operations. Clients lagging further behind must reconnect.
+const MAX_HISTORY = 1000
+
+var (
+	ErrInvalidRevision = errors.New("revision is in the future")
+	ErrRevisionTooOld  = errors.New("revision is too old, reconnect to resync")
+)
+
+// Cursor is a caret or a selection of a session, in code points. Position
+// equals SelectionEnd when nothing is selected.
+type Cursor struct {
+	Position     int `json:"position"`
+	SelectionEnd int `json:"selectionEnd"`
+}
+
+// Document is the state of a file edited by sessions. Every accepted
+// operation bumps the revision, operations based on an older revision are
+// transformed against the ones applied since.
+type Document struct {
+	owner    uuid.UUID
+	filename string
+
+	mu       sync.Mutex
+	text     []rune
+	revision int
+	// history holds operations turning revision-len(history) into revision.
+	history  []*Operation
+	sessions map[string]*Session
+
+	// saveMu serializes saves. saved is the content last read from or written
+	// to the repository, at savedRevision, and savedETag its ETag.
+	// savedRevision is -1 when saved doesn't match any revision.
+	saveMu        sync.Mutex
+	saved         []rune
+	savedETag     string
+	savedRevision int
+
+	done chan struct{}
+}
+
+func newDocument(owner uuid.UUID, filename string, data []byte) *Document {
+	text := []rune(string(data))
+	return &Document{
+		owner:     owner,
+		filename:  filename,
+		text:      text,
+		sessions:  make(map[string]*Session),
+		saved:     text,
+		savedETag: repodb.ETag(data),
+		done:      make(chan struct{}),
+	}
+}
+
+// apply transforms op based on revision against concurrent operations,
+// applies it and returns the transformed operation with the new revision.
+// Cursors of all sessions are moved. Must be called with mu held.
+func (d *Document) apply(revision int, op *Operation) (*Operation, int, error) {
+	if revision < 0 || revision > d.revision {
+		return nil, 0, ErrInvalidRevision
+	}
+	start := d.revision - len(d.history)
+	if revision < start {
+		return nil, 0, ErrRevisionTooOld
+	}
+
+	for _, concurrent := range d.history[revision-start:] {
+		var err error
+		op, _, err = Transform(op, concurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	text, err := op.Apply(d.text)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.text = text
+	d.revision++
+	d.history = append(d.history, op)
+	if len(d.history) > MAX_HISTORY {
+		d.history = d.history[len(d.history)-MAX_HISTORY:]
+	}
+
+	for _, s := range d.sessions {
+		if s.cursor != nil {
+			s.cursor = &Cursor{
+				Position:     TransformIndex(op, s.cursor.Position),
+				SelectionEnd: TransformIndex(op, s.cursor.SelectionEnd),
+			}
+		}
+	}
+
+	return op, d.revision, nil
+}
+
+// transformCursor moves a cursor sent at revision to the current one.
+// Must be called with mu held.
+func (d *Document) transformCursor(revision int, cursor Cursor) (Cursor, error) {
+	if revision < 0 || revision > d.revision {
+		return Cursor{}, ErrInvalidRevision
+	}
+	start := d.revision - len(d.history)
+	if revision < start {
+		return Cursor{}, ErrRevisionTooOld
+	}
+
+	for _, op := range d.history[revision-start:] {
+		cursor.Position = TransformIndex(op, cursor.Position)
+		cursor.SelectionEnd = TransformIndex(op, cursor.SelectionEnd)
+	}
+	cursor.Position = max(0, min(cursor.Position, len(d.text)))
+	cursor.SelectionEnd = max(0, min(cursor.SelectionEnd, len(d.text)))
+
+	return cursor, nil
+}
+
+// MAX_SAVE_ATTEMPTS limits retries of a save racing with other writers.
+const MAX_SAVE_ATTEMPTS = 3
+
+// save writes the document to the repository if it changed. The write is
+// conditional on the content last seen in the repository. If the file was
+// changed by someone else, for example by a plain PUT, the change is merged
+// into the document like an operation of another session and sent to all
+// sessions. The merged document is then saved.
+func (d *Document) save(repo repodb.FileRepository) error {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+
+	for range MAX_SAVE_ATTEMPTS {
+		d.mu.Lock()
+		if d.revision == d.savedRevision {
+			d.mu.Unlock()
+			return nil
+		}
+		text, revision, etag := d.text, d.revision, d.savedETag
+		d.mu.Unlock()
+
+		data := []byte(string(text))
+		err := repo.SaveIfMatch(d.filename, d.owner, data, []string{etag})
+		if err == nil {
+			d.mu.Lock()
+			d.saved, d.savedETag, d.savedRevision = text, repodb.ETag(data), revision
+			d.mu.Unlock()
+			return nil
+		}
+		if !errors.Is(err, repodb.ErrFileModified) {
+			return err
+		}
+
+		current, err := repo.Get(d.filename, d.owner)
+		if err != nil {
+			return err
+		}
+		if err := d.merge(current); err != nil {
+			return err
+		}
+	}
+
+	return repodb.ErrFileModified
+}
+
+// merge applies the difference between the saved content and data to
+// the document. If the history no longer reaches the saved revision, e.g.
+// after an earlier merge, the saved content is still the common ancestor of
+// the document and data: the change is transformed against the difference
+// between the saved content and the document instead.
+func (d *Document) merge(data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	external := []rune(string(data))
+	base, baseText := d.savedRevision, d.saved
+	change := Diff(baseText, external)
+	if base < d.revision-len(d.history) {
+		var err error
+		if change, _, err = Transform(change, Diff(baseText, d.text)); err != nil {
+			return err
+		}
+		base = d.revision
+	}
+
+	op, revision, err := d.apply(base, change)
+	if err != nil {
+		return err
+	}
+	d.saved, d.savedETag, d.savedRevision = external, repodb.ETag(data), -1
+	d.broadcast(ServerMessage{Type: MSG_OP, Revision: revision, Op: op}, nil)
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+)
+
+// Protocol. After connecting the client receives MSG_INIT with the text, the
+// revision, its session id and the other sessions. Then both sides exchange
+// messages:
+//
+//   - MSG_OP from the client carries an operation based on the revision the
+//     client has seen. The server answers MSG_ACK with the new revision and
+//     sends the transformed operation as MSG_OP to everyone else. A client
+//     must wait for the ack before sending its next operation and transform
+//     its pending operations against received ones, like ot.js does.
+//   - MSG_CURSOR from the client carries its cursor at a revision, the server
+//     sends it to everyone else with MSG_CURSOR.
+//   - MSG_JOIN and MSG_LEAVE tell about other sessions.
+//   - MSG_ERROR reports a rejected message or a failed save.
+//
+// Read-only sessions, marked in MSG_INIT, receive everything but can only
+// send cursors.
+const (
+	MSG_INIT   = "init"
+	MSG_OP     = "op"
+	MSG_ACK    = "ack"
+	MSG_CURSOR = "cursor"
+	MSG_JOIN   = "join"
+	MSG_LEAVE  = "leave"
+	MSG_ERROR  = "error"
+)
+
+// Error codes of MSG_ERROR.
+const (
+	ERR_MESSAGE_INVALID  = "MESSAGE_INVALID"
+	ERR_REVISION_INVALID = "REVISION_INVALID"
+	ERR_SAVE_FAILED      = "SAVE_FAILED"
+	ERR_FILE_NOT_FOUND   = "FILE_NOT_FOUND"
+	ERR_READ_ONLY        = "READ_ONLY"
+)
+
+// SEND_BUFFER is the number of messages queued for a session. Sessions that
+// don't keep up are disconnected.
+const SEND_BUFFER = 256
+
+type ClientMessage struct {
+	Type     string     `json:"type"`
+	Revision int        `json:"revision"`
+	Op       *Operation `json:"op,omitempty"`
+	Cursor   *Cursor    `json:"cursor,omitempty"`
+}
+
+// Presence describes a session editing the document.
+type Presence struct {
+	SessionId string    `json:"sessionId"`
+	UserId    uuid.UUID `json:"userId"`
+	ReadOnly  bool      `json:"readOnly,omitempty"`
+	Cursor    *Cursor   `json:"cursor,omitempty"`
+}
+
+// ServerMessage is sent by the server. SessionId is the own session in
+// MSG_INIT and the originating session otherwise, it is empty for changes
+// made outside of the sessions.
+type ServerMessage struct {
+	Type      string     `json:"type"`
+	Revision  int        `json:"revision"`
+	SessionId string     `json:"sessionId,omitempty"`
+	Text      *string    `json:"text,omitempty"`
+	Op        *Operation `json:"op,omitempty"`
+	Sessions  []Presence `json:"sessions,omitempty"`
+	UserId    *uuid.UUID `json:"userId,omitempty"`
+	ReadOnly  bool       `json:"readOnly,omitempty"`
+	Cursor    *Cursor    `json:"cursor,omitempty"`
+	Code      string     `json:"code,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Session is a connection to a document.
+type Session struct {
+	id       string
+	userId   uuid.UUID
+	readOnly bool
+	doc      *Document
+	cursor   *Cursor
+	send     chan ServerMessage
+}
+
+// Conn is the part of a WebSocket connection used by the hub,
+// *websocket.Conn implements it.
+type Conn interface {
+	ReadJSON(v any) error
+	WriteJSON(v any) error
+	Close() error
+}
+
+type docKey struct {
+	owner    uuid.UUID
+	filename string
+}
+
+// Hub keeps documents with connected sessions in memory. A document is loaded
+// when the first session joins, saved every saveInterval while it changes and
+// saved and dropped when the last session leaves. Edits made less than
+// saveInterval before the process stops are lost.
+type Hub struct {
+	repo         repodb.FileRepository
+	saveInterval time.Duration
+	logger       *slog.Logger
+
+	mu   sync.Mutex
+	docs map[docKey]*Document
+}
+
+func NewHub(repo repodb.FileRepository, saveInterval time.Duration, logger *slog.Logger) *Hub {
+	return &Hub{
+		repo:         repo,
+		saveInterval: saveInterval,
+		logger:       logger,
+		docs:         make(map[docKey]*Document),
+	}
+}
+
+// send queues msg for the session. A session with a full queue is
+// disconnected. Must be called with the document lock held.
+func (d *Document) send(s *Session, msg ServerMessage) {
+	if _, ok := d.sessions[s.id]; !ok {
+		return
+	}
+
+	select {
+	case s.send <- msg:
+	default:
+		delete(d.sessions, s.id)
+		close(s.send)
+		d.broadcast(ServerMessage{Type: MSG_LEAVE, Revision: d.revision, SessionId: s.id}, nil)
+	}
+}
+
+// broadcast sends msg to all sessions except the given one. Must be called
+// with the document lock held.
+func (d *Document) broadcast(msg ServerMessage, except *Session) {
+	for _, s := range d.sessions {
+		if s != except {
+			d.send(s, msg)
+		}
+	}
+}
+
+// Join connects a new session of userId to the file of owner. The file is
+// loaded if nobody edits it yet. Read-only sessions can't change the text.
+func (h *Hub) Join(owner uuid.UUID, filename string, userId uuid.UUID, readOnly bool) (*Session, error) {
+	// Loading under the hub lock keeps a document from being loaded twice.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := docKey{owner: owner, filename: filename}
+	doc, ok := h.docs[key]
+	if !ok {
+		data, err := h.repo.Get(filename, owner)
+		if err != nil {
+			return nil, err
+		}
+		doc = newDocument(owner, filename, data)
+		h.docs[key] = doc
+		go h.autosave(doc)
+	}
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	s := &Session{id: uuid.NewString(), userId: userId, readOnly: readOnly, doc: doc, send: make(chan ServerMessage, SEND_BUFFER)}
+	others := make([]Presence, 0, len(doc.sessions))
+	for _, other := range doc.sessions {
+		others = append(others, other.presence())
+	}
+	doc.broadcast(ServerMessage{Type: MSG_JOIN, Revision: doc.revision, SessionId: s.id, UserId: &s.userId, ReadOnly: readOnly}, nil)
+
+	doc.sessions[s.id] = s
+	text := string(doc.text)
+	doc.send(s, ServerMessage{Type: MSG_INIT, Revision: doc.revision, SessionId: s.id, Text: &text, Sessions: others, ReadOnly: readOnly})
+
+	return s, nil
+}
+
+func (s *Session) presence() Presence {
+	return Presence{SessionId: s.id, UserId: s.userId, ReadOnly: s.readOnly, Cursor: s.cursor}
+}
+
+// Serve exchanges messages of the session over conn until either side closes
+// it, then the session leaves.
+func (h *Hub) Serve(conn Conn, s *Session) {
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for msg := range s.send {
+			if err := conn.WriteJSON(msg); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+
+	for {
+		var msg ClientMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if !isDecodeError(err) {
+				break
+			}
+			s.doc.mu.Lock()
+			s.doc.send(s, ServerMessage{Type: MSG_ERROR, Revision: s.doc.revision, Code: ERR_MESSAGE_INVALID, Error: err.Error()})
+			s.doc.mu.Unlock()
+			continue
+		}
+		h.handle(s, msg)
+	}
+
+	h.Leave(s)
+	<-written
+}
+
+func (h *Hub) handle(s *Session, msg ClientMessage) {
+	doc := s.doc
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	switch {
+	case msg.Type == MSG_OP && s.readOnly:
+		doc.send(s, ServerMessage{Type: MSG_ERROR, Revision: doc.revision, Code: ERR_READ_ONLY, Error: "the session can't edit the document"})
+	case msg.Type == MSG_OP && msg.Op != nil:
+		op, revision, err := doc.apply(msg.Revision, msg.Op)
+		if err != nil {
+			doc.send(s, errorMessage(doc.revision, err))
+			return
+		}
+		doc.send(s, ServerMessage{Type: MSG_ACK, Revision: revision})
+		doc.broadcast(ServerMessage{Type: MSG_OP, Revision: revision, SessionId: s.id, Op: op}, s)
+	case msg.Type == MSG_CURSOR && msg.Cursor != nil:
+		cursor, err := doc.transformCursor(msg.Revision, *msg.Cursor)
+		if err != nil {
+			doc.send(s, errorMessage(doc.revision, err))
+			return
+		}
+		s.cursor = &cursor
+		doc.broadcast(ServerMessage{Type: MSG_CURSOR, Revision: doc.revision, SessionId: s.id, UserId: &s.userId, Cursor: &cursor}, s)
+	default:
+		doc.send(s, ServerMessage{Type: MSG_ERROR, Revision: doc.revision, Code: ERR_MESSAGE_INVALID, Error: "unknown message type or missing field"})
+	}
+}
+
+// isDecodeError reports whether a message was read but isn't valid, the
+// connection can still be used then.
+func isDecodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, ErrInvalidOperation)
+}
+
+func errorMessage(revision int, err error) ServerMessage {
+	code := ERR_MESSAGE_INVALID
+	if errors.Is(err, ErrInvalidRevision) || errors.Is(err, ErrRevisionTooOld) {
+		code = ERR_REVISION_INVALID
+	}
+
+	return ServerMessage{Type: MSG_ERROR, Revision: revision, Code: code, Error: err.Error()}
+}
+
+// Leave disconnects the session. The last session saves the document and
+// unloads it.
+func (h *Hub) Leave(s *Session) {
+	doc := s.doc
+	doc.mu.Lock()
+	if _, ok := doc.sessions[s.id]; ok {
+		delete(doc.sessions, s.id)
+		close(s.send)
+		doc.broadcast(ServerMessage{Type: MSG_LEAVE, Revision: doc.revision, SessionId: s.id}, nil)
+	}
+	empty := len(doc.sessions) == 0
+	doc.mu.Unlock()
+	if !empty {
+		return
+	}
+
+	// The document is saved before it is unloaded, so a session joining
+	// right after loads the saved content. Someone may join meanwhile.
+	h.save(doc)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	key := docKey{owner: doc.owner, filename: doc.filename}
+	if len(doc.sessions) == 0 && h.docs[key] == doc {
+		delete(h.docs, key)
+		close(doc.done)
+	}
+}
+
+func (h *Hub) autosave(doc *Document) {
+	ticker := time.NewTicker(h.saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doc.done:
+			return
+		case <-ticker.C:
+			h.save(doc)
+		}
+	}
+}
+
+// save saves the document and reports failures to its sessions. If the file
+// is gone, the sessions are disconnected.
+func (h *Hub) save(doc *Document) {
+	err := doc.save(h.repo)
+	if err == nil {
+		return
+	}
+
+	h.logger.Error("Failed to save collaborative document",
+		slog.String("user_id", doc.owner.String()),
+		slog.String("filename", doc.filename),
+		slog.String("error", err.Error()),
+	)
+
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+
+	if !errors.Is(err, repodb.ErrFileNotFound) {
+		doc.broadcast(ServerMessage{Type: MSG_ERROR, Revision: doc.revision, Code: ERR_SAVE_FAILED, Error: err.Error()}, nil)
+		return
+	}
+
+	doc.broadcast(ServerMessage{Type: MSG_ERROR, Revision: doc.revision, Code: ERR_FILE_NOT_FOUND, Error: err.Error()}, nil)
+	for id, s := range doc.sessions {
+		delete(doc.sessions, id)
+		close(s.send)
+	}
+}
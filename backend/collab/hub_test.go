@@ -0,0 +1,325 @@
+package collab
+
+import (
+	"io"
+	"log/slog"
+	"math/rand"
+	"testing"
+	"time"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHub(t *testing.T) (*Hub, repodb.FileRepository) {
+	repo, err := repodb.NewLocalFileRepo(t.TempDir())
+	require.NoError(t, err)
+
+	return NewHub(repo, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil))), repo
+}
+
+// testClient follows the client side of the protocol like ot.js: at most one
+// operation waits for an ack, later edits are composed into a buffer.
+type testClient struct {
+	t           *testing.T
+	session     *Session
+	text        []rune
+	revision    int
+	outstanding *Operation
+	buffer      *Operation
+	outbox      []ClientMessage
+	inbox       []ServerMessage
+}
+
+func (c *testClient) edit(op *Operation) {
+	text, err := op.Apply(c.text)
+	require.NoError(c.t, err)
+	c.text = text
+
+	switch {
+	case c.outstanding == nil:
+		c.outstanding = op
+		c.outbox = append(c.outbox, ClientMessage{Type: MSG_OP, Revision: c.revision, Op: op})
+	case c.buffer == nil:
+		c.buffer = op
+	default:
+		c.buffer, err = Compose(c.buffer, op)
+		require.NoError(c.t, err)
+	}
+}
+
+// receive moves messages queued by the server into the inbox.
+func (c *testClient) receive() {
+	for {
+		select {
+		case msg := <-c.session.send:
+			c.inbox = append(c.inbox, msg)
+		default:
+			return
+		}
+	}
+}
+
+func (c *testClient) handle(msg ServerMessage) {
+	switch msg.Type {
+	case MSG_INIT:
+		c.text, c.revision = []rune(*msg.Text), msg.Revision
+	case MSG_ACK:
+		c.revision = msg.Revision
+		c.outstanding, c.buffer = c.buffer, nil
+		if c.outstanding != nil {
+			c.outbox = append(c.outbox, ClientMessage{Type: MSG_OP, Revision: c.revision, Op: c.outstanding})
+		}
+	case MSG_OP:
+		c.revision = msg.Revision
+		op := msg.Op
+		var err error
+		if c.outstanding != nil {
+			c.outstanding, op, err = Transform(c.outstanding, op)
+			require.NoError(c.t, err)
+		}
+		if c.buffer != nil {
+			c.buffer, op, err = Transform(c.buffer, op)
+			require.NoError(c.t, err)
+		}
+		c.text, err = op.Apply(c.text)
+		require.NoError(c.t, err)
+	case MSG_ERROR:
+		c.t.Fatalf("unexpected error: %s", msg.Error)
+	}
+}
+
+func TestHubConvergence(t *testing.T) {
+	for seed := range int64(20) {
+		rnd := rand.New(rand.NewSource(seed))
+		hub, repo := newTestHub(t)
+		owner := uuid.New()
+		require.NoError(t, repo.Create("notes.md", owner, []byte("Meeting notes")))
+
+		clients := make([]*testClient, 2+rnd.Intn(4))
+		for i := range clients {
+			s, err := hub.Join(owner, "notes.md", owner, false)
+			require.NoError(t, err)
+			clients[i] = &testClient{t: t, session: s}
+			clients[i].handle(<-s.send)
+		}
+
+		// Every step one client edits, one client message reaches the
+		// server or one server message reaches a client, in random order.
+		for range 500 {
+			c := clients[rnd.Intn(len(clients))]
+			c.receive()
+			switch rnd.Intn(3) {
+			case 0:
+				c.edit(randomOperation(rnd, len(c.text)))
+			case 1:
+				if len(c.outbox) > 0 {
+					hub.handle(c.session, c.outbox[0])
+					c.outbox = c.outbox[1:]
+				}
+			default:
+				if len(c.inbox) > 0 {
+					c.handle(c.inbox[0])
+					c.inbox = c.inbox[1:]
+				}
+			}
+		}
+
+		for pending := true; pending; {
+			pending = false
+			for _, c := range clients {
+				c.receive()
+				for len(c.outbox) > 0 || len(c.inbox) > 0 {
+					pending = true
+					if len(c.outbox) > 0 {
+						hub.handle(c.session, c.outbox[0])
+						c.outbox = c.outbox[1:]
+					}
+					if len(c.inbox) > 0 {
+						c.handle(c.inbox[0])
+						c.inbox = c.inbox[1:]
+					}
+					c.receive()
+				}
+			}
+		}
+
+		doc := clients[0].session.doc
+		for _, c := range clients {
+			assert.Equal(t, string(doc.text), string(c.text), "seed %d", seed)
+			assert.Nil(t, c.outstanding)
+		}
+
+		for _, c := range clients {
+			hub.Leave(c.session)
+		}
+		data, err := repo.Get("notes.md", owner)
+		require.NoError(t, err)
+		assert.Equal(t, string(doc.text), string(data), "seed %d", seed)
+		assert.Empty(t, hub.docs)
+	}
+}
+
+func TestHubPresence(t *testing.T) {
+	hub, repo := newTestHub(t)
+	owner := uuid.New()
+	require.NoError(t, repo.Create("notes.md", owner, []byte("hello")))
+
+	first, err := hub.Join(owner, "notes.md", owner, false)
+	require.NoError(t, err)
+	init := <-first.send
+	assert.Equal(t, MSG_INIT, init.Type)
+	assert.Equal(t, "hello", *init.Text)
+	assert.Empty(t, init.Sessions)
+
+	second, err := hub.Join(owner, "notes.md", owner, false)
+	require.NoError(t, err)
+	assert.Equal(t, MSG_JOIN, (<-first.send).Type)
+	init = <-second.send
+	require.Len(t, init.Sessions, 1)
+	assert.Equal(t, first.id, init.Sessions[0].SessionId)
+
+	hub.handle(first, ClientMessage{Type: MSG_CURSOR, Revision: 0, Cursor: &Cursor{Position: 5, SelectionEnd: 5}})
+	msg := <-second.send
+	assert.Equal(t, MSG_CURSOR, msg.Type)
+	assert.Equal(t, first.id, msg.SessionId)
+
+	// The cursor moves with text inserted before it, also when the insert
+	// was made concurrently with the cursor update.
+	hub.handle(second, ClientMessage{Type: MSG_OP, Revision: 0, Op: (&Operation{}).Insert(">> ").Retain(5)})
+	assert.Equal(t, MSG_ACK, (<-second.send).Type)
+	assert.Equal(t, MSG_OP, (<-first.send).Type)
+	assert.Equal(t, &Cursor{Position: 8, SelectionEnd: 8}, first.cursor)
+
+	hub.handle(second, ClientMessage{Type: MSG_CURSOR, Revision: 0, Cursor: &Cursor{Position: 0, SelectionEnd: 5}})
+	msg = <-first.send
+	assert.Equal(t, &Cursor{Position: 3, SelectionEnd: 8}, msg.Cursor)
+
+	hub.handle(second, ClientMessage{Type: MSG_OP, Revision: 5, Op: (&Operation{}).Retain(8)})
+	msg = <-second.send
+	assert.Equal(t, MSG_ERROR, msg.Type)
+	assert.Equal(t, ERR_REVISION_INVALID, msg.Code)
+
+	hub.Leave(second)
+	msg = <-first.send
+	assert.Equal(t, MSG_LEAVE, msg.Type)
+	assert.Equal(t, second.id, msg.SessionId)
+	hub.Leave(first)
+
+	_, err = hub.Join(owner, "missing.md", owner, false)
+	assert.Equal(t, repodb.ErrFileNotFound, err)
+}
+
+func TestHubReadOnly(t *testing.T) {
+	hub, repo := newTestHub(t)
+	owner, viewer := uuid.New(), uuid.New()
+	require.NoError(t, repo.Create("notes.md", owner, []byte("hello")))
+
+	editor, err := hub.Join(owner, "notes.md", owner, false)
+	require.NoError(t, err)
+	<-editor.send
+	reader, err := hub.Join(owner, "notes.md", viewer, true)
+	require.NoError(t, err)
+	assert.True(t, (<-editor.send).ReadOnly)
+	assert.True(t, (<-reader.send).ReadOnly)
+
+	hub.handle(reader, ClientMessage{Type: MSG_OP, Revision: 0, Op: (&Operation{}).Retain(5).Insert("!")})
+	msg := <-reader.send
+	assert.Equal(t, MSG_ERROR, msg.Type)
+	assert.Equal(t, ERR_READ_ONLY, msg.Code)
+	assert.Equal(t, "hello", string(reader.doc.text))
+
+	// Viewers still see edits and can show their cursor.
+	hub.handle(editor, ClientMessage{Type: MSG_OP, Revision: 0, Op: (&Operation{}).Retain(5).Insert("!")})
+	assert.Equal(t, MSG_ACK, (<-editor.send).Type)
+	assert.Equal(t, MSG_OP, (<-reader.send).Type)
+	hub.handle(reader, ClientMessage{Type: MSG_CURSOR, Revision: 1, Cursor: &Cursor{Position: 6, SelectionEnd: 6}})
+	assert.Equal(t, MSG_CURSOR, (<-editor.send).Type)
+
+	hub.Leave(reader)
+	hub.Leave(editor)
+}
+
+func TestHubMergesExternalChanges(t *testing.T) {
+	hub, repo := newTestHub(t)
+	owner := uuid.New()
+	require.NoError(t, repo.Create("notes.md", owner, []byte("one two")))
+
+	s, err := hub.Join(owner, "notes.md", owner, false)
+	require.NoError(t, err)
+	<-s.send
+
+	hub.handle(s, ClientMessage{Type: MSG_OP, Revision: 0, Op: (&Operation{}).Insert("zero ").Retain(7)})
+	assert.Equal(t, MSG_ACK, (<-s.send).Type)
+
+	// Someone saves the file with a plain PUT meanwhile.
+	require.NoError(t, repo.Save("notes.md", owner, []byte("one two three")))
+
+	hub.save(s.doc)
+	msg := <-s.send
+	assert.Equal(t, MSG_OP, msg.Type)
+	assert.Equal(t, 2, msg.Revision)
+	assert.Empty(t, msg.SessionId)
+
+	data, err := repo.Get("notes.md", owner)
+	require.NoError(t, err)
+	assert.Equal(t, "zero one two three", string(data))
+	assert.Equal(t, "zero one two three", string(s.doc.text))
+
+	// A deleted file disconnects the sessions.
+	require.NoError(t, repo.Delete("notes.md", owner))
+	hub.handle(s, ClientMessage{Type: MSG_OP, Revision: 2, Op: (&Operation{}).Retain(18).Insert("!")})
+	<-s.send
+	hub.save(s.doc)
+	msg = <-s.send
+	assert.Equal(t, ERR_FILE_NOT_FOUND, msg.Code)
+	_, open := <-s.send
+	assert.False(t, open)
+}
+
+// racingRepo saves the next of writes, like a plain PUT of someone else,
+// right before each conditional save.
+type racingRepo struct {
+	repodb.FileRepository
+	writes []string
+}
+
+func (r *racingRepo) SaveIfMatch(filename string, userId uuid.UUID, data []byte, etags []string) error {
+	if len(r.writes) > 0 {
+		if err := r.FileRepository.Save(filename, userId, []byte(r.writes[0])); err != nil {
+			return err
+		}
+		r.writes = r.writes[1:]
+	}
+	return r.FileRepository.SaveIfMatch(filename, userId, data, etags)
+}
+
+func TestHubMergesConsecutiveExternalChanges(t *testing.T) {
+	_, local := newTestHub(t)
+	repo := &racingRepo{FileRepository: local}
+	hub := NewHub(repo, time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	owner := uuid.New()
+	require.NoError(t, repo.Create("notes.md", owner, []byte("one two")))
+
+	s, err := hub.Join(owner, "notes.md", owner, false)
+	require.NoError(t, err)
+	<-s.send
+
+	hub.handle(s, ClientMessage{Type: MSG_OP, Revision: 0, Op: (&Operation{}).Insert("zero ").Retain(7)})
+	assert.Equal(t, MSG_ACK, (<-s.send).Type)
+
+	// Two plain PUTs land while the document is saved, the second one after
+	// the first was merged.
+	repo.writes = []string{"one two three", "one two three four"}
+	require.NoError(t, s.doc.save(repo))
+	assert.Equal(t, MSG_OP, (<-s.send).Type)
+	assert.Equal(t, MSG_OP, (<-s.send).Type)
+
+	data, err := repo.Get("notes.md", owner)
+	require.NoError(t, err)
+	assert.Equal(t, "zero one two three four", string(data))
+	assert.Equal(t, "zero one two three four", string(s.doc.text))
+}
@@ -0,0 +1,365 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Operations follow the ot.js model: an operation walks the whole document
+// and is a sequence of components that retain, insert or delete text. All
+// lengths and positions are in Unicode code points. On the wire an operation
+// is a JSON array where a positive number retains that many code points,
+// a negative number deletes them and a string is inserted, e.g. [5, "abc", -3].
+
+var (
+	ErrInvalidOperation = errors.New("invalid operation")
+	// ErrLengthMismatch is returned when an operation doesn't cover the whole
+	// document it is applied to.
+	ErrLengthMismatch = errors.New("operation length doesn't match the document")
+)
+
+// component is a single step of an operation, exactly one field is set.
+type component struct {
+	retain int
+	insert string
+	delete int
+}
+
+func (c component) len() int {
+	switch {
+	case c.retain > 0:
+		return c.retain
+	case c.delete > 0:
+		return c.delete
+	default:
+		return utf8.RuneCountInString(c.insert)
+	}
+}
+
+type Operation struct {
+	ops []component
+	// baseLen is the length of documents the operation applies to, targetLen
+	// the length of the result.
+	baseLen   int
+	targetLen int
+}
+
+func (o *Operation) BaseLen() int {
+	return o.baseLen
+}
+
+func (o *Operation) TargetLen() int {
+	return o.targetLen
+}
+
+// IsNoop reports whether the operation leaves documents unchanged.
+func (o *Operation) IsNoop() bool {
+	return len(o.ops) == 0 || (len(o.ops) == 1 && o.ops[0].retain > 0)
+}
+
+func (o *Operation) last() *component {
+	if len(o.ops) == 0 {
+		return nil
+	}
+	return &o.ops[len(o.ops)-1]
+}
+
+// Retain skips n code points. Adjacent components of the same kind are
+// merged, so equal operations have equal components.
+func (o *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.baseLen += n
+	o.targetLen += n
+	if last := o.last(); last != nil && last.retain > 0 {
+		last.retain += n
+	} else {
+		o.ops = append(o.ops, component{retain: n})
+	}
+
+	return o
+}
+
+// Insert inserts s. An insert directly followed by a delete is kept before
+// it, which keeps the representation canonical.
+func (o *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return o
+	}
+	o.targetLen += utf8.RuneCountInString(s)
+
+	last := o.last()
+	switch {
+	case last != nil && last.insert != "":
+		last.insert += s
+	case last != nil && last.delete > 0:
+		if len(o.ops) > 1 && o.ops[len(o.ops)-2].insert != "" {
+			o.ops[len(o.ops)-2].insert += s
+		} else {
+			o.ops = append(o.ops, *last)
+			o.ops[len(o.ops)-2] = component{insert: s}
+		}
+	default:
+		o.ops = append(o.ops, component{insert: s})
+	}
+
+	return o
+}
+
+// Delete removes n code points.
+func (o *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+	o.baseLen += n
+	if last := o.last(); last != nil && last.delete > 0 {
+		last.delete += n
+	} else {
+		o.ops = append(o.ops, component{delete: n})
+	}
+
+	return o
+}
+
+// Apply returns the document changed by the operation.
+func (o *Operation) Apply(doc []rune) ([]rune, error) {
+	if len(doc) != o.baseLen {
+		return nil, ErrLengthMismatch
+	}
+
+	result := make([]rune, 0, o.targetLen)
+	pos := 0
+	for _, c := range o.ops {
+		switch {
+		case c.retain > 0:
+			result = append(result, doc[pos:pos+c.retain]...)
+			pos += c.retain
+		case c.delete > 0:
+			pos += c.delete
+		default:
+			result = append(result, []rune(c.insert)...)
+		}
+	}
+
+	return result, nil
+}
+
+// iterator walks the components of an operation and allows to consume them
+// partially.
+type iterator struct {
+	ops []component
+	i   int
+	cur *component
+}
+
+func newIterator(o *Operation) *iterator {
+	it := &iterator{ops: o.ops}
+	it.next()
+	return it
+}
+
+func (it *iterator) next() {
+	if it.i >= len(it.ops) {
+		it.cur = nil
+		return
+	}
+	c := it.ops[it.i]
+	it.i++
+	it.cur = &c
+}
+
+// take consumes n code points of the current component.
+func (it *iterator) take(n int) {
+	c := it.cur
+	switch {
+	case c.retain > 0:
+		c.retain -= n
+		if c.retain == 0 {
+			it.next()
+		}
+	case c.delete > 0:
+		c.delete -= n
+		if c.delete == 0 {
+			it.next()
+		}
+	default:
+		runes := []rune(c.insert)
+		c.insert = string(runes[n:])
+		if c.insert == "" {
+			it.next()
+		}
+	}
+}
+
+// Transform returns a' and b' such that applying a then b' gives the same
+// document as applying b then a'. a and b must apply to the same document.
+// Text inserted by a at the same position as b is placed first.
+func Transform(a, b *Operation) (*Operation, *Operation, error) {
+	if a.baseLen != b.baseLen {
+		return nil, nil, ErrLengthMismatch
+	}
+
+	aPrime, bPrime := &Operation{}, &Operation{}
+	i1, i2 := newIterator(a), newIterator(b)
+	for i1.cur != nil || i2.cur != nil {
+		if i1.cur != nil && i1.cur.insert != "" {
+			aPrime.Insert(i1.cur.insert)
+			bPrime.Retain(i1.cur.len())
+			i1.next()
+			continue
+		}
+		if i2.cur != nil && i2.cur.insert != "" {
+			aPrime.Retain(i2.cur.len())
+			bPrime.Insert(i2.cur.insert)
+			i2.next()
+			continue
+		}
+		if i1.cur == nil || i2.cur == nil {
+			return nil, nil, ErrLengthMismatch
+		}
+
+		n := min(i1.cur.len(), i2.cur.len())
+		switch {
+		case i1.cur.retain > 0 && i2.cur.retain > 0:
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+		case i1.cur.delete > 0 && i2.cur.retain > 0:
+			aPrime.Delete(n)
+		case i1.cur.retain > 0 && i2.cur.delete > 0:
+			bPrime.Delete(n)
+		}
+		// Text deleted by both is just skipped.
+		i1.take(n)
+		i2.take(n)
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// Compose returns an operation with the effect of applying a and then b.
+func Compose(a, b *Operation) (*Operation, error) {
+	if a.targetLen != b.baseLen {
+		return nil, ErrLengthMismatch
+	}
+
+	result := &Operation{}
+	i1, i2 := newIterator(a), newIterator(b)
+	for i1.cur != nil || i2.cur != nil {
+		if i1.cur != nil && i1.cur.delete > 0 {
+			result.Delete(i1.cur.delete)
+			i1.next()
+			continue
+		}
+		if i2.cur != nil && i2.cur.insert != "" {
+			result.Insert(i2.cur.insert)
+			i2.next()
+			continue
+		}
+		if i1.cur == nil || i2.cur == nil {
+			return nil, ErrLengthMismatch
+		}
+
+		n := min(i1.cur.len(), i2.cur.len())
+		switch {
+		case i1.cur.retain > 0 && i2.cur.retain > 0:
+			result.Retain(n)
+		case i1.cur.retain > 0 && i2.cur.delete > 0:
+			result.Delete(n)
+		case i1.cur.insert != "" && i2.cur.retain > 0:
+			result.Insert(string([]rune(i1.cur.insert)[:n]))
+		}
+		// Text inserted by a and deleted by b cancels out.
+		i1.take(n)
+		i2.take(n)
+	}
+
+	return result, nil
+}
+
+// TransformIndex moves a position in the document before o to the same place
+// in the document after it. Text inserted at the position goes before it.
+func TransformIndex(o *Operation, index int) int {
+	result := index
+	for _, c := range o.ops {
+		if index < 0 {
+			break
+		}
+		switch {
+		case c.retain > 0:
+			index -= c.retain
+		case c.delete > 0:
+			result -= min(index, c.delete)
+			index -= c.delete
+		default:
+			result += c.len()
+		}
+	}
+
+	return result
+}
+
+// Diff returns an operation turning a into b. It keeps the common prefix and
+// suffix and replaces everything in between.
+func Diff(a, b []rune) *Operation {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	o := &Operation{}
+	return o.Retain(prefix).Delete(len(a) - prefix - suffix).Insert(string(b[prefix : len(b)-suffix])).Retain(suffix)
+}
+
+func (o *Operation) MarshalJSON() ([]byte, error) {
+	parts := make([]any, 0, len(o.ops))
+	for _, c := range o.ops {
+		switch {
+		case c.retain > 0:
+			parts = append(parts, c.retain)
+		case c.delete > 0:
+			parts = append(parts, -c.delete)
+		default:
+			parts = append(parts, c.insert)
+		}
+	}
+
+	return json.Marshal(parts)
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidOperation, err)
+	}
+
+	*o = Operation{}
+	for _, part := range parts {
+		var n int
+		if err := json.Unmarshal(part, &n); err == nil {
+			switch {
+			case n > 0:
+				o.Retain(n)
+			case n < 0:
+				o.Delete(-n)
+			default:
+				return fmt.Errorf("%w: zero length component", ErrInvalidOperation)
+			}
+			continue
+		}
+
+		var s string
+		if err := json.Unmarshal(part, &s); err != nil || s == "" || !utf8.ValidString(s) {
+			return fmt.Errorf("%w: component must be a non-zero number or a non-empty string", ErrInvalidOperation)
+		}
+		o.Insert(s)
+	}
+
+	return nil
+}
@@ -0,0 +1,140 @@
+package collab
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAlphabet = []rune("ab cж😀\n")
+
+func randomString(rnd *rand.Rand, n int) string {
+	runes := make([]rune, n)
+	for i := range runes {
+		runes[i] = testAlphabet[rnd.Intn(len(testAlphabet))]
+	}
+	return string(runes)
+}
+
+// randomOperation returns an operation applying to documents of length n.
+func randomOperation(rnd *rand.Rand, n int) *Operation {
+	op := &Operation{}
+	for left := n; left > 0; {
+		k := 1 + rnd.Intn(left)
+		switch rnd.Intn(3) {
+		case 0:
+			op.Retain(k)
+		case 1:
+			op.Delete(k)
+		default:
+			op.Insert(randomString(rnd, 1+rnd.Intn(3)))
+			continue
+		}
+		left -= k
+	}
+	if rnd.Intn(2) == 0 {
+		op.Insert(randomString(rnd, 1+rnd.Intn(3)))
+	}
+
+	return op
+}
+
+func TestOperationApply(t *testing.T) {
+	op := (&Operation{}).Retain(2).Insert("ж😀").Delete(1).Retain(1)
+	assert.Equal(t, 4, op.BaseLen())
+	assert.Equal(t, 5, op.TargetLen())
+
+	text, err := op.Apply([]rune("abcd"))
+	require.NoError(t, err)
+	assert.Equal(t, "abж😀d", string(text))
+
+	_, err = op.Apply([]rune("abc"))
+	assert.Equal(t, ErrLengthMismatch, err)
+
+	// An insert after a delete is kept in front of it.
+	assert.Equal(t, (&Operation{}).Insert("x").Delete(1), (&Operation{}).Delete(1).Insert("x"))
+	assert.True(t, (&Operation{}).Retain(3).IsNoop())
+}
+
+func TestOperationJSON(t *testing.T) {
+	op := (&Operation{}).Retain(2).Insert("ж").Delete(3)
+	data, err := json.Marshal(op)
+	require.NoError(t, err)
+	assert.Equal(t, `[2,"ж",-3]`, string(data))
+
+	var decoded Operation
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, op, &decoded)
+
+	for _, invalid := range []string{`[0]`, `[""]`, `[1.5]`, `[true]`, `{}`} {
+		assert.ErrorIs(t, json.Unmarshal([]byte(invalid), &decoded), ErrInvalidOperation, invalid)
+	}
+}
+
+func TestTransformTie(t *testing.T) {
+	a := (&Operation{}).Retain(1).Insert("a")
+	b := (&Operation{}).Retain(1).Insert("b")
+
+	aPrime, bPrime, err := Transform(a, b)
+	require.NoError(t, err)
+
+	ab, err := a.Apply([]rune("x"))
+	require.NoError(t, err)
+	ab, err = bPrime.Apply(ab)
+	require.NoError(t, err)
+	ba, err := b.Apply([]rune("x"))
+	require.NoError(t, err)
+	ba, err = aPrime.Apply(ba)
+	require.NoError(t, err)
+
+	assert.Equal(t, "xab", string(ab))
+	assert.Equal(t, "xab", string(ba))
+}
+
+func TestTransformRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for range 1000 {
+		doc := []rune(randomString(rnd, rnd.Intn(10)))
+		a := randomOperation(rnd, len(doc))
+		b := randomOperation(rnd, len(doc))
+
+		aPrime, bPrime, err := Transform(a, b)
+		require.NoError(t, err)
+
+		afterA, err := a.Apply(doc)
+		require.NoError(t, err)
+		ab, err := bPrime.Apply(afterA)
+		require.NoError(t, err)
+		afterB, err := b.Apply(doc)
+		require.NoError(t, err)
+		ba, err := aPrime.Apply(afterB)
+		require.NoError(t, err)
+		assert.Equal(t, string(ab), string(ba))
+
+		composed, err := Compose(a, bPrime)
+		require.NoError(t, err)
+		direct, err := composed.Apply(doc)
+		require.NoError(t, err)
+		assert.Equal(t, string(ab), string(direct))
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	op := (&Operation{}).Retain(2).Insert("xy").Delete(2).Retain(2)
+	assert.Equal(t, 0, TransformIndex(op, 0))
+	assert.Equal(t, 4, TransformIndex(op, 2))
+	assert.Equal(t, 4, TransformIndex(op, 3))
+	assert.Equal(t, 5, TransformIndex(op, 5))
+}
+
+func TestDiff(t *testing.T) {
+	for _, tt := range [][2]string{{"abc", "abc"}, {"", "жж"}, {"hello world", "hello brave world"}, {"aaa", "aa"}, {"abc", "xyz"}} {
+		op := Diff([]rune(tt[0]), []rune(tt[1]))
+		text, err := op.Apply([]rune(tt[0]))
+		require.NoError(t, err)
+		assert.Equal(t, tt[1], string(text))
+	}
+}
@@ -0,0 +1,96 @@
+package repodb
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TEMP_FILE_SUFFIX marks files that are being written. The extension is never
+// valid for user files, so leftovers of interrupted writes are easy to tell
+// apart.
+const TEMP_FILE_SUFFIX = ".tmp"
+
+// writeTempFile writes data to a temp file, replaced in tests to simulate
+// failures in the middle of a write.
+var writeTempFile = func(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	return err
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, TEMP_FILE_SUFFIX)
+}
+
+// writeFileAtomic replaces the file at path so that readers and crashes see
+// either the old or the new content: data goes to a temp file in the same
+// directory, which is flushed to disk and renamed over path, then the
+// directory is synced to persist the rename.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".*"+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file in %s: %w", dir, err)
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	if err = writeTempFile(f, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes directory entries, making creations and renames in it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// removeTempFiles deletes temp files left by writes interrupted by a crash.
+// Their targets still have the previous content.
+func removeTempFiles(basePath string) error {
+	return filepath.WalkDir(basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove temp file %s: %w", path, err)
+		}
+
+		return nil
+	})
+}
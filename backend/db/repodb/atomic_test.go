@@ -0,0 +1,134 @@
+package repodb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failWrites makes writes of data stop halfway with an error, as if the disk
+// became full.
+func failWrites(t *testing.T, data []byte) {
+	orig := writeTempFile
+	t.Cleanup(func() { writeTempFile = orig })
+
+	writeTempFile = func(f *os.File, d []byte) error {
+		if !bytes.Equal(d, data) {
+			return orig(f, d)
+		}
+		if _, err := f.Write(d[:len(d)/2]); err != nil {
+			return err
+		}
+
+		return errors.New("no space left on device")
+	}
+}
+
+func listTempFiles(t *testing.T, dir string) []string {
+	var temps []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && isTempFile(d.Name()) {
+			temps = append(temps, path)
+		}
+		return err
+	})
+	require.NoError(t, err)
+
+	return temps
+}
+
+func TestLocalFileRepo_InterruptedSave(t *testing.T) {
+	tempDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	repo, err := NewLocalFileRepo(tempDir)
+	require.NoError(t, err)
+
+	filename := "test.md"
+	content := []byte("old content")
+	require.NoError(t, repo.Create(filename, testUUID, content))
+
+	updated := []byte(strings.Repeat("new content ", 100))
+	failWrites(t, updated)
+
+	err = repo.Save(filename, testUUID, updated)
+	assert.Error(t, err)
+
+	retrieved, err := repo.Get(filename, testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, content, retrieved)
+	assert.Empty(t, listTempFiles(t, tempDir))
+
+	err = repo.Create("other.md", testUUID, updated)
+	assert.Error(t, err)
+
+	_, err = repo.Get("other.md", testUUID)
+	assert.Equal(t, ErrFileNotFound, err)
+}
+
+func TestLocalFileRepo_CrashRecovery(t *testing.T) {
+	tempDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	repo, err := NewLocalFileRepo(tempDir)
+	require.NoError(t, err)
+
+	content := []byte("old content")
+	require.NoError(t, repo.CreateFolder("notes", testUUID))
+	require.NoError(t, repo.Create("notes/test.md", testUUID, content))
+	require.NoError(t, repo.Save("notes/test.md", testUUID, content))
+
+	// A crash between writing the temp file and renaming it leaves the temp
+	// file behind, next to the live file and in the history.
+	userDir := filepath.Join(tempDir, testUUID.String())
+	orphans := []string{
+		filepath.Join(userDir, "notes", ".123456"+TEMP_FILE_SUFFIX),
+		filepath.Join(userDir, VERSIONS_DIR, "notes", "test.md", ".654321"+TEMP_FILE_SUFFIX),
+	}
+	for _, orphan := range orphans {
+		require.NoError(t, os.WriteFile(orphan, []byte("new con"), 0644))
+	}
+
+	files, err := repo.GetList(testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"notes/test.md"}, files)
+
+	repo, err = NewLocalFileRepo(tempDir)
+	require.NoError(t, err)
+	assert.Empty(t, listTempFiles(t, tempDir))
+
+	retrieved, err := repo.Get("notes/test.md", testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, content, retrieved)
+
+	versions, err := repo.GetVersions("notes/test.md", testUUID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	tempDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(tempDir, "test.md")
+	require.NoError(t, writeFileAtomic(path, []byte("v1"), 0644))
+	require.NoError(t, writeFileAtomic(path, []byte("v2"), 0644))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), data)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	err = writeFileAtomic(filepath.Join(tempDir, "missing", "test.md"), []byte("v1"), 0644)
+	assert.Error(t, err)
+	assert.Empty(t, listTempFiles(t, tempDir))
+}
@@ -0,0 +1,254 @@
+package repodb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Attachments are images and other files referenced from documents. They are
+// stored per user as <userId>/.attachments/<id>, their metadata as
+// <basePath>/.attachments/<userId>.json next to user roots. Attachments count
+// against the space size of the quota like live documents, but not against
+// the file limit.
+const (
+	ATTACHMENTS_DIR     = ".attachments"
+	MAX_ATTACHMENT_SIZE = 5 << 20 // 5 Mb
+	// MAX_ATTACHMENT_NAME_LEN limits the original name kept for downloads.
+	MAX_ATTACHMENT_NAME_LEN = 255
+)
+
+// AttachmentTypes maps content types accepted for attachments to the
+// extension of their ids. The type is sniffed from the content, the one sent
+// by the client is ignored. SVG is not accepted, it may carry scripts.
+var AttachmentTypes = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/bmp":       ".bmp",
+	"application/pdf": ".pdf",
+	"text/plain":      ".txt",
+}
+
+var ErrAttachmentNotFound = errors.New("attachment not found")
+var ErrAttachmentType = errors.New("attachment type is not allowed")
+var ErrAttachmentTooLarge = errors.New("attachment is too large")
+
+// attachmentIdRe matches ids: the hex SHA-256 of the content with the
+// extension of its type.
+var attachmentIdRe = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z]+$`)
+
+// Attachment is a file of Owner referenced from documents by its URL. Id is
+// derived from the content, so uploading the same content twice yields the
+// same attachment and URLs never change what they point to.
+type Attachment struct {
+	Id          string    `json:"id"`
+	Owner       uuid.UUID `json:"owner"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// IsImage reports whether the attachment can be shown inline.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// NewAttachment checks the content and returns the attachment to store it
+// as. name is the original filename, only its base is kept.
+func NewAttachment(owner uuid.UUID, name string, data []byte) (Attachment, error) {
+	if len(data) > MAX_ATTACHMENT_SIZE {
+		return Attachment{}, ErrAttachmentTooLarge
+	}
+
+	contentType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return Attachment{}, ErrAttachmentType
+	}
+	ext, ok := AttachmentTypes[contentType]
+	if !ok {
+		return Attachment{}, ErrAttachmentType
+	}
+
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:]) + ext
+
+	return Attachment{
+		Id:          id,
+		Owner:       owner,
+		Name:        attachmentName(name, id),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		CreatedAt:   time.Now().UTC().Truncate(time.Millisecond),
+	}, nil
+}
+
+// attachmentName cleans the original filename, the id replaces an empty one.
+func attachmentName(name string, id string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if len(name) > MAX_ATTACHMENT_NAME_LEN {
+		name = strings.ToValidUTF8(name[:MAX_ATTACHMENT_NAME_LEN], "")
+	}
+	if name == "" || name == "." || name == "/" {
+		return id
+	}
+
+	return name
+}
+
+// validateAttachmentId rejects ids that can't belong to an attachment, so
+// they are never used to build paths or keys.
+func validateAttachmentId(id string) error {
+	if !attachmentIdRe.MatchString(id) {
+		return ErrAttachmentNotFound
+	}
+
+	return nil
+}
+
+// sortAttachments orders attachments most recently uploaded first.
+func sortAttachments(attachments []Attachment) {
+	sort.Slice(attachments, func(i, j int) bool {
+		if attachments[i].CreatedAt.Equal(attachments[j].CreatedAt) {
+			return attachments[i].Id < attachments[j].Id
+		}
+		return attachments[i].CreatedAt.After(attachments[j].CreatedAt)
+	})
+}
+
+func findAttachment(attachments []Attachment, id string) int {
+	for i := range attachments {
+		if attachments[i].Id == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func removeAttachment(attachments []Attachment, id string) ([]Attachment, error) {
+	i := findAttachment(attachments, id)
+	if i < 0 {
+		return attachments, ErrAttachmentNotFound
+	}
+
+	return append(attachments[:i], attachments[i+1:]...), nil
+}
+
+// ReferencesAttachment reports whether the document refers to the attachment.
+// Documents link attachments by URLs containing the id, which is unique
+// enough to be searched as plain text.
+func ReferencesAttachment(doc []byte, id string) bool {
+	return bytes.Contains(doc, []byte(id))
+}
+
+// CollectAttachments permanently deletes attachments of the user uploaded
+// before the given time that no document refers to: neither a live file, nor
+// a stored revision, nor a file in the trash, so restoring anything brings its
+// images back. Recent uploads are kept, the document using them may not be
+// saved yet. It returns the number of deleted attachments.
+func CollectAttachments(repo FileRepository, userId uuid.UUID, before time.Time) (int, error) {
+	attachments, err := repo.GetAttachments(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	var candidates []Attachment
+	for _, a := range attachments {
+		if a.CreatedAt.Before(before) {
+			candidates = append(candidates, a)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	// Every document is read once and drops the candidates it refers to.
+	keep := func(doc []byte) {
+		result := candidates[:0]
+		for _, a := range candidates {
+			if !ReferencesAttachment(doc, a.Id) {
+				result = append(result, a)
+			}
+		}
+		candidates = result
+	}
+
+	files, err := repo.GetList(userId)
+	if err != nil {
+		return 0, err
+	}
+	for _, filename := range files {
+		data, err := repo.Get(filename, userId)
+		if err != nil {
+			if err == ErrFileNotFound {
+				continue
+			}
+			return 0, err
+		}
+		keep(data)
+
+		versions, err := repo.GetVersions(filename, userId)
+		if err != nil && err != ErrFileNotFound {
+			return 0, err
+		}
+		for _, v := range versions {
+			data, err := repo.GetVersion(filename, userId, v.Id)
+			if err != nil {
+				if err == ErrVersionNotFound || err == ErrFileNotFound {
+					continue
+				}
+				return 0, err
+			}
+			keep(data)
+		}
+	}
+
+	trash, err := repo.ListTrash(userId)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range trash {
+		data, err := repo.GetTrashContent(item.Id, userId)
+		if err != nil {
+			if err == ErrTrashItemNotFound {
+				continue
+			}
+			return 0, err
+		}
+		keep(data)
+	}
+
+	deleted := 0
+	for _, a := range candidates {
+		if err := repo.DeleteAttachment(userId, a.Id); err != nil {
+			if err == ErrAttachmentNotFound {
+				continue
+			}
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,42 @@
+package repodb
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAttachment(t *testing.T) {
+	owner := uuid.New()
+
+	attachment, err := NewAttachment(owner, "C:\\photos\\cat.png", []byte("\x89PNG\r\n\x1a\nrest"))
+	require.NoError(t, err)
+	assert.Equal(t, "cat.png", attachment.Name)
+	assert.Equal(t, "image/png", attachment.ContentType)
+	assert.True(t, strings.HasSuffix(attachment.Id, ".png"))
+	assert.NoError(t, validateAttachmentId(attachment.Id))
+	assert.True(t, attachment.IsImage())
+
+	// The type comes from the content, not from the name.
+	text, err := NewAttachment(owner, "image.png", []byte("just text"))
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", text.ContentType)
+	assert.True(t, strings.HasSuffix(text.Id, ".txt"))
+	assert.False(t, text.IsImage())
+
+	_, err = NewAttachment(owner, "page.html", []byte("<html><script>alert(1)</script>"))
+	assert.Equal(t, ErrAttachmentType, err)
+	_, err = NewAttachment(owner, "image.svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`))
+	assert.Equal(t, ErrAttachmentType, err)
+	_, err = NewAttachment(owner, "big.txt", make([]byte, MAX_ATTACHMENT_SIZE+1))
+	assert.Equal(t, ErrAttachmentTooLarge, err)
+
+	unnamed, err := NewAttachment(owner, " \x00", []byte("text"))
+	require.NoError(t, err)
+	assert.Equal(t, unnamed.Id, unnamed.Name)
+
+	assert.Equal(t, ErrAttachmentNotFound, validateAttachmentId("../../etc/passwd"))
+}
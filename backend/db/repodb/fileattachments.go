@@ -0,0 +1,173 @@
+package repodb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+func getAttachmentsListPath(basePath string, owner uuid.UUID) string {
+	return filepath.Join(basePath, ATTACHMENTS_DIR, owner.String()+".json")
+}
+
+func getAttachmentPath(basePath string, owner uuid.UUID, id string) string {
+	return filepath.Join(basePath, owner.String(), ATTACHMENTS_DIR, id)
+}
+
+// getAttachmentsSize returns the space used by attachments of the user.
+func (l *LocalFileRepo) getAttachmentsSize(userId uuid.UUID) (int64, error) {
+	dir := filepath.Join(l.basePath, userId.String(), ATTACHMENTS_DIR)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("failed to read attachments directory %s: %w", dir, err)
+	}
+
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || isTempFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+func (l *LocalFileRepo) CreateAttachment(attachment Attachment, data []byte) error {
+	if err := validateAttachmentId(attachment.Id); err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(attachment.Owner.String())
+	defer unlock()
+
+	listPath := getAttachmentsListPath(l.basePath, attachment.Owner)
+	attachments, err := readList[Attachment](listPath)
+	if err != nil {
+		return err
+	}
+	if findAttachment(attachments, attachment.Id) >= 0 {
+		return nil
+	}
+
+	quota, err := l.GetQuota(attachment.Owner)
+	if err != nil {
+		return err
+	}
+	occupied, _, err := l.getUserLiveSpaceAndFileCount(attachment.Owner, []string{})
+	if err != nil {
+		return err
+	}
+	if err := checkQuota(quota, occupied+len(data), 0); err != nil {
+		return err
+	}
+
+	// The content goes first, so listed attachments always have one.
+	path := getAttachmentPath(l.basePath, attachment.Owner, attachment.Id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create attachments directory: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	if err := updateList(listPath, func(attachments []Attachment) ([]Attachment, error) {
+		return append(attachments, attachment), nil
+	}); err != nil {
+		return err
+	}
+
+	return l.trimHistory(attachment.Owner, quota.SpaceSize)
+}
+
+func (l *LocalFileRepo) GetAttachment(owner uuid.UUID, id string) (Attachment, []byte, error) {
+	if err := validateAttachmentId(id); err != nil {
+		return Attachment{}, nil, err
+	}
+
+	attachments, err := readList[Attachment](getAttachmentsListPath(l.basePath, owner))
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	i := findAttachment(attachments, id)
+	if i < 0 {
+		return Attachment{}, nil, ErrAttachmentNotFound
+	}
+
+	data, err := os.ReadFile(getAttachmentPath(l.basePath, owner, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Attachment{}, nil, ErrAttachmentNotFound
+		}
+
+		return Attachment{}, nil, err
+	}
+
+	return attachments[i], data, nil
+}
+
+func (l *LocalFileRepo) GetAttachments(owner uuid.UUID) ([]Attachment, error) {
+	attachments, err := readList[Attachment](getAttachmentsListPath(l.basePath, owner))
+	if err != nil {
+		return nil, err
+	}
+	sortAttachments(attachments)
+
+	return attachments, nil
+}
+
+func (l *LocalFileRepo) DeleteAttachment(owner uuid.UUID, id string) error {
+	if err := validateAttachmentId(id); err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(owner.String())
+	defer unlock()
+
+	if err := updateList(getAttachmentsListPath(l.basePath, owner), func(attachments []Attachment) ([]Attachment, error) {
+		return removeAttachment(attachments, id)
+	}); err != nil {
+		return err
+	}
+
+	if err := os.Remove(getAttachmentPath(l.basePath, owner, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *LocalFileRepo) GetAttachmentOwners() ([]uuid.UUID, error) {
+	entries, err := os.ReadDir(filepath.Join(l.basePath, ATTACHMENTS_DIR))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []uuid.UUID{}, nil
+		}
+
+		return nil, err
+	}
+
+	owners := []uuid.UUID{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" {
+			continue
+		}
+		owner, err := uuid.Parse(name[:len(name)-len(".json")])
+		if err != nil {
+			continue
+		}
+		owners = append(owners, owner)
+	}
+
+	return owners, nil
+}
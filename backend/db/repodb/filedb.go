@@ -2,23 +2,33 @@ package repodb
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// LocalFileRepo stores files in <basePath>/<userId>/<path>. Writes of a user
+// are serialized by a per-user lock, which makes quota checks and conditional
+// writes atomic with the write itself. Reads don't lock, writes are atomic.
 type LocalFileRepo struct {
 	basePath string
+	locks    *keyedMutex
 }
 
 func NewLocalFileRepo(basePath string) (*LocalFileRepo, error) {
 	if err := os.MkdirAll(basePath, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create base directory: %w", err)
 	}
+	if err := removeTempFiles(basePath); err != nil {
+		return nil, err
+	}
 
-	return &LocalFileRepo{basePath: basePath}, nil
+	return &LocalFileRepo{basePath: basePath, locks: newKeyedMutex()}, nil
 }
 
 func IsFileExists(path string) (bool, error) {
@@ -33,16 +43,128 @@ func IsFileExists(path string) (bool, error) {
 	return true, nil
 }
 
+// IsRegularFileExists is like IsFileExists but reports false for directories.
+func IsRegularFileExists(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return info.Mode().IsRegular(), nil
+}
+
+func IsDirExists(path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return info.IsDir(), nil
+}
+
 func getPath(basePath string, userId uuid.UUID, filename string) (string, error) {
 	err := validateFile(filename)
 	if err != nil {
 		return "", err
 	}
-	path := filepath.Join(basePath, userId.String(), filename)
+
+	return joinUserPath(basePath, userId, filename)
+}
+
+func getFolderPath(basePath string, userId uuid.UUID, path string) (string, error) {
+	err := validateFolder(path)
+	if err != nil {
+		return "", err
+	}
+
+	return joinUserPath(basePath, userId, path)
+}
+
+// joinUserPath joins a validated relative path to the user root and makes
+// sure the result stays inside of it.
+func joinUserPath(basePath string, userId uuid.UUID, rel string) (string, error) {
+	root := filepath.Join(basePath, userId.String())
+	path := filepath.Join(root, filepath.FromSlash(rel))
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", &ErrInvalidFilename{Reason: ERR_PATH_TRAVERSAL}
+	}
 
 	return path, nil
 }
 
+// checkParentExists returns ErrFolderNotFound if the folder containing path
+// doesn't exist.
+func checkParentExists(path string) error {
+	exists, err := IsDirExists(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+
+	return nil
+}
+
+// walkUserFiles calls fn for every user file with its slash separated path
+// relative to the user root. Service folders and temp files are skipped.
+func (l *LocalFileRepo) walkUserFiles(userId uuid.UUID, fn func(rel string, info fs.FileInfo) error) error {
+	root := filepath.Join(l.basePath, userId.String())
+	exists, err := IsDirExists(root)
+	if err != nil || !exists {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isTempFile(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.ToSlash(rel), info)
+	})
+}
+
+// checkETag compares the content of the file at path with ifMatch.
+// Must be called with the user lock held.
+func checkETag(path string, ifMatch []string) error {
+	if ifMatch == nil {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return matchETag(data, ifMatch)
+}
+
 func createUserDirIfNotExists(basePath string, userId uuid.UUID) error {
 	path := filepath.Join(basePath, userId.String())
 	_, err := os.Stat(path)
@@ -62,28 +184,49 @@ func createUserDirIfNotExists(basePath string, userId uuid.UUID) error {
 }
 
 func (l *LocalFileRepo) Save(filename string, userId uuid.UUID, data []byte) error {
+	return l.SaveIfMatch(filename, userId, data, nil)
+}
+
+func (l *LocalFileRepo) SaveIfMatch(filename string, userId uuid.UUID, data []byte, ifMatch []string) error {
 	path, err := getPath(l.basePath, userId, filename)
 	if err != nil {
 		return err
 	}
 
-	ex, err := IsFileExists(path)
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	ex, err := IsRegularFileExists(path)
 	if err != nil {
 		return err
 	}
 	if !ex {
 		return ErrFileNotFound
 	}
+	if err := checkETag(path, ifMatch); err != nil {
+		return err
+	}
 
-	occupied, _, err := l.GetUserOccupiedSpaceAndFileCount(userId, []string{filename})
+	quota, err := l.GetQuota(userId)
 	if err != nil {
 		return err
 	}
-	if occupied+len(data) > USER_SPACE_SIZE {
-		return ErrUserSpaceIsFull
+	occupied, _, err := l.getUserLiveSpaceAndFileCount(userId, []string{filename})
+	if err != nil {
+		return err
+	}
+	if err := checkQuota(quota, occupied+len(data), 0); err != nil {
+		return err
+	}
+
+	if err := l.archiveVersion(userId, filename, path); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
 	}
 
-	return os.WriteFile(path, data, 0644)
+	return l.trimHistory(userId, quota.SpaceSize)
 }
 
 func (l *LocalFileRepo) Create(filename string, userId uuid.UUID, data []byte) error {
@@ -97,6 +240,9 @@ func (l *LocalFileRepo) Create(filename string, userId uuid.UUID, data []byte) e
 		return err
 	}
 
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
 	ex, err := IsFileExists(path)
 	if err != nil {
 		return err
@@ -104,19 +250,30 @@ func (l *LocalFileRepo) Create(filename string, userId uuid.UUID, data []byte) e
 	if ex {
 		return ErrFileExists
 	}
+	if err := checkParentExists(path); err != nil {
+		return err
+	}
 
-	occupied, cnt, err := l.GetUserOccupiedSpaceAndFileCount(userId, []string{})
+	quota, err := l.GetQuota(userId)
 	if err != nil {
 		return err
 	}
-	if occupied+len(data) > USER_SPACE_SIZE {
-		return ErrUserSpaceIsFull
+	occupied, cnt, err := l.getUserLiveSpaceAndFileCount(userId, []string{})
+	if err != nil {
+		return err
 	}
-	if cnt+1 > MAX_USER_FILES {
-		return ErrFileNumberLimitReached
+	if err := checkQuota(quota, occupied+len(data), cnt+1); err != nil {
+		return err
 	}
 
-	return os.WriteFile(path, data, 0644)
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	if err := l.markCreated(userId, filename); err != nil {
+		return err
+	}
+
+	return l.trimHistory(userId, quota.SpaceSize)
 }
 
 func (l *LocalFileRepo) Get(filename string, userId uuid.UUID) ([]byte, error) {
@@ -125,7 +282,7 @@ func (l *LocalFileRepo) Get(filename string, userId uuid.UUID) ([]byte, error) {
 		return nil, err
 	}
 
-	ex, err := IsFileExists(path)
+	ex, err := IsRegularFileExists(path)
 	if err != nil {
 		return nil, err
 	}
@@ -142,20 +299,33 @@ func (l *LocalFileRepo) Get(filename string, userId uuid.UUID) ([]byte, error) {
 }
 
 func (l *LocalFileRepo) Delete(filename string, userId uuid.UUID) error {
+	return l.DeleteIfMatch(filename, userId, nil)
+}
+
+func (l *LocalFileRepo) DeleteIfMatch(filename string, userId uuid.UUID, ifMatch []string) error {
 	path, err := getPath(l.basePath, userId, filename)
 	if err != nil {
 		return err
 	}
 
-	ex, err := IsFileExists(path)
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	ex, err := IsRegularFileExists(path)
 	if err != nil {
 		return err
 	}
 	if !ex {
 		return ErrFileNotFound
 	}
+	if err := checkETag(path, ifMatch); err != nil {
+		return err
+	}
+	if err := l.moveToTrash(userId, filename, path, time.Now()); err != nil {
+		return err
+	}
 
-	return os.Remove(path)
+	return l.dropSharing(userId, filename, false)
 }
 
 func (l *LocalFileRepo) GetList(userId uuid.UUID) ([]string, error) {
@@ -164,27 +334,46 @@ func (l *LocalFileRepo) GetList(userId uuid.UUID) ([]string, error) {
 		return nil, err
 	}
 
-	path := filepath.Join(l.basePath, userId.String())
-	files, err := os.ReadDir(path)
+	fileNames := []string{}
+	err = l.walkUserFiles(userId, func(rel string, _ fs.FileInfo) error {
+		fileNames = append(fileNames, rel)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to read base directory %s: %w", path, err)
+		return nil, fmt.Errorf("failed to read user directory: %w", err)
 	}
 
-	var fileNames []string
-	for _, file := range files {
-		if !file.IsDir() {
-			fileNames = append(fileNames, file.Name())
+	return fileNames, nil
+}
+
+func (l *LocalFileRepo) GetFileInfos(userId uuid.UUID) ([]FileInfo, error) {
+	infos := []FileInfo{}
+	root := filepath.Join(l.basePath, userId.String())
+	err := l.walkUserFiles(userId, func(rel string, info fs.FileInfo) error {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		createdAt, err := l.getCreatedAt(userId, rel, info.ModTime())
+		if err != nil {
+			return err
 		}
-	}
 
-	if fileNames == nil {
-		fileNames = []string{}
+		infos = append(infos, newFileInfo(rel, data, createdAt, info.ModTime()))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user directory: %w", err)
 	}
 
-	return fileNames, nil
+	return infos, nil
 }
 
 func (l *LocalFileRepo) Rename(filename string, newFilename string, userId uuid.UUID) error {
+	return l.RenameIfMatch(filename, newFilename, userId, nil)
+}
+
+func (l *LocalFileRepo) RenameIfMatch(filename string, newFilename string, userId uuid.UUID, ifMatch []string) error {
 	oldPath, err := getPath(l.basePath, userId, filename)
 	if err != nil {
 		return err
@@ -197,13 +386,19 @@ func (l *LocalFileRepo) Rename(filename string, newFilename string, userId uuid.
 		return err
 	}
 
-	exists, err := IsFileExists(oldPath)
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	exists, err := IsRegularFileExists(oldPath)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return ErrFileNotFound
 	}
+	if err := checkETag(oldPath, ifMatch); err != nil {
+		return err
+	}
 
 	exists, err = IsFileExists(newPath)
 	if err != nil {
@@ -212,36 +407,83 @@ func (l *LocalFileRepo) Rename(filename string, newFilename string, userId uuid.
 	if exists {
 		return ErrFileExists
 	}
+	if err := checkParentExists(newPath); err != nil {
+		return err
+	}
 	if err := os.Rename(oldPath, newPath); err != nil {
 		return fmt.Errorf("failed to rename file: %w", err)
 	}
+	if err := syncDir(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(oldPath)); err != nil {
+		return err
+	}
+	if err := l.moveSharing(userId, filename, newFilename, false); err != nil {
+		return err
+	}
 
-	return nil
+	return l.renameVersions(userId, filename, newFilename)
 }
 
 func (l *LocalFileRepo) GetUserOccupiedSpaceAndFileCount(userId uuid.UUID, excludedFiles []string) (int, int, error) {
-	path := filepath.Join(l.basePath, userId.String())
-	if exists, err := IsFileExists(path); err != nil || !exists {
-		return 0, 0, err
-	}
+	return l.getUserLiveSpaceAndFileCount(userId, excludedFiles)
+}
 
-	files, err := os.ReadDir(path)
+func (l *LocalFileRepo) GetUserHistorySize(userId uuid.UUID) (int, error) {
+	versions, err := l.getUserVersions(userId)
 	if err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 
+	size := 0
+	for _, v := range versions {
+		size += int(v.size)
+	}
+	return size, nil
+}
+
+func (l *LocalFileRepo) getUserLiveSpaceAndFileCount(userId uuid.UUID, excludedFiles []string) (int, int, error) {
 	var totalSize int64 = 0
 	cnt := 0
-	for _, file := range files {
-		info, err := file.Info()
-		if err != nil {
-			return 0, 0, err
-		}
-		if !info.IsDir() && !slices.Contains(excludedFiles, file.Name()) {
+	err := l.walkUserFiles(userId, func(rel string, info fs.FileInfo) error {
+		if !slices.Contains(excludedFiles, rel) {
 			totalSize += info.Size()
 			cnt += 1
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	attachments, err := l.getAttachmentsSize(userId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(totalSize + attachments), cnt, nil
+}
+
+func (l *LocalFileRepo) GetUsers() ([]uuid.UUID, error) {
+	entries, err := os.ReadDir(l.basePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// User directories are named by the user id, service directories like
+	// ATTACHMENTS_DIR are skipped.
+	users := []uuid.UUID{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		userId, err := uuid.Parse(entry.Name())
+		if err != nil {
+			continue
+		}
+		users = append(users, userId)
 	}
 
-	return int(totalSize), cnt, nil
+	return users, nil
 }
@@ -1,18 +1,72 @@
 package repodb
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 var testUUID uuid.UUID = uuid.New()
 
+// testRepos lists FileRepository implementations the conformance tests run
+// against. PostgreSQL tests are skipped unless TEST_DATABASE_URL is set, S3
+// tests use an in-process fake.
+var testRepos = []struct {
+	name  string
+	setup func(t *testing.T) FileRepository
+}{
+	{"local", func(t *testing.T) FileRepository {
+		tempDir, cleanup := setupTestDir(t)
+		t.Cleanup(cleanup)
+
+		repo, err := NewLocalFileRepo(tempDir)
+		require.NoError(t, err)
+
+		return repo
+	}},
+	{"postgres", func(t *testing.T) FileRepository {
+		url := os.Getenv("TEST_DATABASE_URL")
+		if url == "" {
+			t.Skip("TEST_DATABASE_URL is not set")
+		}
+
+		db, err := pgxpool.New(context.Background(), url)
+		require.NoError(t, err)
+		t.Cleanup(db.Close)
+
+		repo, err := NewPgFileRepo(db)
+		require.NoError(t, err)
+
+		_, err = db.Exec(context.Background(), "TRUNCATE files, folders, file_versions, user_quotas, trash, shares, share_links, attachments")
+		require.NoError(t, err)
+
+		return repo
+	}},
+	{"s3", func(t *testing.T) FileRepository {
+		return newTestS3Repo(t, nil)
+	}},
+}
+
+// forEachRepo runs fn as a subtest against a clean instance of every
+// implementation.
+func forEachRepo(t *testing.T, fn func(t *testing.T, repo FileRepository)) {
+	for _, tr := range testRepos {
+		t.Run(tr.name, func(t *testing.T) {
+			fn(t, tr.setup(t))
+		})
+	}
+}
+
 func setupTestDir(t *testing.T) (string, func()) {
 	tempDir, err := os.MkdirTemp("", "filerepo_test")
 	require.NoError(t, err)
@@ -38,329 +92,1125 @@ func TestNewLocalFileRepo(t *testing.T) {
 	assert.DirExists(t, nonExistentDir)
 }
 
-func TestLocalFileRepo_CreateAndGet(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_CreateAndGet(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		content := []byte("Hello, World!")
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		err := repo.Create(filename, testUUID, content)
+		assert.NoError(t, err)
 
-	filename := "test.md"
-	content := []byte("Hello, World!")
+		if local, ok := repo.(*LocalFileRepo); ok {
+			filePath := filepath.Join(local.basePath, testUUID.String(), filename)
+			assert.FileExists(t, filePath)
+		}
 
-	err = repo.Create(filename, testUUID, content)
-	assert.NoError(t, err)
+		retrievedContent, err := repo.Get(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, content, retrievedContent)
+	})
+}
 
-	filePath := filepath.Join(tempDir, testUUID.String(), filename)
-	assert.FileExists(t, filePath)
+func TestFileRepo_CreateDuplicate(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		content := []byte("Hello, World!")
 
-	retrievedContent, err := repo.Get(filename, testUUID)
-	assert.NoError(t, err)
-	assert.Equal(t, content, retrievedContent)
+		err := repo.Create(filename, testUUID, content)
+		assert.NoError(t, err)
+
+		err = repo.Create(filename, testUUID, []byte("Different content"))
+		assert.Error(t, err)
+		assert.Equal(t, ErrFileExists, err)
+	})
 }
 
-func TestLocalFileRepo_CreateDuplicate(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_GetNonExistent(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		_, err := repo.Get("nonexistent.md", testUUID)
+		assert.Error(t, err)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
+}
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+func TestFileRepo_Save(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		initialContent := []byte("Initial content")
+		updatedContent := []byte("Updated content")
 
-	filename := "test.md"
-	content := []byte("Hello, World!")
+		err := repo.Create(filename, testUUID, initialContent)
+		assert.NoError(t, err)
 
-	err = repo.Create(filename, testUUID, content)
-	assert.NoError(t, err)
+		err = repo.Save(filename, testUUID, updatedContent)
+		assert.NoError(t, err)
 
-	err = repo.Create(filename, testUUID, []byte("Different content"))
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileExists, err)
+		retrievedContent, err := repo.Get(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, updatedContent, retrievedContent)
+	})
 }
 
-func TestLocalFileRepo_GetNonExistent(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_SaveNewFile(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "newfile.md"
+		content := []byte("New content")
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		err := repo.Save(filename, testUUID, content)
+		assert.Error(t, err)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
+}
+
+func TestFileRepo_Delete(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		content := []byte("Hello, World!")
+
+		err := repo.Create(filename, testUUID, content)
+		assert.NoError(t, err)
+
+		err = repo.Delete(filename, testUUID)
+		assert.NoError(t, err)
 
-	_, err = repo.Get("nonexistent.md", testUUID)
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileNotFound, err)
+		_, err = repo.Get(filename, testUUID)
+		assert.Error(t, err)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
 }
 
-func TestLocalFileRepo_Save(t *testing.T) {
+func TestFileRepo_DeleteNonExistent(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		err := repo.Delete("nonexistent.md", testUUID)
+		assert.Error(t, err)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
+}
+
+func TestFileRepo_GetList(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		files := map[string][]byte{
+			"file1.md": []byte("Content 1"),
+			"file2.md": []byte("Content 2"),
+			"file3.md": []byte("Content 3"),
+		}
+
+		for filename, content := range files {
+			err := repo.Create(filename, testUUID, content)
+			assert.NoError(t, err)
+		}
+
+		titles, err := repo.GetList(testUUID)
+		assert.NoError(t, err)
+		assert.Len(t, titles, 3)
+
+		expectedTitles := []string{"file1.md", "file2.md", "file3.md"}
+		for _, expected := range expectedTitles {
+			assert.Contains(t, titles, expected)
+		}
+	})
+}
+
+func TestFileRepo_GetListEmpty(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		titles, err := repo.GetList(testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, titles)
+	})
+}
+
+func TestFileRepo_FilenameValidation(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		testCases := []struct {
+			name        string
+			filename    string
+			shouldError bool
+		}{
+			{"Valid .md file", "test.md", false},
+			{"Valid .markdown file", "test.markdown", false},
+			{"Invalid extension", "test.txt", true},
+			{"No extension", "test", true},
+			{"Path traversal", "../test.md", true},
+			{"Empty filename", "", true},
+			{"Nested path", "subdir/test.md", true},
+			{"Valid with dots", "test.v2.md", false},
+			{"Valid with numbers", "123.md", false},
+			{"Valid with underscores", "test_file.md", false},
+			{"Valid with hyphens", "test-file.md", false},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				err := repo.Create(tc.filename, testUUID, []byte("content"))
+
+				if tc.shouldError {
+					assert.Error(t, err, "Expected error for filename: %s", tc.filename)
+				} else {
+					assert.NoError(t, err, "Expected no error for filename: %s", tc.filename)
+
+					err = repo.Delete(tc.filename, testUUID)
+					assert.NoError(t, err, "Expected no error for file: %s", tc.filename)
+				}
+			})
+		}
+	})
+}
+
+func TestLocalFileRepo_FilePersistence(t *testing.T) {
 	tempDir, cleanup := setupTestDir(t)
 	defer cleanup()
 
-	repo, err := NewLocalFileRepo(tempDir)
+	repo1, err := NewLocalFileRepo(tempDir)
 	require.NoError(t, err)
 
-	filename := "test.md"
-	initialContent := []byte("Initial content")
-	updatedContent := []byte("Updated content")
+	filename := "persistent.md"
+	content := []byte("Persistent content")
 
-	err = repo.Create(filename, testUUID, initialContent)
+	err = repo1.Create(filename, testUUID, content)
 	assert.NoError(t, err)
 
-	err = repo.Save(filename, testUUID, updatedContent)
-	assert.NoError(t, err)
+	repo2, err := NewLocalFileRepo(tempDir)
+	require.NoError(t, err)
 
-	retrievedContent, err := repo.Get(filename, testUUID)
+	retrievedContent, err := repo2.Get(filename, testUUID)
 	assert.NoError(t, err)
-	assert.Equal(t, updatedContent, retrievedContent)
+	assert.Equal(t, content, retrievedContent)
 }
 
-func TestLocalFileRepo_SaveNewFile(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_SpecialCharacters(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		specialFilenames := []string{
+			"file with spaces.md",
+			"file-with-dashes.md",
+			"file_with_underscores.md",
+			"file.with.dots.md",
+			"UPPERCASE.MD",
+			"MixedCase.Md",
+		}
+
+		for _, filename := range specialFilenames {
+			t.Run(filename, func(t *testing.T) {
+				content := []byte("content for " + filename)
+
+				err := repo.Create(filename, testUUID, content)
+				assert.NoError(t, err)
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+				retrieved, err := repo.Get(filename, testUUID)
+				assert.NoError(t, err)
+				assert.Equal(t, content, retrieved)
 
-	filename := "newfile.md"
-	content := []byte("New content")
+				err = repo.Delete(filename, testUUID)
+				assert.NoError(t, err)
+			})
+		}
+	})
+}
 
-	err = repo.Save(filename, testUUID, content)
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileNotFound, err)
+func TestFileNumberLimit(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		for i := range MAX_USER_FILES {
+			filename := fmt.Sprintf("file%d.md", i)
+			t.Run(filename, func(t *testing.T) {
+				content := []byte("content for " + filename)
+
+				err := repo.Create(filename, testUUID, content)
+				assert.NoError(t, err)
+
+				retrieved, err := repo.Get(filename, testUUID)
+				assert.NoError(t, err)
+				assert.Equal(t, content, retrieved)
+			})
+		}
+
+		content := []byte("content for last file")
+		filename := "file_last.md"
+
+		err := repo.Create(filename, testUUID, content)
+		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrFileNumberLimitReached)
+
+		_, err = repo.Get(filename, testUUID)
+		assert.Error(t, err)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
 }
 
-func TestLocalFileRepo_Delete(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestStorageLimit(t *testing.T) {
+	for cnt := 1; cnt <= MAX_USER_FILES; cnt += 1 {
+		t.Run(fmt.Sprintf("file count: %d", cnt), func(t *testing.T) {
+			forEachRepo(t, func(t *testing.T, repo FileRepository) {
+				size := USER_SPACE_SIZE/cnt + cnt
+				content := make([]byte, size)
+				for i := range content {
+					content[i] = 1
+				}
+
+				for i := range cnt - 1 {
+					filename := fmt.Sprintf("file%d.md", i)
+					err := repo.Create(filename, testUUID, content[:size-cnt])
+					assert.NoError(t, err)
+
+					retrieved, err := repo.Get(filename, testUUID)
+					assert.NoError(t, err)
+					assert.Equal(t, content[:size-cnt], retrieved)
+				}
+
+				filename := "last_file.md"
+
+				err := repo.Create(filename, testUUID, content)
+				assert.Error(t, err)
+				assert.ErrorIs(t, err, ErrUserSpaceIsFull)
+
+				_, err = repo.Get(filename, testUUID)
+				assert.Error(t, err)
+				assert.Equal(t, ErrFileNotFound, err)
+			})
+		})
+	}
+}
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+func TestFileRepo_Versions(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		err := repo.Create(filename, testUUID, []byte("v1"))
+		require.NoError(t, err)
 
-	filename := "test.md"
-	content := []byte("Hello, World!")
+		versions, err := repo.GetVersions(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
 
-	err = repo.Create(filename, testUUID, content)
-	assert.NoError(t, err)
+		require.NoError(t, repo.Save(filename, testUUID, []byte("v2")))
+		require.NoError(t, repo.Save(filename, testUUID, []byte("v3")))
 
-	err = repo.Delete(filename, testUUID)
-	assert.NoError(t, err)
+		versions, err = repo.GetVersions(filename, testUUID)
+		assert.NoError(t, err)
+		require.Len(t, versions, 2)
+		assert.Equal(t, 2, versions[0].Id)
+		assert.Equal(t, 1, versions[1].Id)
 
-	_, err = repo.Get(filename, testUUID)
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileNotFound, err)
+		content, err := repo.GetVersion(filename, testUUID, versions[1].Id)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), content)
+
+		_, err = repo.GetVersion(filename, testUUID, 42)
+		assert.Equal(t, ErrVersionNotFound, err)
+
+		_, err = repo.GetVersions("nonexistent.md", testUUID)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
 }
 
-func TestLocalFileRepo_DeleteNonExistent(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_VersionsLimit(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		require.NoError(t, repo.Create(filename, testUUID, []byte("content")))
+		for i := range MAX_FILE_VERSIONS + 3 {
+			require.NoError(t, repo.Save(filename, testUUID, fmt.Appendf(nil, "content %d", i)))
+		}
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		versions, err := repo.GetVersions(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Len(t, versions, MAX_FILE_VERSIONS)
+		assert.Equal(t, MAX_FILE_VERSIONS+3, versions[0].Id)
+	})
+}
+
+func TestFileRepo_RestoreVersion(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		require.NoError(t, repo.Create(filename, testUUID, []byte("good")))
+		require.NoError(t, repo.Save(filename, testUUID, []byte("bad")))
+
+		err := repo.RestoreVersion(filename, testUUID, 1)
+		assert.NoError(t, err)
+
+		content, err := repo.Get(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("good"), content)
 
-	err = repo.Delete("nonexistent.md", testUUID)
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileNotFound, err)
+		content, err = repo.GetVersion(filename, testUUID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("bad"), content)
+	})
 }
 
-func TestLocalFileRepo_GetList(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_VersionsFollowFile(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.Create("old.md", testUUID, []byte("v1")))
+		require.NoError(t, repo.Save("old.md", testUUID, []byte("v2")))
+		require.NoError(t, repo.Rename("old.md", "new.md", testUUID))
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		versions, err := repo.GetVersions("new.md", testUUID)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
 
-	files := map[string][]byte{
-		"file1.md": []byte("Content 1"),
-		"file2.md": []byte("Content 2"),
-		"file3.md": []byte("Content 3"),
-	}
+		require.NoError(t, repo.Delete("new.md", testUUID))
+		require.NoError(t, repo.Create("new.md", testUUID, []byte("v1")))
 
-	for filename, content := range files {
-		err = repo.Create(filename, testUUID, content)
+		versions, err = repo.GetVersions("new.md", testUUID)
 		assert.NoError(t, err)
-	}
+		assert.Empty(t, versions)
+	})
+}
 
-	titles, err := repo.GetList(testUUID)
-	assert.NoError(t, err)
-	assert.Len(t, titles, 3)
+func TestFileRepo_VersionsQuota(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		half := make([]byte, USER_SPACE_SIZE/2)
+		filename := "test.md"
+		require.NoError(t, repo.Create(filename, testUUID, half))
+		require.NoError(t, repo.Save(filename, testUUID, half))
 
-	expectedTitles := []string{"file1.md", "file2.md", "file3.md"}
-	for _, expected := range expectedTitles {
-		assert.Contains(t, titles, expected)
-	}
+		// The stored revision isn't part of the usage checked against the quota.
+		occupied, cnt, err := repo.GetUserOccupiedSpaceAndFileCount(testUUID, []string{})
+		assert.NoError(t, err)
+		assert.Equal(t, USER_SPACE_SIZE/2, occupied)
+		assert.Equal(t, 1, cnt)
+		history, err := repo.GetUserHistorySize(testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, USER_SPACE_SIZE/2, history)
+
+		// History must not prevent writes of live files: the oldest revision is
+		// evicted to make room.
+		err = repo.Create("other.md", testUUID, []byte("content"))
+		assert.NoError(t, err)
+
+		versions, err := repo.GetVersions(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
+
+		occupied, _, err = repo.GetUserOccupiedSpaceAndFileCount(testUUID, []string{})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, occupied, USER_SPACE_SIZE)
+	})
 }
 
-func TestLocalFileRepo_GetListEmpty(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_VersionIdsNotReused(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		half := make([]byte, USER_SPACE_SIZE/2)
+		filename := "test.md"
+		require.NoError(t, repo.Create(filename, testUUID, half))
+		require.NoError(t, repo.Save(filename, testUUID, []byte("v2")))
+		require.NoError(t, repo.Create("other.md", testUUID, half))
+
+		// The only revision was evicted for other.md.
+		versions, err := repo.GetVersions(filename, testUUID)
+		require.NoError(t, err)
+		require.Empty(t, versions)
+
+		require.NoError(t, repo.Save(filename, testUUID, []byte("v3")))
+
+		versions, err = repo.GetVersions(filename, testUUID)
+		require.NoError(t, err)
+		require.Len(t, versions, 1)
+		assert.Equal(t, 2, versions[0].Id)
+
+		_, err = repo.GetVersion(filename, testUUID, 1)
+		assert.Equal(t, ErrVersionNotFound, err)
+	})
+}
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+func TestFileRepo_GetUsers(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		users, err := repo.GetUsers()
+		require.NoError(t, err)
+		assert.Empty(t, users)
 
-	titles, err := repo.GetList(testUUID)
-	assert.NoError(t, err)
-	assert.Empty(t, titles)
+		other := uuid.New()
+		require.NoError(t, repo.Create("a.md", testUUID, []byte("a")))
+		require.NoError(t, repo.CreateFolder("notes", other))
+
+		users, err = repo.GetUsers()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []uuid.UUID{testUUID, other}, users)
+	})
 }
 
-func TestLocalFileRepo_FilenameValidation(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_SaveIfMatch(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		content := []byte("v1")
+		require.NoError(t, repo.Create(filename, testUUID, content))
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		err := repo.SaveIfMatch(filename, testUUID, []byte("v2"), []string{ETag(content)})
+		assert.NoError(t, err)
 
-	testCases := []struct {
-		name        string
-		filename    string
-		shouldError bool
-	}{
-		{"Valid .md file", "test.md", false},
-		{"Valid .markdown file", "test.markdown", false},
-		{"Invalid extension", "test.txt", true},
-		{"No extension", "test", true},
-		{"Path traversal", "../test.md", true},
-		{"Empty filename", "", true},
-		{"Nested path", "subdir/test.md", true},
-		{"Valid with dots", "test.v2.md", false},
-		{"Valid with numbers", "123.md", false},
-		{"Valid with underscores", "test_file.md", false},
-		{"Valid with hyphens", "test-file.md", false},
-	}
+		err = repo.SaveIfMatch(filename, testUUID, []byte("v3"), []string{ETag(content)})
+		assert.Equal(t, ErrFileModified, err)
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			err := repo.Create(tc.filename, testUUID, []byte("content"))
+		err = repo.SaveIfMatch(filename, testUUID, []byte("v3"), []string{})
+		assert.Equal(t, ErrFileModified, err)
 
-			if tc.shouldError {
-				assert.Error(t, err, "Expected error for filename: %s", tc.filename)
-			} else {
-				assert.NoError(t, err, "Expected no error for filename: %s", tc.filename)
+		err = repo.SaveIfMatch(filename, testUUID, []byte("v3"), nil)
+		assert.NoError(t, err)
 
-				err = repo.Delete(tc.filename, testUUID)
-				assert.NoError(t, err, "Expected no error for file: %s", tc.filename)
-			}
-		})
-	}
+		retrieved, err := repo.Get(filename, testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v3"), retrieved)
+	})
 }
 
-func TestLocalFileRepo_FilePersistence(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_DeleteAndRenameIfMatch(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		content := []byte("content")
+		stale := []string{ETag([]byte("stale"))}
+		require.NoError(t, repo.Create("test.md", testUUID, content))
 
-	repo1, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		err := repo.RenameIfMatch("test.md", "renamed.md", testUUID, stale)
+		assert.Equal(t, ErrFileModified, err)
 
-	filename := "persistent.md"
-	content := []byte("Persistent content")
+		err = repo.RenameIfMatch("test.md", "renamed.md", testUUID, []string{ETag(content)})
+		assert.NoError(t, err)
 
-	err = repo1.Create(filename, testUUID, content)
-	assert.NoError(t, err)
+		err = repo.DeleteIfMatch("renamed.md", testUUID, stale)
+		assert.Equal(t, ErrFileModified, err)
 
-	repo2, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		err = repo.DeleteIfMatch("renamed.md", testUUID, []string{"other", ETag(content)})
+		assert.NoError(t, err)
 
-	retrievedContent, err := repo2.Get(filename, testUUID)
-	assert.NoError(t, err)
-	assert.Equal(t, content, retrievedContent)
+		_, err = repo.Get("renamed.md", testUUID)
+		assert.Equal(t, ErrFileNotFound, err)
+	})
 }
 
-func TestLocalFileRepo_SpecialCharacters(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_SaveIfMatchConcurrent(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		filename := "test.md"
+		content := []byte("content")
+		require.NoError(t, repo.Create(filename, testUUID, content))
+
+		const writers = 20
+		errs := make(chan error, writers)
+		for i := range writers {
+			go func() {
+				errs <- repo.SaveIfMatch(filename, testUUID, fmt.Appendf(nil, "writer %d", i), []string{ETag(content)})
+			}()
+		}
+
+		succeeded := 0
+		for range writers {
+			err := <-errs
+			if err == nil {
+				succeeded++
+			} else {
+				assert.Equal(t, ErrFileModified, err)
+			}
+		}
+		assert.Equal(t, 1, succeeded)
+	})
+}
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+func TestFileRepo_Folders(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		err := repo.Create("notes/test.md", testUUID, []byte("content"))
+		assert.Equal(t, ErrFolderNotFound, err)
 
-	specialFilenames := []string{
-		"file with spaces.md",
-		"file-with-dashes.md",
-		"file_with_underscores.md",
-		"file.with.dots.md",
-		"UPPERCASE.MD",
-		"MixedCase.Md",
-	}
+		require.NoError(t, repo.CreateFolder("notes", testUUID))
+		require.NoError(t, repo.CreateFolder("notes/2024", testUUID))
+		assert.Equal(t, ErrFolderExists, repo.CreateFolder("notes", testUUID))
 
-	for _, filename := range specialFilenames {
-		t.Run(filename, func(t *testing.T) {
-			content := []byte("content for " + filename)
+		require.NoError(t, repo.Create("notes/2024/test.md", testUUID, []byte("nested")))
+		require.NoError(t, repo.Create("root.md", testUUID, []byte("root")))
+		if local, ok := repo.(*LocalFileRepo); ok {
+			assert.DirExists(t, filepath.Join(local.basePath, testUUID.String(), "notes", "2024"))
+		}
 
-			err := repo.Create(filename, testUUID, content)
-			assert.NoError(t, err)
+		content, err := repo.Get("notes/2024/test.md", testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("nested"), content)
 
-			retrieved, err := repo.Get(filename, testUUID)
-			assert.NoError(t, err)
-			assert.Equal(t, content, retrieved)
+		files, err := repo.GetList(testUUID)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"notes/2024/test.md", "root.md"}, files)
 
-			err = repo.Delete(filename, testUUID)
-			assert.NoError(t, err)
-		})
-	}
+		tree, err := repo.GetTree(testUUID)
+		assert.NoError(t, err)
+		require.Len(t, tree, 2)
+		assert.Equal(t, FileTreeNode{Name: "notes", Path: "notes", IsFolder: true, Children: []FileTreeNode{
+			{Name: "2024", Path: "notes/2024", IsFolder: true, Children: []FileTreeNode{
+				{Name: "test.md", Path: "notes/2024/test.md"},
+			}},
+		}}, tree[0])
+		assert.Equal(t, FileTreeNode{Name: "root.md", Path: "root.md"}, tree[1])
+
+		_, err = repo.Get("notes", testUUID)
+		assert.Error(t, err)
+	})
 }
 
-func TestFileNumberLimit(t *testing.T) {
-	tempDir, cleanup := setupTestDir(t)
-	defer cleanup()
+func TestFileRepo_MoveAndRenameFolders(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.CreateFolder("a", testUUID))
+		require.NoError(t, repo.CreateFolder("b", testUUID))
+		require.NoError(t, repo.Create("a/test.md", testUUID, []byte("v1")))
+		require.NoError(t, repo.Save("a/test.md", testUUID, []byte("v2")))
 
-	repo, err := NewLocalFileRepo(tempDir)
-	require.NoError(t, err)
+		assert.Equal(t, ErrMoveIntoItself, repo.RenameFolder("a", "a/c", testUUID))
+		assert.Equal(t, ErrFolderExists, repo.RenameFolder("a", "b", testUUID))
+		assert.Equal(t, ErrFolderNotFound, repo.RenameFolder("a", "missing/a", testUUID))
 
-	for i := range MAX_USER_FILES {
-		filename := fmt.Sprintf("file%d.md", i)
-		t.Run(filename, func(t *testing.T) {
-			content := []byte("content for " + filename)
+		require.NoError(t, repo.RenameFolder("a", "b/a", testUUID))
 
-			err := repo.Create(filename, testUUID, content)
-			assert.NoError(t, err)
+		content, err := repo.Get("b/a/test.md", testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), content)
 
-			retrieved, err := repo.Get(filename, testUUID)
-			assert.NoError(t, err)
-			assert.Equal(t, content, retrieved)
-		})
-	}
+		versions, err := repo.GetVersions("b/a/test.md", testUUID)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
+
+		require.NoError(t, repo.Rename("b/a/test.md", "moved.md", testUUID))
+		_, err = repo.Get("moved.md", testUUID)
+		assert.NoError(t, err)
 
-	content := []byte("content for last file")
-	filename := "file_last.md"
+		versions, err = repo.GetVersions("moved.md", testUUID)
+		assert.NoError(t, err)
+		assert.Len(t, versions, 1)
+	})
+}
 
-	err = repo.Create(filename, testUUID, content)
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileNumberLimitReached, err)
+func TestFileRepo_DeleteFolder(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.CreateFolder("notes", testUUID))
+		require.NoError(t, repo.Create("notes/test.md", testUUID, []byte("content")))
 
-	_, err = repo.Get(filename, testUUID)
-	assert.Error(t, err)
-	assert.Equal(t, ErrFileNotFound, err)
+		assert.Equal(t, ErrFolderNotEmpty, repo.DeleteFolder("notes", testUUID, false))
+		assert.Equal(t, ErrFolderNotFound, repo.DeleteFolder("missing", testUUID, false))
+
+		require.NoError(t, repo.DeleteFolder("notes", testUUID, true))
+
+		files, err := repo.GetList(testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
 }
 
-func TestStorageLimit(t *testing.T) {
-	for cnt := 1; cnt <= MAX_USER_FILES; cnt += 1 {
-		t.Run(fmt.Sprintf("file count: %d", cnt), func(t *testing.T) {
-			tempDir, cleanup := setupTestDir(t)
-			defer cleanup()
+func TestFileRepo_NestedQuota(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.CreateFolder("a", testUUID))
+		require.NoError(t, repo.CreateFolder("a/b", testUUID))
+		for i := range MAX_USER_FILES {
+			require.NoError(t, repo.Create(fmt.Sprintf("a/b/file%d.md", i), testUUID, []byte("content")))
+		}
 
-			repo, err := NewLocalFileRepo(tempDir)
-			require.NoError(t, err)
+		occupied, cnt, err := repo.GetUserOccupiedSpaceAndFileCount(testUUID, []string{})
+		assert.NoError(t, err)
+		assert.Equal(t, MAX_USER_FILES*len("content"), occupied)
+		assert.Equal(t, MAX_USER_FILES, cnt)
 
-			size := USER_SPACE_SIZE/cnt + cnt
-			content := make([]byte, size)
-			for i := range content {
-				content[i] = 1
-			}
+		err = repo.Create("last.md", testUUID, []byte("content"))
+		assert.ErrorIs(t, err, ErrFileNumberLimitReached)
+	})
+}
+
+func TestFileRepo_ConcurrentQuota(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		const workers = 4 * MAX_USER_FILES
+		chunk := make([]byte, USER_SPACE_SIZE/3)
+
+		var created atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
 
-			for i := range cnt - 1 {
 				filename := fmt.Sprintf("file%d.md", i)
-				err = repo.Create(filename, testUUID, content[:size-cnt])
-				assert.NoError(t, err)
+				err := repo.Create(filename, testUUID, []byte("content"))
+				if err != nil {
+					assert.ErrorIs(t, err, ErrFileNumberLimitReached)
+					return
+				}
+				created.Add(1)
+			}()
+		}
+		close(start)
+		wg.Wait()
+		assert.Equal(t, int32(MAX_USER_FILES), created.Load())
+
+		files, err := repo.GetList(testUUID)
+		require.NoError(t, err)
+
+		start = make(chan struct{})
+		for i, filename := range files {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				for range 3 {
+					err := repo.Save(filename, testUUID, chunk)
+					if err != nil {
+						assert.ErrorIs(t, err, ErrUserSpaceIsFull)
+					}
+				}
+				assert.NoError(t, repo.Rename(filename, fmt.Sprintf("renamed%d.md", i), testUUID))
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		occupied, cnt, err := repo.GetUserOccupiedSpaceAndFileCount(testUUID, []string{})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, occupied, USER_SPACE_SIZE)
+		assert.Equal(t, MAX_USER_FILES, cnt)
+	})
+}
 
-				retrieved, err := repo.Get(filename, testUUID)
-				assert.NoError(t, err)
-				assert.Equal(t, content[:size-cnt], retrieved)
-			}
+func TestFileRepo_QuotaOverride(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		quota, err := repo.GetQuota(testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, Quota{Plan: DEFAULT_PLAN, SpaceSize: USER_SPACE_SIZE, MaxFiles: MAX_USER_FILES}, quota)
 
-			filename := "last_file.md"
+		override, err := repo.GetQuotaOverride(testUUID)
+		assert.NoError(t, err)
+		assert.Nil(t, override)
 
-			err = repo.Create(filename, testUUID, content)
-			assert.Error(t, err)
-			assert.Equal(t, ErrUserSpaceIsFull, err)
+		require.NoError(t, repo.SetQuotaOverride(testUUID, &QuotaOverride{MaxFiles: 1}))
+		require.NoError(t, repo.Create("a.md", testUUID, []byte("content")))
 
-			_, err = repo.Get(filename, testUUID)
-			assert.Error(t, err)
-			assert.Equal(t, ErrFileNotFound, err)
-		})
-	}
+		var quotaErr *QuotaError
+		err = repo.Create("b.md", testUUID, []byte("content"))
+		require.ErrorAs(t, err, &quotaErr)
+		assert.ErrorIs(t, err, ErrFileNumberLimitReached)
+		assert.Equal(t, 1, quotaErr.Quota.MaxFiles)
+
+		require.NoError(t, repo.SetQuotaOverride(testUUID, &QuotaOverride{SpaceSize: 10}))
+		err = repo.Save("a.md", testUUID, []byte("longer content"))
+		require.ErrorAs(t, err, &quotaErr)
+		assert.ErrorIs(t, err, ErrUserSpaceIsFull)
+		assert.Equal(t, 10, quotaErr.Quota.SpaceSize)
+
+		override, err = repo.GetQuotaOverride(testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, &QuotaOverride{SpaceSize: 10}, override)
+
+		assert.ErrorIs(t, repo.SetQuotaOverride(testUUID, &QuotaOverride{Plan: "missing"}), ErrPlanNotFound)
+		assert.ErrorIs(t, repo.SetQuotaOverride(testUUID, &QuotaOverride{MaxFiles: -1}), ErrInvalidQuota)
+
+		require.NoError(t, repo.SetQuotaOverride(testUUID, nil))
+		require.NoError(t, repo.SetQuotaOverride(testUUID, nil))
+		require.NoError(t, repo.Create("b.md", testUUID, []byte("content")))
+
+		quota, err = repo.GetQuota(testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, MAX_USER_FILES, quota.MaxFiles)
+	})
+}
+
+func TestFileRepo_Trash(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		content := []byte("content")
+		require.NoError(t, repo.Create("test.md", testUUID, content))
+		require.NoError(t, repo.Save("test.md", testUUID, []byte("updated")))
+		require.NoError(t, repo.Delete("test.md", testUUID))
+
+		items, err := repo.ListTrash(testUUID)
+		assert.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, "test.md", items[0].Filename)
+		assert.Equal(t, int64(len("updated")), items[0].Size)
+		assert.WithinDuration(t, time.Now(), items[0].DeletedAt, time.Minute)
+
+		occupied, cnt, err := repo.GetUserOccupiedSpaceAndFileCount(testUUID, []string{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, occupied)
+		assert.Equal(t, 0, cnt)
+
+		filename, err := repo.RestoreFromTrash(items[0].Id, testUUID, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "test.md", filename)
+
+		data, err := repo.Get("test.md", testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("updated"), data)
+
+		versions, err := repo.GetVersions("test.md", testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, versions)
+
+		items, err = repo.ListTrash(testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+
+		_, err = repo.RestoreFromTrash(uuid.NewString(), testUUID, false)
+		assert.Equal(t, ErrTrashItemNotFound, err)
+		_, err = repo.RestoreFromTrash("../test.md", testUUID, false)
+		assert.Equal(t, ErrTrashItemNotFound, err)
+	})
+}
+
+func TestFileRepo_TrashRestoreCollision(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.Create("test.md", testUUID, []byte("old")))
+		require.NoError(t, repo.Delete("test.md", testUUID))
+		require.NoError(t, repo.Create("test.md", testUUID, []byte("new")))
+		require.NoError(t, repo.Create("test (1).md", testUUID, []byte("new")))
+
+		items, err := repo.ListTrash(testUUID)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+
+		_, err = repo.RestoreFromTrash(items[0].Id, testUUID, false)
+		assert.Equal(t, ErrFileExists, err)
+
+		filename, err := repo.RestoreFromTrash(items[0].Id, testUUID, true)
+		assert.NoError(t, err)
+		assert.Equal(t, "test (2).md", filename)
+
+		data, err := repo.Get("test (2).md", testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("old"), data)
+	})
+}
+
+func TestFileRepo_TrashFolder(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.CreateFolder("notes", testUUID))
+		require.NoError(t, repo.CreateFolder("notes/2024", testUUID))
+		require.NoError(t, repo.Create("notes/a.md", testUUID, []byte("a")))
+		require.NoError(t, repo.Create("notes/2024/b.md", testUUID, []byte("b")))
+		require.NoError(t, repo.DeleteFolder("notes", testUUID, true))
+
+		items, err := repo.ListTrash(testUUID)
+		assert.NoError(t, err)
+		require.Len(t, items, 2)
+
+		// Both files are deleted at once, the order of items is not defined.
+		ids := map[string]string{}
+		for _, item := range items {
+			ids[item.Filename] = item.Id
+		}
+		require.Contains(t, ids, "notes/a.md")
+		require.Contains(t, ids, "notes/2024/b.md")
+
+		filename, err := repo.RestoreFromTrash(ids["notes/2024/b.md"], testUUID, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "notes/2024/b.md", filename)
+
+		tree, err := repo.GetTree(testUUID)
+		assert.NoError(t, err)
+		assert.Equal(t, []FileTreeNode{{Name: "notes", Path: "notes", IsFolder: true, Children: []FileTreeNode{
+			{Name: "2024", Path: "notes/2024", IsFolder: true, Children: []FileTreeNode{
+				{Name: "b.md", Path: "notes/2024/b.md"},
+			}},
+		}}}, tree)
+
+		require.NoError(t, repo.DeleteFromTrash(ids["notes/a.md"], testUUID))
+		assert.Equal(t, ErrTrashItemNotFound, repo.DeleteFromTrash(ids["notes/a.md"], testUUID))
+
+		items, err = repo.ListTrash(testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+}
+
+func TestFileRepo_TrashRestoreQuota(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.SetQuotaOverride(testUUID, &QuotaOverride{MaxFiles: 1}))
+		require.NoError(t, repo.Create("a.md", testUUID, []byte("a")))
+		require.NoError(t, repo.Delete("a.md", testUUID))
+		require.NoError(t, repo.Create("b.md", testUUID, []byte("b")))
+
+		items, err := repo.ListTrash(testUUID)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+
+		_, err = repo.RestoreFromTrash(items[0].Id, testUUID, false)
+		assert.ErrorIs(t, err, ErrFileNumberLimitReached)
+
+		require.NoError(t, repo.EmptyTrash(testUUID))
+		items, err = repo.ListTrash(testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, items)
+	})
+}
+
+func TestFileRepo_PurgeTrash(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		otherUUID := uuid.New()
+		require.NoError(t, repo.Create("a.md", testUUID, []byte("a")))
+		require.NoError(t, repo.Create("b.md", otherUUID, []byte("b")))
+		require.NoError(t, repo.Delete("a.md", testUUID))
+		require.NoError(t, repo.Delete("b.md", otherUUID))
+
+		purged, err := repo.PurgeTrash(time.Now().Add(-time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, purged)
+
+		purged, err = repo.PurgeTrash(time.Now().Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, purged)
+
+		for _, userId := range []uuid.UUID{testUUID, otherUUID} {
+			items, err := repo.ListTrash(userId)
+			assert.NoError(t, err)
+			assert.Empty(t, items)
+		}
+	})
+}
+
+func TestFileRepo_GetFileInfos(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		infos, err := repo.GetFileInfos(testUUID)
+		assert.NoError(t, err)
+		assert.Empty(t, infos)
+
+		require.NoError(t, repo.CreateFolder("notes", testUUID))
+		require.NoError(t, repo.Create("notes/a.md", testUUID, []byte("draft")))
+
+		infos, err = repo.GetFileInfos(testUUID)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		createdAt := infos[0].CreatedAt
+
+		content := []byte("# Meeting notes\n\nDiscuss the plan - twice.\n")
+		require.NoError(t, repo.Save("notes/a.md", testUUID, content))
+		require.NoError(t, repo.Rename("notes/a.md", "notes/b.md", testUUID))
+
+		infos, err = repo.GetFileInfos(testUUID)
+		require.NoError(t, err)
+		require.Len(t, infos, 1)
+		assert.Equal(t, "notes/b.md", infos[0].Path)
+		assert.Equal(t, int64(len(content)), infos[0].Size)
+		assert.Equal(t, ETag(content), infos[0].ETag)
+		assert.Equal(t, 6, infos[0].WordCount)
+		assert.Equal(t, "Meeting notes", infos[0].Title)
+		assert.True(t, infos[0].CreatedAt.Equal(createdAt), "creation time must survive saves and renames")
+		assert.False(t, infos[0].ModifiedAt.Before(createdAt))
+		assert.WithinDuration(t, time.Now(), infos[0].ModifiedAt, time.Minute)
+	})
+}
+
+func TestFileRepo_Shares(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		viewer, editor := uuid.New(), uuid.New()
+		require.NoError(t, repo.CreateFolder("notes", testUUID))
+		require.NoError(t, repo.Create("notes/a.md", testUUID, []byte("a")))
+		require.NoError(t, repo.Create("b.md", testUUID, []byte("b")))
+
+		assert.Equal(t, ErrFileNotFound, repo.ShareFile("missing.md", testUUID, viewer, ROLE_VIEWER))
+		assert.Equal(t, ErrInvalidShare, repo.ShareFile("b.md", testUUID, testUUID, ROLE_VIEWER))
+		assert.Equal(t, ErrInvalidShare, repo.ShareFile("b.md", testUUID, viewer, "owner"))
+
+		require.NoError(t, repo.ShareFile("notes/a.md", testUUID, viewer, ROLE_EDITOR))
+		require.NoError(t, repo.ShareFile("notes/a.md", testUUID, viewer, ROLE_VIEWER))
+		require.NoError(t, repo.ShareFile("notes/a.md", testUUID, editor, ROLE_EDITOR))
+		require.NoError(t, repo.ShareFile("b.md", testUUID, viewer, ROLE_VIEWER))
+
+		shares, err := repo.GetShares(testUUID, "notes/a.md")
+		require.NoError(t, err)
+		require.Len(t, shares, 2)
+		roles := map[uuid.UUID]string{}
+		for _, s := range shares {
+			assert.Equal(t, testUUID, s.Owner)
+			assert.Equal(t, "notes/a.md", s.Filename)
+			roles[s.UserId] = s.Role
+		}
+		assert.Equal(t, map[uuid.UUID]string{viewer: ROLE_VIEWER, editor: ROLE_EDITOR}, roles)
+
+		shared, err := repo.GetSharedWith(viewer)
+		require.NoError(t, err)
+		require.Len(t, shared, 2)
+		assert.Equal(t, "b.md", shared[0].Filename)
+		assert.Equal(t, "notes/a.md", shared[1].Filename)
+
+		// Shares follow renames and go away with deleted files.
+		require.NoError(t, repo.Rename("notes/a.md", "notes/c.md", testUUID))
+		require.NoError(t, repo.RenameFolder("notes", "archive", testUUID))
+		shared, err = repo.GetSharedWith(editor)
+		require.NoError(t, err)
+		require.Len(t, shared, 1)
+		assert.Equal(t, "archive/c.md", shared[0].Filename)
+
+		require.NoError(t, repo.DeleteFolder("archive", testUUID, true))
+		require.NoError(t, repo.Delete("b.md", testUUID))
+		shares, err = repo.GetShares(testUUID, "")
+		require.NoError(t, err)
+		assert.Empty(t, shares)
+
+		require.NoError(t, repo.Create("b.md", testUUID, []byte("new")))
+		shared, err = repo.GetSharedWith(viewer)
+		require.NoError(t, err)
+		assert.Empty(t, shared)
+
+		require.NoError(t, repo.ShareFile("b.md", testUUID, viewer, ROLE_VIEWER))
+		require.NoError(t, repo.UnshareFile("b.md", testUUID, viewer))
+		assert.Equal(t, ErrShareNotFound, repo.UnshareFile("b.md", testUUID, viewer))
+	})
+}
+
+func TestFileRepo_ShareLinks(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.CreateFolder("notes", testUUID))
+		require.NoError(t, repo.Create("notes/a.md", testUUID, []byte("a")))
+		require.NoError(t, repo.Create("b.md", testUUID, []byte("b")))
+
+		newLink := func(filename string) ShareLink {
+			token, err := NewShareLinkToken(testUUID)
+			require.NoError(t, err)
+			return ShareLink{Token: token, Owner: testUUID, Filename: filename, CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+		}
+
+		assert.Equal(t, ErrFileNotFound, repo.CreateShareLink(newLink("missing.md")))
+
+		first, second := newLink("notes/a.md"), newLink("b.md")
+		expires := time.Now().Add(time.Hour).UTC().Truncate(time.Millisecond)
+		second.ExpiresAt = &expires
+		second.PasswordHash = "hash"
+		require.NoError(t, repo.CreateShareLink(first))
+		require.NoError(t, repo.CreateShareLink(second))
+
+		link, err := repo.GetShareLink(second.Token)
+		require.NoError(t, err)
+		assert.Equal(t, "b.md", link.Filename)
+		assert.Equal(t, "hash", link.PasswordHash)
+		require.NotNil(t, link.ExpiresAt)
+		assert.True(t, expires.Equal(*link.ExpiresAt))
+		assert.Nil(t, link.LastAccessedAt)
+
+		_, err = repo.GetShareLink(newLink("b.md").Token)
+		assert.Equal(t, ErrShareLinkNotFound, err)
+		_, err = repo.GetShareLink("garbage")
+		assert.Equal(t, ErrShareLinkNotFound, err)
+
+		accessed := time.Now().UTC().Truncate(time.Millisecond)
+		require.NoError(t, repo.RecordShareLinkAccess(first.Token, accessed))
+		require.NoError(t, repo.RecordShareLinkAccess(first.Token, accessed))
+		link, err = repo.GetShareLink(first.Token)
+		require.NoError(t, err)
+		assert.Equal(t, 2, link.Accesses)
+		require.NotNil(t, link.LastAccessedAt)
+		assert.True(t, accessed.Equal(*link.LastAccessedAt))
+
+		// Links follow renames and go away with deleted files.
+		require.NoError(t, repo.RenameFolder("notes", "archive", testUUID))
+		links, err := repo.GetShareLinks(testUUID, "")
+		require.NoError(t, err)
+		require.Len(t, links, 2)
+		assert.Equal(t, "archive/a.md", links[0].Filename)
+		assert.Equal(t, "b.md", links[1].Filename)
+
+		require.NoError(t, repo.Delete("archive/a.md", testUUID))
+		_, err = repo.GetShareLink(first.Token)
+		assert.Equal(t, ErrShareLinkNotFound, err)
+
+		links, err = repo.GetShareLinks(testUUID, "b.md")
+		require.NoError(t, err)
+		assert.Len(t, links, 1)
+		require.NoError(t, repo.DeleteShareLink(testUUID, second.Token))
+		assert.Equal(t, ErrShareLinkNotFound, repo.DeleteShareLink(testUUID, second.Token))
+		assert.Equal(t, ErrShareLinkNotFound, repo.RecordShareLinkAccess(second.Token, accessed))
+	})
+}
+
+// testImage returns PNG content of the given size, distinct for every seed.
+func testImage(size int, seed byte) []byte {
+	data := make([]byte, size)
+	copy(data, "\x89PNG\r\n\x1a\n")
+	data[size-1] = seed
+	return data
+}
+
+func TestFileRepo_Attachments(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		require.NoError(t, repo.SetQuotaOverride(testUUID, &QuotaOverride{SpaceSize: 100, MaxFiles: 1}))
+		require.NoError(t, repo.Create("a.md", testUUID, []byte("a")))
+
+		data := testImage(60, 1)
+		attachment, err := NewAttachment(testUUID, "photo.png", data)
+		require.NoError(t, err)
+		require.NoError(t, repo.CreateAttachment(attachment, data))
+		// The same content again is kept as it is.
+		again, err := NewAttachment(testUUID, "copy.png", data)
+		require.NoError(t, err)
+		require.NoError(t, repo.CreateAttachment(again, data))
+
+		stored, content, err := repo.GetAttachment(testUUID, attachment.Id)
+		require.NoError(t, err)
+		assert.Equal(t, data, content)
+		assert.Equal(t, "photo.png", stored.Name)
+		assert.Equal(t, "image/png", stored.ContentType)
+		assert.Equal(t, int64(60), stored.Size)
+		assert.True(t, attachment.CreatedAt.Equal(stored.CreatedAt))
+
+		_, _, err = repo.GetAttachment(uuid.New(), attachment.Id)
+		assert.Equal(t, ErrAttachmentNotFound, err)
+		_, _, err = repo.GetAttachment(testUUID, "../a.md")
+		assert.Equal(t, ErrAttachmentNotFound, err)
+
+		// Attachments take space, but aren't files.
+		occupied, cnt, err := repo.GetUserOccupiedSpaceAndFileCount(testUUID, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 61, occupied)
+		assert.Equal(t, 1, cnt)
+		files, err := repo.GetList(testUUID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a.md"}, files)
+
+		big := testImage(40, 2)
+		second, err := NewAttachment(testUUID, "big.png", big)
+		require.NoError(t, err)
+		assert.ErrorIs(t, repo.CreateAttachment(second, big), ErrUserSpaceIsFull)
+		assert.ErrorIs(t, repo.Save("a.md", testUUID, make([]byte, 41)), ErrUserSpaceIsFull)
+
+		owners, err := repo.GetAttachmentOwners()
+		require.NoError(t, err)
+		assert.Equal(t, []uuid.UUID{testUUID}, owners)
+
+		attachments, err := repo.GetAttachments(testUUID)
+		require.NoError(t, err)
+		require.Len(t, attachments, 1)
+		assert.Equal(t, attachment.Id, attachments[0].Id)
+
+		require.NoError(t, repo.DeleteAttachment(testUUID, attachment.Id))
+		assert.Equal(t, ErrAttachmentNotFound, repo.DeleteAttachment(testUUID, attachment.Id))
+		require.NoError(t, repo.CreateAttachment(second, big))
+	})
+}
+
+func TestFileRepo_CollectAttachments(t *testing.T) {
+	forEachRepo(t, func(t *testing.T, repo FileRepository) {
+		upload := func(seed byte) Attachment {
+			data := testImage(16, seed)
+			attachment, err := NewAttachment(testUUID, "image.png", data)
+			require.NoError(t, err)
+			require.NoError(t, repo.CreateAttachment(attachment, data))
+			return attachment
+		}
+		live, history, trashed, unused := upload(1), upload(2), upload(3), upload(4)
+
+		ref := func(a Attachment) []byte {
+			return []byte("![image](/api/attachments/" + testUUID.String() + "/" + a.Id + ")")
+		}
+		require.NoError(t, repo.Create("a.md", testUUID, ref(history)))
+		require.NoError(t, repo.Save("a.md", testUUID, ref(live)))
+		require.NoError(t, repo.Create("b.md", testUUID, ref(trashed)))
+		require.NoError(t, repo.Delete("b.md", testUUID))
+
+		deleted, err := CollectAttachments(repo, testUUID, time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 0, deleted, "recent uploads are kept")
+
+		deleted, err = CollectAttachments(repo, testUUID, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+
+		attachments, err := repo.GetAttachments(testUUID)
+		require.NoError(t, err)
+		var ids []string
+		for _, a := range attachments {
+			ids = append(ids, a.Id)
+		}
+		assert.ElementsMatch(t, []string{live.Id, history.Id, trashed.Id}, ids)
+		_, _, err = repo.GetAttachment(testUUID, unused.Id)
+		assert.Equal(t, ErrAttachmentNotFound, err)
+
+		require.NoError(t, repo.EmptyTrash(testUUID))
+		deleted, err = CollectAttachments(repo, testUUID, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, deleted)
+	})
 }
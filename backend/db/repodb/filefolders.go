@@ -0,0 +1,205 @@
+package repodb
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func readTree(dir string, rel string) ([]FileTreeNode, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	nodes := []FileTreeNode{}
+	for _, entry := range entries {
+		if isTempFile(entry.Name()) {
+			continue
+		}
+
+		node := FileTreeNode{
+			Name:     entry.Name(),
+			Path:     path.Join(rel, entry.Name()),
+			IsFolder: entry.IsDir(),
+		}
+
+		if entry.IsDir() {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			node.Children, err = readTree(filepath.Join(dir, entry.Name()), node.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].IsFolder && !nodes[j].IsFolder
+	})
+
+	return nodes, nil
+}
+
+func (l *LocalFileRepo) GetTree(userId uuid.UUID) ([]FileTreeNode, error) {
+	err := createUserDirIfNotExists(l.basePath, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return readTree(filepath.Join(l.basePath, userId.String()), "")
+}
+
+func (l *LocalFileRepo) CreateFolder(folder string, userId uuid.UUID) error {
+	err := createUserDirIfNotExists(l.basePath, userId)
+	if err != nil {
+		return err
+	}
+
+	path, err := getFolderPath(l.basePath, userId, folder)
+	if err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	if err := checkNotExists(path); err != nil {
+		return err
+	}
+	if err := checkParentExists(path); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(path, 0755); err != nil {
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func (l *LocalFileRepo) RenameFolder(folder string, newFolder string, userId uuid.UUID) error {
+	oldPath, err := getFolderPath(l.basePath, userId, folder)
+	if err != nil {
+		return err
+	}
+	newPath, err := getFolderPath(l.basePath, userId, newFolder)
+	if err != nil {
+		return err
+	}
+	if newFolder == folder || strings.HasPrefix(newFolder, folder+"/") {
+		return ErrMoveIntoItself
+	}
+
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	exists, err := IsDirExists(oldPath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+	if err := checkNotExists(newPath); err != nil {
+		return err
+	}
+	if err := checkParentExists(newPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("failed to rename folder: %w", err)
+	}
+	if err := syncDir(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+	if err := l.moveSharing(userId, folder, newFolder, true); err != nil {
+		return err
+	}
+
+	return l.renameVersions(userId, folder, newFolder)
+}
+
+func (l *LocalFileRepo) DeleteFolder(folder string, userId uuid.UUID, recursive bool) error {
+	path, err := getFolderPath(l.basePath, userId, folder)
+	if err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	exists, err := IsDirExists(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+
+	if !recursive {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return ErrFolderNotEmpty
+		}
+	}
+
+	deletedAt := time.Now()
+	err = filepath.WalkDir(path, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isTempFile(d.Name()) {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, filePath)
+		if err != nil {
+			return err
+		}
+
+		return l.moveToTrash(userId, folder+"/"+filepath.ToSlash(rel), filePath, deletedAt)
+	})
+	if err != nil {
+		return err
+	}
+	if err := l.dropSharing(userId, folder, true); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to delete folder: %w", err)
+	}
+
+	return os.RemoveAll(getVersionsPath(l.basePath, userId, folder))
+}
+
+// checkNotExists returns ErrFolderExists or ErrFileExists if something is
+// already stored at path.
+func checkNotExists(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+	if info.IsDir() {
+		return ErrFolderExists
+	}
+
+	return ErrFileExists
+}
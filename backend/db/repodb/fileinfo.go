@@ -0,0 +1,159 @@
+package repodb
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FileInfo is the metadata of a live file. Title is the text of the first
+// heading, empty if the file has none.
+type FileInfo struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	ETag       string    `json:"etag"`
+	WordCount  int       `json:"wordCount"`
+	Title      string    `json:"title"`
+}
+
+func newFileInfo(filename string, data []byte, createdAt time.Time, modifiedAt time.Time) FileInfo {
+	return FileInfo{
+		Path:       filename,
+		Size:       int64(len(data)),
+		CreatedAt:  createdAt,
+		ModifiedAt: modifiedAt,
+		ETag:       ETag(data),
+		WordCount:  countWords(data),
+		Title:      extractTitle(data),
+	}
+}
+
+// countWords counts whitespace separated words, markup like "#" or "-" that
+// has no letters or digits is not counted.
+func countWords(data []byte) int {
+	cnt := 0
+	for _, field := range bytes.Fields(data) {
+		if bytes.IndexFunc(field, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+// extractTitle returns the text of the first ATX heading ("# Title") outside
+// of fenced code blocks.
+func extractTitle(data []byte) string {
+	inFence := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			continue
+		}
+
+		level := len(line) - len(strings.TrimLeft(line, "#"))
+		if level == 0 || level > 6 {
+			continue
+		}
+		rest := line[level:]
+		if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+			continue
+		}
+
+		title := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(rest), "#"))
+		if title != "" {
+			return title
+		}
+	}
+
+	return ""
+}
+
+// Fields files can be sorted by in FileQuery.
+const (
+	SORT_BY_NAME        = "name"
+	SORT_BY_TITLE       = "title"
+	SORT_BY_SIZE        = "size"
+	SORT_BY_CREATED_AT  = "createdAt"
+	SORT_BY_MODIFIED_AT = "modifiedAt"
+	SORT_BY_WORD_COUNT  = "wordCount"
+)
+
+var ErrInvalidSort = errors.New("unknown sort field")
+
+// FileQuery selects a page of files. Folder limits files to the folder and
+// its subfolders, Search matches the path or the title case-insensitively.
+// A zero Limit means no limit.
+type FileQuery struct {
+	Folder string
+	Search string
+	SortBy string
+	Desc   bool
+	Offset int
+	Limit  int
+}
+
+// QueryFiles filters and sorts files and returns the requested page with the
+// number of matching files. Ties are broken by path, so pages are stable.
+func QueryFiles(files []FileInfo, q FileQuery) ([]FileInfo, int, error) {
+	var compare func(a, b FileInfo) int
+	switch q.SortBy {
+	case "", SORT_BY_NAME:
+		compare = func(a, b FileInfo) int { return 0 }
+	case SORT_BY_TITLE:
+		compare = func(a, b FileInfo) int { return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title)) }
+	case SORT_BY_SIZE:
+		compare = func(a, b FileInfo) int { return cmp.Compare(a.Size, b.Size) }
+	case SORT_BY_CREATED_AT:
+		compare = func(a, b FileInfo) int { return a.CreatedAt.Compare(b.CreatedAt) }
+	case SORT_BY_MODIFIED_AT:
+		compare = func(a, b FileInfo) int { return a.ModifiedAt.Compare(b.ModifiedAt) }
+	case SORT_BY_WORD_COUNT:
+		compare = func(a, b FileInfo) int { return cmp.Compare(a.WordCount, b.WordCount) }
+	default:
+		return nil, 0, ErrInvalidSort
+	}
+
+	search := strings.ToLower(q.Search)
+	result := []FileInfo{}
+	for _, f := range files {
+		if q.Folder != "" && !strings.HasPrefix(f.Path, q.Folder+"/") {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(f.Path), search) &&
+			!strings.Contains(strings.ToLower(f.Title), search) {
+			continue
+		}
+		result = append(result, f)
+	}
+
+	slices.SortStableFunc(result, func(a, b FileInfo) int {
+		c := compare(a, b)
+		if c == 0 {
+			c = strings.Compare(a.Path, b.Path)
+		}
+		if q.Desc {
+			return -c
+		}
+		return c
+	})
+
+	total := len(result)
+	start := min(q.Offset, total)
+	end := total
+	if q.Limit > 0 {
+		end = min(start+q.Limit, total)
+	}
+
+	return result[start:end], total, nil
+}
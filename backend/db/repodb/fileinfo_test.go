@@ -0,0 +1,80 @@
+package repodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractTitle(t *testing.T) {
+	tests := []struct {
+		content string
+		title   string
+	}{
+		{"# Title\ntext", "Title"},
+		{"text\n\n## Second level ##\n# Later", "Second level"},
+		{"```\n# not a title\n```\n# Title", "Title"},
+		{"#hashtag\n#\n#   \n### Found", "Found"},
+		{"####### too deep", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.title, extractTitle([]byte(tt.content)), tt.content)
+	}
+}
+
+func TestCountWords(t *testing.T) {
+	assert.Equal(t, 0, countWords(nil))
+	assert.Equal(t, 4, countWords([]byte("# Title\n\n- first item, 2\n---")))
+	assert.Equal(t, 3, countWords([]byte("Привет, мир 42")))
+}
+
+func TestQueryFiles(t *testing.T) {
+	now := time.Now()
+	files := []FileInfo{
+		{Path: "b.md", Size: 10, ModifiedAt: now, Title: "Shopping"},
+		{Path: "notes/a.md", Size: 30, ModifiedAt: now.Add(-time.Hour), Title: "Meeting"},
+		{Path: "notes/c.md", Size: 20, ModifiedAt: now.Add(-2 * time.Hour)},
+		{Path: "notes.md", Size: 20, ModifiedAt: now.Add(time.Hour)},
+	}
+	paths := func(infos []FileInfo) []string {
+		result := []string{}
+		for _, info := range infos {
+			result = append(result, info.Path)
+		}
+		return result
+	}
+
+	page, total, err := QueryFiles(files, FileQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, []string{"b.md", "notes.md", "notes/a.md", "notes/c.md"}, paths(page))
+
+	page, _, err = QueryFiles(files, FileQuery{SortBy: SORT_BY_MODIFIED_AT, Desc: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"notes.md", "b.md", "notes/a.md", "notes/c.md"}, paths(page))
+
+	page, _, err = QueryFiles(files, FileQuery{SortBy: SORT_BY_SIZE})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.md", "notes.md", "notes/c.md", "notes/a.md"}, paths(page))
+
+	page, total, err = QueryFiles(files, FileQuery{Folder: "notes", Offset: 1, Limit: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []string{"notes/c.md"}, paths(page))
+
+	page, total, err = QueryFiles(files, FileQuery{Search: "meet"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []string{"notes/a.md"}, paths(page))
+
+	page, total, err = QueryFiles(files, FileQuery{Offset: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Empty(t, page)
+
+	_, _, err = QueryFiles(files, FileQuery{SortBy: "owner"})
+	assert.Equal(t, ErrInvalidSort, err)
+}
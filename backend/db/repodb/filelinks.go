@@ -0,0 +1,88 @@
+package repodb
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func getLinksPath(basePath string, owner uuid.UUID) string {
+	return filepath.Join(basePath, LINKS_DIR, owner.String()+".json")
+}
+
+func (l *LocalFileRepo) updateLinks(owner uuid.UUID, fn func([]ShareLink) ([]ShareLink, error)) error {
+	return updateList(getLinksPath(l.basePath, owner), fn)
+}
+
+func (l *LocalFileRepo) CreateShareLink(link ShareLink) error {
+	path, err := getPath(l.basePath, link.Owner, link.Filename)
+	if err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(link.Owner.String())
+	defer unlock()
+
+	exists, err := IsRegularFileExists(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFileNotFound
+	}
+
+	return l.updateLinks(link.Owner, func(links []ShareLink) ([]ShareLink, error) {
+		return append(links, link), nil
+	})
+}
+
+func (l *LocalFileRepo) GetShareLink(token string) (ShareLink, error) {
+	owner, err := shareLinkOwner(token)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	links, err := readList[ShareLink](getLinksPath(l.basePath, owner))
+	if err != nil {
+		return ShareLink{}, err
+	}
+	i := findLink(links, token)
+	if i < 0 {
+		return ShareLink{}, ErrShareLinkNotFound
+	}
+
+	return links[i], nil
+}
+
+func (l *LocalFileRepo) GetShareLinks(owner uuid.UUID, filename string) ([]ShareLink, error) {
+	links, err := readList[ShareLink](getLinksPath(l.basePath, owner))
+	if err != nil {
+		return nil, err
+	}
+
+	return filterLinks(links, filename), nil
+}
+
+func (l *LocalFileRepo) DeleteShareLink(owner uuid.UUID, token string) error {
+	unlock := l.locks.Lock(owner.String())
+	defer unlock()
+
+	return l.updateLinks(owner, func(links []ShareLink) ([]ShareLink, error) {
+		return removeLink(links, token)
+	})
+}
+
+func (l *LocalFileRepo) RecordShareLinkAccess(token string, at time.Time) error {
+	owner, err := shareLinkOwner(token)
+	if err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(owner.String())
+	defer unlock()
+
+	return l.updateLinks(owner, func(links []ShareLink) ([]ShareLink, error) {
+		return recordLinkAccess(links, token, at.UTC())
+	})
+}
@@ -0,0 +1,72 @@
+package repodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// Quota overrides are stored as <basePath>/.quotas/<userId>.json, next to
+// user roots.
+const QUOTAS_DIR = ".quotas"
+
+func getQuotaPath(basePath string, userId uuid.UUID) string {
+	return filepath.Join(basePath, QUOTAS_DIR, userId.String()+".json")
+}
+
+func (l *LocalFileRepo) GetQuota(userId uuid.UUID) (Quota, error) {
+	override, err := l.GetQuotaOverride(userId)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	return resolveQuota(override), nil
+}
+
+func (l *LocalFileRepo) GetQuotaOverride(userId uuid.UUID) (*QuotaOverride, error) {
+	data, err := os.ReadFile(getQuotaPath(l.basePath, userId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var override QuotaOverride
+	if err := json.Unmarshal(data, &override); err != nil {
+		return nil, fmt.Errorf("failed to parse quota of user %s: %w", userId, err)
+	}
+
+	return &override, nil
+}
+
+func (l *LocalFileRepo) SetQuotaOverride(userId uuid.UUID, override *QuotaOverride) error {
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	path := getQuotaPath(l.basePath, userId)
+	if override == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	if err := validateQuotaOverride(override); err != nil {
+		return err
+	}
+	data, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create quotas directory: %w", err)
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
@@ -0,0 +1,174 @@
+package repodb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func getSharesPath(basePath string, owner uuid.UUID) string {
+	return filepath.Join(basePath, SHARES_DIR, owner.String()+".json")
+}
+
+// readList reads a JSON list of shares or links, empty if the file doesn't
+// exist.
+func readList[T any](path string) ([]T, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []T{}, nil
+		}
+
+		return nil, err
+	}
+
+	var items []T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return items, nil
+}
+
+// updateList rewrites the list in path with fn, an empty list removes the
+// file. Must be called with the owner lock held.
+func updateList[T any](path string, fn func([]T) ([]T, error)) error {
+	items, err := readList[T](path)
+	if err != nil {
+		return err
+	}
+	items, err = fn(items)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
+
+func (l *LocalFileRepo) updateShares(owner uuid.UUID, fn func([]Share) ([]Share, error)) error {
+	return updateList(getSharesPath(l.basePath, owner), fn)
+}
+
+// moveSharing makes shares and links of the renamed file or folder path
+// follow it to newPath. Must be called with the owner lock held.
+func (l *LocalFileRepo) moveSharing(owner uuid.UUID, path string, newPath string, folder bool) error {
+	if err := l.updateShares(owner, func(shares []Share) ([]Share, error) {
+		return moveShares(shares, path, newPath, folder), nil
+	}); err != nil {
+		return err
+	}
+
+	return l.updateLinks(owner, func(links []ShareLink) ([]ShareLink, error) {
+		return moveLinks(links, path, newPath, folder), nil
+	})
+}
+
+// dropSharing removes shares and links of the file or folder path. It is
+// called once the files are in the trash, so a failed delete keeps them.
+// Must be called with the owner lock held.
+func (l *LocalFileRepo) dropSharing(owner uuid.UUID, path string, folder bool) error {
+	if err := l.updateShares(owner, func(shares []Share) ([]Share, error) {
+		return dropShares(shares, path, folder), nil
+	}); err != nil {
+		return err
+	}
+
+	return l.updateLinks(owner, func(links []ShareLink) ([]ShareLink, error) {
+		return dropLinks(links, path, folder), nil
+	})
+}
+
+func (l *LocalFileRepo) ShareFile(filename string, owner uuid.UUID, userId uuid.UUID, role string) error {
+	path, err := getPath(l.basePath, owner, filename)
+	if err != nil {
+		return err
+	}
+	if err := validateShare(owner, userId, role); err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(owner.String())
+	defer unlock()
+
+	exists, err := IsRegularFileExists(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFileNotFound
+	}
+
+	return l.updateShares(owner, func(shares []Share) ([]Share, error) {
+		return putShare(shares, Share{Owner: owner, Filename: filename, UserId: userId, Role: role, CreatedAt: time.Now().UTC()}), nil
+	})
+}
+
+func (l *LocalFileRepo) UnshareFile(filename string, owner uuid.UUID, userId uuid.UUID) error {
+	unlock := l.locks.Lock(owner.String())
+	defer unlock()
+
+	return l.updateShares(owner, func(shares []Share) ([]Share, error) {
+		return removeShare(shares, filename, userId)
+	})
+}
+
+func (l *LocalFileRepo) GetShares(owner uuid.UUID, filename string) ([]Share, error) {
+	shares, err := readList[Share](getSharesPath(l.basePath, owner))
+	if err != nil {
+		return nil, err
+	}
+
+	return filterShares(shares, filename), nil
+}
+
+func (l *LocalFileRepo) GetSharedWith(userId uuid.UUID) ([]Share, error) {
+	dir := filepath.Join(l.basePath, SHARES_DIR)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Share{}, nil
+		}
+
+		return nil, fmt.Errorf("failed to read shares directory: %w", err)
+	}
+
+	result := []Share{}
+	for _, entry := range entries {
+		if _, err := uuid.Parse(strings.TrimSuffix(entry.Name(), ".json")); err != nil || entry.IsDir() {
+			continue
+		}
+
+		shares, err := readList[Share](filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range shares {
+			if s.UserId == userId {
+				result = append(result, s)
+			}
+		}
+	}
+	sortShares(result)
+
+	return result, nil
+}
@@ -0,0 +1,291 @@
+package repodb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A trashed file <user>/<path> is stored as <user>/.trash/<id>/<path>, its
+// modification time is the deletion time.
+
+func getTrashPath(basePath string, userId uuid.UUID) string {
+	return filepath.Join(basePath, userId.String(), TRASH_DIR)
+}
+
+// errTrashFileFound stops the walk of an item directory.
+var errTrashFileFound = errors.New("trash file found")
+
+// readTrashItem returns the item stored in dir with the path of its file.
+// An item without a file is left by an interrupted delete and reported as
+// ErrTrashItemNotFound.
+func readTrashItem(dir string, id string) (TrashItem, string, error) {
+	var item TrashItem
+	var filePath string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isTempFile(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		item = TrashItem{Id: id, Filename: filepath.ToSlash(rel), Size: info.Size(), DeletedAt: info.ModTime()}
+		filePath = path
+
+		return errTrashFileFound
+	})
+	if errors.Is(err, errTrashFileFound) {
+		return item, filePath, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return TrashItem{}, "", err
+	}
+
+	return TrashItem{}, "", ErrTrashItemNotFound
+}
+
+// moveToTrash moves the file at path into a new trash item and drops its
+// history. Must be called with the user lock held.
+func (l *LocalFileRepo) moveToTrash(userId uuid.UUID, filename string, path string, deletedAt time.Time) error {
+	dst := filepath.Join(getTrashPath(l.basePath, userId), newTrashId(), filepath.FromSlash(filename))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create trash directory: %w", err)
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return fmt.Errorf("failed to move file to trash: %w", err)
+	}
+	// The deletion time is only set on the trashed file, so a failed delete
+	// leaves the live one as it was. Without it the item would be purged too
+	// early, so the file is moved back.
+	if err := os.Chtimes(dst, deletedAt, deletedAt); err != nil {
+		if restoreErr := os.Rename(dst, path); restoreErr != nil {
+			return errors.Join(err, restoreErr)
+		}
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(getVersionsPath(l.basePath, userId, filename))
+}
+
+func (l *LocalFileRepo) ListTrash(userId uuid.UUID) ([]TrashItem, error) {
+	dir := getTrashPath(l.basePath, userId)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashItem{}, nil
+		}
+
+		return nil, fmt.Errorf("failed to read trash directory %s: %w", dir, err)
+	}
+
+	items := []TrashItem{}
+	for _, entry := range entries {
+		if !entry.IsDir() || validateTrashId(entry.Name()) != nil {
+			continue
+		}
+
+		item, _, err := readTrashItem(filepath.Join(dir, entry.Name()), entry.Name())
+		if err != nil {
+			if err == ErrTrashItemNotFound {
+				continue
+			}
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	sortTrash(items)
+
+	return items, nil
+}
+
+func (l *LocalFileRepo) RestoreFromTrash(id string, userId uuid.UUID, autoRename bool) (string, error) {
+	if err := validateTrashId(id); err != nil {
+		return "", err
+	}
+
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	itemDir := filepath.Join(getTrashPath(l.basePath, userId), id)
+	item, src, err := readTrashItem(itemDir, id)
+	if err != nil {
+		return "", err
+	}
+
+	quota, err := l.GetQuota(userId)
+	if err != nil {
+		return "", err
+	}
+	occupied, cnt, err := l.getUserLiveSpaceAndFileCount(userId, []string{})
+	if err != nil {
+		return "", err
+	}
+	if err := checkQuota(quota, occupied+int(item.Size), cnt+1); err != nil {
+		return "", err
+	}
+
+	filename, err := pickRestoreName(item.Filename, autoRename, func(name string) (bool, error) {
+		path, err := getPath(l.basePath, userId, name)
+		if err != nil {
+			return false, err
+		}
+		return IsFileExists(path)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	path, err := getPath(l.basePath, userId, filename)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create folder: %w", err)
+	}
+	if err := os.Rename(src, path); err != nil {
+		return "", fmt.Errorf("failed to restore file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(itemDir); err != nil {
+		return "", err
+	}
+	if err := l.markCreated(userId, filename); err != nil {
+		return "", err
+	}
+
+	return filename, l.trimHistory(userId, quota.SpaceSize)
+}
+
+func (l *LocalFileRepo) GetTrashContent(id string, userId uuid.UUID) ([]byte, error) {
+	if err := validateTrashId(id); err != nil {
+		return nil, err
+	}
+
+	_, path, err := readTrashItem(filepath.Join(getTrashPath(l.basePath, userId), id), id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrTrashItemNotFound
+		}
+
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (l *LocalFileRepo) DeleteFromTrash(id string, userId uuid.UUID) error {
+	if err := validateTrashId(id); err != nil {
+		return err
+	}
+
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	itemDir := filepath.Join(getTrashPath(l.basePath, userId), id)
+	exists, err := IsDirExists(itemDir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrTrashItemNotFound
+	}
+
+	return os.RemoveAll(itemDir)
+}
+
+func (l *LocalFileRepo) EmptyTrash(userId uuid.UUID) error {
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	return os.RemoveAll(getTrashPath(l.basePath, userId))
+}
+
+func (l *LocalFileRepo) PurgeTrash(before time.Time) (int, error) {
+	entries, err := os.ReadDir(l.basePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read base directory: %w", err)
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		userId, err := uuid.Parse(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		n, err := l.purgeUserTrash(userId, before)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+func (l *LocalFileRepo) purgeUserTrash(userId uuid.UUID, before time.Time) (int, error) {
+	unlock := l.locks.Lock(userId.String())
+	defer unlock()
+
+	dir := getTrashPath(l.basePath, userId)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+
+		return 0, fmt.Errorf("failed to read trash directory %s: %w", dir, err)
+	}
+
+	purged := 0
+	for _, entry := range entries {
+		if validateTrashId(entry.Name()) != nil {
+			continue
+		}
+
+		itemDir := filepath.Join(dir, entry.Name())
+		item, _, err := readTrashItem(itemDir, entry.Name())
+		switch {
+		case err == ErrTrashItemNotFound:
+			// A leftover of an interrupted delete, removed right away.
+		case err != nil:
+			return purged, err
+		case !item.DeletedAt.Before(before):
+			continue
+		default:
+			purged++
+		}
+
+		if err := os.RemoveAll(itemDir); err != nil {
+			return purged, fmt.Errorf("failed to purge trash item %s: %w", itemDir, err)
+		}
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,334 @@
+package repodb
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Revisions of <user>/<path> are stored as <user>/.versions/<path>/<id>.
+// The directory is skipped by GetList, and user folders can't clash with it
+// because they must not start with a dot.
+const VERSIONS_DIR = ".versions"
+
+// CREATED_MARKER is an empty file in the history directory of a file, its
+// modification time is the creation time of the file. Saves replace the file,
+// so the file itself doesn't keep it. The name can't clash with revisions.
+const CREATED_MARKER = ".created"
+
+// LAST_VERSION_MARKER holds the id of the last revision of a file in its
+// history directory, so ids aren't reused after revisions are evicted.
+const LAST_VERSION_MARKER = ".last"
+
+type storedVersion struct {
+	path    string
+	id      int
+	size    int64
+	modTime time.Time
+}
+
+func getVersionsPath(basePath string, userId uuid.UUID, filename string) string {
+	return filepath.Join(basePath, userId.String(), VERSIONS_DIR, filename)
+}
+
+// readVersions returns revisions stored in dir sorted by id.
+func readVersions(dir string) ([]storedVersion, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to read versions directory %s: %w", dir, err)
+	}
+
+	var versions []storedVersion
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil || entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, storedVersion{
+			path:    filepath.Join(dir, entry.Name()),
+			id:      id,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].id < versions[j].id })
+
+	return versions, nil
+}
+
+func (l *LocalFileRepo) getUserVersions(userId uuid.UUID) ([]storedVersion, error) {
+	root := filepath.Join(l.basePath, userId.String(), VERSIONS_DIR)
+	exists, err := IsDirExists(root)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	// Histories of nested files are nested the same way, so the whole subtree
+	// is scanned. Only revisions have numeric names.
+	var versions []storedVersion
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		id, err := strconv.Atoi(d.Name())
+		if err != nil {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		versions = append(versions, storedVersion{
+			path:    path,
+			id:      id,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read versions directory %s: %w", root, err)
+	}
+
+	return versions, nil
+}
+
+// archiveVersion copies the current content of the file into its history and
+// drops revisions exceeding MAX_FILE_VERSIONS.
+func (l *LocalFileRepo) archiveVersion(userId uuid.UUID, filename string, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dir := getVersionsPath(l.basePath, userId, filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create versions directory %s: %w", dir, err)
+	}
+
+	versions, err := readVersions(dir)
+	if err != nil {
+		return err
+	}
+
+	id, err := nextVersionId(dir, versions)
+	if err != nil {
+		return err
+	}
+
+	versionPath := filepath.Join(dir, strconv.Itoa(id))
+	if err := writeFileAtomic(versionPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(versionPath, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+
+	for len(versions)+1 > MAX_FILE_VERSIONS {
+		if err := os.Remove(versions[0].path); err != nil {
+			return err
+		}
+		versions = versions[1:]
+	}
+
+	return nil
+}
+
+// nextVersionId returns the id of the next revision in dir and records it as
+// the last one. Histories without a marker continue after their newest
+// revision.
+func nextVersionId(dir string, versions []storedVersion) (int, error) {
+	last := 0
+	if len(versions) > 0 {
+		last = versions[len(versions)-1].id
+	}
+
+	markerPath := filepath.Join(dir, LAST_VERSION_MARKER)
+	data, err := os.ReadFile(markerPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if recorded, err := strconv.Atoi(string(data)); err == nil && recorded > last {
+		last = recorded
+	}
+
+	id := last + 1
+	if err := writeFileAtomic(markerPath, []byte(strconv.Itoa(id)), 0644); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// trimHistory evicts the oldest revisions of the user until live files and
+// history fit into spaceSize.
+func (l *LocalFileRepo) trimHistory(userId uuid.UUID, spaceSize int) error {
+	occupied, _, err := l.getUserLiveSpaceAndFileCount(userId, []string{})
+	if err != nil {
+		return err
+	}
+
+	versions, err := l.getUserVersions(userId)
+	if err != nil {
+		return err
+	}
+
+	total := int64(occupied)
+	for _, v := range versions {
+		total += v.size
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].modTime.Equal(versions[j].modTime) {
+			return versions[i].id < versions[j].id
+		}
+		return versions[i].modTime.Before(versions[j].modTime)
+	})
+
+	for _, v := range versions {
+		if total <= int64(spaceSize) {
+			break
+		}
+		if err := os.Remove(v.path); err != nil {
+			return err
+		}
+		total -= v.size
+	}
+
+	return nil
+}
+
+func (l *LocalFileRepo) renameVersions(userId uuid.UUID, filename string, newFilename string) error {
+	oldDir := getVersionsPath(l.basePath, userId, filename)
+	exists, err := IsFileExists(oldDir)
+	if err != nil || !exists {
+		return err
+	}
+
+	newDir := getVersionsPath(l.basePath, userId, newFilename)
+	if err := os.MkdirAll(filepath.Dir(newDir), 0755); err != nil {
+		return fmt.Errorf("failed to create versions directory: %w", err)
+	}
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return fmt.Errorf("failed to rename versions: %w", err)
+	}
+
+	return nil
+}
+
+func (l *LocalFileRepo) GetVersions(filename string, userId uuid.UUID) ([]FileVersion, error) {
+	path, err := getPath(l.basePath, userId, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, err := IsRegularFileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ex {
+		return nil, ErrFileNotFound
+	}
+
+	versions, err := readVersions(getVersionsPath(l.basePath, userId, filename))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]FileVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		result = append(result, FileVersion{
+			Id:         versions[i].id,
+			Size:       versions[i].size,
+			ModifiedAt: versions[i].modTime,
+		})
+	}
+
+	return result, nil
+}
+
+func (l *LocalFileRepo) GetVersion(filename string, userId uuid.UUID, versionId int) ([]byte, error) {
+	path, err := getPath(l.basePath, userId, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, err := IsRegularFileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ex {
+		return nil, ErrFileNotFound
+	}
+
+	versionPath := filepath.Join(getVersionsPath(l.basePath, userId, filename), strconv.Itoa(versionId))
+	bytes, err := os.ReadFile(versionPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrVersionNotFound
+		}
+
+		return nil, err
+	}
+
+	return bytes, nil
+}
+
+func (l *LocalFileRepo) RestoreVersion(filename string, userId uuid.UUID, versionId int) error {
+	data, err := l.GetVersion(filename, userId, versionId)
+	if err != nil {
+		return err
+	}
+
+	return l.Save(filename, userId, data)
+}
+
+// markCreated records the creation time of a new file.
+func (l *LocalFileRepo) markCreated(userId uuid.UUID, filename string) error {
+	dir := getVersionsPath(l.basePath, userId, filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create versions directory %s: %w", dir, err)
+	}
+
+	return writeFileAtomic(filepath.Join(dir, CREATED_MARKER), nil, 0644)
+}
+
+// getCreatedAt returns the creation time of the file, or modTime for files
+// created without a marker.
+func (l *LocalFileRepo) getCreatedAt(userId uuid.UUID, filename string, modTime time.Time) (time.Time, error) {
+	info, err := os.Stat(filepath.Join(getVersionsPath(l.basePath, userId, filename), CREATED_MARKER))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return modTime, nil
+		}
+
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
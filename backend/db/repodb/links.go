@@ -0,0 +1,144 @@
+package repodb
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Share links of a user's files are stored as <basePath>/.links/<ownerId>.json,
+// next to user roots.
+const LINKS_DIR = ".links"
+
+// LINK_TOKEN_RANDOM_BYTES is the unguessable part of a link token.
+const LINK_TOKEN_RANDOM_BYTES = 24
+
+var ErrShareLinkNotFound = errors.New("share link not found")
+
+// ShareLink gives anyone knowing Token read access to a file of Owner, until
+// ExpiresAt if it is set. PasswordHash is a bcrypt hash, empty if the link
+// isn't protected. Like shares, links follow renames of the file and are
+// dropped when it is deleted.
+type ShareLink struct {
+	Token          string     `json:"token"`
+	Owner          uuid.UUID  `json:"owner"`
+	Filename       string     `json:"filename"`
+	PasswordHash   string     `json:"passwordHash,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+	Accesses       int        `json:"accesses"`
+	LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+}
+
+// Expired reports whether the link can no longer be used at now.
+func (l *ShareLink) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
+
+// NewShareLinkToken returns a token for a new link to a file of owner. The
+// token starts with the owner id, so storages keeping links per owner find
+// them without an index.
+func NewShareLinkToken(owner uuid.UUID) (string, error) {
+	data := make([]byte, len(owner)+LINK_TOKEN_RANDOM_BYTES)
+	copy(data, owner[:])
+	if _, err := rand.Read(data[len(owner):]); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// shareLinkOwner returns the owner encoded in the token.
+func shareLinkOwner(token string) (uuid.UUID, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != len(uuid.UUID{})+LINK_TOKEN_RANDOM_BYTES {
+		return uuid.UUID{}, ErrShareLinkNotFound
+	}
+
+	return uuid.FromBytes(data[:len(uuid.UUID{})])
+}
+
+// sortLinks orders links by filename and creation time.
+func sortLinks(links []ShareLink) {
+	sort.Slice(links, func(i, j int) bool {
+		a, b := links[i], links[j]
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+// findLink returns the index of the link with the token, -1 if there is none.
+// Tokens are compared in constant time.
+func findLink(links []ShareLink, token string) int {
+	for i := range links {
+		if subtle.ConstantTimeCompare([]byte(links[i].Token), []byte(token)) == 1 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func removeLink(links []ShareLink, token string) ([]ShareLink, error) {
+	i := findLink(links, token)
+	if i < 0 {
+		return links, ErrShareLinkNotFound
+	}
+
+	return append(links[:i], links[i+1:]...), nil
+}
+
+func recordLinkAccess(links []ShareLink, token string, at time.Time) ([]ShareLink, error) {
+	i := findLink(links, token)
+	if i < 0 {
+		return links, ErrShareLinkNotFound
+	}
+	links[i].Accesses++
+	links[i].LastAccessedAt = &at
+
+	return links, nil
+}
+
+// moveLinks follows a rename of the file or folder path to newPath.
+func moveLinks(links []ShareLink, path string, newPath string, folder bool) []ShareLink {
+	for i := range links {
+		if inPath(links[i].Filename, path, folder) {
+			links[i].Filename = newPath + strings.TrimPrefix(links[i].Filename, path)
+		}
+	}
+
+	return links
+}
+
+// dropLinks removes links to the deleted file or folder path.
+func dropLinks(links []ShareLink, path string, folder bool) []ShareLink {
+	result := links[:0]
+	for _, l := range links {
+		if !inPath(l.Filename, path, folder) {
+			result = append(result, l)
+		}
+	}
+
+	return result
+}
+
+// filterLinks returns links to filename, all of them if it is empty.
+func filterLinks(links []ShareLink, filename string) []ShareLink {
+	result := []ShareLink{}
+	for _, l := range links {
+		if filename == "" || l.Filename == filename {
+			result = append(result, l)
+		}
+	}
+	sortLinks(result)
+
+	return result
+}
@@ -0,0 +1,62 @@
+package repodb
+
+import (
+	"slices"
+	"sync"
+)
+
+// keyedMutex hands out mutexes by key. Unused mutexes are dropped, so the map
+// only holds keys that are currently locked or waited for.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock locks all keys in a stable order, so callers locking overlapping key
+// sets can't deadlock. It returns a function that unlocks them.
+func (k *keyedMutex) Lock(keys ...string) func() {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	locks := make([]*keyedLock, len(keys))
+	k.mu.Lock()
+	for i, key := range keys {
+		lock, ok := k.locks[key]
+		if !ok {
+			lock = &keyedLock{}
+			k.locks[key] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	k.mu.Unlock()
+
+	for _, lock := range locks {
+		lock.mu.Lock()
+	}
+
+	return func() {
+		for _, lock := range locks {
+			lock.mu.Unlock()
+		}
+
+		k.mu.Lock()
+		for i, key := range keys {
+			locks[i].refs--
+			if locks[i].refs == 0 {
+				delete(k.locks, key)
+			}
+		}
+		k.mu.Unlock()
+	}
+}
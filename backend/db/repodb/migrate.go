@@ -0,0 +1,68 @@
+package repodb
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// Any constant works, it only has to differ from other advisory locks.
+const migrationLockId = 7412903
+
+// Migrate applies migrations/*.sql that are not applied yet, in name order.
+// All of them run in one transaction under an advisory lock, so several
+// backend replicas may start at the same time.
+func Migrate(ctx context.Context, db *pgxpool.Pool) error {
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockId); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS storage_schema_migrations (
+			name TEXT PRIMARY KEY,
+			applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		)`)
+		if err != nil {
+			return fmt.Errorf("failed to create migrations table: %w", err)
+		}
+
+		for _, name := range names {
+			var applied bool
+			err := tx.QueryRow(ctx,
+				"SELECT EXISTS(SELECT 1 FROM storage_schema_migrations WHERE name=$1)", name).Scan(&applied)
+			if err != nil {
+				return err
+			}
+			if applied {
+				continue
+			}
+
+			script, err := migrations.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, string(script)); err != nil {
+				return fmt.Errorf("failed to apply migration %s: %w", name, err)
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO storage_schema_migrations (name) VALUES ($1)", name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS folders (
+    user_id UUID NOT NULL,
+    path TEXT NOT NULL,
+    PRIMARY KEY (user_id, path)
+);
+
+CREATE TABLE IF NOT EXISTS files (
+    user_id UUID NOT NULL,
+    path TEXT NOT NULL,
+    content BYTEA NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, path)
+);
+
+-- Revisions follow renames and are removed together with the file.
+CREATE TABLE IF NOT EXISTS file_versions (
+    user_id UUID NOT NULL,
+    path TEXT NOT NULL,
+    id INTEGER NOT NULL,
+    content BYTEA NOT NULL,
+    size BIGINT NOT NULL,
+    modified_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, path, id),
+    FOREIGN KEY (user_id, path) REFERENCES files (user_id, path)
+        ON UPDATE CASCADE ON DELETE CASCADE
+);
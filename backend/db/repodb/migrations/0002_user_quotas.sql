@@ -0,0 +1,7 @@
+-- Per-user quota overrides, limits of 0 mean the limits of the plan.
+CREATE TABLE IF NOT EXISTS user_quotas (
+    user_id UUID PRIMARY KEY,
+    plan TEXT NOT NULL DEFAULT '',
+    space_size BIGINT NOT NULL DEFAULT 0,
+    max_files INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,12 @@
+-- Deleted files, kept until they are restored or purged. History is not kept.
+CREATE TABLE IF NOT EXISTS trash (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    path TEXT NOT NULL,
+    content BYTEA NOT NULL,
+    size BIGINT NOT NULL,
+    deleted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS trash_user_id_idx ON trash (user_id);
+CREATE INDEX IF NOT EXISTS trash_deleted_at_idx ON trash (deleted_at);
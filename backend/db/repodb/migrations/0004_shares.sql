@@ -0,0 +1,13 @@
+-- Shares follow renames of the file and are removed together with it.
+CREATE TABLE IF NOT EXISTS shares (
+    owner_id UUID NOT NULL,
+    path TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    role TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (owner_id, path, user_id),
+    FOREIGN KEY (owner_id, path) REFERENCES files (user_id, path)
+        ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS shares_user_id_idx ON shares (user_id);
@@ -0,0 +1,16 @@
+-- Like shares, links follow renames of the file and are removed together
+-- with it.
+CREATE TABLE IF NOT EXISTS share_links (
+    token TEXT PRIMARY KEY,
+    owner_id UUID NOT NULL,
+    path TEXT NOT NULL,
+    password_hash TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    accesses INTEGER NOT NULL DEFAULT 0,
+    last_accessed_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (owner_id, path) REFERENCES files (user_id, path)
+        ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS share_links_owner_id_idx ON share_links (owner_id, path);
@@ -0,0 +1,11 @@
+-- Attachments referenced from documents, identified by a hash of the content.
+CREATE TABLE IF NOT EXISTS attachments (
+    owner_id UUID NOT NULL,
+    id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    content BYTEA NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (owner_id, id)
+);
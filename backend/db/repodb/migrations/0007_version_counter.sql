@@ -0,0 +1,7 @@
+-- Id of the last revision of a file. Revisions take their ids from it, so
+-- ids aren't reused after revisions are evicted.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS last_version_id INTEGER NOT NULL DEFAULT 0;
+
+UPDATE files f SET last_version_id = v.max_id
+FROM (SELECT user_id, path, MAX(id) AS max_id FROM file_versions GROUP BY user_id, path) v
+WHERE f.user_id = v.user_id AND f.path = v.path;
@@ -0,0 +1,1148 @@
+package repodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PgFileRepo stores files, folders and revisions in PostgreSQL. Writes of a
+// user are serialized by a transaction scoped advisory lock, which makes
+// conditional writes and quota checks atomic across backend replicas.
+type PgFileRepo struct {
+	db *pgxpool.Pool
+}
+
+func NewPgFileRepo(db *pgxpool.Pool) (*PgFileRepo, error) {
+	if err := Migrate(context.Background(), db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &PgFileRepo{db: db}, nil
+}
+
+func (p *PgFileRepo) withUserTx(userId uuid.UUID, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	ctx := context.Background()
+	return pgx.BeginFunc(ctx, p.db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", userId.String())
+		if err != nil {
+			return err
+		}
+
+		return fn(ctx, tx)
+	})
+}
+
+// parentFolder returns the folder containing the path, "" for the user root.
+func parentFolder(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+
+	return dir
+}
+
+func pgCheckNotExists(ctx context.Context, tx pgx.Tx, userId uuid.UUID, p string) error {
+	var isFile, isFolder bool
+	err := tx.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM files WHERE user_id=$1 AND path=$2),
+		        EXISTS(SELECT 1 FROM folders WHERE user_id=$1 AND path=$2)`,
+		userId, p).Scan(&isFile, &isFolder)
+	if err != nil {
+		return err
+	}
+	if isFolder {
+		return ErrFolderExists
+	}
+	if isFile {
+		return ErrFileExists
+	}
+
+	return nil
+}
+
+func pgFolderExists(ctx context.Context, tx pgx.Tx, userId uuid.UUID, folder string) (bool, error) {
+	if folder == "" {
+		return true, nil
+	}
+
+	var exists bool
+	err := tx.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM folders WHERE user_id=$1 AND path=$2)", userId, folder).Scan(&exists)
+
+	return exists, err
+}
+
+func pgCheckParentExists(ctx context.Context, tx pgx.Tx, userId uuid.UUID, p string) error {
+	exists, err := pgFolderExists(ctx, tx, userId, parentFolder(p))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+
+	return nil
+}
+
+// pgLockFile returns the file content and locks its row until the end of tx.
+func pgLockFile(ctx context.Context, tx pgx.Tx, userId uuid.UUID, filename string) ([]byte, error) {
+	var content []byte
+	err := tx.QueryRow(ctx,
+		"SELECT content FROM files WHERE user_id=$1 AND path=$2 FOR UPDATE", userId, filename).Scan(&content)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrFileNotFound
+		}
+
+		return nil, err
+	}
+
+	return content, nil
+}
+
+// pgLiveSpaceAndFileCount returns the space used by live files (except
+// excludedFiles) and attachments, and the number of live files.
+func pgLiveSpaceAndFileCount(ctx context.Context, q pgx.Tx, userId uuid.UUID, excludedFiles []string) (int, int, error) {
+	var occupied int64
+	var cnt int
+	err := q.QueryRow(ctx,
+		`SELECT (SELECT COALESCE(SUM(size), 0) FROM files WHERE user_id=$1 AND NOT (path = ANY($2))) +
+		        (SELECT COALESCE(SUM(size), 0) FROM attachments WHERE owner_id=$1),
+		        (SELECT COUNT(*) FROM files WHERE user_id=$1 AND NOT (path = ANY($2)))`,
+		userId, excludedFiles).Scan(&occupied, &cnt)
+
+	return int(occupied), cnt, err
+}
+
+// pgArchiveVersion copies the current content of the file into its history
+// and drops revisions exceeding MAX_FILE_VERSIONS. Ids come from the counter
+// of the file, so they aren't reused after revisions are evicted.
+func pgArchiveVersion(ctx context.Context, tx pgx.Tx, userId uuid.UUID, filename string) error {
+	var id int
+	err := tx.QueryRow(ctx,
+		`UPDATE files SET last_version_id = last_version_id + 1
+		 WHERE user_id=$1 AND path=$2 RETURNING last_version_id`,
+		userId, filename).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to archive version: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO file_versions (user_id, path, id, content, size, modified_at)
+		 SELECT user_id, path, $3, content, size, modified_at
+		 FROM files WHERE user_id=$1 AND path=$2`,
+		userId, filename, id)
+	if err != nil {
+		return fmt.Errorf("failed to archive version: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		"DELETE FROM file_versions WHERE user_id=$1 AND path=$2 AND id <= $3",
+		userId, filename, id-MAX_FILE_VERSIONS)
+
+	return err
+}
+
+// pgTrimHistory evicts the oldest revisions of the user until live files and
+// history fit into spaceSize.
+func pgTrimHistory(ctx context.Context, tx pgx.Tx, userId uuid.UUID, spaceSize int) error {
+	var total int64
+	err := tx.QueryRow(ctx,
+		`SELECT (SELECT COALESCE(SUM(size), 0) FROM files WHERE user_id=$1) +
+		        (SELECT COALESCE(SUM(size), 0) FROM attachments WHERE owner_id=$1) +
+		        (SELECT COALESCE(SUM(size), 0) FROM file_versions WHERE user_id=$1)`,
+		userId).Scan(&total)
+	if err != nil {
+		return err
+	}
+	if total <= int64(spaceSize) {
+		return nil
+	}
+
+	rows, err := tx.Query(ctx,
+		"SELECT path, id, size FROM file_versions WHERE user_id=$1 ORDER BY modified_at, id", userId)
+	if err != nil {
+		return err
+	}
+
+	type versionKey struct {
+		path string
+		id   int
+	}
+	var evicted []versionKey
+	for rows.Next() && total > int64(spaceSize) {
+		var key versionKey
+		var size int64
+		if err := rows.Scan(&key.path, &key.id, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		evicted = append(evicted, key)
+		total -= size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range evicted {
+		_, err := tx.Exec(ctx,
+			"DELETE FROM file_versions WHERE user_id=$1 AND path=$2 AND id=$3", userId, key.path, key.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pgTrashFiles moves files matching cond into the trash, their history is
+// removed through ON DELETE CASCADE.
+func pgTrashFiles(ctx context.Context, tx pgx.Tx, cond string, args ...any) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO trash (id, user_id, path, content, size)
+		 SELECT gen_random_uuid(), user_id, path, content, size FROM files WHERE `+cond, args...)
+	if err != nil {
+		return fmt.Errorf("failed to move files to trash: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM files WHERE "+cond, args...)
+
+	return err
+}
+
+func (p *PgFileRepo) Save(filename string, userId uuid.UUID, data []byte) error {
+	return p.SaveIfMatch(filename, userId, data, nil)
+}
+
+func (p *PgFileRepo) SaveIfMatch(filename string, userId uuid.UUID, data []byte, ifMatch []string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		current, err := pgLockFile(ctx, tx, userId, filename)
+		if err != nil {
+			return err
+		}
+		if err := matchETag(current, ifMatch); err != nil {
+			return err
+		}
+
+		quota, err := pgGetQuota(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		occupied, _, err := pgLiveSpaceAndFileCount(ctx, tx, userId, []string{filename})
+		if err != nil {
+			return err
+		}
+		if err := checkQuota(quota, occupied+len(data), 0); err != nil {
+			return err
+		}
+
+		if err := pgArchiveVersion(ctx, tx, userId, filename); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			"UPDATE files SET content=$3, size=$4, modified_at=NOW() WHERE user_id=$1 AND path=$2",
+			userId, filename, data, len(data))
+		if err != nil {
+			return err
+		}
+
+		return pgTrimHistory(ctx, tx, userId, quota.SpaceSize)
+	})
+}
+
+func (p *PgFileRepo) Create(filename string, userId uuid.UUID, data []byte) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		if err := pgCheckNotExists(ctx, tx, userId, filename); err != nil {
+			if errors.Is(err, ErrFolderExists) {
+				return ErrFileExists
+			}
+			return err
+		}
+		if err := pgCheckParentExists(ctx, tx, userId, filename); err != nil {
+			return err
+		}
+
+		quota, err := pgGetQuota(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		occupied, cnt, err := pgLiveSpaceAndFileCount(ctx, tx, userId, []string{})
+		if err != nil {
+			return err
+		}
+		if err := checkQuota(quota, occupied+len(data), cnt+1); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx,
+			"INSERT INTO files (user_id, path, content, size) VALUES ($1, $2, $3, $4)",
+			userId, filename, data, len(data))
+		if err != nil {
+			return err
+		}
+
+		return pgTrimHistory(ctx, tx, userId, quota.SpaceSize)
+	})
+}
+
+func (p *PgFileRepo) Get(filename string, userId uuid.UUID) ([]byte, error) {
+	if err := validateFile(filename); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err := p.db.QueryRow(context.Background(),
+		"SELECT content FROM files WHERE user_id=$1 AND path=$2", userId, filename).Scan(&content)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrFileNotFound
+		}
+
+		return nil, err
+	}
+
+	return content, nil
+}
+
+func (p *PgFileRepo) Delete(filename string, userId uuid.UUID) error {
+	return p.DeleteIfMatch(filename, userId, nil)
+}
+
+func (p *PgFileRepo) DeleteIfMatch(filename string, userId uuid.UUID, ifMatch []string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		current, err := pgLockFile(ctx, tx, userId, filename)
+		if err != nil {
+			return err
+		}
+		if err := matchETag(current, ifMatch); err != nil {
+			return err
+		}
+
+		return pgTrashFiles(ctx, tx, "user_id=$1 AND path=$2", userId, filename)
+	})
+}
+
+func (p *PgFileRepo) GetList(userId uuid.UUID) ([]string, error) {
+	rows, err := p.db.Query(context.Background(),
+		"SELECT path FROM files WHERE user_id=$1 ORDER BY path", userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file list: %w", err)
+	}
+
+	fileNames, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file list: %w", err)
+	}
+	if fileNames == nil {
+		fileNames = []string{}
+	}
+
+	return fileNames, nil
+}
+
+func (p *PgFileRepo) GetFileInfos(userId uuid.UUID) ([]FileInfo, error) {
+	rows, err := p.db.Query(context.Background(),
+		"SELECT path, content, created_at, modified_at FROM files WHERE user_id=$1 ORDER BY path", userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file list: %w", err)
+	}
+	defer rows.Close()
+
+	infos := []FileInfo{}
+	for rows.Next() {
+		var filename string
+		var content []byte
+		var createdAt, modifiedAt time.Time
+		if err := rows.Scan(&filename, &content, &createdAt, &modifiedAt); err != nil {
+			return nil, err
+		}
+		infos = append(infos, newFileInfo(filename, content, createdAt, modifiedAt))
+	}
+
+	return infos, rows.Err()
+}
+
+func (p *PgFileRepo) Rename(filename string, newFilename string, userId uuid.UUID) error {
+	return p.RenameIfMatch(filename, newFilename, userId, nil)
+}
+
+func (p *PgFileRepo) RenameIfMatch(filename string, newFilename string, userId uuid.UUID, ifMatch []string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+	if err := validateFile(newFilename); err != nil {
+		return err
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		current, err := pgLockFile(ctx, tx, userId, filename)
+		if err != nil {
+			return err
+		}
+		if err := matchETag(current, ifMatch); err != nil {
+			return err
+		}
+
+		if err := pgCheckNotExists(ctx, tx, userId, newFilename); err != nil {
+			if errors.Is(err, ErrFolderExists) {
+				return ErrFileExists
+			}
+			return err
+		}
+		if err := pgCheckParentExists(ctx, tx, userId, newFilename); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx,
+			"UPDATE files SET path=$3 WHERE user_id=$1 AND path=$2", userId, filename, newFilename)
+		if err != nil {
+			return fmt.Errorf("failed to rename file: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func (p *PgFileRepo) GetUserOccupiedSpaceAndFileCount(userId uuid.UUID, excludedFiles []string) (int, int, error) {
+	if excludedFiles == nil {
+		// A nil slice is sent as NULL, which would exclude every file.
+		excludedFiles = []string{}
+	}
+
+	var occupied int64
+	var cnt int
+	err := p.db.QueryRow(context.Background(),
+		`SELECT (SELECT COALESCE(SUM(size), 0) FROM files WHERE user_id=$1 AND NOT (path = ANY($2))) +
+		        (SELECT COALESCE(SUM(size), 0) FROM attachments WHERE owner_id=$1),
+		        (SELECT COUNT(*) FROM files WHERE user_id=$1 AND NOT (path = ANY($2)))`,
+		userId, excludedFiles).Scan(&occupied, &cnt)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return int(occupied), cnt, nil
+}
+
+func (p *PgFileRepo) GetUserHistorySize(userId uuid.UUID) (int, error) {
+	var size int64
+	err := p.db.QueryRow(context.Background(),
+		`SELECT COALESCE(SUM(size), 0) FROM file_versions WHERE user_id=$1`, userId).Scan(&size)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(size), nil
+}
+
+// pgQuerier is implemented by both the pool and transactions.
+type pgQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func pgGetQuotaOverride(ctx context.Context, q pgQuerier, userId uuid.UUID) (*QuotaOverride, error) {
+	var override QuotaOverride
+	err := q.QueryRow(ctx,
+		"SELECT plan, space_size, max_files FROM user_quotas WHERE user_id=$1", userId).
+		Scan(&override.Plan, &override.SpaceSize, &override.MaxFiles)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return &override, nil
+}
+
+func pgGetQuota(ctx context.Context, q pgQuerier, userId uuid.UUID) (Quota, error) {
+	override, err := pgGetQuotaOverride(ctx, q, userId)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	return resolveQuota(override), nil
+}
+
+func (p *PgFileRepo) GetQuota(userId uuid.UUID) (Quota, error) {
+	return pgGetQuota(context.Background(), p.db, userId)
+}
+
+func (p *PgFileRepo) GetQuotaOverride(userId uuid.UUID) (*QuotaOverride, error) {
+	return pgGetQuotaOverride(context.Background(), p.db, userId)
+}
+
+func (p *PgFileRepo) SetQuotaOverride(userId uuid.UUID, override *QuotaOverride) error {
+	ctx := context.Background()
+	if override == nil {
+		_, err := p.db.Exec(ctx, "DELETE FROM user_quotas WHERE user_id=$1", userId)
+		return err
+	}
+
+	if err := validateQuotaOverride(override); err != nil {
+		return err
+	}
+	_, err := p.db.Exec(ctx,
+		`INSERT INTO user_quotas (user_id, plan, space_size, max_files) VALUES ($1, $2, $3, $4)
+		 ON CONFLICT (user_id) DO UPDATE
+		 SET plan = EXCLUDED.plan, space_size = EXCLUDED.space_size, max_files = EXCLUDED.max_files`,
+		userId, override.Plan, override.SpaceSize, override.MaxFiles)
+
+	return err
+}
+
+func (p *PgFileRepo) ShareFile(filename string, owner uuid.UUID, userId uuid.UUID, role string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+	if err := validateShare(owner, userId, role); err != nil {
+		return err
+	}
+
+	return p.withUserTx(owner, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := pgLockFile(ctx, tx, owner, filename); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx,
+			`INSERT INTO shares (owner_id, path, user_id, role) VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (owner_id, path, user_id) DO UPDATE SET role = EXCLUDED.role`,
+			owner, filename, userId, role)
+
+		return err
+	})
+}
+
+func (p *PgFileRepo) UnshareFile(filename string, owner uuid.UUID, userId uuid.UUID) error {
+	tag, err := p.db.Exec(context.Background(),
+		"DELETE FROM shares WHERE owner_id=$1 AND path=$2 AND user_id=$3", owner, filename, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrShareNotFound
+	}
+
+	return nil
+}
+
+func (p *PgFileRepo) queryShares(ctx context.Context, cond string, args ...any) ([]Share, error) {
+	rows, err := p.db.Query(ctx,
+		"SELECT owner_id, path, user_id, role, created_at FROM shares WHERE "+cond+
+			" ORDER BY owner_id::text, path, created_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []Share{}
+	for rows.Next() {
+		var s Share
+		if err := rows.Scan(&s.Owner, &s.Filename, &s.UserId, &s.Role, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		shares = append(shares, s)
+	}
+
+	return shares, rows.Err()
+}
+
+func (p *PgFileRepo) GetShares(owner uuid.UUID, filename string) ([]Share, error) {
+	ctx := context.Background()
+	if filename == "" {
+		return p.queryShares(ctx, "owner_id=$1", owner)
+	}
+
+	return p.queryShares(ctx, "owner_id=$1 AND path=$2", owner, filename)
+}
+
+func (p *PgFileRepo) GetSharedWith(userId uuid.UUID) ([]Share, error) {
+	return p.queryShares(context.Background(), "user_id=$1", userId)
+}
+
+func (p *PgFileRepo) CreateShareLink(link ShareLink) error {
+	if err := validateFile(link.Filename); err != nil {
+		return err
+	}
+
+	return p.withUserTx(link.Owner, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := pgLockFile(ctx, tx, link.Owner, link.Filename); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx,
+			`INSERT INTO share_links (token, owner_id, path, password_hash, created_at, expires_at)
+			 VALUES ($1, $2, $3, $4, $5, $6)`,
+			link.Token, link.Owner, link.Filename, link.PasswordHash, link.CreatedAt, link.ExpiresAt)
+
+		return err
+	})
+}
+
+func (p *PgFileRepo) queryLinks(ctx context.Context, cond string, args ...any) ([]ShareLink, error) {
+	rows, err := p.db.Query(ctx,
+		`SELECT token, owner_id, path, password_hash, created_at, expires_at, accesses, last_accessed_at
+		 FROM share_links WHERE `+cond+" ORDER BY path, created_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		var l ShareLink
+		if err := rows.Scan(&l.Token, &l.Owner, &l.Filename, &l.PasswordHash, &l.CreatedAt,
+			&l.ExpiresAt, &l.Accesses, &l.LastAccessedAt); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+
+	return links, rows.Err()
+}
+
+func (p *PgFileRepo) GetShareLink(token string) (ShareLink, error) {
+	links, err := p.queryLinks(context.Background(), "token=$1", token)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	if len(links) == 0 {
+		return ShareLink{}, ErrShareLinkNotFound
+	}
+
+	return links[0], nil
+}
+
+func (p *PgFileRepo) GetShareLinks(owner uuid.UUID, filename string) ([]ShareLink, error) {
+	ctx := context.Background()
+	if filename == "" {
+		return p.queryLinks(ctx, "owner_id=$1", owner)
+	}
+
+	return p.queryLinks(ctx, "owner_id=$1 AND path=$2", owner, filename)
+}
+
+func (p *PgFileRepo) DeleteShareLink(owner uuid.UUID, token string) error {
+	tag, err := p.db.Exec(context.Background(),
+		"DELETE FROM share_links WHERE owner_id=$1 AND token=$2", owner, token)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrShareLinkNotFound
+	}
+
+	return nil
+}
+
+func (p *PgFileRepo) RecordShareLinkAccess(token string, at time.Time) error {
+	tag, err := p.db.Exec(context.Background(),
+		"UPDATE share_links SET accesses = accesses + 1, last_accessed_at = $2 WHERE token=$1", token, at)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrShareLinkNotFound
+	}
+
+	return nil
+}
+
+func (p *PgFileRepo) GetTree(userId uuid.UUID) ([]FileTreeNode, error) {
+	ctx := context.Background()
+
+	rows, err := p.db.Query(ctx, "SELECT path FROM folders WHERE user_id=$1", userId)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := p.GetList(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildTree(folders, files), nil
+}
+
+func (p *PgFileRepo) CreateFolder(folder string, userId uuid.UUID) error {
+	if err := validateFolder(folder); err != nil {
+		return err
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		if err := pgCheckNotExists(ctx, tx, userId, folder); err != nil {
+			return err
+		}
+		if err := pgCheckParentExists(ctx, tx, userId, folder); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, "INSERT INTO folders (user_id, path) VALUES ($1, $2)", userId, folder)
+
+		return err
+	})
+}
+
+func (p *PgFileRepo) RenameFolder(folder string, newFolder string, userId uuid.UUID) error {
+	if err := validateFolder(folder); err != nil {
+		return err
+	}
+	if err := validateFolder(newFolder); err != nil {
+		return err
+	}
+	if newFolder == folder || strings.HasPrefix(newFolder, folder+"/") {
+		return ErrMoveIntoItself
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		exists, err := pgFolderExists(ctx, tx, userId, folder)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrFolderNotFound
+		}
+		if err := pgCheckNotExists(ctx, tx, userId, newFolder); err != nil {
+			return err
+		}
+		if err := pgCheckParentExists(ctx, tx, userId, newFolder); err != nil {
+			return err
+		}
+
+		// Revisions follow the files through ON UPDATE CASCADE.
+		for _, table := range []string{"folders", "files"} {
+			_, err := tx.Exec(ctx,
+				`UPDATE `+table+` SET path = $3::text || substr(path, length($2::text) + 1)
+				 WHERE user_id=$1 AND (path = $2 OR starts_with(path, $2::text || '/'))`,
+				userId, folder, newFolder)
+			if err != nil {
+				return fmt.Errorf("failed to rename folder: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (p *PgFileRepo) DeleteFolder(folder string, userId uuid.UUID, recursive bool) error {
+	if err := validateFolder(folder); err != nil {
+		return err
+	}
+
+	return p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		exists, err := pgFolderExists(ctx, tx, userId, folder)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrFolderNotFound
+		}
+
+		if !recursive {
+			var notEmpty bool
+			err := tx.QueryRow(ctx,
+				`SELECT EXISTS(SELECT 1 FROM files WHERE user_id=$1 AND starts_with(path, $2::text || '/'))
+				     OR EXISTS(SELECT 1 FROM folders WHERE user_id=$1 AND starts_with(path, $2::text || '/'))`,
+				userId, folder).Scan(&notEmpty)
+			if err != nil {
+				return err
+			}
+			if notEmpty {
+				return ErrFolderNotEmpty
+			}
+		}
+
+		err = pgTrashFiles(ctx, tx, "user_id=$1 AND starts_with(path, $2::text || '/')", userId, folder)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx,
+			"DELETE FROM folders WHERE user_id=$1 AND (path = $2 OR starts_with(path, $2::text || '/'))", userId, folder)
+
+		return err
+	})
+}
+
+func (p *PgFileRepo) fileExists(ctx context.Context, userId uuid.UUID, filename string) error {
+	var exists bool
+	err := p.db.QueryRow(ctx,
+		"SELECT EXISTS(SELECT 1 FROM files WHERE user_id=$1 AND path=$2)", userId, filename).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFileNotFound
+	}
+
+	return nil
+}
+
+func (p *PgFileRepo) GetVersions(filename string, userId uuid.UUID) ([]FileVersion, error) {
+	if err := validateFile(filename); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err := p.fileExists(ctx, userId, filename); err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.Query(ctx,
+		`SELECT id, size, modified_at FROM file_versions
+		 WHERE user_id=$1 AND path=$2 ORDER BY id DESC`,
+		userId, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (FileVersion, error) {
+		var v FileVersion
+		err := row.Scan(&v.Id, &v.Size, &v.ModifiedAt)
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		versions = []FileVersion{}
+	}
+
+	return versions, nil
+}
+
+func (p *PgFileRepo) GetVersion(filename string, userId uuid.UUID, versionId int) ([]byte, error) {
+	if err := validateFile(filename); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if err := p.fileExists(ctx, userId, filename); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err := p.db.QueryRow(ctx,
+		"SELECT content FROM file_versions WHERE user_id=$1 AND path=$2 AND id=$3",
+		userId, filename, versionId).Scan(&content)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrVersionNotFound
+		}
+
+		return nil, err
+	}
+
+	return content, nil
+}
+
+func (p *PgFileRepo) RestoreVersion(filename string, userId uuid.UUID, versionId int) error {
+	data, err := p.GetVersion(filename, userId, versionId)
+	if err != nil {
+		return err
+	}
+
+	return p.Save(filename, userId, data)
+}
+
+func (p *PgFileRepo) ListTrash(userId uuid.UUID) ([]TrashItem, error) {
+	rows, err := p.db.Query(context.Background(),
+		"SELECT id, path, size, deleted_at FROM trash WHERE user_id=$1 ORDER BY deleted_at DESC, path", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []TrashItem{}
+	for rows.Next() {
+		var id uuid.UUID
+		var item TrashItem
+		if err := rows.Scan(&id, &item.Filename, &item.Size, &item.DeletedAt); err != nil {
+			return nil, err
+		}
+		item.Id = id.String()
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (p *PgFileRepo) RestoreFromTrash(id string, userId uuid.UUID, autoRename bool) (string, error) {
+	if err := validateTrashId(id); err != nil {
+		return "", err
+	}
+
+	var filename string
+	err := p.withUserTx(userId, func(ctx context.Context, tx pgx.Tx) error {
+		var path string
+		var content []byte
+		err := tx.QueryRow(ctx,
+			"SELECT path, content FROM trash WHERE id=$1 AND user_id=$2 FOR UPDATE", id, userId).
+			Scan(&path, &content)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrTrashItemNotFound
+			}
+
+			return err
+		}
+
+		quota, err := pgGetQuota(ctx, tx, userId)
+		if err != nil {
+			return err
+		}
+		occupied, cnt, err := pgLiveSpaceAndFileCount(ctx, tx, userId, []string{})
+		if err != nil {
+			return err
+		}
+		if err := checkQuota(quota, occupied+len(content), cnt+1); err != nil {
+			return err
+		}
+
+		filename, err = pickRestoreName(path, autoRename, func(name string) (bool, error) {
+			err := pgCheckNotExists(ctx, tx, userId, name)
+			if errors.Is(err, ErrFileExists) || errors.Is(err, ErrFolderExists) {
+				return true, nil
+			}
+			return false, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, folder := range parentFolders(filename) {
+			_, err := tx.Exec(ctx,
+				"INSERT INTO folders (user_id, path) VALUES ($1, $2) ON CONFLICT DO NOTHING", userId, folder)
+			if err != nil {
+				return fmt.Errorf("failed to create folder: %w", err)
+			}
+		}
+		_, err = tx.Exec(ctx,
+			"INSERT INTO files (user_id, path, content, size) VALUES ($1, $2, $3, $4)",
+			userId, filename, content, len(content))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM trash WHERE id=$1", id); err != nil {
+			return err
+		}
+
+		return pgTrimHistory(ctx, tx, userId, quota.SpaceSize)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return filename, nil
+}
+
+func (p *PgFileRepo) GetTrashContent(id string, userId uuid.UUID) ([]byte, error) {
+	if err := validateTrashId(id); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err := p.db.QueryRow(context.Background(),
+		"SELECT content FROM trash WHERE id=$1 AND user_id=$2", id, userId).Scan(&content)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrTrashItemNotFound
+		}
+
+		return nil, err
+	}
+
+	return content, nil
+}
+
+func (p *PgFileRepo) DeleteFromTrash(id string, userId uuid.UUID) error {
+	if err := validateTrashId(id); err != nil {
+		return err
+	}
+
+	tag, err := p.db.Exec(context.Background(), "DELETE FROM trash WHERE id=$1 AND user_id=$2", id, userId)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTrashItemNotFound
+	}
+
+	return nil
+}
+
+func (p *PgFileRepo) EmptyTrash(userId uuid.UUID) error {
+	_, err := p.db.Exec(context.Background(), "DELETE FROM trash WHERE user_id=$1", userId)
+	return err
+}
+
+func (p *PgFileRepo) PurgeTrash(before time.Time) (int, error) {
+	tag, err := p.db.Exec(context.Background(), "DELETE FROM trash WHERE deleted_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (p *PgFileRepo) CreateAttachment(attachment Attachment, data []byte) error {
+	if err := validateAttachmentId(attachment.Id); err != nil {
+		return err
+	}
+
+	return p.withUserTx(attachment.Owner, func(ctx context.Context, tx pgx.Tx) error {
+		var exists bool
+		err := tx.QueryRow(ctx,
+			"SELECT EXISTS(SELECT 1 FROM attachments WHERE owner_id=$1 AND id=$2)",
+			attachment.Owner, attachment.Id).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+
+		quota, err := pgGetQuota(ctx, tx, attachment.Owner)
+		if err != nil {
+			return err
+		}
+		occupied, _, err := pgLiveSpaceAndFileCount(ctx, tx, attachment.Owner, []string{})
+		if err != nil {
+			return err
+		}
+		if err := checkQuota(quota, occupied+len(data), 0); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx,
+			`INSERT INTO attachments (owner_id, id, name, content_type, content, size, created_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			attachment.Owner, attachment.Id, attachment.Name, attachment.ContentType, data, len(data),
+			attachment.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		return pgTrimHistory(ctx, tx, attachment.Owner, quota.SpaceSize)
+	})
+}
+
+func (p *PgFileRepo) GetAttachment(owner uuid.UUID, id string) (Attachment, []byte, error) {
+	if err := validateAttachmentId(id); err != nil {
+		return Attachment{}, nil, err
+	}
+
+	a := Attachment{Id: id, Owner: owner}
+	var content []byte
+	err := p.db.QueryRow(context.Background(),
+		"SELECT name, content_type, content, size, created_at FROM attachments WHERE owner_id=$1 AND id=$2",
+		owner, id).Scan(&a.Name, &a.ContentType, &content, &a.Size, &a.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Attachment{}, nil, ErrAttachmentNotFound
+		}
+
+		return Attachment{}, nil, err
+	}
+
+	return a, content, nil
+}
+
+func (p *PgFileRepo) GetAttachments(owner uuid.UUID) ([]Attachment, error) {
+	rows, err := p.db.Query(context.Background(),
+		`SELECT id, name, content_type, size, created_at FROM attachments
+		 WHERE owner_id=$1 ORDER BY created_at DESC, id`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		a := Attachment{Owner: owner}
+		if err := rows.Scan(&a.Id, &a.Name, &a.ContentType, &a.Size, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+
+	return attachments, rows.Err()
+}
+
+func (p *PgFileRepo) DeleteAttachment(owner uuid.UUID, id string) error {
+	if err := validateAttachmentId(id); err != nil {
+		return err
+	}
+
+	tag, err := p.db.Exec(context.Background(),
+		"DELETE FROM attachments WHERE owner_id=$1 AND id=$2", owner, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAttachmentNotFound
+	}
+
+	return nil
+}
+
+func (p *PgFileRepo) GetAttachmentOwners() ([]uuid.UUID, error) {
+	rows, err := p.db.Query(context.Background(), "SELECT DISTINCT owner_id FROM attachments")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := []uuid.UUID{}
+	for rows.Next() {
+		var owner uuid.UUID
+		if err := rows.Scan(&owner); err != nil {
+			return nil, err
+		}
+		owners = append(owners, owner)
+	}
+
+	return owners, rows.Err()
+}
+
+func (p *PgFileRepo) GetUsers() ([]uuid.UUID, error) {
+	rows, err := p.db.Query(context.Background(),
+		"SELECT user_id FROM files UNION SELECT user_id FROM folders")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []uuid.UUID{}
+	for rows.Next() {
+		var userId uuid.UUID
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		users = append(users, userId)
+	}
+
+	return users, rows.Err()
+}
@@ -0,0 +1,136 @@
+package repodb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_PLAN applies to users without a quota override.
+const DEFAULT_PLAN = "free"
+
+var ErrPlanNotFound = errors.New("quota plan not found")
+var ErrInvalidQuota = errors.New("quota limits must not be negative")
+
+// Quota limits the storage of a user, see USER_SPACE_SIZE for the accounting
+// rules.
+type Quota struct {
+	Plan      string `json:"plan"`
+	SpaceSize int    `json:"spaceSize"`
+	MaxFiles  int    `json:"maxFiles"`
+}
+
+// QuotaOverride is stored per user. Plan selects one of Plans instead of
+// DEFAULT_PLAN, non-zero limits replace the limits of the plan.
+type QuotaOverride struct {
+	Plan      string `json:"plan,omitempty"`
+	SpaceSize int    `json:"spaceSize,omitempty"`
+	MaxFiles  int    `json:"maxFiles,omitempty"`
+}
+
+// QuotaError is returned when a write doesn't fit into the quota of the user.
+// It wraps ErrUserSpaceIsFull or ErrFileNumberLimitReached.
+type QuotaError struct {
+	Err   error
+	Quota Quota
+}
+
+func (e *QuotaError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *QuotaError) Unwrap() error {
+	return e.Err
+}
+
+// Plans maps plan names to their limits. It is set once at startup, see
+// ParsePlans.
+var Plans = map[string]Quota{
+	DEFAULT_PLAN: {Plan: DEFAULT_PLAN, SpaceSize: USER_SPACE_SIZE, MaxFiles: MAX_USER_FILES},
+}
+
+// ParsePlans parses plans in the form "free=102400/5,team=10485760/100",
+// where limits are the space size in bytes and the number of files. If
+// DEFAULT_PLAN is not listed, it keeps the built-in limits.
+func ParsePlans(s string) (map[string]Quota, error) {
+	plans := map[string]Quota{
+		DEFAULT_PLAN: {Plan: DEFAULT_PLAN, SpaceSize: USER_SPACE_SIZE, MaxFiles: MAX_USER_FILES},
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, limits, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid plan %q", item)
+		}
+		size, files, ok := strings.Cut(limits, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid limits of plan %q", name)
+		}
+
+		spaceSize, err := strconv.Atoi(size)
+		if err != nil || spaceSize <= 0 {
+			return nil, fmt.Errorf("invalid space size of plan %q", name)
+		}
+		maxFiles, err := strconv.Atoi(files)
+		if err != nil || maxFiles <= 0 {
+			return nil, fmt.Errorf("invalid file limit of plan %q", name)
+		}
+
+		plans[name] = Quota{Plan: name, SpaceSize: spaceSize, MaxFiles: maxFiles}
+	}
+
+	return plans, nil
+}
+
+func validateQuotaOverride(o *QuotaOverride) error {
+	if o.SpaceSize < 0 || o.MaxFiles < 0 {
+		return ErrInvalidQuota
+	}
+	if o.Plan != "" {
+		if _, ok := Plans[o.Plan]; !ok {
+			return ErrPlanNotFound
+		}
+	}
+
+	return nil
+}
+
+// resolveQuota returns the effective quota for an override, nil means none.
+// Overrides referring to removed plans fall back to DEFAULT_PLAN.
+func resolveQuota(o *QuotaOverride) Quota {
+	quota := Plans[DEFAULT_PLAN]
+	if o == nil {
+		return quota
+	}
+
+	if plan, ok := Plans[o.Plan]; ok {
+		quota = plan
+	}
+	if o.SpaceSize > 0 {
+		quota.SpaceSize = o.SpaceSize
+	}
+	if o.MaxFiles > 0 {
+		quota.MaxFiles = o.MaxFiles
+	}
+
+	return quota
+}
+
+// checkQuota returns a QuotaError if live files taking occupied bytes in cnt
+// files don't fit into the quota.
+func checkQuota(quota Quota, occupied int, cnt int) error {
+	if occupied > quota.SpaceSize {
+		return &QuotaError{Err: ErrUserSpaceIsFull, Quota: quota}
+	}
+	if cnt > quota.MaxFiles {
+		return &QuotaError{Err: ErrFileNumberLimitReached, Quota: quota}
+	}
+
+	return nil
+}
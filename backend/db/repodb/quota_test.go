@@ -0,0 +1,49 @@
+package repodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlans(t *testing.T) {
+	plans, err := ParsePlans("team=1048576/100, pro=2097152/1000")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Quota{
+		DEFAULT_PLAN: {Plan: DEFAULT_PLAN, SpaceSize: USER_SPACE_SIZE, MaxFiles: MAX_USER_FILES},
+		"team":       {Plan: "team", SpaceSize: 1048576, MaxFiles: 100},
+		"pro":        {Plan: "pro", SpaceSize: 2097152, MaxFiles: 1000},
+	}, plans)
+
+	plans, err = ParsePlans("free=200/2")
+	require.NoError(t, err)
+	assert.Equal(t, Quota{Plan: DEFAULT_PLAN, SpaceSize: 200, MaxFiles: 2}, plans[DEFAULT_PLAN])
+
+	plans, err = ParsePlans("")
+	require.NoError(t, err)
+	assert.Len(t, plans, 1)
+
+	for _, invalid := range []string{"team", "team=100", "=100/1", "team=abc/1", "team=100/0", "team=-1/5"} {
+		_, err := ParsePlans(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestResolveQuota(t *testing.T) {
+	orig := Plans
+	t.Cleanup(func() { Plans = orig })
+
+	var err error
+	Plans, err = ParsePlans("team=1000/10")
+	require.NoError(t, err)
+
+	assert.Equal(t, Plans[DEFAULT_PLAN], resolveQuota(nil))
+	assert.Equal(t, Quota{Plan: "team", SpaceSize: 1000, MaxFiles: 10}, resolveQuota(&QuotaOverride{Plan: "team"}))
+	assert.Equal(t, Quota{Plan: "team", SpaceSize: 1000, MaxFiles: 20}, resolveQuota(&QuotaOverride{Plan: "team", MaxFiles: 20}))
+	assert.Equal(t, Quota{Plan: DEFAULT_PLAN, SpaceSize: 50, MaxFiles: MAX_USER_FILES}, resolveQuota(&QuotaOverride{SpaceSize: 50}))
+	assert.Equal(t, Plans[DEFAULT_PLAN], resolveQuota(&QuotaOverride{Plan: "removed"}))
+
+	assert.NoError(t, validateQuotaOverride(&QuotaOverride{Plan: "team"}))
+	assert.ErrorIs(t, validateQuotaOverride(&QuotaOverride{Plan: "removed"}), ErrPlanNotFound)
+}
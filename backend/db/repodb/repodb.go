@@ -1,19 +1,45 @@
 package repodb
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"path"
 	"path/filepath"
 	"slices"
+	"sort"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/google/uuid"
 )
 
+// Quota accounting.
+//
+// The space size of a quota limits the sum of live documents and their stored
+// revisions. Revisions never make a write fail: only live documents are
+// checked against the limit, and after every write the oldest revisions of the
+// user are evicted until live documents plus history fit into the limit again.
+// So history only uses space that live documents leave free. Revisions are not
+// counted in the file limit, trashed files are not counted at all. Attachments
+// are checked against the space size like live documents, but aren't counted
+// in the file limit either.
+//
+// USER_SPACE_SIZE and MAX_USER_FILES are the built-in limits of DEFAULT_PLAN,
+// see Plans.
 const (
-	USER_SPACE_SIZE = 100 << 10 // 100 Kb
-	MAX_USER_FILES  = 5
+	USER_SPACE_SIZE   = 100 << 10 // 100 Kb
+	MAX_USER_FILES    = 5
+	MAX_FILE_VERSIONS = 10
+)
+
+// Files may live in nested folders: a filename is a slash separated path
+// relative to the user root, e.g. "notes/2024/meeting.md".
+const (
+	MAX_PATH_LEN     = 1024
+	MAX_FOLDER_DEPTH = 8
 )
 
 var ErrFileNotFound = errors.New("file not found")
@@ -21,10 +47,20 @@ var ErrFileExists = errors.New("file already exists")
 var ErrUserNotFound = errors.New("user not found")
 var ErrUserSpaceIsFull = errors.New("user space is full")
 var ErrFileNumberLimitReached = errors.New("file number limit has been reached")
+var ErrVersionNotFound = errors.New("file version not found")
+var ErrFileModified = errors.New("file has been modified")
+var ErrFolderNotFound = errors.New("folder not found")
+var ErrFolderExists = errors.New("folder already exists")
+var ErrFolderNotEmpty = errors.New("folder is not empty")
+var ErrMoveIntoItself = errors.New("folder can't be moved into itself")
 
 const (
 	ERR_INVALID_CHARACTERS = "filename contains invalid characters"
-	ERR_PATH_IN_FILENAME   = "filename must not contain file path"
+	ERR_PATH_TRAVERSAL     = "path must not leave user storage"
+	ERR_EMPTY_SEGMENT      = "path must not contain empty segments"
+	ERR_HIDDEN_FOLDER      = "folder name must not start with a dot"
+	ERR_TOO_DEEP           = "folders are nested too deep"
+	ERR_PATH_TOO_LONG      = "path is too long"
 	ERR_BAD_EXTENSION      = "file extension must be .md"
 	ERR_EMPTY_FILENAME     = "filename must not be empty"
 	ERR_TRAILING_DOT_SPACE = "filename must not end with a dot or space"
@@ -52,30 +88,307 @@ var reservedBaseNames = []string{
 	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
 }
 
+// FileVersion describes a previous revision of a file. Id grows with every
+// save, ModifiedAt is the time the revision content was written.
+type FileVersion struct {
+	Id         int       `json:"id"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+}
+
+// FileTreeNode is a file or a folder in the user storage. Path is relative
+// to the user root.
+type FileTreeNode struct {
+	Name     string         `json:"name"`
+	Path     string         `json:"path"`
+	IsFolder bool           `json:"isFolder"`
+	Children []FileTreeNode `json:"children,omitempty"`
+}
+
 type FileRepository interface {
 	Save(filename string, userId uuid.UUID, data []byte) error
 	Create(filename string, userId uuid.UUID, data []byte) error
 	Get(filename string, userId uuid.UUID) ([]byte, error)
+	// Delete moves the file into the trash, see TRASH_DIR.
 	Delete(filename string, userId uuid.UUID) error
+	// GetList returns paths of all user files, including nested ones.
 	GetList(userId uuid.UUID) ([]string, error)
+	// GetFileInfos returns metadata of all user files.
+	GetFileInfos(userId uuid.UUID) ([]FileInfo, error)
 	Rename(filename string, newFilename string, userId uuid.UUID) error
+
+	// Conditional variants of Save, Delete and Rename. The operation is only
+	// performed if the current ETag of the file is one of ifMatch, otherwise
+	// ErrFileModified is returned. The check and the write are atomic. A nil
+	// ifMatch makes the operation unconditional.
+	SaveIfMatch(filename string, userId uuid.UUID, data []byte, ifMatch []string) error
+	DeleteIfMatch(filename string, userId uuid.UUID, ifMatch []string) error
+	RenameIfMatch(filename string, newFilename string, userId uuid.UUID, ifMatch []string) error
+
+	// GetUserOccupiedSpaceAndFileCount returns the space used by live files
+	// (except excludedFiles) and attachments, and the number of live files.
+	// This is the usage checked against the quota, see USER_SPACE_SIZE.
+	GetUserOccupiedSpaceAndFileCount(userId uuid.UUID, excludedFiles []string) (int, int, error)
+	// GetUserHistorySize returns the space used by stored revisions, which are
+	// evicted to fit the quota instead of counting against it.
+	GetUserHistorySize(userId uuid.UUID) (int, error)
+
+	// GetQuota returns the effective quota of the user.
+	GetQuota(userId uuid.UUID) (Quota, error)
+	// GetQuotaOverride returns the stored override, nil if there is none.
+	GetQuotaOverride(userId uuid.UUID) (*QuotaOverride, error)
+	// SetQuotaOverride stores the override of the user, nil removes it.
+	SetQuotaOverride(userId uuid.UUID, override *QuotaOverride) error
+
+	// GetTree returns user files and folders, folders first.
+	GetTree(userId uuid.UUID) ([]FileTreeNode, error)
+	// CreateFolder creates a folder, its parent must exist.
+	CreateFolder(path string, userId uuid.UUID) error
+	// RenameFolder renames or moves a folder with all its content.
+	RenameFolder(path string, newPath string, userId uuid.UUID) error
+	// DeleteFolder deletes a folder. A non-empty folder is only deleted if
+	// recursive is set, otherwise ErrFolderNotEmpty is returned. Files of the
+	// folder are moved into the trash.
+	DeleteFolder(path string, userId uuid.UUID, recursive bool) error
+
+	// ListTrash returns trashed files of the user, most recently deleted
+	// first.
+	ListTrash(userId uuid.UUID) ([]TrashItem, error)
+	// RestoreFromTrash moves the item back to the path it was deleted from,
+	// recreating missing folders, and returns that path. The restored file is
+	// checked against the quota like a new one. If the path is taken,
+	// ErrFileExists is returned, or with autoRename the file gets a free name
+	// like "note (1).md".
+	RestoreFromTrash(id string, userId uuid.UUID, autoRename bool) (string, error)
+	// DeleteFromTrash permanently deletes the item.
+	DeleteFromTrash(id string, userId uuid.UUID) error
+	// EmptyTrash permanently deletes all trashed files of the user.
+	EmptyTrash(userId uuid.UUID) error
+	// PurgeTrash permanently deletes items of all users trashed before the
+	// given time and returns their number.
+	PurgeTrash(before time.Time) (int, error)
+
+	// ShareFile grants userId the role on a file of owner, or changes the
+	// role of an existing share. See Share.
+	ShareFile(filename string, owner uuid.UUID, userId uuid.UUID, role string) error
+	// UnshareFile revokes the share, ErrShareNotFound if there is none.
+	UnshareFile(filename string, owner uuid.UUID, userId uuid.UUID) error
+	// GetShares returns shares of the owner's file, of all files if filename
+	// is empty.
+	GetShares(owner uuid.UUID, filename string) ([]Share, error)
+	// GetSharedWith returns files of other users shared with the user.
+	GetSharedWith(userId uuid.UUID) ([]Share, error)
+
+	// CreateShareLink stores a new link to an existing file of link.Owner.
+	CreateShareLink(link ShareLink) error
+	// GetShareLink returns the link with the token, ErrShareLinkNotFound if
+	// there is none.
+	GetShareLink(token string) (ShareLink, error)
+	// GetShareLinks returns links to the owner's file, to all files if
+	// filename is empty.
+	GetShareLinks(owner uuid.UUID, filename string) ([]ShareLink, error)
+	// DeleteShareLink revokes the link, ErrShareLinkNotFound if there is none.
+	DeleteShareLink(owner uuid.UUID, token string) error
+	// RecordShareLinkAccess counts an access to the link at the given time.
+	RecordShareLinkAccess(token string, at time.Time) error
+
+	// GetVersions returns stored revisions of the file, newest first.
+	GetVersions(filename string, userId uuid.UUID) ([]FileVersion, error)
+	GetVersion(filename string, userId uuid.UUID, versionId int) ([]byte, error)
+	// RestoreVersion saves the revision content as the current one. The
+	// replaced content is kept in history, so a restore can be undone.
+	RestoreVersion(filename string, userId uuid.UUID, versionId int) error
+
+	// GetTrashContent returns the content of the trashed file.
+	GetTrashContent(id string, userId uuid.UUID) ([]byte, error)
+
+	// CreateAttachment stores an attachment made by NewAttachment, checked
+	// against the quota. Storing content the owner already has is a no-op.
+	CreateAttachment(attachment Attachment, data []byte) error
+	// GetAttachment returns the attachment with its content,
+	// ErrAttachmentNotFound if there is none.
+	GetAttachment(owner uuid.UUID, id string) (Attachment, []byte, error)
+	// GetAttachments returns attachments of the owner, most recent first.
+	GetAttachments(owner uuid.UUID) ([]Attachment, error)
+	// DeleteAttachment permanently deletes the attachment.
+	DeleteAttachment(owner uuid.UUID, id string) error
+	// GetAttachmentOwners returns users having attachments.
+	GetAttachmentOwners() ([]uuid.UUID, error)
+	// GetUsers returns users having stored files or folders.
+	GetUsers() ([]uuid.UUID, error)
+}
+
+// buildTree assembles the tree from slash separated folder and file paths.
+// Folders come first on every level, then entries are sorted by name.
+func buildTree(folders []string, files []string) []FileTreeNode {
+	type node struct {
+		FileTreeNode
+		children []*node
+	}
+
+	root := &node{}
+	nodes := map[string]*node{}
+	parentOf := func(p string) *node {
+		if parent, ok := nodes[path.Dir(p)]; ok {
+			return parent
+		}
+		return root
+	}
+
+	folders = slices.Clone(folders)
+	slices.Sort(folders)
+	for _, folder := range folders {
+		n := &node{FileTreeNode: FileTreeNode{Name: path.Base(folder), Path: folder, IsFolder: true}}
+		nodes[folder] = n
+		parent := parentOf(folder)
+		parent.children = append(parent.children, n)
+	}
+	for _, file := range files {
+		parent := parentOf(file)
+		parent.children = append(parent.children, &node{FileTreeNode: FileTreeNode{Name: path.Base(file), Path: file}})
+	}
+
+	var convert func(n *node) []FileTreeNode
+	convert = func(n *node) []FileTreeNode {
+		sort.SliceStable(n.children, func(i, j int) bool {
+			a, b := n.children[i], n.children[j]
+			if a.IsFolder != b.IsFolder {
+				return a.IsFolder
+			}
+			return a.Name < b.Name
+		})
+
+		result := []FileTreeNode{}
+		for _, child := range n.children {
+			if child.IsFolder {
+				child.Children = convert(child)
+			}
+			result = append(result, child.FileTreeNode)
+		}
+		return result
+	}
+
+	return convert(root)
+}
+
+// ETag returns a strong entity tag of the file content, without quotes.
+func ETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func matchETag(data []byte, ifMatch []string) error {
+	if ifMatch == nil {
+		return nil
+	}
+	if !slices.Contains(ifMatch, ETag(data)) {
+		return ErrFileModified
+	}
+
+	return nil
 }
 
+// validateFile checks a file path relative to the user root. Every folder
+// segment must pass validateFolderName and the last segment must be a valid
+// markdown filename.
 func validateFile(filename string) error {
 	if strings.TrimSpace(filename) == "" {
 		return &ErrInvalidFilename{Reason: ERR_ONLY_SPACES}
 	}
-	if filename == "" {
-		return &ErrInvalidFilename{Reason: ERR_EMPTY_FILENAME}
-	}
-	if len(filename) > 255 {
-		return &ErrInvalidFilename{Reason: ERR_TOO_LONG}
+	if len(filename) > MAX_PATH_LEN {
+		return &ErrInvalidFilename{Reason: ERR_PATH_TOO_LONG}
 	}
 	if !utf8.ValidString(filename) {
 		return &ErrInvalidFilename{Reason: ERR_INVALID_CHARACTERS}
 	}
-	if filepath.Base(filename) != filename {
-		return &ErrInvalidFilename{Reason: ERR_PATH_IN_FILENAME}
+
+	if i := strings.LastIndex(filename, "/"); i >= 0 {
+		if err := validateFolderSegments(filename[:i]); err != nil {
+			return err
+		}
+		filename = filename[i+1:]
+	}
+
+	return validateFilename(filename)
+}
+
+// ValidateFile and ValidateFolder check paths like storages do before writes,
+// for callers validating a batch of writes up front.
+func ValidateFile(filename string) error {
+	return validateFile(filename)
+}
+
+func ValidateFolder(path string) error {
+	return validateFolder(path)
+}
+
+// validateFolder checks a folder path relative to the user root.
+func validateFolder(path string) error {
+	if strings.TrimSpace(path) == "" {
+		return &ErrInvalidFilename{Reason: ERR_ONLY_SPACES}
+	}
+	if len(path) > MAX_PATH_LEN {
+		return &ErrInvalidFilename{Reason: ERR_PATH_TOO_LONG}
+	}
+	if !utf8.ValidString(path) {
+		return &ErrInvalidFilename{Reason: ERR_INVALID_CHARACTERS}
+	}
+
+	return validateFolderSegments(path)
+}
+
+func validateFolderSegments(path string) error {
+	segments := strings.Split(path, "/")
+	if len(segments) > MAX_FOLDER_DEPTH {
+		return &ErrInvalidFilename{Reason: ERR_TOO_DEEP}
+	}
+	for _, name := range segments {
+		if err := validateFolderName(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateFolderName(name string) error {
+	if name == "" {
+		return &ErrInvalidFilename{Reason: ERR_EMPTY_SEGMENT}
+	}
+	if name == "." || name == ".." {
+		return &ErrInvalidFilename{Reason: ERR_PATH_TRAVERSAL}
+	}
+	if len(name) > 255 {
+		return &ErrInvalidFilename{Reason: ERR_TOO_LONG}
+	}
+	// Dot folders are reserved for service data like VERSIONS_DIR.
+	if strings.HasPrefix(name, ".") {
+		return &ErrInvalidFilename{Reason: ERR_HIDDEN_FOLDER}
+	}
+	if strings.TrimSpace(name) == "" {
+		return &ErrInvalidFilename{Reason: ERR_ONLY_SPACES}
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return &ErrInvalidFilename{Reason: ERR_TRAILING_DOT_SPACE}
+	}
+	for _, r := range reservedBaseNames {
+		if strings.EqualFold(name, r) {
+			return &ErrInvalidFilename{Reason: ERR_RESERVED, ReservedAs: r}
+		}
+	}
+	if bad := findInvalidRunes(name); len(bad) > 0 {
+		return &ErrInvalidFilename{Reason: ERR_INVALID_CHARACTERS, InvalidRunes: bad}
+	}
+
+	return nil
+}
+
+func validateFilename(filename string) error {
+	if strings.TrimSpace(filename) == "" {
+		return &ErrInvalidFilename{Reason: ERR_ONLY_SPACES}
+	}
+	if len(filename) > 255 {
+		return &ErrInvalidFilename{Reason: ERR_TOO_LONG}
 	}
 	ext := strings.ToLower(filepath.Ext(filename))
 	if !slices.Contains(validExtensions, ext) {
@@ -107,9 +420,16 @@ func validateFile(filename string) error {
 			return &ErrInvalidFilename{Reason: ERR_RESERVED, ReservedAs: r}
 		}
 	}
+	if bad := findInvalidRunes(filename); len(bad) > 0 {
+		return &ErrInvalidFilename{Reason: ERR_INVALID_CHARACTERS, InvalidRunes: bad}
+	}
+	return nil
+}
+
+func findInvalidRunes(name string) []rune {
 	seen := make(map[rune]struct{})
 	var bad []rune
-	for _, ch := range filename {
+	for _, ch := range name {
 		if ch <= 0x1F || ch == 0x7F {
 			if _, ok := seen[ch]; !ok {
 				seen[ch] = struct{}{}
@@ -127,10 +447,8 @@ func validateFile(filename string) error {
 			}
 		}
 	}
-	if len(bad) > 0 {
-		return &ErrInvalidFilename{Reason: ERR_INVALID_CHARACTERS, InvalidRunes: bad}
-	}
-	return nil
+
+	return bad
 }
 
 func isValidFilename(filename string) bool {
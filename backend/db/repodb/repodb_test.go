@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIsValidFilename(t *testing.T) {
@@ -42,8 +44,15 @@ func TestValidateFile(t *testing.T) {
 		{"Valid md file", "test.md", false, ""},
 		{"Valid txt file", "test.markdown", false, ""},
 		{"Invalid extension", "test.jpg", true, fmt.Sprintf("Invalid filename: %s", ERR_BAD_EXTENSION)},
-		{"Path traversal", "../test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_PATH_IN_FILENAME)},
-		{"Invalid filename", "file/name.md", true, fmt.Sprintf("Invalid filename: %s", ERR_PATH_IN_FILENAME)},
+		{"Path traversal", "../test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_PATH_TRAVERSAL)},
+		{"Nested traversal", "notes/../../test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_PATH_TRAVERSAL)},
+		{"Nested file", "file/name.md", false, ""},
+		{"Absolute path", "/test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_EMPTY_SEGMENT)},
+		{"Double separator", "notes//test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_EMPTY_SEGMENT)},
+		{"Hidden folder", ".versions/test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_HIDDEN_FOLDER)},
+		{"Backslash", "notes\\test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_INVALID_CHARACTERS)},
+		{"Too deep", strings.Repeat("a/", MAX_FOLDER_DEPTH+1) + "test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_TOO_DEEP)},
+		{"Reserved folder", "con/test.md", true, fmt.Sprintf("Invalid filename: %s", ERR_RESERVED)},
 		{"Empty filename", "", true, fmt.Sprintf("Invalid filename: %s", ERR_ONLY_SPACES)},
 		{"Comma in filename", "file,md.md", true, fmt.Sprintf("Invalid filename: %s", ERR_INVALID_CHARACTERS)},
 		{"Dot file with valid ext", ".env.md", false, ""},
@@ -68,3 +77,21 @@ func TestValidateFile(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildTree(t *testing.T) {
+	tree := buildTree(
+		[]string{"notes/2024", "notes", "empty"},
+		[]string{"root.md", "notes/2024/b.md", "notes/a.md"},
+	)
+
+	assert.Equal(t, []FileTreeNode{
+		{Name: "empty", Path: "empty", IsFolder: true, Children: []FileTreeNode{}},
+		{Name: "notes", Path: "notes", IsFolder: true, Children: []FileTreeNode{
+			{Name: "2024", Path: "notes/2024", IsFolder: true, Children: []FileTreeNode{
+				{Name: "b.md", Path: "notes/2024/b.md"},
+			}},
+			{Name: "a.md", Path: "notes/a.md"},
+		}},
+		{Name: "root.md", Path: "root.md"},
+	}, tree)
+}
@@ -0,0 +1,1507 @@
+package repodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+)
+
+// Revisions keep the modification time of the replaced content here, object
+// timestamps can't be set through the S3 API.
+const s3ModifiedAtMeta = "Modified-At"
+
+// Files keep their creation time here, saves replace the object.
+const s3CreatedAtMeta = "Created-At"
+
+// Files keep the id of their last revision here, so ids aren't reused after
+// revisions are evicted.
+const s3LastVersionMeta = "Last-Version"
+
+// S3FileRepo stores <prefix>/<userId>/<path> objects in an S3 compatible
+// bucket using the same layout as LocalFileRepo: folders are empty objects
+// with a trailing slash and revisions live under <userId>/.versions/.
+// Writes of a user are serialized within the process, so a bucket must be
+// served by a single backend instance.
+type S3FileRepo struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	locks  *keyedMutex
+}
+
+type s3Object struct {
+	rel     string
+	size    int64
+	modTime time.Time
+}
+
+// s3UserObjects is a classified listing of the objects of a user. Paths are
+// relative to the user root.
+type s3UserObjects struct {
+	files       []s3Object
+	folders     []string
+	versions    []s3Object
+	trash       []s3Object
+	attachments []s3Object
+}
+
+func NewS3FileRepo(client *minio.Client, bucket string, prefix string) (*S3FileRepo, error) {
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %s: %w", bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+		}
+	}
+
+	return &S3FileRepo{client: client, bucket: bucket, prefix: prefix, locks: newKeyedMutex()}, nil
+}
+
+func (s *S3FileRepo) userKey(userId uuid.UUID) string {
+	return path.Join(s.prefix, userId.String()) + "/"
+}
+
+func (s *S3FileRepo) objectKey(userId uuid.UUID, rel string) string {
+	return s.userKey(userId) + rel
+}
+
+func (s *S3FileRepo) folderKey(userId uuid.UUID, folder string) string {
+	return s.userKey(userId) + folder + "/"
+}
+
+func (s *S3FileRepo) versionsKey(userId uuid.UUID, filename string) string {
+	return s.userKey(userId) + VERSIONS_DIR + "/" + filename + "/"
+}
+
+// trashKey is the prefix of a trash item, the item holds a single object
+// <userId>/.trash/<id>/<path>. Copying sets its modification time, which is
+// the deletion time.
+func (s *S3FileRepo) trashKey(userId uuid.UUID, id string) string {
+	return s.userKey(userId) + TRASH_DIR + "/" + id + "/"
+}
+
+func isNoSuchKey(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+func (s *S3FileRepo) objectExists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNoSuchKey(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// getObject returns the object content with its info, ErrFileNotFound if
+// there is no such object.
+func (s *S3FileRepo) getObject(ctx context.Context, key string) ([]byte, minio.ObjectInfo, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		if isNoSuchKey(err) {
+			return nil, minio.ObjectInfo{}, ErrFileNotFound
+		}
+
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+
+	return data, info, nil
+}
+
+func (s *S3FileRepo) putObject(ctx context.Context, key string, data []byte, meta map[string]string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{UserMetadata: meta})
+	if err != nil {
+		return fmt.Errorf("failed to write object %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (s *S3FileRepo) listKeys(ctx context.Context, prefix string) ([]minio.ObjectInfo, error) {
+	var objects []minio.ObjectInfo
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", obj.Err)
+		}
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+func (s *S3FileRepo) listUser(ctx context.Context, userId uuid.UUID) (s3UserObjects, error) {
+	var result s3UserObjects
+
+	root := s.userKey(userId)
+	objects, err := s.listKeys(ctx, root)
+	if err != nil {
+		return result, err
+	}
+
+	versionsRoot, trashRoot, attachmentsRoot := VERSIONS_DIR+"/", TRASH_DIR+"/", ATTACHMENTS_DIR+"/"
+	for _, obj := range objects {
+		rel := strings.TrimPrefix(obj.Key, root)
+		switch {
+		case strings.HasPrefix(rel, versionsRoot):
+			result.versions = append(result.versions, s3Object{
+				rel:     strings.TrimPrefix(rel, versionsRoot),
+				size:    obj.Size,
+				modTime: obj.LastModified,
+			})
+		case strings.HasPrefix(rel, trashRoot):
+			result.trash = append(result.trash, s3Object{
+				rel:     strings.TrimPrefix(rel, trashRoot),
+				size:    obj.Size,
+				modTime: obj.LastModified,
+			})
+		case strings.HasPrefix(rel, attachmentsRoot):
+			result.attachments = append(result.attachments, s3Object{
+				rel:     strings.TrimPrefix(rel, attachmentsRoot),
+				size:    obj.Size,
+				modTime: obj.LastModified,
+			})
+		case strings.HasSuffix(rel, "/"):
+			result.folders = append(result.folders, strings.TrimSuffix(rel, "/"))
+		default:
+			result.files = append(result.files, s3Object{rel: rel, size: obj.Size, modTime: obj.LastModified})
+		}
+	}
+
+	return result, nil
+}
+
+// liveSpaceAndFileCount returns the space used by live files (except
+// excludedFiles) and attachments, and the number of live files.
+func (u s3UserObjects) liveSpaceAndFileCount(excludedFiles []string) (int, int) {
+	var occupied int64
+	cnt := 0
+	for _, f := range u.files {
+		if !slices.Contains(excludedFiles, f.rel) {
+			occupied += f.size
+			cnt++
+		}
+	}
+	for _, a := range u.attachments {
+		occupied += a.size
+	}
+
+	return int(occupied), cnt
+}
+
+// checkNotExists returns ErrFolderExists or ErrFileExists if something is
+// already stored at rel.
+func (s *S3FileRepo) checkNotExists(ctx context.Context, userId uuid.UUID, rel string) error {
+	exists, err := s.objectExists(ctx, s.folderKey(userId, rel))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrFolderExists
+	}
+
+	exists, err = s.objectExists(ctx, s.objectKey(userId, rel))
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrFileExists
+	}
+
+	return nil
+}
+
+func (s *S3FileRepo) folderExists(ctx context.Context, userId uuid.UUID, folder string) (bool, error) {
+	if folder == "" {
+		return true, nil
+	}
+
+	return s.objectExists(ctx, s.folderKey(userId, folder))
+}
+
+func (s *S3FileRepo) checkParentExists(ctx context.Context, userId uuid.UUID, rel string) error {
+	exists, err := s.folderExists(ctx, userId, parentFolder(rel))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+
+	return nil
+}
+
+type s3Move struct {
+	from string
+	to   string
+}
+
+// movesWithPrefix returns moves of every object under prefix to newPrefix.
+func (s *S3FileRepo) movesWithPrefix(ctx context.Context, prefix string, newPrefix string) ([]s3Move, error) {
+	keys, err := s.keysWithPrefix(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make([]s3Move, 0, len(keys))
+	for _, key := range keys {
+		moves = append(moves, s3Move{from: key, to: newPrefix + strings.TrimPrefix(key, prefix)})
+	}
+
+	return moves, nil
+}
+
+// moveObjects emulates a rename, which S3 lacks: every object is copied and
+// the originals are removed only after all copies succeeded. If a copy fails
+// the copies made so far are removed, so the sources stay intact.
+func (s *S3FileRepo) moveObjects(ctx context.Context, moves []s3Move) error {
+	copied := make([]string, 0, len(moves))
+	for _, m := range moves {
+		_, err := s.client.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: s.bucket, Object: m.to},
+			minio.CopySrcOptions{Bucket: s.bucket, Object: m.from})
+		if err != nil {
+			_ = s.removeObjects(ctx, copied)
+
+			return fmt.Errorf("failed to copy object %s: %w", m.from, err)
+		}
+		copied = append(copied, m.to)
+	}
+
+	sources := make([]string, 0, len(moves))
+	for _, m := range moves {
+		sources = append(sources, m.from)
+	}
+
+	return s.removeObjects(ctx, sources)
+}
+
+func (s *S3FileRepo) removeObjects(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("failed to remove object %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *S3FileRepo) keysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := s.listKeys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+
+	return keys, nil
+}
+
+// readVersions returns revisions of the file sorted by id.
+func (s *S3FileRepo) readVersions(ctx context.Context, userId uuid.UUID, filename string) ([]storedVersion, error) {
+	prefix := s.versionsKey(userId, filename)
+
+	var versions []storedVersion
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list versions: %w", obj.Err)
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(obj.Key, prefix))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, storedVersion{path: obj.Key, id: id, size: obj.Size, modTime: obj.LastModified})
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].id < versions[j].id })
+
+	return versions, nil
+}
+
+// archiveVersion stores the current content of the file as a new revision
+// after lastId, the last revision recorded on the file, drops revisions
+// exceeding MAX_FILE_VERSIONS and returns the id of the new revision.
+func (s *S3FileRepo) archiveVersion(ctx context.Context, userId uuid.UUID, filename string, data []byte, modTime time.Time, lastId int) (int, error) {
+	versions, err := s.readVersions(ctx, userId, filename)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(versions) > 0 && versions[len(versions)-1].id > lastId {
+		lastId = versions[len(versions)-1].id
+	}
+	id := lastId + 1
+
+	meta := map[string]string{s3ModifiedAtMeta: modTime.UTC().Format(time.RFC3339Nano)}
+	if err := s.putObject(ctx, s.versionsKey(userId, filename)+strconv.Itoa(id), data, meta); err != nil {
+		return 0, err
+	}
+
+	for len(versions)+1 > MAX_FILE_VERSIONS {
+		if err := s.client.RemoveObject(ctx, s.bucket, versions[0].path, minio.RemoveObjectOptions{}); err != nil {
+			return 0, err
+		}
+		versions = versions[1:]
+	}
+
+	return id, nil
+}
+
+// trimHistory evicts the oldest revisions of the user until live files and
+// history fit into spaceSize.
+func (s *S3FileRepo) trimHistory(ctx context.Context, userId uuid.UUID, spaceSize int) error {
+	objects, err := s.listUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+
+	occupied, _ := objects.liveSpaceAndFileCount([]string{})
+	total := int64(occupied)
+	for _, v := range objects.versions {
+		total += v.size
+	}
+
+	// Object timestamps have a second precision, ties are broken by id.
+	versions := objects.versions
+	versionId := func(v s3Object) int {
+		id, _ := strconv.Atoi(path.Base(v.rel))
+		return id
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if versions[i].modTime.Equal(versions[j].modTime) {
+			return versionId(versions[i]) < versionId(versions[j])
+		}
+		return versions[i].modTime.Before(versions[j].modTime)
+	})
+
+	for _, v := range versions {
+		if total <= int64(spaceSize) {
+			break
+		}
+		key := s.userKey(userId) + VERSIONS_DIR + "/" + v.rel
+		if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+		total -= v.size
+	}
+
+	return nil
+}
+
+func (s *S3FileRepo) Save(filename string, userId uuid.UUID, data []byte) error {
+	return s.SaveIfMatch(filename, userId, data, nil)
+}
+
+func (s *S3FileRepo) SaveIfMatch(filename string, userId uuid.UUID, data []byte, ifMatch []string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	current, info, err := s.getObject(ctx, s.objectKey(userId, filename))
+	if err != nil {
+		return err
+	}
+	if err := matchETag(current, ifMatch); err != nil {
+		return err
+	}
+
+	quota, err := s.GetQuota(userId)
+	if err != nil {
+		return err
+	}
+	objects, err := s.listUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	occupied, _ := objects.liveSpaceAndFileCount([]string{filename})
+	if err := checkQuota(quota, occupied+len(data), 0); err != nil {
+		return err
+	}
+
+	lastId, _ := strconv.Atoi(info.UserMetadata[s3LastVersionMeta])
+	id, err := s.archiveVersion(ctx, userId, filename, current, info.LastModified, lastId)
+	if err != nil {
+		return err
+	}
+	meta := map[string]string{s3LastVersionMeta: strconv.Itoa(id)}
+	if createdAt, ok := info.UserMetadata[s3CreatedAtMeta]; ok {
+		meta[s3CreatedAtMeta] = createdAt
+	}
+	if err := s.putObject(ctx, s.objectKey(userId, filename), data, meta); err != nil {
+		return err
+	}
+
+	return s.trimHistory(ctx, userId, quota.SpaceSize)
+}
+
+func (s *S3FileRepo) Create(filename string, userId uuid.UUID, data []byte) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	if err := s.checkNotExists(ctx, userId, filename); err != nil {
+		if err == ErrFolderExists {
+			return ErrFileExists
+		}
+		return err
+	}
+	if err := s.checkParentExists(ctx, userId, filename); err != nil {
+		return err
+	}
+
+	quota, err := s.GetQuota(userId)
+	if err != nil {
+		return err
+	}
+	objects, err := s.listUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	occupied, cnt := objects.liveSpaceAndFileCount([]string{})
+	if err := checkQuota(quota, occupied+len(data), cnt+1); err != nil {
+		return err
+	}
+
+	// Object timestamps have a second precision, so has the creation time.
+	meta := map[string]string{s3CreatedAtMeta: time.Now().UTC().Format(time.RFC3339)}
+	if err := s.putObject(ctx, s.objectKey(userId, filename), data, meta); err != nil {
+		return err
+	}
+
+	return s.trimHistory(ctx, userId, quota.SpaceSize)
+}
+
+func (s *S3FileRepo) Get(filename string, userId uuid.UUID) ([]byte, error) {
+	if err := validateFile(filename); err != nil {
+		return nil, err
+	}
+
+	data, _, err := s.getObject(context.Background(), s.objectKey(userId, filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *S3FileRepo) Delete(filename string, userId uuid.UUID) error {
+	return s.DeleteIfMatch(filename, userId, nil)
+}
+
+func (s *S3FileRepo) DeleteIfMatch(filename string, userId uuid.UUID, ifMatch []string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	current, _, err := s.getObject(ctx, s.objectKey(userId, filename))
+	if err != nil {
+		return err
+	}
+	if err := matchETag(current, ifMatch); err != nil {
+		return err
+	}
+
+	move := s3Move{from: s.objectKey(userId, filename), to: s.trashKey(userId, newTrashId()) + filename}
+	if err := s.moveObjects(ctx, []s3Move{move}); err != nil {
+		return fmt.Errorf("failed to move file to trash: %w", err)
+	}
+	if err := s.dropSharing(ctx, userId, filename, false); err != nil {
+		return err
+	}
+
+	versions, err := s.keysWithPrefix(ctx, s.versionsKey(userId, filename))
+	if err != nil {
+		return err
+	}
+
+	return s.removeObjects(ctx, versions)
+}
+
+func (s *S3FileRepo) GetList(userId uuid.UUID) ([]string, error) {
+	objects, err := s.listUser(context.Background(), userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file list: %w", err)
+	}
+
+	fileNames := make([]string, 0, len(objects.files))
+	for _, f := range objects.files {
+		fileNames = append(fileNames, f.rel)
+	}
+
+	return fileNames, nil
+}
+
+func (s *S3FileRepo) GetFileInfos(userId uuid.UUID) ([]FileInfo, error) {
+	ctx := context.Background()
+	objects, err := s.listUser(ctx, userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load file list: %w", err)
+	}
+
+	infos := make([]FileInfo, 0, len(objects.files))
+	for _, f := range objects.files {
+		data, info, err := s.getObject(ctx, s.objectKey(userId, f.rel))
+		if err != nil {
+			if err == ErrFileNotFound {
+				// Deleted since the listing.
+				continue
+			}
+			return nil, err
+		}
+
+		createdAt := info.LastModified
+		if t, err := time.Parse(time.RFC3339, info.UserMetadata[s3CreatedAtMeta]); err == nil {
+			createdAt = t
+		}
+		infos = append(infos, newFileInfo(f.rel, data, createdAt, info.LastModified))
+	}
+
+	return infos, nil
+}
+
+func (s *S3FileRepo) Rename(filename string, newFilename string, userId uuid.UUID) error {
+	return s.RenameIfMatch(filename, newFilename, userId, nil)
+}
+
+func (s *S3FileRepo) RenameIfMatch(filename string, newFilename string, userId uuid.UUID, ifMatch []string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+	if err := validateFile(newFilename); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	current, _, err := s.getObject(ctx, s.objectKey(userId, filename))
+	if err != nil {
+		return err
+	}
+	if err := matchETag(current, ifMatch); err != nil {
+		return err
+	}
+
+	if err := s.checkNotExists(ctx, userId, newFilename); err != nil {
+		if err == ErrFolderExists {
+			return ErrFileExists
+		}
+		return err
+	}
+	if err := s.checkParentExists(ctx, userId, newFilename); err != nil {
+		return err
+	}
+
+	moves, err := s.movesWithPrefix(ctx, s.versionsKey(userId, filename), s.versionsKey(userId, newFilename))
+	if err != nil {
+		return err
+	}
+	// The file is copied last and removed last.
+	moves = append(moves, s3Move{from: s.objectKey(userId, filename), to: s.objectKey(userId, newFilename)})
+	if err := s.moveObjects(ctx, moves); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return s.moveSharing(ctx, userId, filename, newFilename, false)
+}
+
+func (s *S3FileRepo) GetUserOccupiedSpaceAndFileCount(userId uuid.UUID, excludedFiles []string) (int, int, error) {
+	objects, err := s.listUser(context.Background(), userId)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	occupied, cnt := objects.liveSpaceAndFileCount(excludedFiles)
+	return occupied, cnt, nil
+}
+
+func (s *S3FileRepo) GetUserHistorySize(userId uuid.UUID) (int, error) {
+	objects, err := s.listUser(context.Background(), userId)
+	if err != nil {
+		return 0, err
+	}
+
+	size := 0
+	for _, v := range objects.versions {
+		size += int(v.size)
+	}
+	return size, nil
+}
+
+// quotaKey is outside of user roots, so overrides don't show up in listings.
+func (s *S3FileRepo) quotaKey(userId uuid.UUID) string {
+	return path.Join(s.prefix, QUOTAS_DIR, userId.String()+".json")
+}
+
+func (s *S3FileRepo) GetQuota(userId uuid.UUID) (Quota, error) {
+	override, err := s.GetQuotaOverride(userId)
+	if err != nil {
+		return Quota{}, err
+	}
+
+	return resolveQuota(override), nil
+}
+
+func (s *S3FileRepo) GetQuotaOverride(userId uuid.UUID) (*QuotaOverride, error) {
+	data, _, err := s.getObject(context.Background(), s.quotaKey(userId))
+	if err != nil {
+		if err == ErrFileNotFound {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var override QuotaOverride
+	if err := json.Unmarshal(data, &override); err != nil {
+		return nil, fmt.Errorf("failed to parse quota of user %s: %w", userId, err)
+	}
+
+	return &override, nil
+}
+
+func (s *S3FileRepo) SetQuotaOverride(userId uuid.UUID, override *QuotaOverride) error {
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	if override == nil {
+		return s.removeObjects(ctx, []string{s.quotaKey(userId)})
+	}
+
+	if err := validateQuotaOverride(override); err != nil {
+		return err
+	}
+	data, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(ctx, s.quotaKey(userId), data, nil)
+}
+
+// sharesKey is outside of user roots like quotaKey.
+func (s *S3FileRepo) sharesKey(owner uuid.UUID) string {
+	return path.Join(s.prefix, SHARES_DIR, owner.String()+".json")
+}
+
+// readS3List reads a JSON list of shares or links, empty if the object
+// doesn't exist.
+func readS3List[T any](ctx context.Context, s *S3FileRepo, key string) ([]T, error) {
+	data, _, err := s.getObject(ctx, key)
+	if err != nil {
+		if err == ErrFileNotFound {
+			return []T{}, nil
+		}
+
+		return nil, err
+	}
+
+	var items []T
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", key, err)
+	}
+
+	return items, nil
+}
+
+// updateS3List rewrites the list in key with fn, an empty list removes the
+// object. Must be called with the owner lock held.
+func updateS3List[T any](ctx context.Context, s *S3FileRepo, key string, fn func([]T) ([]T, error)) error {
+	items, err := readS3List[T](ctx, s, key)
+	if err != nil {
+		return err
+	}
+	items, err = fn(items)
+	if err != nil {
+		return err
+	}
+
+	if len(items) == 0 {
+		return s.removeObjects(ctx, []string{key})
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	return s.putObject(ctx, key, data, nil)
+}
+
+func (s *S3FileRepo) updateShares(ctx context.Context, owner uuid.UUID, fn func([]Share) ([]Share, error)) error {
+	return updateS3List(ctx, s, s.sharesKey(owner), fn)
+}
+
+// moveSharing makes shares and links of the renamed file or folder path
+// follow it to newPath. Must be called with the owner lock held.
+func (s *S3FileRepo) moveSharing(ctx context.Context, owner uuid.UUID, path string, newPath string, folder bool) error {
+	if err := s.updateShares(ctx, owner, func(shares []Share) ([]Share, error) {
+		return moveShares(shares, path, newPath, folder), nil
+	}); err != nil {
+		return err
+	}
+
+	return s.updateLinks(ctx, owner, func(links []ShareLink) ([]ShareLink, error) {
+		return moveLinks(links, path, newPath, folder), nil
+	})
+}
+
+// dropSharing removes shares and links of the file or folder path. It is
+// called once the files are in the trash, so a failed delete keeps them.
+// Must be called with the owner lock held.
+func (s *S3FileRepo) dropSharing(ctx context.Context, owner uuid.UUID, path string, folder bool) error {
+	if err := s.updateShares(ctx, owner, func(shares []Share) ([]Share, error) {
+		return dropShares(shares, path, folder), nil
+	}); err != nil {
+		return err
+	}
+
+	return s.updateLinks(ctx, owner, func(links []ShareLink) ([]ShareLink, error) {
+		return dropLinks(links, path, folder), nil
+	})
+}
+
+func (s *S3FileRepo) ShareFile(filename string, owner uuid.UUID, userId uuid.UUID, role string) error {
+	if err := validateFile(filename); err != nil {
+		return err
+	}
+	if err := validateShare(owner, userId, role); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(owner.String())
+	defer unlock()
+
+	ctx := context.Background()
+	exists, err := s.objectExists(ctx, s.objectKey(owner, filename))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFileNotFound
+	}
+
+	return s.updateShares(ctx, owner, func(shares []Share) ([]Share, error) {
+		return putShare(shares, Share{Owner: owner, Filename: filename, UserId: userId, Role: role, CreatedAt: time.Now().UTC()}), nil
+	})
+}
+
+func (s *S3FileRepo) UnshareFile(filename string, owner uuid.UUID, userId uuid.UUID) error {
+	unlock := s.locks.Lock(owner.String())
+	defer unlock()
+
+	return s.updateShares(context.Background(), owner, func(shares []Share) ([]Share, error) {
+		return removeShare(shares, filename, userId)
+	})
+}
+
+func (s *S3FileRepo) GetShares(owner uuid.UUID, filename string) ([]Share, error) {
+	shares, err := readS3List[Share](context.Background(), s, s.sharesKey(owner))
+	if err != nil {
+		return nil, err
+	}
+
+	return filterShares(shares, filename), nil
+}
+
+func (s *S3FileRepo) GetSharedWith(userId uuid.UUID) ([]Share, error) {
+	ctx := context.Background()
+	objects, err := s.listKeys(ctx, path.Join(s.prefix, SHARES_DIR)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Share{}
+	for _, obj := range objects {
+		shares, err := readS3List[Share](ctx, s, obj.Key)
+		if err != nil {
+			return nil, err
+		}
+		for _, share := range shares {
+			if share.UserId == userId {
+				result = append(result, share)
+			}
+		}
+	}
+	sortShares(result)
+
+	return result, nil
+}
+
+// linksKey is outside of user roots like sharesKey.
+func (s *S3FileRepo) linksKey(owner uuid.UUID) string {
+	return path.Join(s.prefix, LINKS_DIR, owner.String()+".json")
+}
+
+func (s *S3FileRepo) updateLinks(ctx context.Context, owner uuid.UUID, fn func([]ShareLink) ([]ShareLink, error)) error {
+	return updateS3List(ctx, s, s.linksKey(owner), fn)
+}
+
+func (s *S3FileRepo) CreateShareLink(link ShareLink) error {
+	if err := validateFile(link.Filename); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(link.Owner.String())
+	defer unlock()
+
+	ctx := context.Background()
+	exists, err := s.objectExists(ctx, s.objectKey(link.Owner, link.Filename))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFileNotFound
+	}
+
+	return s.updateLinks(ctx, link.Owner, func(links []ShareLink) ([]ShareLink, error) {
+		return append(links, link), nil
+	})
+}
+
+func (s *S3FileRepo) GetShareLink(token string) (ShareLink, error) {
+	owner, err := shareLinkOwner(token)
+	if err != nil {
+		return ShareLink{}, err
+	}
+
+	links, err := readS3List[ShareLink](context.Background(), s, s.linksKey(owner))
+	if err != nil {
+		return ShareLink{}, err
+	}
+	i := findLink(links, token)
+	if i < 0 {
+		return ShareLink{}, ErrShareLinkNotFound
+	}
+
+	return links[i], nil
+}
+
+func (s *S3FileRepo) GetShareLinks(owner uuid.UUID, filename string) ([]ShareLink, error) {
+	links, err := readS3List[ShareLink](context.Background(), s, s.linksKey(owner))
+	if err != nil {
+		return nil, err
+	}
+
+	return filterLinks(links, filename), nil
+}
+
+func (s *S3FileRepo) DeleteShareLink(owner uuid.UUID, token string) error {
+	unlock := s.locks.Lock(owner.String())
+	defer unlock()
+
+	return s.updateLinks(context.Background(), owner, func(links []ShareLink) ([]ShareLink, error) {
+		return removeLink(links, token)
+	})
+}
+
+func (s *S3FileRepo) RecordShareLinkAccess(token string, at time.Time) error {
+	owner, err := shareLinkOwner(token)
+	if err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(owner.String())
+	defer unlock()
+
+	return s.updateLinks(context.Background(), owner, func(links []ShareLink) ([]ShareLink, error) {
+		return recordLinkAccess(links, token, at.UTC())
+	})
+}
+
+func (s *S3FileRepo) GetTree(userId uuid.UUID) ([]FileTreeNode, error) {
+	objects, err := s.listUser(context.Background(), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(objects.files))
+	for _, f := range objects.files {
+		files = append(files, f.rel)
+	}
+
+	return buildTree(objects.folders, files), nil
+}
+
+func (s *S3FileRepo) CreateFolder(folder string, userId uuid.UUID) error {
+	if err := validateFolder(folder); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	if err := s.checkNotExists(ctx, userId, folder); err != nil {
+		return err
+	}
+	if err := s.checkParentExists(ctx, userId, folder); err != nil {
+		return err
+	}
+
+	return s.putObject(ctx, s.folderKey(userId, folder), nil, nil)
+}
+
+func (s *S3FileRepo) RenameFolder(folder string, newFolder string, userId uuid.UUID) error {
+	if err := validateFolder(folder); err != nil {
+		return err
+	}
+	if err := validateFolder(newFolder); err != nil {
+		return err
+	}
+	if newFolder == folder || strings.HasPrefix(newFolder, folder+"/") {
+		return ErrMoveIntoItself
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	exists, err := s.folderExists(ctx, userId, folder)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+	if err := s.checkNotExists(ctx, userId, newFolder); err != nil {
+		return err
+	}
+	if err := s.checkParentExists(ctx, userId, newFolder); err != nil {
+		return err
+	}
+
+	moves, err := s.movesWithPrefix(ctx, s.versionsKey(userId, folder), s.versionsKey(userId, newFolder))
+	if err != nil {
+		return err
+	}
+	files, err := s.movesWithPrefix(ctx, s.folderKey(userId, folder), s.folderKey(userId, newFolder))
+	if err != nil {
+		return err
+	}
+	if err := s.moveObjects(ctx, append(moves, files...)); err != nil {
+		return fmt.Errorf("failed to rename folder: %w", err)
+	}
+
+	return s.moveSharing(ctx, userId, folder, newFolder, true)
+}
+
+func (s *S3FileRepo) DeleteFolder(folder string, userId uuid.UUID, recursive bool) error {
+	if err := validateFolder(folder); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	exists, err := s.folderExists(ctx, userId, folder)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrFolderNotFound
+	}
+
+	prefix := s.folderKey(userId, folder)
+	keys, err := s.keysWithPrefix(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if !recursive && len(keys) > 1 {
+		return ErrFolderNotEmpty
+	}
+
+	versions, err := s.keysWithPrefix(ctx, s.versionsKey(userId, folder))
+	if err != nil {
+		return err
+	}
+
+	var moves []s3Move
+	var markers []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			markers = append(markers, key)
+			continue
+		}
+		rel := strings.TrimPrefix(key, s.userKey(userId))
+		moves = append(moves, s3Move{from: key, to: s.trashKey(userId, newTrashId()) + rel})
+	}
+	if err := s.moveObjects(ctx, moves); err != nil {
+		return fmt.Errorf("failed to move files to trash: %w", err)
+	}
+	if err := s.dropSharing(ctx, userId, folder, true); err != nil {
+		return err
+	}
+
+	// The marker goes last, so an interrupted delete leaves the folder
+	// visible instead of orphaned history.
+	sort.Slice(markers, func(i, j int) bool { return markers[i] != prefix && markers[j] == prefix })
+
+	return s.removeObjects(ctx, append(versions, markers...))
+}
+
+func (s *S3FileRepo) GetVersions(filename string, userId uuid.UUID) ([]FileVersion, error) {
+	if err := validateFile(filename); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := s.objectExists(ctx, s.objectKey(userId, filename))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrFileNotFound
+	}
+
+	versions, err := s.readVersions(ctx, userId, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]FileVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		modTime := versions[i].modTime
+		info, err := s.client.StatObject(ctx, s.bucket, versions[i].path, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339Nano, info.UserMetadata[s3ModifiedAtMeta]); err == nil {
+			modTime = t
+		}
+
+		result = append(result, FileVersion{
+			Id:         versions[i].id,
+			Size:       versions[i].size,
+			ModifiedAt: modTime,
+		})
+	}
+
+	return result, nil
+}
+
+func (s *S3FileRepo) GetVersion(filename string, userId uuid.UUID, versionId int) ([]byte, error) {
+	if err := validateFile(filename); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := s.objectExists(ctx, s.objectKey(userId, filename))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrFileNotFound
+	}
+
+	data, _, err := s.getObject(ctx, s.versionsKey(userId, filename)+strconv.Itoa(versionId))
+	if err != nil {
+		if err == ErrFileNotFound {
+			return nil, ErrVersionNotFound
+		}
+
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *S3FileRepo) RestoreVersion(filename string, userId uuid.UUID, versionId int) error {
+	data, err := s.GetVersion(filename, userId, versionId)
+	if err != nil {
+		return err
+	}
+
+	return s.Save(filename, userId, data)
+}
+
+// trashItems converts trash objects of a listing into items. An item holds a
+// single object, so ids don't repeat.
+func (u s3UserObjects) trashItems() []TrashItem {
+	items := make([]TrashItem, 0, len(u.trash))
+	for _, obj := range u.trash {
+		id, filename, ok := strings.Cut(obj.rel, "/")
+		if !ok || validateTrashId(id) != nil {
+			continue
+		}
+		items = append(items, TrashItem{Id: id, Filename: filename, Size: obj.size, DeletedAt: obj.modTime})
+	}
+
+	return items
+}
+
+func (s *S3FileRepo) ListTrash(userId uuid.UUID) ([]TrashItem, error) {
+	objects, err := s.listUser(context.Background(), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	items := objects.trashItems()
+	sortTrash(items)
+
+	return items, nil
+}
+
+func (s *S3FileRepo) GetTrashContent(id string, userId uuid.UUID) ([]byte, error) {
+	if err := validateTrashId(id); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	key, _, err := s.findTrashItem(ctx, userId, id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := s.getObject(ctx, key)
+	if err == ErrFileNotFound {
+		return nil, ErrTrashItemNotFound
+	}
+
+	return data, err
+}
+
+// findTrashItem returns the key of the item object with the path it was
+// deleted from.
+func (s *S3FileRepo) findTrashItem(ctx context.Context, userId uuid.UUID, id string) (string, string, error) {
+	prefix := s.trashKey(userId, id)
+	keys, err := s.keysWithPrefix(ctx, prefix)
+	if err != nil {
+		return "", "", err
+	}
+	if len(keys) == 0 {
+		return "", "", ErrTrashItemNotFound
+	}
+
+	return keys[0], strings.TrimPrefix(keys[0], prefix), nil
+}
+
+func (s *S3FileRepo) RestoreFromTrash(id string, userId uuid.UUID, autoRename bool) (string, error) {
+	if err := validateTrashId(id); err != nil {
+		return "", err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	key, path, err := s.findTrashItem(ctx, userId, id)
+	if err != nil {
+		return "", err
+	}
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	quota, err := s.GetQuota(userId)
+	if err != nil {
+		return "", err
+	}
+	objects, err := s.listUser(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+	occupied, cnt := objects.liveSpaceAndFileCount([]string{})
+	if err := checkQuota(quota, occupied+int(info.Size), cnt+1); err != nil {
+		return "", err
+	}
+
+	filename, err := pickRestoreName(path, autoRename, func(name string) (bool, error) {
+		err := s.checkNotExists(ctx, userId, name)
+		if err == ErrFileExists || err == ErrFolderExists {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, folder := range parentFolders(filename) {
+		exists, err := s.folderExists(ctx, userId, folder)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			if err := s.putObject(ctx, s.folderKey(userId, folder), nil, nil); err != nil {
+				return "", err
+			}
+		}
+	}
+	if err := s.moveObjects(ctx, []s3Move{{from: key, to: s.objectKey(userId, filename)}}); err != nil {
+		return "", fmt.Errorf("failed to restore file: %w", err)
+	}
+
+	return filename, s.trimHistory(ctx, userId, quota.SpaceSize)
+}
+
+func (s *S3FileRepo) DeleteFromTrash(id string, userId uuid.UUID) error {
+	if err := validateTrashId(id); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	key, _, err := s.findTrashItem(ctx, userId, id)
+	if err != nil {
+		return err
+	}
+
+	return s.removeObjects(ctx, []string{key})
+}
+
+func (s *S3FileRepo) EmptyTrash(userId uuid.UUID) error {
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	ctx := context.Background()
+	keys, err := s.keysWithPrefix(ctx, s.userKey(userId)+TRASH_DIR+"/")
+	if err != nil {
+		return err
+	}
+
+	return s.removeObjects(ctx, keys)
+}
+
+func (s *S3FileRepo) PurgeTrash(before time.Time) (int, error) {
+	ctx := context.Background()
+
+	usersPrefix := strings.TrimSuffix(s.userKey(uuid.Nil), uuid.Nil.String()+"/")
+	var users []uuid.UUID
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: usersPrefix}) {
+		if obj.Err != nil {
+			return 0, fmt.Errorf("failed to list users: %w", obj.Err)
+		}
+		userId, err := uuid.Parse(strings.TrimSuffix(strings.TrimPrefix(obj.Key, usersPrefix), "/"))
+		if err == nil {
+			users = append(users, userId)
+		}
+	}
+
+	purged := 0
+	for _, userId := range users {
+		n, err := s.purgeUserTrash(ctx, userId, before)
+		purged += n
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+func (s *S3FileRepo) purgeUserTrash(ctx context.Context, userId uuid.UUID, before time.Time) (int, error) {
+	unlock := s.locks.Lock(userId.String())
+	defer unlock()
+
+	objects, err := s.listUser(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []string
+	for _, item := range objects.trashItems() {
+		if item.DeletedAt.Before(before) {
+			keys = append(keys, s.trashKey(userId, item.Id)+item.Filename)
+		}
+	}
+
+	return len(keys), s.removeObjects(ctx, keys)
+}
+
+// attachmentsKey is outside of user roots like quotaKey, attachment content
+// is stored under <userId>/.attachments/.
+func (s *S3FileRepo) attachmentsKey(owner uuid.UUID) string {
+	return path.Join(s.prefix, ATTACHMENTS_DIR, owner.String()+".json")
+}
+
+func (s *S3FileRepo) attachmentKey(owner uuid.UUID, id string) string {
+	return s.userKey(owner) + ATTACHMENTS_DIR + "/" + id
+}
+
+func (s *S3FileRepo) CreateAttachment(attachment Attachment, data []byte) error {
+	if err := validateAttachmentId(attachment.Id); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(attachment.Owner.String())
+	defer unlock()
+
+	ctx := context.Background()
+	key := s.attachmentsKey(attachment.Owner)
+	attachments, err := readS3List[Attachment](ctx, s, key)
+	if err != nil {
+		return err
+	}
+	if findAttachment(attachments, attachment.Id) >= 0 {
+		return nil
+	}
+
+	quota, err := s.GetQuota(attachment.Owner)
+	if err != nil {
+		return err
+	}
+	objects, err := s.listUser(ctx, attachment.Owner)
+	if err != nil {
+		return err
+	}
+	occupied, _ := objects.liveSpaceAndFileCount([]string{})
+	if err := checkQuota(quota, occupied+len(data), 0); err != nil {
+		return err
+	}
+
+	// The content goes first, so listed attachments always have one.
+	if err := s.putObject(ctx, s.attachmentKey(attachment.Owner, attachment.Id), data, nil); err != nil {
+		return err
+	}
+	if err := updateS3List(ctx, s, key, func(attachments []Attachment) ([]Attachment, error) {
+		return append(attachments, attachment), nil
+	}); err != nil {
+		return err
+	}
+
+	return s.trimHistory(ctx, attachment.Owner, quota.SpaceSize)
+}
+
+func (s *S3FileRepo) GetAttachment(owner uuid.UUID, id string) (Attachment, []byte, error) {
+	if err := validateAttachmentId(id); err != nil {
+		return Attachment{}, nil, err
+	}
+
+	ctx := context.Background()
+	attachments, err := readS3List[Attachment](ctx, s, s.attachmentsKey(owner))
+	if err != nil {
+		return Attachment{}, nil, err
+	}
+	i := findAttachment(attachments, id)
+	if i < 0 {
+		return Attachment{}, nil, ErrAttachmentNotFound
+	}
+
+	data, _, err := s.getObject(ctx, s.attachmentKey(owner, id))
+	if err != nil {
+		if err == ErrFileNotFound {
+			return Attachment{}, nil, ErrAttachmentNotFound
+		}
+
+		return Attachment{}, nil, err
+	}
+
+	return attachments[i], data, nil
+}
+
+func (s *S3FileRepo) GetAttachments(owner uuid.UUID) ([]Attachment, error) {
+	attachments, err := readS3List[Attachment](context.Background(), s, s.attachmentsKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	sortAttachments(attachments)
+
+	return attachments, nil
+}
+
+func (s *S3FileRepo) DeleteAttachment(owner uuid.UUID, id string) error {
+	if err := validateAttachmentId(id); err != nil {
+		return err
+	}
+
+	unlock := s.locks.Lock(owner.String())
+	defer unlock()
+
+	ctx := context.Background()
+	if err := updateS3List(ctx, s, s.attachmentsKey(owner), func(attachments []Attachment) ([]Attachment, error) {
+		return removeAttachment(attachments, id)
+	}); err != nil {
+		return err
+	}
+
+	return s.removeObjects(ctx, []string{s.attachmentKey(owner, id)})
+}
+
+func (s *S3FileRepo) GetAttachmentOwners() ([]uuid.UUID, error) {
+	prefix := path.Join(s.prefix, ATTACHMENTS_DIR) + "/"
+	objects, err := s.listKeys(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := []uuid.UUID{}
+	for _, obj := range objects {
+		owner, err := uuid.Parse(strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), ".json"))
+		if err == nil {
+			owners = append(owners, owner)
+		}
+	}
+
+	return owners, nil
+}
+
+func (s *S3FileRepo) GetUsers() ([]uuid.UUID, error) {
+	var prefix string
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+
+	// Listing without recursion returns the user directories as prefixes.
+	users := []uuid.UUID{}
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list users: %w", obj.Err)
+		}
+		userId, err := uuid.Parse(strings.TrimSuffix(strings.TrimPrefix(obj.Key, prefix), "/"))
+		if err == nil {
+			users = append(users, userId)
+		}
+	}
+
+	return users, nil
+}
@@ -0,0 +1,133 @@
+package repodb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestS3Repo creates a repository backed by an in-process S3 fake. While
+// failCopy is set, copying live files fails and copying revisions succeeds,
+// so renames fail halfway.
+func newTestS3Repo(t *testing.T, failCopy *atomic.Bool) *S3FileRepo {
+	faker := gofakes3.New(s3mem.New()).Server()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copying := r.Header.Get("X-Amz-Copy-Source") != "" && !strings.Contains(r.URL.Path, VERSIONS_DIR)
+		if failCopy != nil && failCopy.Load() && copying {
+			http.Error(w, "copy failed", http.StatusInternalServerError)
+			return
+		}
+		// The fake requires Content-Length even for chunked uploads, which
+		// the client uses for empty objects such as folder markers.
+		if r.Header.Get("Content-Length") == "" {
+			if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" {
+				r.Header.Set("Content-Length", decoded)
+			}
+		}
+		faker.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:      credentials.NewStaticV4("key", "secret", ""),
+		MaxRetries: 1,
+	})
+	require.NoError(t, err)
+
+	repo, err := NewS3FileRepo(client, "markdown", "storage")
+	require.NoError(t, err)
+
+	return repo
+}
+
+func s3Keys(t *testing.T, repo *S3FileRepo) []string {
+	keys, err := repo.keysWithPrefix(context.Background(), "")
+	require.NoError(t, err)
+
+	return keys
+}
+
+func TestS3FileRepo_Keys(t *testing.T) {
+	repo := newTestS3Repo(t, nil)
+
+	require.NoError(t, repo.CreateFolder("notes", testUUID))
+	require.NoError(t, repo.Create("notes/test.md", testUUID, []byte("v1")))
+	require.NoError(t, repo.Save("notes/test.md", testUUID, []byte("v2")))
+
+	user := "storage/" + testUUID.String()
+	assert.ElementsMatch(t, []string{
+		user + "/notes/",
+		user + "/notes/test.md",
+		user + "/.versions/notes/test.md/1",
+	}, s3Keys(t, repo))
+
+	versions, err := repo.GetVersions("notes/test.md", testUUID)
+	assert.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.False(t, versions[0].ModifiedAt.IsZero())
+}
+
+func TestS3FileRepo_RenameFailure(t *testing.T) {
+	var failCopy atomic.Bool
+	repo := newTestS3Repo(t, &failCopy)
+
+	require.NoError(t, repo.CreateFolder("notes", testUUID))
+	require.NoError(t, repo.Create("notes/test.md", testUUID, []byte("v1")))
+	require.NoError(t, repo.Save("notes/test.md", testUUID, []byte("v2")))
+	before := s3Keys(t, repo)
+
+	failCopy.Store(true)
+	assert.Error(t, repo.Rename("notes/test.md", "moved.md", testUUID))
+	assert.Error(t, repo.RenameFolder("notes", "archive", testUUID))
+	failCopy.Store(false)
+
+	assert.ElementsMatch(t, before, s3Keys(t, repo))
+
+	content, err := repo.Get("notes/test.md", testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), content)
+
+	require.NoError(t, repo.RenameFolder("notes", "archive", testUUID))
+	content, err = repo.Get("archive/test.md", testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), content)
+
+	versions, err := repo.GetVersions("archive/test.md", testUUID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+}
+
+func TestS3FileRepo_DeleteFailureKeepsSharing(t *testing.T) {
+	var failCopy atomic.Bool
+	repo := newTestS3Repo(t, &failCopy)
+	reader := uuid.New()
+
+	require.NoError(t, repo.CreateFolder("notes", testUUID))
+	require.NoError(t, repo.Create("notes/test.md", testUUID, []byte("v1")))
+	require.NoError(t, repo.ShareFile("notes/test.md", testUUID, reader, ROLE_VIEWER))
+
+	failCopy.Store(true)
+	assert.Error(t, repo.Delete("notes/test.md", testUUID))
+	assert.Error(t, repo.DeleteFolder("notes", testUUID, true))
+	failCopy.Store(false)
+
+	shares, err := repo.GetShares(testUUID, "notes/test.md")
+	assert.NoError(t, err)
+	assert.Len(t, shares, 1)
+
+	require.NoError(t, repo.DeleteFolder("notes", testUUID, true))
+	shares, err = repo.GetSharedWith(reader)
+	assert.NoError(t, err)
+	assert.Empty(t, shares)
+}
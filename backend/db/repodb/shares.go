@@ -0,0 +1,129 @@
+package repodb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Roles a file can be shared with. Viewers may read the file and its history,
+// editors may also change its content. Only the owner renames, deletes and
+// shares a file.
+const (
+	ROLE_VIEWER = "viewer"
+	ROLE_EDITOR = "editor"
+)
+
+// Shares of a user's files are stored as <basePath>/.shares/<ownerId>.json,
+// next to user roots.
+const SHARES_DIR = ".shares"
+
+var (
+	ErrShareNotFound = errors.New("share not found")
+	ErrInvalidShare  = errors.New("invalid share")
+)
+
+// Share grants UserId a role on a file of Owner. Shares follow renames of the
+// file and are dropped when it is deleted, restoring the file from the trash
+// doesn't bring them back.
+type Share struct {
+	Owner     uuid.UUID `json:"owner"`
+	Filename  string    `json:"filename"`
+	UserId    uuid.UUID `json:"userId"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func validateShare(owner uuid.UUID, userId uuid.UUID, role string) error {
+	if owner == userId || (role != ROLE_VIEWER && role != ROLE_EDITOR) {
+		return ErrInvalidShare
+	}
+
+	return nil
+}
+
+// sortShares orders shares by owner, filename and creation time.
+func sortShares(shares []Share) {
+	sort.Slice(shares, func(i, j int) bool {
+		a, b := shares[i], shares[j]
+		if a.Owner != b.Owner {
+			return a.Owner.String() < b.Owner.String()
+		}
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+// putShare adds the share or changes the role of an existing one.
+func putShare(shares []Share, share Share) []Share {
+	for i := range shares {
+		if shares[i].Filename == share.Filename && shares[i].UserId == share.UserId {
+			shares[i].Role = share.Role
+			return shares
+		}
+	}
+
+	return append(shares, share)
+}
+
+// removeShare drops the share of userId on filename, ErrShareNotFound if there
+// is none.
+func removeShare(shares []Share, filename string, userId uuid.UUID) ([]Share, error) {
+	for i := range shares {
+		if shares[i].Filename == filename && shares[i].UserId == userId {
+			return append(shares[:i], shares[i+1:]...), nil
+		}
+	}
+
+	return shares, ErrShareNotFound
+}
+
+// inPath reports whether filename is path itself, or is inside of it if path
+// is a folder.
+func inPath(filename string, path string, folder bool) bool {
+	if folder {
+		return strings.HasPrefix(filename, path+"/")
+	}
+	return filename == path
+}
+
+// moveShares follows a rename of the file or folder path to newPath.
+func moveShares(shares []Share, path string, newPath string, folder bool) []Share {
+	for i := range shares {
+		if inPath(shares[i].Filename, path, folder) {
+			shares[i].Filename = newPath + strings.TrimPrefix(shares[i].Filename, path)
+		}
+	}
+
+	return shares
+}
+
+// dropShares removes shares of the deleted file or folder path.
+func dropShares(shares []Share, path string, folder bool) []Share {
+	result := shares[:0]
+	for _, s := range shares {
+		if !inPath(s.Filename, path, folder) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// filterShares returns shares of filename, all of them if it is empty.
+func filterShares(shares []Share, filename string) []Share {
+	result := []Share{}
+	for _, s := range shares {
+		if filename == "" || s.Filename == filename {
+			result = append(result, s)
+		}
+	}
+	sortShares(result)
+
+	return result
+}
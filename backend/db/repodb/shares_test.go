@@ -0,0 +1,51 @@
+package repodb
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShareList(t *testing.T) {
+	userId := uuid.New()
+	shares := []Share{
+		{Filename: "notes/a.md", UserId: userId, Role: ROLE_VIEWER},
+		{Filename: "notes.md", UserId: userId, Role: ROLE_VIEWER},
+		{Filename: "notes/sub/b.md", UserId: userId, Role: ROLE_VIEWER},
+	}
+
+	shares = putShare(shares, Share{Filename: "notes.md", UserId: userId, Role: ROLE_EDITOR})
+	assert.Len(t, shares, 3)
+	assert.Equal(t, ROLE_EDITOR, shares[1].Role)
+
+	shares = moveShares(shares, "notes", "archive", true)
+	assert.Equal(t, []string{"archive/a.md", "notes.md", "archive/sub/b.md"},
+		[]string{shares[0].Filename, shares[1].Filename, shares[2].Filename})
+
+	shares = dropShares(shares, "archive/sub", true)
+	assert.Len(t, shares, 2)
+
+	shares, err := removeShare(shares, "notes.md", userId)
+	assert.NoError(t, err)
+	_, err = removeShare(shares, "notes.md", userId)
+	assert.Equal(t, ErrShareNotFound, err)
+}
+
+func TestShareLinkToken(t *testing.T) {
+	owner := uuid.New()
+	token, err := NewShareLinkToken(owner)
+	assert.NoError(t, err)
+	other, err := NewShareLinkToken(owner)
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, other)
+
+	parsed, err := shareLinkOwner(token)
+	assert.NoError(t, err)
+	assert.Equal(t, owner, parsed)
+
+	_, err = shareLinkOwner(token[:len(token)-2])
+	assert.Equal(t, ErrShareLinkNotFound, err)
+	_, err = shareLinkOwner("../../etc")
+	assert.Equal(t, ErrShareLinkNotFound, err)
+}
@@ -0,0 +1,103 @@
+package repodb
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Deleted files are moved into the trash of the user, where they can be
+// restored until they are purged. Trashed files don't count against the quota
+// and lose their history. Every file gets its own item, so deleting a folder
+// trashes each file in it.
+const (
+	TRASH_DIR = ".trash"
+	// MAX_RESTORE_RENAMES limits the attempts to find a free name on restore.
+	MAX_RESTORE_RENAMES = 100
+)
+
+var ErrTrashItemNotFound = errors.New("trash item not found")
+
+// TrashItem is a file in the trash. Filename is the path the file was deleted
+// from.
+type TrashItem struct {
+	Id        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+func newTrashId() string {
+	return uuid.NewString()
+}
+
+// validateTrashId rejects ids that can't belong to an item, so they are never
+// used to build paths or keys.
+func validateTrashId(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrTrashItemNotFound
+	}
+
+	return nil
+}
+
+// sortTrash orders items most recently deleted first.
+func sortTrash(items []TrashItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].DeletedAt.Equal(items[j].DeletedAt) {
+			return items[i].Filename < items[j].Filename
+		}
+		return items[i].DeletedAt.After(items[j].DeletedAt)
+	})
+}
+
+// parentFolders returns the folders containing filename, outermost first.
+func parentFolders(filename string) []string {
+	var folders []string
+	for dir := parentFolder(filename); dir != ""; dir = parentFolder(dir) {
+		folders = append([]string{dir}, folders...)
+	}
+
+	return folders
+}
+
+// restoreName returns the n-th candidate path for restoring filename:
+// "notes/a.md", "notes/a (1).md", "notes/a (2).md" and so on.
+func restoreName(filename string, n int) string {
+	if n == 0 {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), n, ext)
+}
+
+// pickRestoreName returns the path to restore filename to. If the path is
+// taken, ErrFileExists is returned, or with autoRename the first free
+// candidate of restoreName.
+func pickRestoreName(filename string, autoRename bool, taken func(name string) (bool, error)) (string, error) {
+	for n := 0; n <= MAX_RESTORE_RENAMES; n++ {
+		name := restoreName(filename, n)
+		if err := validateFile(name); err != nil {
+			return "", ErrFileExists
+		}
+
+		isTaken, err := taken(name)
+		if err != nil {
+			return "", err
+		}
+		if !isTaken {
+			return name, nil
+		}
+		if !autoRename {
+			return "", ErrFileExists
+		}
+	}
+
+	return "", ErrFileExists
+}
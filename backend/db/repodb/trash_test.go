@@ -0,0 +1,26 @@
+package repodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickRestoreName(t *testing.T) {
+	taken := map[string]bool{"notes/a.md": true, "notes/a (1).md": true}
+	isTaken := func(name string) (bool, error) { return taken[name], nil }
+
+	name, err := pickRestoreName("notes/b.md", false, isTaken)
+	assert.NoError(t, err)
+	assert.Equal(t, "notes/b.md", name)
+
+	_, err = pickRestoreName("notes/a.md", false, isTaken)
+	assert.Equal(t, ErrFileExists, err)
+
+	name, err = pickRestoreName("notes/a.md", true, isTaken)
+	assert.NoError(t, err)
+	assert.Equal(t, "notes/a (2).md", name)
+
+	assert.Equal(t, []string{"a", "a/b"}, parentFolders("a/b/c.md"))
+	assert.Empty(t, parentFolders("c.md"))
+}
@@ -0,0 +1,56 @@
+package search
+
+import (
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// attachmentRefRe matches references to attachments in any form of their
+// URL, /api/attachments/<owner>/<hash>.<ext>. The hash of the content
+// identifies the attachment by itself, the extension isn't kept.
+var attachmentRefRe = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}/[0-9a-f]{64}`)
+
+// attachmentRefHashLen is the length of the hash the attachment ids start
+// with.
+const attachmentRefHashLen = 64
+
+func attachmentRef(owner uuid.UUID, id string) string {
+	if len(id) < attachmentRefHashLen {
+		return ""
+	}
+
+	return owner.String() + "/" + id[:attachmentRefHashLen]
+}
+
+// parseAttachmentRefs returns the attachments the document refers to, nil
+// if there are none.
+func parseAttachmentRefs(data []byte) map[string]bool {
+	var refs map[string]bool
+	for _, m := range attachmentRefRe.FindAll(data, -1) {
+		if refs == nil {
+			refs = make(map[string]bool)
+		}
+		refs[string(m)] = true
+	}
+
+	return refs
+}
+
+// ReferencesAttachment reports whether the file of the user refers to the
+// attachment of owner, without reading the file.
+func (i *Index) ReferencesAttachment(userId uuid.UUID, filename string, owner uuid.UUID, id string) (bool, error) {
+	u, err := i.lockUser(userId)
+	if err != nil {
+		return false, err
+	}
+	defer u.mu.Unlock()
+
+	doc, ok := u.docs[filename]
+	if !ok {
+		return false, nil
+	}
+
+	ref := attachmentRef(owner, id)
+	return ref != "" && doc.attachments[ref], nil
+}
@@ -0,0 +1,266 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+)
+
+// Index is an in-memory inverted index of user documents, links between them
+// and the attachments they refer to. The index of a user is built from the
+// repository by BuildAll or on first use, so it is rebuilt from scratch on
+// every start. Writes must go through IndexedRepository to keep it in sync;
+// writes made by other processes are only seen after Rebuild.
+type Index struct {
+	repo  repodb.FileRepository
+	mu    sync.Mutex
+	users map[uuid.UUID]*userIndex
+}
+
+// userIndex holds the documents of a user. Its mutex is held while the index
+// is built or a document is re-read, so updates are applied in the order the
+// repository was read.
+type userIndex struct {
+	mu       sync.Mutex
+	built    bool
+	docs     map[string]*document
+	postings map[string]map[string][]int // term -> path -> token positions
+}
+
+type document struct {
+	path   string
+	text   []rune
+	tokens []token
+	// pathTerms are terms of the path, matches there rank the document higher.
+	pathTerms []token
+	links     []link
+	// attachments are the references to attachments, see attachmentRef.
+	attachments map[string]bool
+}
+
+// token is a lowercased word with its offsets in the text, in runes.
+type token struct {
+	term  string
+	start int
+	end   int
+}
+
+func NewIndex(repo repodb.FileRepository) *Index {
+	return &Index{repo: repo, users: make(map[uuid.UUID]*userIndex)}
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func tokenize(text []rune) []token {
+	var tokens []token
+	start := -1
+	for i := 0; i <= len(text); i++ {
+		if i < len(text) && isWordRune(text[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{term: strings.ToLower(string(text[start:i])), start: start, end: i})
+			start = -1
+		}
+	}
+
+	return tokens
+}
+
+func (u *userIndex) reset() {
+	u.docs = make(map[string]*document)
+	u.postings = make(map[string]map[string][]int)
+}
+
+func (u *userIndex) add(path string, data []byte) {
+	u.remove(path)
+
+	text := []rune(string(data))
+	links := parseLinks(data)
+	runeOffsets(data, links)
+	doc := &document{
+		path:        path,
+		text:        text,
+		tokens:      tokenize(text),
+		pathTerms:   tokenize([]rune(path)),
+		links:       links,
+		attachments: parseAttachmentRefs(data),
+	}
+	u.docs[path] = doc
+	for pos, t := range doc.tokens {
+		docs, ok := u.postings[t.term]
+		if !ok {
+			docs = make(map[string][]int)
+			u.postings[t.term] = docs
+		}
+		docs[path] = append(docs[path], pos)
+	}
+}
+
+func (u *userIndex) remove(path string) {
+	doc, ok := u.docs[path]
+	if !ok {
+		return
+	}
+
+	for _, t := range doc.tokens {
+		if docs, ok := u.postings[t.term]; ok {
+			delete(docs, path)
+			if len(docs) == 0 {
+				delete(u.postings, t.term)
+			}
+		}
+	}
+	delete(u.docs, path)
+}
+
+func (i *Index) user(userId uuid.UUID) *userIndex {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	u, ok := i.users[userId]
+	if !ok {
+		u = &userIndex{}
+		i.users[userId] = u
+	}
+
+	return u
+}
+
+// build reads all files of the user. Must be called with u.mu held.
+func (i *Index) build(u *userIndex, userId uuid.UUID) error {
+	u.built = false
+	u.reset()
+
+	files, err := i.repo.GetList(userId)
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		data, err := i.repo.Get(path, userId)
+		if err != nil {
+			if errors.Is(err, repodb.ErrFileNotFound) {
+				continue
+			}
+			return err
+		}
+		u.add(path, data)
+	}
+
+	u.built = true
+
+	return nil
+}
+
+// lockUser returns the built index of the user, locked. The caller must
+// unlock it.
+func (i *Index) lockUser(userId uuid.UUID) (*userIndex, error) {
+	u := i.user(userId)
+	u.mu.Lock()
+	if !u.built {
+		if err := i.build(u, userId); err != nil {
+			u.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	return u, nil
+}
+
+// BuildAll builds the indexes of all users of the repository that aren't
+// built yet and returns how many were built. Indexes that fail are built on
+// first use instead.
+func (i *Index) BuildAll() (int, error) {
+	users, err := i.repo.GetUsers()
+	if err != nil {
+		return 0, err
+	}
+
+	built := 0
+	var errs []error
+	for _, userId := range users {
+		u, err := i.lockUser(userId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", userId, err))
+			continue
+		}
+		u.mu.Unlock()
+		built++
+	}
+
+	return built, errors.Join(errs...)
+}
+
+// Rebuild drops the index of the user and reads all files again.
+func (i *Index) Rebuild(userId uuid.UUID) error {
+	u := i.user(userId)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return i.build(u, userId)
+}
+
+// refresh re-reads the files from the repository, files that are gone are
+// removed from the index. Folders are refreshed with all their files. An index
+// that isn't built is left alone, it reads everything on first use. If the
+// repository fails, the index is dropped and built again on next use.
+func (i *Index) refresh(userId uuid.UUID, files []string, folders []string) {
+	u := i.user(userId)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.built {
+		return
+	}
+	if err := i.refreshLocked(u, userId, files, folders); err != nil {
+		u.built = false
+	}
+}
+
+func (i *Index) refreshLocked(u *userIndex, userId uuid.UUID, files []string, folders []string) error {
+	if len(folders) > 0 {
+		list, err := i.repo.GetList(userId)
+		if err != nil {
+			return err
+		}
+
+		for _, folder := range folders {
+			for path := range u.docs {
+				if strings.HasPrefix(path, folder+"/") {
+					u.remove(path)
+				}
+			}
+			for _, path := range list {
+				if strings.HasPrefix(path, folder+"/") {
+					files = append(files, path)
+				}
+			}
+		}
+	}
+
+	for _, path := range files {
+		data, err := i.repo.Get(path, userId)
+		if err != nil {
+			var invalid *repodb.ErrInvalidFilename
+			if errors.Is(err, repodb.ErrFileNotFound) || errors.As(err, &invalid) {
+				u.remove(path)
+				continue
+			}
+			return err
+		}
+		u.add(path, data)
+	}
+
+	return nil
+}
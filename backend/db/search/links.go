@@ -0,0 +1,562 @@
+package search
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+)
+
+// Documents link each other with wiki links, [[Note]], [[folder/Note]] or
+// [[Note#Heading|text]], and with Markdown links to relative paths like
+// [text](../folder/note.md#heading). Wiki links without a folder are resolved
+// by file name anywhere in the user storage: a file in the folder of the
+// linking document wins, then the shortest path. Wiki links with a folder and
+// Markdown links starting with "/" are relative to the user root. Links in
+// fenced code blocks and code spans are ignored.
+var (
+	wikiLinkRe = regexp.MustCompile(`\[\[([^\[\]\n|#]+)(#[^\[\]\n|]*)?(\|[^\[\]\n]*)?\]\]`)
+	mdLinkRe   = regexp.MustCompile(`\]\(\s*(?:<([^<>\n]*)>|([^()\s<>]+))(?:\s+(?:"[^"\n]*"|'[^'\n]*'))?\s*\)`)
+)
+
+var markdownExts = []string{".md", ".markdown"}
+
+// linkPathEscaper escapes characters of file names that end or change the
+// meaning of a Markdown link target.
+var linkPathEscaper = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "#", "%23")
+
+// link is a reference to a document. target is the path as written without
+// heading or alias, unescaped for Markdown links. start and end are offsets
+// of the target in the document: bytes from parseLinks, runes in the index.
+type link struct {
+	wiki   bool
+	target string
+	start  int
+	end    int
+	// bracketed Markdown targets are written in <>, unescaped.
+	bracketed bool
+}
+
+type Backlink struct {
+	Path    string  `json:"path"`
+	Snippet Snippet `json:"snippet"`
+}
+
+// GraphNode is a document, or a missing one some document links to.
+type GraphNode struct {
+	Path    string `json:"path"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// GraphEdge is a link from Source to Target, Count is the number of links.
+type GraphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Count  int    `json:"count"`
+}
+
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// Rewrite is a document updated to keep its links working after a rename. It
+// must only be saved at Path while its content still has ETag.
+type Rewrite struct {
+	Path string
+	Data []byte
+	ETag string
+}
+
+func hasMarkdownExt(p string) bool {
+	return slices.Contains(markdownExts, strings.ToLower(path.Ext(p)))
+}
+
+func trimMarkdownExt(p string) string {
+	if hasMarkdownExt(p) {
+		return p[:len(p)-len(path.Ext(p))]
+	}
+
+	return p
+}
+
+func outsideRoot(p string) bool {
+	return p == "." || p == ".." || strings.HasPrefix(p, "../")
+}
+
+// blank replaces everything but line breaks with spaces.
+func blank(b []byte) {
+	for i := range b {
+		if b[i] != '\n' {
+			b[i] = ' '
+		}
+	}
+}
+
+// maskCode returns a copy of the document with fenced code blocks and code
+// spans blanked, so offsets of the rest stay the same.
+func maskCode(data []byte) []byte {
+	masked := bytes.Clone(data)
+	var fence []byte
+	for pos := 0; pos < len(masked); {
+		end := bytes.IndexByte(masked[pos:], '\n')
+		if end < 0 {
+			end = len(masked)
+		} else {
+			end += pos
+		}
+		line := masked[pos:end]
+		trimmed := bytes.TrimLeft(line, " ")
+		indented := len(line)-len(trimmed) >= 4
+
+		switch {
+		case fence != nil:
+			// A closing fence is at least as long as the opening one.
+			if !indented && bytes.HasPrefix(trimmed, fence) &&
+				len(bytes.TrimSpace(bytes.TrimLeft(trimmed, string(fence[:1])))) == 0 {
+				fence = nil
+			}
+			blank(line)
+		case !indented && (bytes.HasPrefix(trimmed, []byte("```")) || bytes.HasPrefix(trimmed, []byte("~~~"))):
+			n := len(trimmed) - len(bytes.TrimLeft(trimmed, string(trimmed[:1])))
+			fence = bytes.Repeat(trimmed[:1], n)
+			blank(line)
+		default:
+			maskCodeSpans(line)
+		}
+
+		pos = end + 1
+	}
+
+	return masked
+}
+
+// maskCodeSpans blanks code spans of a line: text between backtick runs of
+// the same length.
+func maskCodeSpans(line []byte) {
+	run := func(i int) int {
+		n := 0
+		for i+n < len(line) && line[i+n] == '`' {
+			n++
+		}
+		return n
+	}
+
+	for i := 0; i < len(line); {
+		if line[i] != '`' {
+			i++
+			continue
+		}
+		n := run(i)
+		closing := -1
+		for j := i + n; j < len(line); {
+			if line[j] != '`' {
+				j++
+				continue
+			}
+			m := run(j)
+			if m == n {
+				closing = j
+				break
+			}
+			j += m
+		}
+		if closing < 0 {
+			i += n
+			continue
+		}
+		blank(line[i : closing+n])
+		i = closing + n
+	}
+}
+
+// parseLinks returns links of the document ordered by offset. Markdown links
+// count only if they point to a Markdown file.
+func parseLinks(data []byte) []link {
+	masked := maskCode(data)
+	var links []link
+
+	for _, m := range wikiLinkRe.FindAllSubmatchIndex(masked, -1) {
+		start, end := m[2], m[3]
+		for start < end && data[start] == ' ' {
+			start++
+		}
+		for end > start && data[end-1] == ' ' {
+			end--
+		}
+		if start == end {
+			continue
+		}
+		links = append(links, link{wiki: true, target: string(data[start:end]), start: start, end: end})
+	}
+
+	for _, m := range mdLinkRe.FindAllSubmatchIndex(masked, -1) {
+		start, end, bracketed := m[2], m[3], true
+		if start < 0 {
+			start, end, bracketed = m[4], m[5], false
+		}
+		target := string(data[start:end])
+		target, _, _ = strings.Cut(target, "#")
+		target, _, _ = strings.Cut(target, "?")
+		end = start + len(target)
+		// Colons are not allowed in file names, so the target is a URL.
+		if target == "" || strings.Contains(target, ":") {
+			continue
+		}
+		if !bracketed {
+			if unescaped, err := url.PathUnescape(target); err == nil {
+				target = unescaped
+			}
+		}
+		if !hasMarkdownExt(target) {
+			continue
+		}
+		links = append(links, link{target: target, start: start, end: end, bracketed: bracketed})
+	}
+
+	sort.Slice(links, func(i, j int) bool { return links[i].start < links[j].start })
+
+	return links
+}
+
+// runeOffsets converts byte offsets of links in data to rune offsets.
+func runeOffsets(data []byte, links []link) {
+	pos, runes := 0, 0
+	advance := func(offset int) int {
+		runes += utf8.RuneCount(data[pos:offset])
+		pos = offset
+		return runes
+	}
+
+	for i := range links {
+		links[i].start = advance(links[i].start)
+		links[i].end = advance(links[i].end)
+	}
+}
+
+// resolver resolves link targets among documents of a user.
+type resolver struct {
+	paths map[string]bool
+	// names maps lowercased file names without extension to paths.
+	names map[string][]string
+}
+
+func newResolver(paths []string) *resolver {
+	r := &resolver{paths: make(map[string]bool, len(paths)), names: make(map[string][]string)}
+	for _, p := range paths {
+		r.paths[p] = true
+		name := strings.ToLower(trimMarkdownExt(path.Base(p)))
+		r.names[name] = append(r.names[name], p)
+	}
+
+	return r
+}
+
+// resolve returns the path a link of the document at from points to and
+// whether that document exists. Links leaving the user root resolve to "".
+func (r *resolver) resolve(from string, l link) (string, bool) {
+	if !l.wiki {
+		var p string
+		if strings.HasPrefix(l.target, "/") {
+			p = path.Clean(strings.TrimLeft(l.target, "/"))
+		} else {
+			p = path.Join(path.Dir(from), l.target)
+		}
+		if outsideRoot(p) {
+			return "", false
+		}
+		return p, r.paths[p]
+	}
+
+	target := strings.TrimLeft(l.target, "/")
+	if strings.Contains(target, "/") {
+		p := path.Clean(target)
+		if outsideRoot(p) {
+			return "", false
+		}
+		if hasMarkdownExt(p) {
+			return p, r.paths[p]
+		}
+		for _, ext := range markdownExts {
+			if r.paths[p+ext] {
+				return p + ext, true
+			}
+		}
+		return p + markdownExts[0], false
+	}
+
+	dir := path.Dir(from)
+	best := ""
+	for _, p := range r.names[strings.ToLower(trimMarkdownExt(target))] {
+		if hasMarkdownExt(target) && !strings.EqualFold(path.Base(p), target) {
+			continue
+		}
+		if best == "" || closer(p, best, dir) {
+			best = p
+		}
+	}
+	if best != "" {
+		return best, true
+	}
+	if hasMarkdownExt(target) {
+		return target, false
+	}
+
+	return target + markdownExts[0], false
+}
+
+// closer reports whether a is a better match than b for a wiki link from a
+// document in dir.
+func closer(a, b, dir string) bool {
+	if inA, inB := path.Dir(a) == dir, path.Dir(b) == dir; inA != inB {
+		return inA
+	}
+	if da, db := strings.Count(a, "/"), strings.Count(b, "/"); da != db {
+		return da < db
+	}
+
+	return a < b
+}
+
+// relativePath returns the path to target from the folder dir.
+func relativePath(dir string, target string) string {
+	if dir == "." {
+		return target
+	}
+
+	from := strings.Split(dir, "/")
+	to := strings.Split(target, "/")
+	common := 0
+	for common < len(from) && common < len(to)-1 && from[common] == to[common] {
+		common++
+	}
+
+	return strings.Repeat("../", len(from)-common) + strings.Join(to[common:], "/")
+}
+
+// linkTarget returns the target to write in the link l of the document at
+// dest to point to newPath, keeping the form of the link where possible. It
+// returns "" if a wiki link can't express the path.
+func linkTarget(after *resolver, dest string, l link, newPath string) string {
+	if !l.wiki {
+		target := relativePath(path.Dir(dest), newPath)
+		if strings.HasPrefix(l.target, "/") {
+			target = "/" + newPath
+		}
+		if l.bracketed {
+			return target
+		}
+		return linkPathEscaper.Replace(target)
+	}
+
+	short := newPath
+	if !hasMarkdownExt(l.target) {
+		short = trimMarkdownExt(newPath)
+	}
+	var candidates []string
+	if !strings.Contains(strings.TrimLeft(l.target, "/"), "/") {
+		candidates = append(candidates, path.Base(short))
+	}
+	candidates = append(candidates, short, newPath)
+
+	for _, c := range candidates {
+		if strings.ContainsAny(c, "#[]|") {
+			continue
+		}
+		if p, ok := after.resolve(dest, link{wiki: true, target: c}); ok && p == newPath {
+			return c
+		}
+	}
+
+	return ""
+}
+
+// rewriteLinks updates links of the document at from, which will be at dest,
+// after oldPath is renamed to newPath. Relative Markdown links of a document
+// moved to another folder are updated to point to the same documents.
+func rewriteLinks(data []byte, from, dest, oldPath, newPath string, before, after *resolver) []byte {
+	moved := path.Dir(from) != path.Dir(dest)
+
+	var out []byte
+	last := 0
+	for _, l := range parseLinks(data) {
+		target, ok := before.resolve(from, l)
+		if !ok {
+			continue
+		}
+
+		var replacement string
+		switch {
+		case target == oldPath:
+			replacement = linkTarget(after, dest, l, newPath)
+		case moved && !l.wiki && !strings.HasPrefix(l.target, "/"):
+			replacement = linkTarget(after, dest, l, target)
+		}
+		if replacement == "" {
+			continue
+		}
+
+		out = append(out, data[last:l.start]...)
+		out = append(out, replacement...)
+		last = l.end
+	}
+	if out == nil {
+		return data
+	}
+
+	return append(out, data[last:]...)
+}
+
+// paths returns paths of the indexed documents, sorted.
+func (u *userIndex) paths() []string {
+	paths := make([]string, 0, len(u.docs))
+	for p := range u.docs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// Backlinks returns documents of the user linking to the file, sorted by
+// path. Snippets show the text around the links.
+func (i *Index) Backlinks(userId uuid.UUID, filename string) ([]Backlink, error) {
+	u, err := i.lockUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer u.mu.Unlock()
+
+	r := newResolver(u.paths())
+	backlinks := []Backlink{}
+	for _, p := range u.paths() {
+		if p == filename {
+			continue
+		}
+
+		doc := u.docs[p]
+		var ranges []Highlight
+		for _, l := range doc.links {
+			if target, ok := r.resolve(p, l); ok && target == filename {
+				ranges = append(ranges, Highlight{Start: l.start, End: l.end})
+			}
+		}
+		if len(ranges) > 0 {
+			backlinks = append(backlinks, Backlink{Path: p, Snippet: snippetAround(doc, ranges)})
+		}
+	}
+
+	return backlinks, nil
+}
+
+// Graph returns documents of the user and links between them. Links to
+// missing documents add missing nodes, links of a document to itself are
+// left out.
+func (i *Index) Graph(userId uuid.UUID) (Graph, error) {
+	u, err := i.lockUser(userId)
+	if err != nil {
+		return Graph{}, err
+	}
+	defer u.mu.Unlock()
+
+	paths := u.paths()
+	r := newResolver(paths)
+	graph := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	missing := make(map[string]bool)
+	for _, p := range paths {
+		graph.Nodes = append(graph.Nodes, GraphNode{Path: p})
+
+		counts := make(map[string]int)
+		for _, l := range u.docs[p].links {
+			target, ok := r.resolve(p, l)
+			if target == "" || target == p {
+				continue
+			}
+			if !ok {
+				missing[target] = true
+			}
+			counts[target]++
+		}
+		for target, count := range counts {
+			graph.Edges = append(graph.Edges, GraphEdge{Source: p, Target: target, Count: count})
+		}
+	}
+	for p := range missing {
+		graph.Nodes = append(graph.Nodes, GraphNode{Path: p, Missing: true})
+	}
+
+	sort.Slice(graph.Nodes, func(a, b int) bool { return graph.Nodes[a].Path < graph.Nodes[b].Path })
+	sort.Slice(graph.Edges, func(a, b int) bool {
+		if graph.Edges[a].Source != graph.Edges[b].Source {
+			return graph.Edges[a].Source < graph.Edges[b].Source
+		}
+		return graph.Edges[a].Target < graph.Edges[b].Target
+	})
+
+	return graph, nil
+}
+
+// RenameRewrites returns documents of the user to update when the file at
+// oldPath is renamed to newPath: links to the file are changed to the new
+// path, and relative links of the file itself to keep pointing to the same
+// documents from its new folder. It must be called before the rename, the
+// rewrites are saved after it.
+func (i *Index) RenameRewrites(userId uuid.UUID, oldPath, newPath string) ([]Rewrite, error) {
+	u, err := i.lockUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	defer u.mu.Unlock()
+
+	if _, ok := u.docs[oldPath]; !ok {
+		return nil, nil
+	}
+
+	paths := u.paths()
+	before := newResolver(paths)
+	renamed := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p != oldPath {
+			renamed = append(renamed, p)
+		}
+	}
+	after := newResolver(append(renamed, newPath))
+
+	var rewrites []Rewrite
+	for _, p := range paths {
+		if p != oldPath && !slices.ContainsFunc(u.docs[p].links, func(l link) bool {
+			target, ok := before.resolve(p, l)
+			return ok && target == oldPath
+		}) {
+			continue
+		}
+
+		data, err := i.repo.Get(p, userId)
+		if err != nil {
+			if errors.Is(err, repodb.ErrFileNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		dest := p
+		if p == oldPath {
+			dest = newPath
+		}
+		updated := rewriteLinks(data, p, dest, oldPath, newPath, before, after)
+		if !bytes.Equal(updated, data) {
+			rewrites = append(rewrites, Rewrite{Path: dest, Data: updated, ETag: repodb.ETag(data)})
+		}
+	}
+
+	return rewrites, nil
+}
@@ -0,0 +1,178 @@
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func linkTargets(links []link) []string {
+	targets := []string{}
+	for _, l := range links {
+		targets = append(targets, l.target)
+	}
+	return targets
+}
+
+func TestParseLinks(t *testing.T) {
+	doc := []byte("See [[ Note ]], [[folder/Other#Intro|the other]] and [text](../a%20b.md#x).\n" +
+		"Not links: [site](https://example.com/x.md), [pic](img.png), `[[code]]`.\n" +
+		"```\n[[fenced]]\n```\n" +
+		"[angle](<my note.md> \"title\") ![[Embed.md]]\n")
+
+	links := parseLinks(doc)
+	assert.Equal(t, []string{"Note", "folder/Other", "../a b.md", "my note.md", "Embed.md"}, linkTargets(links))
+	assert.Equal(t, "Note", string(doc[links[0].start:links[0].end]))
+	assert.Equal(t, "../a%20b.md", string(doc[links[2].start:links[2].end]))
+	assert.True(t, links[3].bracketed)
+	assert.False(t, links[2].wiki)
+}
+
+func TestResolveLinks(t *testing.T) {
+	r := newResolver([]string{"note.md", "a/note.md", "a/b/deep.md", "a/other.markdown", "x/Deep.md"})
+
+	cases := []struct {
+		from   string
+		link   link
+		target string
+		ok     bool
+	}{
+		{"a/b/deep.md", link{wiki: true, target: "Note"}, "note.md", true},
+		{"a/other.markdown", link{wiki: true, target: "note"}, "a/note.md", true},
+		{"note.md", link{wiki: true, target: "deep"}, "x/Deep.md", true},
+		{"note.md", link{wiki: true, target: "a/other"}, "a/other.markdown", true},
+		{"note.md", link{wiki: true, target: "deep.markdown"}, "deep.markdown", false},
+		{"note.md", link{wiki: true, target: "Missing"}, "Missing.md", false},
+		{"a/b/deep.md", link{target: "../note.md"}, "a/note.md", true},
+		{"a/b/deep.md", link{target: "/note.md"}, "note.md", true},
+		{"a/b/deep.md", link{target: "../../../note.md"}, "", false},
+	}
+	for _, c := range cases {
+		target, ok := r.resolve(c.from, c.link)
+		assert.Equal(t, c.target, target, c.link.target)
+		assert.Equal(t, c.ok, ok, c.link.target)
+	}
+}
+
+func TestBacklinksAndGraph(t *testing.T) {
+	repo, index := newTestRepo(t)
+	userId := uuid.New()
+
+	require.NoError(t, repo.CreateFolder("projects", userId))
+	require.NoError(t, repo.Create("projects/plan.md", userId, []byte("# Plan\n\nSee [[Ideas]] and [[Ideas]].")))
+	require.NoError(t, repo.Create("ideas.md", userId, []byte("Back to [the plan](projects/plan.md), [[Ideas]] and [[Todo]].")))
+	require.NoError(t, repo.Create("lonely.md", userId, []byte("No links.")))
+
+	backlinks, err := index.Backlinks(userId, "ideas.md")
+	require.NoError(t, err)
+	require.Len(t, backlinks, 1)
+	assert.Equal(t, "projects/plan.md", backlinks[0].Path)
+	assert.Equal(t, "# Plan\n\nSee [[Ideas]] and [[Ideas]].", backlinks[0].Snippet.Text)
+	assert.Equal(t, []Highlight{{Start: 14, End: 19}, {Start: 28, End: 33}}, backlinks[0].Snippet.Highlights)
+
+	graph, err := index.Graph(userId)
+	require.NoError(t, err)
+	assert.Equal(t, []GraphNode{
+		{Path: "Todo.md", Missing: true},
+		{Path: "ideas.md"},
+		{Path: "lonely.md"},
+		{Path: "projects/plan.md"},
+	}, graph.Nodes)
+	assert.Equal(t, []GraphEdge{
+		{Source: "ideas.md", Target: "Todo.md", Count: 1},
+		{Source: "ideas.md", Target: "projects/plan.md", Count: 1},
+		{Source: "projects/plan.md", Target: "ideas.md", Count: 2},
+	}, graph.Edges)
+
+	// The graph follows writes.
+	require.NoError(t, repo.Save("projects/plan.md", userId, []byte("No more ideas.")))
+	backlinks, err = index.Backlinks(userId, "ideas.md")
+	require.NoError(t, err)
+	assert.Empty(t, backlinks)
+}
+
+func TestRenameRewrites(t *testing.T) {
+	repo, index := newTestRepo(t)
+	userId := uuid.New()
+
+	require.NoError(t, repo.CreateFolder("notes", userId))
+	require.NoError(t, repo.CreateFolder("archive", userId))
+	require.NoError(t, repo.Create("notes/target.md", userId, []byte("Up: [index](../index.md), self: [[Target]].")))
+	require.NoError(t, repo.Create("index.md", userId, []byte("[[Target]], [[notes/target|alias]], [t](notes/target.md#top), `[[Target]]`.")))
+	require.NoError(t, repo.Create("archive/old.md", userId, []byte("[t](<../notes/target.md>)")))
+
+	rewrites, err := index.RenameRewrites(userId, "notes/target.md", "archive/Moved Note.md")
+	require.NoError(t, err)
+
+	contents := map[string]string{}
+	for _, rw := range rewrites {
+		current, err := repo.Get(rw.Path, userId)
+		if rw.Path == "archive/Moved Note.md" {
+			current, err = repo.Get("notes/target.md", userId)
+		}
+		require.NoError(t, err)
+		assert.Equal(t, repodb.ETag(current), rw.ETag)
+		contents[rw.Path] = string(rw.Data)
+	}
+	assert.Equal(t, map[string]string{
+		"index.md":              "[[Moved Note]], [[archive/Moved Note|alias]], [t](archive/Moved%20Note.md#top), `[[Target]]`.",
+		"archive/old.md":        "[t](<Moved Note.md>)",
+		"archive/Moved Note.md": "Up: [index](../index.md), self: [[Moved Note]].",
+	}, contents)
+
+	// A name used by another file is replaced with the path.
+	require.NoError(t, repo.Create("Moved Note.md", userId, nil))
+	rewrites, err = index.RenameRewrites(userId, "notes/target.md", "archive/Moved Note.md")
+	require.NoError(t, err)
+	for _, rw := range rewrites {
+		if rw.Path == "index.md" {
+			assert.Equal(t, "[[archive/Moved Note]], [[archive/Moved Note|alias]], [t](archive/Moved%20Note.md#top), `[[Target]]`.", string(rw.Data))
+		}
+	}
+
+	rewrites, err = index.RenameRewrites(userId, "missing.md", "other.md")
+	require.NoError(t, err)
+	assert.Empty(t, rewrites)
+}
+
+func TestRewriteMovedDocument(t *testing.T) {
+	before := newResolver([]string{"a/doc.md", "a/sibling.md", "top.md"})
+	after := newResolver([]string{"b/c/doc.md", "a/sibling.md", "top.md"})
+
+	data := []byte("[s](sibling.md) [t](../top.md) [r](/top.md) [[sibling]] [m](missing.md)")
+	assert.Equal(t, "[s](../../a/sibling.md) [t](../../top.md) [r](/top.md) [[sibling]] [m](missing.md)",
+		string(rewriteLinks(data, "a/doc.md", "b/c/doc.md", "a/doc.md", "b/c/doc.md", before, after)))
+}
+
+func TestReferencesAttachment(t *testing.T) {
+	repo, index := newTestRepo(t)
+	userId, owner := uuid.New(), uuid.New()
+	id := strings.Repeat("ab", 32) + ".png"
+	require.NoError(t, repo.Create("a.md", userId, []byte("![pic](/api/attachments/"+owner.String()+"/"+id+")")))
+
+	ok, err := index.ReferencesAttachment(userId, "a.md", owner, id)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// Other owners, other ids and other documents don't match.
+	ok, err = index.ReferencesAttachment(userId, "a.md", userId, id)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = index.ReferencesAttachment(userId, "a.md", owner, strings.Repeat("cd", 32)+".png")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = index.ReferencesAttachment(userId, "missing.md", owner, id)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Saves update the references.
+	require.NoError(t, repo.Save("a.md", userId, []byte("no pictures")))
+	ok, err = index.ReferencesAttachment(userId, "a.md", owner, id)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
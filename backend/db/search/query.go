@@ -0,0 +1,318 @@
+package search
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var ErrEmptyQuery = errors.New("query has no terms")
+
+// BM25 parameters and the score added per query term found in the path.
+const (
+	BM25_K1          = 1.2
+	BM25_B           = 0.75
+	PATH_MATCH_BOOST = 2.0
+	// SNIPPET_CONTEXT is the number of runes shown before the first match,
+	// SNIPPET_LENGTH the length of the whole snippet.
+	SNIPPET_CONTEXT = 60
+	SNIPPET_LENGTH  = 240
+)
+
+// clause is a part of a query: a single term, a term prefix ("mark*") or a
+// quoted phrase. Every clause must match a document.
+type clause struct {
+	terms  []string
+	prefix bool
+}
+
+// Highlight marks a match in the snippet. Offsets are in Unicode code points
+// relative to the snippet text, End is exclusive.
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type Snippet struct {
+	Text       string      `json:"text"`
+	Highlights []Highlight `json:"highlights"`
+}
+
+type Result struct {
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Snippet Snippet `json:"snippet"`
+}
+
+// parseQuery splits the query into clauses. Words are split like document
+// text, so "foo-bar" without quotes is two terms. A trailing "*" makes the
+// last term of a word a prefix.
+func parseQuery(q string) []clause {
+	var clauses []clause
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			tokens := tokenize([]rune(part))
+			if len(tokens) == 0 {
+				continue
+			}
+			terms := make([]string, len(tokens))
+			for j, t := range tokens {
+				terms[j] = t.term
+			}
+			clauses = append(clauses, clause{terms: terms})
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			tokens := tokenize([]rune(word))
+			for j, t := range tokens {
+				prefix := j == len(tokens)-1 && strings.HasSuffix(word, "*")
+				clauses = append(clauses, clause{terms: []string{t.term}, prefix: prefix})
+			}
+		}
+	}
+
+	return clauses
+}
+
+// expand returns the indexed terms matching a single-term clause.
+func (u *userIndex) expand(c clause) []string {
+	if !c.prefix {
+		if _, ok := u.postings[c.terms[0]]; ok {
+			return []string{c.terms[0]}
+		}
+		return nil
+	}
+
+	var terms []string
+	for term := range u.postings {
+		if strings.HasPrefix(term, c.terms[0]) {
+			terms = append(terms, term)
+		}
+	}
+
+	return terms
+}
+
+// match returns the token ranges of doc matched by the clause.
+func (u *userIndex) match(doc *document, c clause, expanded []string) [][2]int {
+	var spans [][2]int
+	if len(c.terms) == 1 {
+		for _, term := range expanded {
+			for _, pos := range u.postings[term][doc.path] {
+				spans = append(spans, [2]int{pos, pos + 1})
+			}
+		}
+		return spans
+	}
+
+	for _, pos := range u.postings[c.terms[0]][doc.path] {
+		if pos+len(c.terms) > len(doc.tokens) {
+			continue
+		}
+		matched := true
+		for j, term := range c.terms[1:] {
+			if doc.tokens[pos+1+j].term != term {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			spans = append(spans, [2]int{pos, pos + len(c.terms)})
+		}
+	}
+
+	return spans
+}
+
+// pathMatches reports whether the path of doc contains the clause.
+func pathMatches(doc *document, c clause) bool {
+	for i := range doc.pathTerms {
+		if i+len(c.terms) > len(doc.pathTerms) {
+			break
+		}
+		matched := true
+		for j, term := range c.terms {
+			t := doc.pathTerms[i+j].term
+			last := j == len(c.terms)-1
+			if t != term && !(c.prefix && last && strings.HasPrefix(t, term)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Search returns documents of the user matching all clauses of the query,
+// best first. Documents are ranked by BM25 over the matched clauses, with a
+// boost for clauses found in the path. Ties are broken by path. limit <= 0
+// returns all results. The second value is the number of all matches.
+func (i *Index) Search(userId uuid.UUID, q string, limit int) ([]Result, int, error) {
+	clauses := parseQuery(q)
+	if len(clauses) == 0 {
+		return nil, 0, ErrEmptyQuery
+	}
+
+	u, err := i.lockUser(userId)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer u.mu.Unlock()
+
+	avgLen := 0.0
+	for _, doc := range u.docs {
+		avgLen += float64(len(doc.tokens))
+	}
+	if len(u.docs) > 0 {
+		avgLen /= float64(len(u.docs))
+	}
+
+	type hit struct {
+		doc   *document
+		score float64
+		spans [][2]int
+	}
+	var hits []hit
+	expanded := make([][]string, len(clauses))
+	for j, c := range clauses {
+		expanded[j] = u.expand(c)
+	}
+
+	for _, doc := range u.docs {
+		h := hit{doc: doc}
+		for j, c := range clauses {
+			spans := u.match(doc, c, expanded[j])
+			inPath := pathMatches(doc, c)
+			if len(spans) == 0 && !inPath {
+				h.doc = nil
+				break
+			}
+
+			if len(spans) > 0 {
+				h.score += u.bm25(c, expanded[j], len(spans), len(doc.tokens), avgLen)
+			}
+			if inPath {
+				h.score += PATH_MATCH_BOOST
+			}
+			h.spans = append(h.spans, spans...)
+		}
+		if h.doc != nil {
+			hits = append(hits, h)
+		}
+	}
+
+	sort.Slice(hits, func(a, b int) bool {
+		if hits[a].score != hits[b].score {
+			return hits[a].score > hits[b].score
+		}
+		return hits[a].doc.path < hits[b].doc.path
+	})
+
+	total := len(hits)
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	results := make([]Result, 0, len(hits))
+	for _, h := range hits {
+		results = append(results, Result{
+			Path:    h.doc.path,
+			Score:   math.Round(h.score*1000) / 1000,
+			Snippet: makeSnippet(h.doc, h.spans),
+		})
+	}
+
+	return results, total, nil
+}
+
+// bm25 scores a clause matched freq times in a document of docLen tokens.
+// The document frequency of a prefix clause is the number of documents
+// containing any of its terms, of a phrase the rarest of its terms.
+func (u *userIndex) bm25(c clause, expanded []string, freq int, docLen int, avgLen float64) float64 {
+	df := 0
+	if len(c.terms) == 1 {
+		docs := map[string]bool{}
+		for _, term := range expanded {
+			for path := range u.postings[term] {
+				docs[path] = true
+			}
+		}
+		df = len(docs)
+	} else {
+		df = len(u.docs)
+		for _, term := range c.terms {
+			df = min(df, len(u.postings[term]))
+		}
+	}
+
+	n := float64(len(u.docs))
+	idf := math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+	tf := float64(freq)
+	norm := 1.0
+	if avgLen > 0 {
+		norm = 1 - BM25_B + BM25_B*float64(docLen)/avgLen
+	}
+
+	return idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*norm)
+}
+
+// makeSnippet cuts a piece of the document around the first match and marks
+// all matches inside of it. spans are token ranges.
+func makeSnippet(doc *document, spans [][2]int) Snippet {
+	ranges := make([]Highlight, 0, len(spans))
+	for _, s := range spans {
+		ranges = append(ranges, Highlight{Start: doc.tokens[s[0]].start, End: doc.tokens[s[1]-1].end})
+	}
+
+	return snippetAround(doc, ranges)
+}
+
+// snippetAround cuts a piece of the document around the first of ranges,
+// which are offsets in the text, and marks all ranges inside of it.
+func snippetAround(doc *document, ranges []Highlight) Snippet {
+	slices.SortFunc(ranges, func(a, b Highlight) int {
+		if a.Start != b.Start {
+			return a.Start - b.Start
+		}
+		return b.End - a.End
+	})
+
+	from := 0
+	if len(ranges) > 0 {
+		from = max(ranges[0].Start-SNIPPET_CONTEXT, 0)
+		// Don't cut a word in half.
+		for from > 0 && isWordRune(doc.text[from-1]) && from < ranges[0].Start {
+			from++
+		}
+	}
+	to := min(from+SNIPPET_LENGTH, len(doc.text))
+	minTo := from
+	if len(ranges) > 0 {
+		minTo = min(ranges[0].End, to)
+	}
+	for to < len(doc.text) && to > minTo && isWordRune(doc.text[to-1]) && isWordRune(doc.text[to]) {
+		to--
+	}
+
+	snippet := Snippet{Highlights: []Highlight{}}
+	last := from
+	for _, r := range ranges {
+		if r.Start < last || r.End > to {
+			continue
+		}
+		snippet.Highlights = append(snippet.Highlights, Highlight{Start: r.Start - from, End: r.End - from})
+		last = r.End
+	}
+	snippet.Text = string(doc.text[from:to])
+
+	return snippet
+}
@@ -0,0 +1,187 @@
+package search
+
+import (
+	"testing"
+
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRepo(t *testing.T) (*IndexedRepository, *Index) {
+	local, err := repodb.NewLocalFileRepo(t.TempDir())
+	require.NoError(t, err)
+
+	index := NewIndex(local)
+	return NewIndexedRepository(local, index), index
+}
+
+func resultPaths(results []Result) []string {
+	paths := []string{}
+	for _, r := range results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func TestParseQuery(t *testing.T) {
+	assert.Equal(t, []clause{
+		{terms: []string{"go"}},
+		{terms: []string{"quick", "brown"}},
+		{terms: []string{"mark"}, prefix: true},
+		{terms: []string{"foo"}},
+		{terms: []string{"bar"}},
+	}, parseQuery(`Go "quick, Brown" mark* foo-bar ""`))
+	assert.Empty(t, parseQuery(` * " " --`))
+}
+
+func TestSearch(t *testing.T) {
+	repo, index := newTestRepo(t)
+	userId := uuid.New()
+
+	require.NoError(t, repo.Create("fox.md", userId, []byte("The quick brown fox jumps over the lazy dog.")))
+	require.NoError(t, repo.Create("dogs.md", userId, []byte("Dogs: a dog, another dog and a brown dog.")))
+	require.NoError(t, repo.Create("markdown.md", userId, []byte("Markdown is a markup language.")))
+
+	results, total, err := index.Search(userId, "dog", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []string{"dogs.md", "fox.md"}, resultPaths(results))
+
+	results, _, err = index.Search(userId, `"brown fox"`, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fox.md"}, resultPaths(results))
+	assert.Equal(t, "The quick brown fox jumps over the lazy dog.", results[0].Snippet.Text)
+	assert.Equal(t, []Highlight{{Start: 10, End: 19}}, results[0].Snippet.Highlights)
+
+	results, _, err = index.Search(userId, `"fox brown"`, 0)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	results, _, err = index.Search(userId, "mark*", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"markdown.md"}, resultPaths(results))
+	assert.Equal(t, []Highlight{{Start: 0, End: 8}, {Start: 14, End: 20}}, results[0].Snippet.Highlights)
+
+	results, _, err = index.Search(userId, "brown dog", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"dogs.md"}, resultPaths(results))
+
+	// Path matches count, even without a match in the text.
+	results, _, err = index.Search(userId, "fox", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fox.md"}, resultPaths(results))
+
+	_, _, err = index.Search(userId, `""`, 0)
+	assert.Equal(t, ErrEmptyQuery, err)
+}
+
+func TestSearchSnippet(t *testing.T) {
+	repo, index := newTestRepo(t)
+	userId := uuid.New()
+
+	prefix := ""
+	for range 30 {
+		prefix += "lorem "
+	}
+	require.NoError(t, repo.Create("long.md", userId, []byte(prefix+"Привет, мир!")))
+
+	results, _, err := index.Search(userId, "мир", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	snippet := results[0].Snippet
+	require.Len(t, snippet.Highlights, 1)
+	h := snippet.Highlights[0]
+	assert.Equal(t, "мир", string([]rune(snippet.Text)[h.Start:h.End]))
+	assert.Equal(t, "lorem ", string([]rune(snippet.Text)[:6]))
+}
+
+func TestIndexedRepository(t *testing.T) {
+	repo, index := newTestRepo(t)
+	userId := uuid.New()
+	search := func(q string) []string {
+		results, _, err := index.Search(userId, q, 0)
+		require.NoError(t, err)
+		return resultPaths(results)
+	}
+
+	require.NoError(t, repo.CreateFolder("notes", userId))
+	require.NoError(t, repo.Create("notes/a.md", userId, []byte("alpha")))
+	assert.Equal(t, []string{"notes/a.md"}, search("alpha"))
+
+	require.NoError(t, repo.Save("notes/a.md", userId, []byte("beta")))
+	assert.Empty(t, search("alpha"))
+	assert.Equal(t, []string{"notes/a.md"}, search("beta"))
+
+	require.NoError(t, repo.RestoreVersion("notes/a.md", userId, 1))
+	assert.Equal(t, []string{"notes/a.md"}, search("alpha"))
+
+	require.NoError(t, repo.Rename("notes/a.md", "notes/b.md", userId))
+	assert.Equal(t, []string{"notes/b.md"}, search("alpha"))
+
+	require.NoError(t, repo.RenameFolder("notes", "archive", userId))
+	assert.Equal(t, []string{"archive/b.md"}, search("alpha"))
+
+	require.NoError(t, repo.DeleteFolder("archive", userId, true))
+	assert.Empty(t, search("alpha"))
+
+	items, err := repo.ListTrash(userId)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	filename, err := repo.RestoreFromTrash(items[0].Id, userId, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filename}, search("alpha"))
+
+	require.NoError(t, repo.Delete(filename, userId))
+	assert.Empty(t, search("alpha"))
+
+	// Users don't see each other's documents.
+	require.NoError(t, repo.Create("a.md", uuid.New(), []byte("alpha")))
+	assert.Empty(t, search("alpha"))
+}
+
+func TestIndexRebuild(t *testing.T) {
+	local, err := repodb.NewLocalFileRepo(t.TempDir())
+	require.NoError(t, err)
+	index := NewIndex(local)
+	userId := uuid.New()
+
+	// Files written before the first search are read when the index is built.
+	require.NoError(t, local.Create("a.md", userId, []byte("gamma")))
+	results, _, err := index.Search(userId, "gamma", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.md"}, resultPaths(results))
+
+	// Writes bypassing the index are only seen after a rebuild.
+	require.NoError(t, local.Create("b.md", userId, []byte("gamma")))
+	results, _, err = index.Search(userId, "gamma", 0)
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	require.NoError(t, index.Rebuild(userId))
+	results, _, err = index.Search(userId, "gamma", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.md", "b.md"}, resultPaths(results))
+}
+
+func TestIndexBuildAll(t *testing.T) {
+	local, err := repodb.NewLocalFileRepo(t.TempDir())
+	require.NoError(t, err)
+	alice, bob := uuid.New(), uuid.New()
+	require.NoError(t, local.Create("a.md", alice, []byte("delta")))
+	require.NoError(t, local.Create("b.md", bob, []byte("delta")))
+
+	index := NewIndex(local)
+	built, err := index.BuildAll()
+	require.NoError(t, err)
+	assert.Equal(t, 2, built)
+
+	// Built indexes are used as they are, writes bypassing them aren't seen.
+	require.NoError(t, local.Create("c.md", alice, []byte("delta")))
+	results, _, err := index.Search(alice, "delta", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.md"}, resultPaths(results))
+}
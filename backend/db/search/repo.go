@@ -0,0 +1,89 @@
+package search
+
+import (
+	"backend/db/repodb"
+
+	"github.com/google/uuid"
+)
+
+// IndexedRepository updates the index after every write to the wrapped
+// repository. Failed writes refresh the index too, since a write may fail
+// after the content was already changed. Reads are passed through.
+type IndexedRepository struct {
+	repodb.FileRepository
+	index *Index
+}
+
+func NewIndexedRepository(repo repodb.FileRepository, index *Index) *IndexedRepository {
+	return &IndexedRepository{FileRepository: repo, index: index}
+}
+
+func (r *IndexedRepository) Save(filename string, userId uuid.UUID, data []byte) error {
+	return r.SaveIfMatch(filename, userId, data, nil)
+}
+
+func (r *IndexedRepository) SaveIfMatch(filename string, userId uuid.UUID, data []byte, ifMatch []string) error {
+	err := r.FileRepository.SaveIfMatch(filename, userId, data, ifMatch)
+	r.index.refresh(userId, []string{filename}, nil)
+
+	return err
+}
+
+func (r *IndexedRepository) Create(filename string, userId uuid.UUID, data []byte) error {
+	err := r.FileRepository.Create(filename, userId, data)
+	r.index.refresh(userId, []string{filename}, nil)
+
+	return err
+}
+
+func (r *IndexedRepository) Delete(filename string, userId uuid.UUID) error {
+	return r.DeleteIfMatch(filename, userId, nil)
+}
+
+func (r *IndexedRepository) DeleteIfMatch(filename string, userId uuid.UUID, ifMatch []string) error {
+	err := r.FileRepository.DeleteIfMatch(filename, userId, ifMatch)
+	r.index.refresh(userId, []string{filename}, nil)
+
+	return err
+}
+
+func (r *IndexedRepository) Rename(filename string, newFilename string, userId uuid.UUID) error {
+	return r.RenameIfMatch(filename, newFilename, userId, nil)
+}
+
+func (r *IndexedRepository) RenameIfMatch(filename string, newFilename string, userId uuid.UUID, ifMatch []string) error {
+	err := r.FileRepository.RenameIfMatch(filename, newFilename, userId, ifMatch)
+	r.index.refresh(userId, []string{filename, newFilename}, nil)
+
+	return err
+}
+
+func (r *IndexedRepository) RenameFolder(path string, newPath string, userId uuid.UUID) error {
+	err := r.FileRepository.RenameFolder(path, newPath, userId)
+	r.index.refresh(userId, nil, []string{path, newPath})
+
+	return err
+}
+
+func (r *IndexedRepository) DeleteFolder(path string, userId uuid.UUID, recursive bool) error {
+	err := r.FileRepository.DeleteFolder(path, userId, recursive)
+	r.index.refresh(userId, nil, []string{path})
+
+	return err
+}
+
+func (r *IndexedRepository) RestoreFromTrash(id string, userId uuid.UUID, autoRename bool) (string, error) {
+	filename, err := r.FileRepository.RestoreFromTrash(id, userId, autoRename)
+	if filename != "" {
+		r.index.refresh(userId, []string{filename}, nil)
+	}
+
+	return filename, err
+}
+
+func (r *IndexedRepository) RestoreVersion(filename string, userId uuid.UUID, versionId int) error {
+	err := r.FileRepository.RestoreVersion(filename, userId, versionId)
+	r.index.refresh(userId, []string{filename}, nil)
+
+	return err
+}
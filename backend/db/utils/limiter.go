@@ -1,47 +1,175 @@
 package utils
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// MAX_FILES actions per WINDOW_LENGTH is the limit of NewRateLimiter.
 const (
 	MAX_FILES     = 5
 	WINDOW_LENGTH = 5 * time.Second
 )
 
+// Rate is a limit of actions within a sliding window.
+type Rate struct {
+	Limit  int
+	Window time.Duration
+}
+
+func (r Rate) String() string {
+	return strconv.Itoa(r.Limit) + "/" + r.Window.String()
+}
+
+// ParseRates parses rates in the form "api=300/1m,upload=5/5s", where the
+// window is a Go duration. Rates missing from s are taken from defaults.
+func ParseRates(s string, defaults map[string]Rate) (map[string]Rate, error) {
+	rates := make(map[string]Rate, len(defaults))
+	for name, rate := range defaults {
+		rates[name] = rate
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, rate, ok := strings.Cut(item, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid rate %q", item)
+		}
+		if _, ok := defaults[name]; !ok {
+			return nil, fmt.Errorf("unknown rate %q", name)
+		}
+		limit, window, ok := strings.Cut(rate, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate %q", name)
+		}
+
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit of rate %q", name)
+		}
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid window of rate %q", name)
+		}
+
+		rates[name] = Rate{Limit: n, Window: d}
+	}
+
+	return rates, nil
+}
+
+// Decision is the outcome of RateLimiter.Take. Reset is the time until the
+// window of the user is empty again, RetryAfter the time until the next
+// action is allowed, zero if it is allowed now.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimiter allows a key, usually a user, at most Rate.Limit actions
+// within a sliding window. Keys idle for a whole window are forgotten, so
+// memory only grows with the number of active keys.
 type RateLimiter struct {
-	mu  sync.Mutex
-	mem map[uuid.UUID][]time.Time
+	rate      Rate
+	mu        sync.Mutex
+	mem       map[string][]time.Time
+	lastEvict time.Time
 }
 
 func NewRateLimiter() *RateLimiter {
+	return NewRateLimiterWithRate(Rate{Limit: MAX_FILES, Window: WINDOW_LENGTH})
+}
+
+func NewRateLimiterWithRate(rate Rate) *RateLimiter {
 	return &RateLimiter{
-		mem: make(map[uuid.UUID][]time.Time),
+		rate: rate,
+		mem:  make(map[string][]time.Time),
 	}
 }
 
+func (r *RateLimiter) Rate() Rate {
+	return r.rate
+}
+
 func (r *RateLimiter) Allow(userId uuid.UUID) bool {
+	return r.Take(userId).Allowed
+}
+
+// Take counts an action of the user if the limit allows it.
+func (r *RateLimiter) Take(userId uuid.UUID) Decision {
+	return r.TakeKey(userId.String())
+}
+
+// TakeKey counts an action of the key, e.g. a client address, if the limit
+// allows it.
+func (r *RateLimiter) TakeKey(key string) Decision {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+
 	now := time.Now()
-	times := r.mem[userId]
-	valid := times[:0]
+	if now.Sub(r.lastEvict) > r.rate.Window {
+		r.evict(now)
+	}
+
+	valid := r.valid(key, now)
+	decision := Decision{Limit: r.rate.Limit}
+	if len(valid) < r.rate.Limit {
+		valid = append(valid, now)
+		decision.Allowed = true
+	} else {
+		// The oldest action leaves the window first.
+		decision.RetryAfter = valid[0].Add(r.rate.Window).Sub(now)
+	}
+	r.mem[key] = valid
+
+	decision.Remaining = r.rate.Limit - len(valid)
+	decision.Reset = valid[len(valid)-1].Add(r.rate.Window).Sub(now)
+
+	return decision
+}
 
+// valid returns actions of the key within the window at now.
+func (r *RateLimiter) valid(key string, now time.Time) []time.Time {
+	times := r.mem[key]
+	valid := times[:0]
 	for _, t := range times {
-		if now.Sub(t) <= WINDOW_LENGTH {
+		if now.Sub(t) < r.rate.Window {
 			valid = append(valid, t)
 		}
 	}
-	r.mem[userId] = valid
 
-	if len(valid) >= MAX_FILES {
-		return false
+	return valid
+}
+
+// evict forgets keys without actions within the window at now. Must be
+// called with the lock held.
+func (r *RateLimiter) evict(now time.Time) {
+	for key := range r.mem {
+		if valid := r.valid(key, now); len(valid) > 0 {
+			r.mem[key] = valid
+		} else {
+			delete(r.mem, key)
+		}
 	}
+	r.lastEvict = now
+}
 
-	r.mem[userId] = append(r.mem[userId], now)
+// Len returns the number of remembered keys.
+func (r *RateLimiter) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return true
+	return len(r.mem)
 }
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Lockout locks a key, e.g. a password protected resource, out after a
+// number of failures in a row. The lock lasts base and doubles with every
+// further failure up to max. Keys without failures for max are forgotten, so
+// memory only grows with the number of keys failing recently.
+type Lockout struct {
+	failures  int
+	base      time.Duration
+	max       time.Duration
+	mu        sync.Mutex
+	mem       map[string]*lockoutState
+	lastEvict time.Time
+}
+
+type lockoutState struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// NewLockout returns a lockout locking keys after failures failures in a row.
+func NewLockout(failures int, base time.Duration, max time.Duration) *Lockout {
+	return &Lockout{
+		failures: failures,
+		base:     base,
+		max:      max,
+		mem:      make(map[string]*lockoutState),
+	}
+}
+
+// Locked returns how long the key stays locked, zero if it isn't.
+func (l *Lockout) Locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, ok := l.mem[key]
+	if !ok {
+		return 0
+	}
+
+	return max(state.until.Sub(time.Now()), 0)
+}
+
+// Fail counts a failure of the key and returns how long it is locked now,
+// zero if it isn't.
+func (l *Lockout) Fail(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastEvict) > l.max {
+		l.evict(now)
+	}
+
+	state, ok := l.mem[key]
+	if !ok {
+		state = &lockoutState{}
+		l.mem[key] = state
+	}
+	state.failures++
+	state.last = now
+
+	if state.failures < l.failures {
+		return 0
+	}
+	lock := l.base
+	for range state.failures - l.failures {
+		if lock >= l.max {
+			break
+		}
+		lock *= 2
+	}
+	lock = min(lock, l.max)
+	state.until = now.Add(lock)
+
+	return lock
+}
+
+// Succeed forgets the failures of the key.
+func (l *Lockout) Succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.mem, key)
+}
+
+// evict forgets keys without failures for max, their locks are over. Must be
+// called with the lock held.
+func (l *Lockout) evict(now time.Time) {
+	for key, state := range l.mem {
+		if now.Sub(state.last) > l.max {
+			delete(l.mem, key)
+		}
+	}
+	l.lastEvict = now
+}
+
+// Len returns the number of remembered keys.
+func (l *Lockout) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.mem)
+}
@@ -0,0 +1,446 @@
+package export
+
+import (
+	"backend/render"
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+)
+
+// DOCX_MAX_LIST_LEVEL is the deepest list level of WordprocessingML, deeper
+// lists stay at it.
+const DOCX_MAX_LIST_LEVEL = 8
+
+// DOCX_INDENT is the indentation of a list level, in twentieths of a point.
+const DOCX_INDENT = 720
+
+const docxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+<Override PartName="/word/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.styles+xml"/>
+<Override PartName="/word/numbering.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.numbering+xml"/>
+<Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/>
+</Types>
+`
+
+const docxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/>
+</Relationships>
+`
+
+const docxCore = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<dc:title>%s</dc:title>
+<dcterms:modified xsi:type="dcterms:W3CDTF">%s</dcterms:modified>
+</cp:coreProperties>
+`
+
+// docxStyles follows the look of rendered pages, see render.Stylesheet.
+const docxStyles = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+<w:docDefaults>
+<w:rPrDefault><w:rPr><w:rFonts w:ascii="Calibri" w:hAnsi="Calibri" w:eastAsia="Calibri" w:cs="Calibri"/><w:sz w:val="22"/><w:szCs w:val="22"/></w:rPr></w:rPrDefault>
+<w:pPrDefault><w:pPr><w:spacing w:after="120" w:line="276" w:lineRule="auto"/></w:pPr></w:pPrDefault>
+</w:docDefaults>
+<w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/><w:qFormat/></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="360" w:after="120"/><w:outlineLvl w:val="0"/></w:pPr><w:rPr><w:b/><w:sz w:val="36"/><w:szCs w:val="36"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="300" w:after="120"/><w:outlineLvl w:val="1"/></w:pPr><w:rPr><w:b/><w:sz w:val="30"/><w:szCs w:val="30"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:outlineLvl w:val="2"/></w:pPr><w:rPr><w:b/><w:sz w:val="26"/><w:szCs w:val="26"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading4"><w:name w:val="heading 4"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:outlineLvl w:val="3"/></w:pPr><w:rPr><w:b/><w:sz w:val="24"/><w:szCs w:val="24"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading5"><w:name w:val="heading 5"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:outlineLvl w:val="4"/></w:pPr><w:rPr><w:b/><w:sz w:val="22"/><w:szCs w:val="22"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Heading6"><w:name w:val="heading 6"/><w:basedOn w:val="Normal"/><w:next w:val="Normal"/><w:qFormat/><w:pPr><w:keepNext/><w:spacing w:before="240" w:after="120"/><w:outlineLvl w:val="5"/></w:pPr><w:rPr><w:b/><w:color w:val="57606A"/><w:sz w:val="22"/><w:szCs w:val="22"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Quote"><w:name w:val="Quote"/><w:basedOn w:val="Normal"/><w:qFormat/><w:pPr><w:pBdr><w:left w:val="single" w:sz="18" w:space="8" w:color="D0D7DE"/></w:pBdr><w:ind w:left="360"/></w:pPr><w:rPr><w:color w:val="57606A"/></w:rPr></w:style>
+<w:style w:type="paragraph" w:styleId="Code"><w:name w:val="Code"/><w:basedOn w:val="Normal"/><w:pPr><w:shd w:val="clear" w:color="auto" w:fill="F6F8FA"/><w:spacing w:line="240" w:lineRule="auto"/></w:pPr><w:rPr><w:rFonts w:ascii="Consolas" w:hAnsi="Consolas" w:cs="Consolas"/><w:sz w:val="20"/><w:szCs w:val="20"/></w:rPr></w:style>
+<w:style w:type="character" w:styleId="CodeChar"><w:name w:val="Code Char"/><w:rPr><w:rFonts w:ascii="Consolas" w:hAnsi="Consolas" w:cs="Consolas"/><w:shd w:val="clear" w:color="auto" w:fill="F6F8FA"/></w:rPr></w:style>
+<w:style w:type="character" w:styleId="Hyperlink"><w:name w:val="Hyperlink"/><w:rPr><w:color w:val="0969DA"/><w:u w:val="single"/></w:rPr></w:style>
+<w:style w:type="table" w:styleId="Table"><w:name w:val="Table"/><w:tblPr><w:tblBorders><w:top w:val="single" w:sz="4" w:space="0" w:color="D0D7DE"/><w:left w:val="single" w:sz="4" w:space="0" w:color="D0D7DE"/><w:bottom w:val="single" w:sz="4" w:space="0" w:color="D0D7DE"/><w:right w:val="single" w:sz="4" w:space="0" w:color="D0D7DE"/><w:insideH w:val="single" w:sz="4" w:space="0" w:color="D0D7DE"/><w:insideV w:val="single" w:sz="4" w:space="0" w:color="D0D7DE"/></w:tblBorders><w:tblCellMar><w:left w:w="108" w:type="dxa"/><w:right w:w="108" w:type="dxa"/></w:tblCellMar></w:tblPr></w:style>
+</w:styles>
+`
+
+// docxBullets are the bullets of list levels, repeated for deeper levels.
+var docxBullets = []string{"•", "◦", "▪"}
+
+// docxLinkSchemes are the link schemes kept as hyperlinks. Other links, like
+// relative ones, have no target outside of the editor and stay plain text.
+var docxLinkSchemes = []string{"http://", "https://", "mailto:"}
+
+// docxNumbering is a list, a numbering instance of WordprocessingML.
+type docxNumbering struct {
+	Ordered bool
+	Level   int
+	Start   int
+}
+
+// docxRun is the formatting of a text run.
+type docxRun struct {
+	Bold   bool
+	Italic bool
+	Strike bool
+	Code   bool
+	Sup    bool
+	Link   bool
+}
+
+// docxWriter writes the body of a document and collects the parts it
+// refers to.
+type docxWriter struct {
+	src   []byte
+	body  bytes.Buffer
+	links []string
+	lists []docxNumbering
+
+	quote int
+	level int
+	// item is the numbering id of the first paragraph of a list item, 0 if
+	// the paragraph isn't the first one.
+	item int
+	// note is written before the first paragraph of a footnote.
+	note string
+}
+
+// DOCX converts the Markdown document into an Office Open XML document.
+// Raw HTML is dropped and images are replaced with links to them, the
+// document doesn't embed anything.
+func DOCX(title string, src []byte, modified time.Time) ([]byte, error) {
+	d := &docxWriter{src: src}
+	d.blocks(render.Parse(src))
+
+	var document bytes.Buffer
+	document.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<w:body>
+`)
+	document.Write(d.body.Bytes())
+	document.WriteString(`<w:sectPr><w:pgSz w:w="11906" w:h="16838"/><w:pgMar w:top="1134" w:right="850" w:bottom="1134" w:left="1701" w:header="708" w:footer="708" w:gutter="0"/></w:sectPr>
+</w:body>
+</w:document>
+`)
+
+	var rels bytes.Buffer
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+<Relationship Id="rIdNumbering" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/numbering" Target="numbering.xml"/>
+`)
+	for i, link := range d.links {
+		fmt.Fprintf(&rels, `<Relationship Id="rIdLink%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="%s" TargetMode="External"/>`+"\n",
+			i+1, render.EscapeXML(link))
+	}
+	rels.WriteString("</Relationships>\n")
+
+	return writeZip([]zipEntry{
+		{Name: "[Content_Types].xml", Data: []byte(docxContentTypes)},
+		{Name: "_rels/.rels", Data: []byte(docxRels)},
+		{Name: "docProps/core.xml", Data: fmt.Appendf(nil, docxCore, render.EscapeXML(title), modified.UTC().Format(time.RFC3339))},
+		{Name: "word/document.xml", Data: document.Bytes()},
+		{Name: "word/_rels/document.xml.rels", Data: rels.Bytes()},
+		{Name: "word/styles.xml", Data: []byte(docxStyles)},
+		{Name: "word/numbering.xml", Data: d.numbering()},
+	}, modified)
+}
+
+// numbering returns the numbering part: a bullet and a decimal list
+// definition, and an instance of one of them for every list, so that
+// ordered lists are numbered from their own start.
+func (d *docxWriter) numbering() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:numbering xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+`)
+	for id, ordered := range []bool{false, true} {
+		fmt.Fprintf(&buf, `<w:abstractNum w:abstractNumId="%d"><w:multiLevelType w:val="hybridMultilevel"/>`, id)
+		for level := 0; level <= DOCX_MAX_LIST_LEVEL; level++ {
+			format, text := "bullet", docxBullets[level%len(docxBullets)]
+			if ordered {
+				format, text = "decimal", fmt.Sprintf("%%%d.", level+1)
+			}
+			fmt.Fprintf(&buf, `<w:lvl w:ilvl="%d"><w:start w:val="1"/><w:numFmt w:val="%s"/><w:lvlText w:val="%s"/><w:lvlJc w:val="left"/><w:pPr><w:ind w:left="%d" w:hanging="360"/></w:pPr></w:lvl>`,
+				level, format, text, DOCX_INDENT*(level+1))
+		}
+		buf.WriteString("</w:abstractNum>\n")
+	}
+	for i, list := range d.lists {
+		if !list.Ordered {
+			fmt.Fprintf(&buf, `<w:num w:numId="%d"><w:abstractNumId w:val="0"/></w:num>`+"\n", i+1)
+			continue
+		}
+		fmt.Fprintf(&buf, `<w:num w:numId="%d"><w:abstractNumId w:val="1"/><w:lvlOverride w:ilvl="%d"><w:startOverride w:val="%d"/></w:lvlOverride></w:num>`+"\n",
+			i+1, list.Level, list.Start)
+	}
+	buf.WriteString("</w:numbering>\n")
+
+	return buf.Bytes()
+}
+
+func (d *docxWriter) blocks(parent ast.Node) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		d.block(n)
+	}
+}
+
+func (d *docxWriter) block(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Heading:
+		d.paragraph(fmt.Sprintf("Heading%d", n.Level), n)
+	case *ast.Paragraph, *ast.TextBlock:
+		d.paragraph("", n)
+	case *ast.ThematicBreak:
+		d.thematicBreak()
+	case *ast.CodeBlock, *ast.FencedCodeBlock:
+		d.code(n)
+	case *ast.Blockquote:
+		d.quote++
+		d.blocks(n)
+		d.quote--
+	case *ast.List:
+		d.list(n)
+	case *east.Table:
+		d.table(n)
+	case *east.FootnoteList:
+		d.footnotes(n)
+	case *ast.HTMLBlock:
+		// Raw HTML has no equivalent in documents.
+	default:
+		d.blocks(n)
+	}
+}
+
+// paragraphProperties writes properties of a paragraph with the style in the
+// current quote, list and list item.
+func (d *docxWriter) paragraphProperties(style string) {
+	if style == "" && d.quote > 0 {
+		style = "Quote"
+	}
+
+	var props strings.Builder
+	if style != "" {
+		fmt.Fprintf(&props, `<w:pStyle w:val="%s"/>`, style)
+	}
+	switch {
+	case d.item != 0:
+		fmt.Fprintf(&props, `<w:numPr><w:ilvl w:val="%d"/><w:numId w:val="%d"/></w:numPr>`, d.lists[d.item-1].Level, d.item)
+		d.item = 0
+	case d.level > 0:
+		fmt.Fprintf(&props, `<w:ind w:left="%d"/>`, DOCX_INDENT*min(d.level, DOCX_MAX_LIST_LEVEL+1))
+	}
+	if props.Len() > 0 {
+		d.body.WriteString("<w:pPr>" + props.String() + "</w:pPr>")
+	}
+}
+
+func (d *docxWriter) paragraph(style string, n ast.Node) {
+	d.body.WriteString("<w:p>")
+	d.paragraphProperties(style)
+	if d.note != "" {
+		d.run(docxRun{Sup: true}, d.note+" ")
+		d.note = ""
+	}
+	d.inlines(n, docxRun{})
+	d.body.WriteString("</w:p>\n")
+}
+
+func (d *docxWriter) thematicBreak() {
+	d.body.WriteString(`<w:p><w:pPr><w:pBdr><w:bottom w:val="single" w:sz="6" w:space="1" w:color="D0D7DE"/></w:pBdr></w:pPr></w:p>` + "\n")
+}
+
+// code writes a code block as one paragraph with line breaks.
+func (d *docxWriter) code(n ast.Node) {
+	d.body.WriteString("<w:p>")
+	d.paragraphProperties("Code")
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		if i > 0 {
+			d.body.WriteString("<w:r><w:br/></w:r>")
+		}
+		line := lines.At(i)
+		d.run(docxRun{}, strings.TrimRight(string(line.Value(d.src)), "\r\n"))
+	}
+	d.body.WriteString("</w:p>\n")
+}
+
+func (d *docxWriter) list(n *ast.List) {
+	start := 0
+	if n.IsOrdered() {
+		start = n.Start
+	}
+	d.lists = append(d.lists, docxNumbering{Ordered: n.IsOrdered(), Level: min(d.level, DOCX_MAX_LIST_LEVEL), Start: start})
+	id := len(d.lists)
+
+	d.level++
+	for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+		d.item = id
+		d.blocks(item)
+		if d.item != 0 {
+			// An empty item still gets its bullet.
+			d.body.WriteString("<w:p>")
+			d.paragraphProperties("")
+			d.body.WriteString("</w:p>\n")
+		}
+	}
+	d.level--
+}
+
+func (d *docxWriter) table(n *east.Table) {
+	d.body.WriteString(`<w:tbl><w:tblPr><w:tblStyle w:val="Table"/><w:tblW w:w="0" w:type="auto"/></w:tblPr><w:tblGrid>`)
+	for range n.Alignments {
+		d.body.WriteString("<w:gridCol/>")
+	}
+	d.body.WriteString("</w:tblGrid>\n")
+
+	for row := n.FirstChild(); row != nil; row = row.NextSibling() {
+		_, header := row.(*east.TableHeader)
+		d.body.WriteString("<w:tr>")
+		if header {
+			d.body.WriteString("<w:trPr><w:tblHeader/></w:trPr>")
+		}
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			d.body.WriteString(`<w:tc><w:p><w:pPr><w:spacing w:after="0"/>`)
+			if cell, ok := cell.(*east.TableCell); ok {
+				switch cell.Alignment {
+				case east.AlignLeft:
+					d.body.WriteString(`<w:jc w:val="left"/>`)
+				case east.AlignCenter:
+					d.body.WriteString(`<w:jc w:val="center"/>`)
+				case east.AlignRight:
+					d.body.WriteString(`<w:jc w:val="right"/>`)
+				}
+			}
+			d.body.WriteString("</w:pPr>")
+			d.inlines(cell, docxRun{Bold: header})
+			d.body.WriteString("</w:p></w:tc>")
+		}
+		d.body.WriteString("</w:tr>\n")
+	}
+	d.body.WriteString("</w:tbl>\n")
+	// Adjacent tables would be merged without a paragraph between them.
+	d.body.WriteString("<w:p/>\n")
+}
+
+// footnotes writes footnotes at the end of the document, after a break.
+func (d *docxWriter) footnotes(n *east.FootnoteList) {
+	d.thematicBreak()
+	for note := n.FirstChild(); note != nil; note = note.NextSibling() {
+		if note, ok := note.(*east.Footnote); ok {
+			d.note = fmt.Sprint(note.Index)
+		}
+		d.blocks(note)
+	}
+}
+
+func (d *docxWriter) inlines(parent ast.Node, r docxRun) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		d.inline(n, r)
+	}
+}
+
+func (d *docxWriter) inline(n ast.Node, r docxRun) {
+	switch n := n.(type) {
+	case *ast.Text:
+		d.run(r, string(n.Segment.Value(d.src)))
+		if n.HardLineBreak() {
+			d.body.WriteString("<w:r><w:br/></w:r>")
+		} else if n.SoftLineBreak() {
+			d.run(r, " ")
+		}
+	case *ast.String:
+		d.run(r, string(n.Value))
+	case *ast.CodeSpan:
+		r.Code = true
+		d.inlines(n, r)
+	case *ast.Emphasis:
+		if n.Level >= 2 {
+			r.Bold = true
+		} else {
+			r.Italic = true
+		}
+		d.inlines(n, r)
+	case *east.Strikethrough:
+		r.Strike = true
+		d.inlines(n, r)
+	case *ast.Link:
+		d.link(string(n.Destination), r, func(r docxRun) { d.inlines(n, r) })
+	case *ast.Image:
+		// Images aren't embedded, their alternative text links to them.
+		d.link(string(n.Destination), r, func(r docxRun) { d.inlines(n, r) })
+	case *ast.AutoLink:
+		url := string(n.URL(d.src))
+		if n.AutoLinkType == ast.AutoLinkEmail && !strings.HasPrefix(strings.ToLower(url), "mailto:") {
+			url = "mailto:" + url
+		}
+		d.link(url, r, func(r docxRun) { d.run(r, string(n.Label(d.src))) })
+	case *east.TaskCheckBox:
+		if n.IsChecked {
+			d.run(r, "☒ ")
+		} else {
+			d.run(r, "☐ ")
+		}
+	case *east.FootnoteLink:
+		r.Sup = true
+		d.run(r, fmt.Sprint(n.Index))
+	case *east.FootnoteBacklink, *ast.RawHTML:
+	default:
+		d.inlines(n, r)
+	}
+}
+
+// link writes content as a hyperlink to url, or as is if the url isn't
+// allowed or the content is already inside a link.
+func (d *docxWriter) link(url string, r docxRun, content func(r docxRun)) {
+	allowed := false
+	for _, scheme := range docxLinkSchemes {
+		if strings.HasPrefix(strings.ToLower(url), scheme) {
+			allowed = true
+		}
+	}
+	if !allowed || r.Link {
+		content(r)
+		return
+	}
+
+	d.links = append(d.links, url)
+	fmt.Fprintf(&d.body, `<w:hyperlink r:id="rIdLink%d" w:history="1">`, len(d.links))
+	r.Link = true
+	content(r)
+	d.body.WriteString("</w:hyperlink>")
+}
+
+func (d *docxWriter) run(r docxRun, text string) {
+	if text == "" {
+		return
+	}
+
+	d.body.WriteString("<w:r>")
+	if r != (docxRun{}) {
+		d.body.WriteString("<w:rPr>")
+		switch {
+		case r.Link:
+			d.body.WriteString(`<w:rStyle w:val="Hyperlink"/>`)
+		case r.Code:
+			d.body.WriteString(`<w:rStyle w:val="CodeChar"/>`)
+		}
+		if r.Bold {
+			d.body.WriteString("<w:b/>")
+		}
+		if r.Italic {
+			d.body.WriteString("<w:i/>")
+		}
+		if r.Strike {
+			d.body.WriteString("<w:strike/>")
+		}
+		if r.Sup {
+			d.body.WriteString(`<w:vertAlign w:val="superscript"/>`)
+		}
+		d.body.WriteString("</w:rPr>")
+	}
+	d.body.WriteString(`<w:t xml:space="preserve">`)
+	d.body.WriteString(render.EscapeXML(text))
+	d.body.WriteString("</w:t></w:r>")
+}
@@ -0,0 +1,209 @@
+package export
+
+import (
+	"backend/render"
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yuin/goldmark/ast"
+)
+
+// NAV_HEADING_LEVEL is the deepest heading listed in the table of contents
+// of a book, next to its chapters.
+const NAV_HEADING_LEVEL = 2
+
+// epubLanguage is required by EPUB, documents don't declare their language.
+const epubLanguage = "und"
+
+var epubTemplates = template.Must(template.New("epub").Funcs(template.FuncMap{"xml": render.EscapeXML}).Parse(`
+{{define "container"}}<?xml version="1.0" encoding="utf-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles>
+<rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+</rootfiles>
+</container>
+{{end}}
+{{define "package"}}<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:identifier id="book-id">urn:uuid:{{.Id}}</dc:identifier>
+<dc:title>{{xml .Title}}</dc:title>
+<dc:language>{{.Language}}</dc:language>
+<meta property="dcterms:modified">{{.Modified}}</meta>
+</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="style" href="style.css" media-type="text/css"/>
+{{range .Chapters}}<item id="{{.Id}}" href="{{.Id}}.xhtml" media-type="application/xhtml+xml"{{if .Remote}} properties="remote-resources"{{end}}/>
+{{end}}</manifest>
+<spine>
+{{range .Chapters}}<itemref idref="{{.Id}}"/>
+{{end}}</spine>
+</package>
+{{end}}
+{{define "nav"}}<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>{{xml .Title}}</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+<nav epub:type="toc" id="toc">
+<h1>{{xml .Title}}</h1>
+<ol>
+{{range .Chapters}}<li><a href="{{.Id}}.xhtml">{{xml .Title}}</a>{{if .Headings}}
+<ol>
+{{$id := .Id}}{{range .Headings}}<li><a href="{{$id}}.xhtml#{{xml .Id}}">{{xml .Title}}</a></li>
+{{end}}</ol>
+{{end}}</li>
+{{end}}</ol>
+</nav>
+</body>
+</html>
+{{end}}
+{{define "chapter"}}<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>{{xml .Title}}</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+{{.Body}}</body>
+</html>
+{{end}}
+`))
+
+type epubHeading struct {
+	Id    string
+	Title string
+}
+
+type epubChapter struct {
+	Id       string
+	Title    string
+	Body     string
+	Headings []epubHeading
+	// Remote is set if the chapter refers to images outside of the book.
+	Remote bool
+}
+
+// EPUB packs the chapters into an EPUB 3 book with a table of contents of
+// chapters and their top headings. The book identifier is derived from the
+// content, exporting the same documents gives the same book.
+func EPUB(title string, chapters []Chapter, modified time.Time) ([]byte, error) {
+	book := struct {
+		Id       uuid.UUID
+		Title    string
+		Language string
+		Modified string
+		Chapters []epubChapter
+	}{
+		Title:    title,
+		Language: epubLanguage,
+		Modified: modified.UTC().Format(time.RFC3339),
+	}
+
+	hash := sha1.New()
+	hash.Write([]byte(title))
+	for i, chapter := range chapters {
+		body, err := render.XHTML(chapter.Markdown)
+		if err != nil {
+			return nil, err
+		}
+		hash.Write([]byte{0})
+		hash.Write(chapter.Markdown)
+
+		book.Chapters = append(book.Chapters, epubChapter{
+			Id:       fmt.Sprintf("chapter-%d", i+1),
+			Title:    chapter.Title,
+			Body:     string(body),
+			Headings: headings(chapter.Markdown),
+			Remote:   bytes.Contains(body, []byte(`src="http`)),
+		})
+	}
+	book.Id = uuid.NewSHA1(uuid.NameSpaceOID, hash.Sum(nil))
+
+	entries := []zipEntry{{Name: "mimetype", Data: []byte("application/epub+zip"), Stored: true}}
+	add := func(name string, tmpl string, data any) error {
+		var buf bytes.Buffer
+		if err := epubTemplates.ExecuteTemplate(&buf, tmpl, data); err != nil {
+			return err
+		}
+		entries = append(entries, zipEntry{Name: name, Data: buf.Bytes()})
+		return nil
+	}
+
+	if err := add("META-INF/container.xml", "container", nil); err != nil {
+		return nil, err
+	}
+	if err := add("OEBPS/content.opf", "package", book); err != nil {
+		return nil, err
+	}
+	if err := add("OEBPS/nav.xhtml", "nav", book); err != nil {
+		return nil, err
+	}
+	entries = append(entries, zipEntry{Name: "OEBPS/style.css", Data: []byte(render.Stylesheet)})
+	for _, chapter := range book.Chapters {
+		if err := add("OEBPS/"+chapter.Id+".xhtml", "chapter", chapter); err != nil {
+			return nil, err
+		}
+	}
+
+	return writeZip(entries, modified)
+}
+
+// headings returns headings of the document up to NAV_HEADING_LEVEL with the
+// ids they get when rendered.
+func headings(src []byte) []epubHeading {
+	var result []epubHeading
+	doc := render.Parse(src)
+	for n := doc.FirstChild(); n != nil; n = n.NextSibling() {
+		heading, ok := n.(*ast.Heading)
+		if !ok || heading.Level > NAV_HEADING_LEVEL {
+			continue
+		}
+		id, ok := heading.AttributeString("id")
+		if !ok {
+			continue
+		}
+		idBytes, _ := id.([]byte)
+		title := plainText(heading, src)
+		if title == "" {
+			continue
+		}
+		result = append(result, epubHeading{Id: string(idBytes), Title: title})
+	}
+
+	return result
+}
+
+// plainText returns the text of inline content without markup.
+func plainText(n ast.Node, src []byte) string {
+	var b strings.Builder
+	ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Text:
+			b.Write(n.Segment.Value(src))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				b.WriteByte(' ')
+			}
+		case *ast.String:
+			b.Write(n.Value)
+		case *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+
+	return strings.TrimSpace(b.String())
+}
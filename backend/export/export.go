@@ -0,0 +1,51 @@
+// Package export converts Markdown documents into files for other
+// applications: EPUB books and Office Open XML (DOCX) documents. Everything
+// is generated in process, without external tools.
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"time"
+)
+
+// Chapter is a document of a book.
+type Chapter struct {
+	Title    string
+	Markdown []byte
+}
+
+// zipEntry is a file of a ZIP based format. Stored entries aren't
+// compressed and have no modified time: it would be written to an extra
+// field, which EPUB forbids for its first entry.
+type zipEntry struct {
+	Name   string
+	Data   []byte
+	Stored bool
+}
+
+// writeZip packs entries in order. Compressed ones get the modified time, so the
+// archive only depends on its input.
+func writeZip(entries []zipEntry, modified time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.Name, Method: zip.Store}
+		if !e.Stored {
+			header.Method = zip.Deflate
+			header.Modified = modified
+		}
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(e.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
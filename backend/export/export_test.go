@@ -0,0 +1,165 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var modified = time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+
+const document = `# Notes
+
+Some **bold**, *italic*, ~~struck~~ and ` + "`code`" + ` text with a [link](https://example.com/?a=1&b=2),
+a [relative one](other.md), <span>raw HTML</span> and a footnote[^1].
+
+## Lists
+
+- one
+- two
+  1. nested
+  2. list
+- [x] done
+
+3. three
+4. four
+
+> quoted
+
+| Name | Size |
+|:-----|-----:|
+| a.md | 10 |
+
+` + "```go\nfunc main() {\n\t<tag> & \"x\"\n}\n```" + `
+
+---
+
+[^1]: The note.
+`
+
+// unzip returns the entries of the archive in order.
+func unzip(t *testing.T, data []byte) ([]*zip.File, map[string]string) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	contents := map[string]string{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		rc.Close()
+		contents[f.Name] = string(content)
+	}
+
+	return r.File, contents
+}
+
+// requireXML checks that all XML entries are well-formed.
+func requireXML(t *testing.T, contents map[string]string) {
+	for name, content := range contents {
+		switch path.Ext(name) {
+		case ".xml", ".rels", ".opf", ".xhtml":
+		default:
+			continue
+		}
+
+		decoder := xml.NewDecoder(bytes.NewReader([]byte(content)))
+		// XHTML entities are not declared, the output must not use them.
+		decoder.Strict = true
+		for {
+			_, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err, name)
+		}
+	}
+}
+
+func TestEPUB(t *testing.T) {
+	book, err := EPUB("Book & notes", []Chapter{
+		{Title: "Notes", Markdown: []byte(document)},
+		{Title: "Second", Markdown: []byte("Text ![image](https://example.com/a.png)")},
+	}, modified)
+	require.NoError(t, err)
+
+	files, contents := unzip(t, book)
+	require.NotEmpty(t, files)
+	assert.Equal(t, "mimetype", files[0].Name)
+	assert.Equal(t, zip.Store, files[0].Method)
+	assert.Empty(t, files[0].Extra)
+	assert.Equal(t, "application/epub+zip", contents["mimetype"])
+	requireXML(t, contents)
+
+	opf := contents["OEBPS/content.opf"]
+	assert.Contains(t, opf, "<dc:title>Book &amp; notes</dc:title>")
+	assert.Contains(t, opf, `<meta property="dcterms:modified">2025-05-01T12:00:00Z</meta>`)
+	assert.Contains(t, opf, `<item id="chapter-1" href="chapter-1.xhtml" media-type="application/xhtml+xml"/>`)
+	assert.Contains(t, opf, `<item id="chapter-2" href="chapter-2.xhtml" media-type="application/xhtml+xml" properties="remote-resources"/>`)
+	assert.Contains(t, opf, "<itemref idref=\"chapter-1\"/>\n<itemref idref=\"chapter-2\"/>")
+
+	nav := contents["OEBPS/nav.xhtml"]
+	assert.Contains(t, nav, `<a href="chapter-1.xhtml#notes">Notes</a>`)
+	assert.Contains(t, nav, `<a href="chapter-1.xhtml#lists">Lists</a>`)
+	assert.Contains(t, nav, `<a href="chapter-2.xhtml">Second</a>`)
+
+	chapter := contents["OEBPS/chapter-1.xhtml"]
+	assert.Contains(t, chapter, `<h1 id="notes">Notes</h1>`)
+	assert.Contains(t, chapter, "<span>raw HTML</span>")
+	assert.Contains(t, chapter, "&lt;tag&gt; &amp; &#34;x&#34;")
+
+	again, err := EPUB("Book & notes", []Chapter{
+		{Title: "Notes", Markdown: []byte(document)},
+		{Title: "Second", Markdown: []byte("Text ![image](https://example.com/a.png)")},
+	}, modified)
+	require.NoError(t, err)
+	assert.Equal(t, book, again, "output must be deterministic")
+}
+
+func TestDOCX(t *testing.T) {
+	doc, err := DOCX("Notes <1>", []byte(document), modified)
+	require.NoError(t, err)
+
+	files, contents := unzip(t, doc)
+	assert.Equal(t, "[Content_Types].xml", files[0].Name)
+	requireXML(t, contents)
+
+	assert.Contains(t, contents["docProps/core.xml"], "<dc:title>Notes &lt;1&gt;</dc:title>")
+
+	body := contents["word/document.xml"]
+	assert.Contains(t, body, `<w:pStyle w:val="Heading1"/></w:pPr><w:r><w:t xml:space="preserve">Notes</w:t></w:r>`)
+	assert.Contains(t, body, `<w:rPr><w:b/></w:rPr><w:t xml:space="preserve">bold</w:t>`)
+	assert.Contains(t, body, `<w:rPr><w:i/></w:rPr><w:t xml:space="preserve">italic</w:t>`)
+	assert.Contains(t, body, `<w:rPr><w:strike/></w:rPr><w:t xml:space="preserve">struck</w:t>`)
+	assert.Contains(t, body, `<w:rPr><w:rStyle w:val="CodeChar"/></w:rPr><w:t xml:space="preserve">code</w:t>`)
+	assert.Contains(t, body, `<w:hyperlink r:id="rIdLink1" w:history="1"><w:r><w:rPr><w:rStyle w:val="Hyperlink"/></w:rPr><w:t xml:space="preserve">link</w:t></w:r></w:hyperlink>`)
+	assert.Contains(t, body, `<w:t xml:space="preserve">relative one</w:t>`)
+	assert.NotContains(t, body, "span")
+	assert.Contains(t, body, `<w:numPr><w:ilvl w:val="0"/><w:numId w:val="1"/></w:numPr>`)
+	assert.Contains(t, body, `<w:numPr><w:ilvl w:val="1"/><w:numId w:val="2"/></w:numPr>`)
+	assert.Contains(t, body, "☒ ")
+	assert.Contains(t, body, `<w:pStyle w:val="Quote"/>`)
+	assert.Contains(t, body, `<w:jc w:val="right"/>`)
+	assert.Contains(t, body, `<w:t xml:space="preserve">func main() {</w:t></w:r><w:r><w:br/></w:r><w:r><w:t xml:space="preserve">`+"\t"+`&lt;tag&gt; &amp; &#34;x&#34;</w:t>`)
+	assert.Contains(t, body, `<w:p><w:r><w:rPr><w:vertAlign w:val="superscript"/></w:rPr><w:t xml:space="preserve">1 </w:t></w:r><w:r><w:t xml:space="preserve">The</w:t>`)
+
+	rels := contents["word/_rels/document.xml.rels"]
+	assert.Contains(t, rels, `Target="https://example.com/?a=1&amp;b=2" TargetMode="External"`)
+	assert.NotContains(t, rels, "other.md")
+
+	numbering := contents["word/numbering.xml"]
+	assert.Contains(t, numbering, `<w:num w:numId="2"><w:abstractNumId w:val="1"/><w:lvlOverride w:ilvl="1"><w:startOverride w:val="1"/></w:lvlOverride></w:num>`)
+	assert.Contains(t, numbering, `<w:num w:numId="3"><w:abstractNumId w:val="1"/><w:lvlOverride w:ilvl="0"><w:startOverride w:val="3"/></w:lvlOverride></w:num>`)
+
+	again, err := DOCX("Notes <1>", []byte(document), modified)
+	require.NoError(t, err)
+	assert.Equal(t, doc, again, "output must be deterministic")
+}
@@ -1,17 +1,33 @@
 package main
 
 import (
+	"archive/zip"
+	"backend/collab"
 	"backend/db/repodb"
+	"backend/db/search"
+	"backend/db/utils"
+	"backend/export"
+	"backend/render"
+	"backend/users"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -23,10 +39,26 @@ var (
 			Help: "Total number of HTTP requests",
 		},
 	)
+	shareLinkAccessesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "share_link_accesses_total",
+			Help: "Total number of accesses to public share links",
+		},
+		[]string{"format", "result"},
+	)
+	rateLimitedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_rate_limited_requests_total",
+			Help: "Total number of HTTP requests rejected by rate limits",
+		},
+		[]string{"limit"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(shareLinkAccessesTotal)
+	prometheus.MustRegister(rateLimitedRequestsTotal)
 }
 
 // @Summary Check server health
@@ -63,7 +95,10 @@ func logMiddleware() gin.HandlerFunc {
 	}
 }
 
-func authMiddleware() gin.HandlerFunc {
+// authMiddleware accepts requests with an access token signed with one of
+// keys and naming its login session. With sessions set, tokens of revoked
+// sessions are rejected too.
+func authMiddleware(keys jwks.Keys, sessions *users.SessionCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString, err := c.Cookie("access_token")
 		if err != nil || tokenString == "" {
@@ -71,33 +106,142 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		token, err := parseToken(tokenString)
-		if err != nil || token == nil {
-			if ve, ok := err.(*jwt.ValidationError); ok {
-				if ve.Errors&jwt.ValidationErrorExpired != 0 {
-					c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Token has expired"})
-					return
-				}
+		claims, err := jwks.Parse(c.Request.Context(), keys, tokenString)
+		if err != nil {
+			switch {
+			case errors.Is(err, jwks.ErrTokenExpired):
+				c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Token has expired"})
+			case errors.Is(err, jwks.ErrUnavailable):
+				Logger.Error("Failed to get signing keys", slog.String("error", err.Error()))
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Token can't be verified now"})
+			default:
+				c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Wrong jwt"})
 			}
+			return
+		}
 
-			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Wrong jwt"})
+		userId, exists := claims["user_id"]
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			userId, exists := claims["user_id"]
-			if !exists {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
-				return
-			}
+		sid, exists := claims["sid"]
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
+			return
+		}
+		if sessions != nil && !checkSession(c, sessions, sid, userId) {
+			return
+		}
+
+		c.Set("user_id", userId)
+
+		c.Next()
+	}
+}
+
+// checkSession rejects the request if the session of its access token was
+// revoked, or can't be checked while the auth service fails.
+func checkSession(c *gin.Context, sessions *users.SessionCache, sid any, userId any) bool {
+	sidStr, _ := sid.(string)
+	sessionId, err := uuid.Parse(sidStr)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
+		return false
+	}
+	userIdStr, _ := userId.(string)
+	parsedUserId, err := uuid.Parse(userIdStr)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
+		return false
+	}
+
+	active, err := sessions.SessionActive(c.Request.Context(), sessionId, parsedUserId)
+	if err != nil {
+		Logger.Error("Failed to check session", slog.String("session_id", sessionId.String()), slog.String("error", err.Error()))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Session can't be verified now"})
+		return false
+	}
+	if !active {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Session has been revoked"})
+		return false
+	}
+
+	return true
+}
+
+// Rate limits of API requests per user. RATE_LIMIT_API applies to every
+// request, RATE_LIMIT_UPLOAD in addition to requests adding content: file
+// and attachment uploads and imports. Public share links are read without a
+// user, RATE_LIMIT_LINK limits them per client address and
+// RATE_LIMIT_LINK_TOKEN per link, so password guesses from many addresses
+// are limited too.
+const (
+	RATE_LIMIT_API        = "api"
+	RATE_LIMIT_UPLOAD     = "upload"
+	RATE_LIMIT_LINK       = "link"
+	RATE_LIMIT_LINK_TOKEN = "link_token"
+)
+
+var defaultRateLimits = map[string]utils.Rate{
+	RATE_LIMIT_API:        {Limit: 300, Window: time.Minute},
+	RATE_LIMIT_UPLOAD:     {Limit: utils.MAX_FILES, Window: utils.WINDOW_LENGTH},
+	RATE_LIMIT_LINK:       {Limit: 60, Window: time.Minute},
+	RATE_LIMIT_LINK_TOKEN: {Limit: 300, Window: time.Minute},
+}
+
+// ceilSeconds rounds d up to whole seconds for headers.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// rateLimitMiddleware limits requests of a user with limiter, it must follow
+// authMiddleware. Responses get RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers; rejected requests get 429 with Retry-After. When
+// several limits apply, the headers of the last one are sent.
+func rateLimitMiddleware(name string, limiter *utils.RateLimiter) gin.HandlerFunc {
+	return keyedRateLimitMiddleware(name, limiter, func(c *gin.Context) (string, bool) {
+		userId := getUserId(c)
+		if userId == nil {
+			return "", false
+		}
+		return userId.String(), true
+	})
+}
+
+// keyedRateLimitMiddleware limits requests by the key of the request, e.g.
+// the client address. key aborts the request if it returns false.
+func keyedRateLimitMiddleware(name string, limiter *utils.RateLimiter, key func(c *gin.Context) (string, bool)) gin.HandlerFunc {
+	rate := limiter.Rate()
+	policy := fmt.Sprintf("%d;w=%d", rate.Limit, ceilSeconds(rate.Window))
 
-			c.Set("user_id", userId)
+	return func(c *gin.Context) {
+		k, ok := key(c)
+		if !ok {
+			return
+		}
 
+		decision := limiter.TakeKey(k)
+		c.Header("RateLimit-Policy", policy)
+		c.Header("RateLimit-Limit", strconv.Itoa(decision.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+		if decision.Allowed {
 			c.Next()
-		} else {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid token claims"})
 			return
 		}
+
+		retryAfter := ceilSeconds(decision.RetryAfter)
+		rateLimitedRequestsTotal.WithLabelValues(name).Inc()
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		abortRich(c, http.StatusTooManyRequests, "RATE_LIMITED",
+			"Слишком много запросов, повторите попытку позже.", "", map[string]any{
+				"limit":             name,
+				"max":               rate.Limit,
+				"windowSeconds":     ceilSeconds(rate.Window),
+				"retryAfterSeconds": retryAfter,
+			})
 	}
 }
 
@@ -157,6 +301,94 @@ func getUserId(c *gin.Context) *uuid.UUID {
 	return &userId
 }
 
+// getIfMatch returns entity tags listed in the If-Match header. It returns nil
+// when the header is absent or "*", which makes repository writes
+// unconditional. Weak tags are dropped since they never match under strong
+// comparison.
+func getIfMatch(c *gin.Context) []string {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return nil
+	}
+
+	etags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		etags = append(etags, strings.Trim(tag, `"`))
+	}
+
+	return etags
+}
+
+func setETag(c *gin.Context, data []byte) {
+	c.Header("ETag", `"`+repodb.ETag(data)+`"`)
+}
+
+// ROLE_OWNER is the role of users in their own storage, it can't be shared.
+const ROLE_OWNER = "owner"
+
+// roleAllows reports whether role grants the required one: editors can do
+// everything viewers can.
+func roleAllows(role, required string) bool {
+	switch required {
+	case repodb.ROLE_VIEWER:
+		return role != ""
+	case repodb.ROLE_EDITOR:
+		return role == repodb.ROLE_EDITOR || role == ROLE_OWNER
+	default:
+		return role == ROLE_OWNER
+	}
+}
+
+// getFileOwner returns the owner of the file and the role of the user in it.
+// Files of other users are addressed with the owner query parameter and must
+// be shared with the user with at least the required role. Files that aren't
+// shared with the user are reported as missing.
+func getFileOwner(c *gin.Context, repo repodb.FileRepository, userId uuid.UUID, filename, required string) (uuid.UUID, string, bool) {
+	ownerStr := c.Query("owner")
+	if ownerStr == "" {
+		return userId, ROLE_OWNER, true
+	}
+
+	owner, err := uuid.Parse(ownerStr)
+	if err != nil {
+		abortRich(c, http.StatusBadRequest, "USER_ID_INVALID",
+			"Некорректный идентификатор пользователя.", "owner", nil)
+		return uuid.UUID{}, "", false
+	}
+	if owner == userId {
+		return userId, ROLE_OWNER, true
+	}
+
+	shares, err := repo.GetShares(owner, filename)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load shares: " + err.Error()})
+		return uuid.UUID{}, "", false
+	}
+
+	role := ""
+	for _, share := range shares {
+		if share.UserId == userId {
+			role = share.Role
+		}
+	}
+	if role == "" {
+		abortRich(c, http.StatusNotFound, "FILE_NOT_FOUND",
+			"Файл не найден.", "filename", nil)
+		return uuid.UUID{}, "", false
+	}
+	if !roleAllows(role, required) {
+		abortRich(c, http.StatusForbidden, "ACCESS_DENIED",
+			"Недостаточно прав для этого действия.", "", map[string]any{"role": role, "required": required})
+		return uuid.UUID{}, "", false
+	}
+
+	return owner, role, true
+}
+
 // @Summary Upload file
 // @Tags files
 // @Description Upload new file to server
@@ -188,6 +420,8 @@ func uploadFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
+	setETag(c, file.bytes)
+
 	c.JSON(http.StatusOK, UploadResponse{
 		Message:  "File uploaded successfully",
 		Filename: file.name,
@@ -199,12 +433,16 @@ func uploadFileHandler(c *gin.Context, repo repodb.FileRepository) {
 // @Description Send edited file to server
 // @Param filename path string true "Filename to save"
 // @Param file formData file true "File to save"
+// @Param If-Match header string false "ETag of the edited revision"
+// @Param owner query string false "Owner of a file shared with the user as editor"
 // @Produce json
 // @Success 200 {object} EditResponce "Edit responce"
 // @Failure 400 {object} ErrorResponce "Error responce"
 // @Failure 401 {object} ErrorResponce "Error responce"
+// @Failure 403 {object} ErrorResponse "Error response"
 // @Failure 404 {object} ErrorResponce "Error responce"
 // @Failure 409 {object} ErrorResponce "Error responce"
+// @Failure 412 {object} ErrorResponse "Error response"
 // @Failure 500 {object} ErrorResponce "Error responce"
 // @Router /api/file/{filename} [put]
 func editFileHandler(c *gin.Context, repo repodb.FileRepository) {
@@ -218,7 +456,12 @@ func editFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
-	if err := repo.Save(file.name, *userId, file.bytes); err != nil {
+	owner, _, ok := getFileOwner(c, repo, *userId, file.name, repodb.ROLE_EDITOR)
+	if !ok {
+		return
+	}
+
+	if err := repo.SaveIfMatch(file.name, owner, file.bytes, getIfMatch(c)); err != nil {
 		if mapRepoErr(c, err, "name") {
 			return
 		}
@@ -226,6 +469,8 @@ func editFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
+	setETag(c, file.bytes)
+
 	c.JSON(http.StatusOK, EditResponse{
 		Message:  "File saved successfully",
 		Filename: file.name,
@@ -236,6 +481,7 @@ func editFileHandler(c *gin.Context, repo repodb.FileRepository) {
 // @Tags files
 // @Description Download a file by filename
 // @Param filename path string true "Filename to download"
+// @Param owner query string false "Owner of a file shared with the user"
 // @Produce octet-stream
 // @Success 200 {file} file "File content"
 // @Failure 400 {object} ErrorResponse "Error response"
@@ -251,7 +497,12 @@ func downloadFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
-	bytes, err := repo.Get(filename, *userId)
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_VIEWER)
+	if !ok {
+		return
+	}
+
+	bytes, err := repo.Get(filename, owner)
 	if err != nil {
 		if mapRepoErr(c, err, "filename") {
 			return
@@ -260,22 +511,24 @@ func downloadFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
-	c.Header("Content-Disposition", "attachment; filename="+filename)
+	setETag(c, bytes)
+	c.Header("Content-Disposition", "attachment; filename="+path.Base(filename))
 	c.Data(http.StatusOK, "application/octet-stream", bytes)
 }
 
-// @Summary Delete file
-// @Tags files
-// @Description Delete file from server
+// @Summary Render file
+// @Tags render
+// @Description Render a Markdown file to sanitized HTML. CommonMark is extended with GFM tables, task lists, strikethrough, autolinks and footnotes
+// @Param filename path string true "Filename to render"
+// @Param owner query string false "Owner of a file shared with the user"
 // @Produce json
-// @Param filename path string true "Filename to delete"
-// @Success 200 {object} DeleteResponse "Delete response"
+// @Success 200 {object} RenderResponse "Render response"
 // @Failure 400 {object} ErrorResponse "Error response"
 // @Failure 401 {object} ErrorResponse "Error response"
 // @Failure 404 {object} ErrorResponse "Error response"
 // @Failure 500 {object} ErrorResponse "Error response"
-// @Router /api/file/{filename} [delete]
-func deleteFileHandler(c *gin.Context, repo repodb.FileRepository) {
+// @Router /api/file/{filename}/render [get]
+func renderFileHandler(c *gin.Context, repo repodb.FileRepository) {
 	filename := c.Param("filename")
 
 	userId := getUserId(c)
@@ -283,64 +536,116 @@ func deleteFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
-	if err := repo.Delete(filename, *userId); err != nil {
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_VIEWER)
+	if !ok {
+		return
+	}
+
+	data, err := repo.Get(filename, owner)
+	if err != nil {
 		if mapRepoErr(c, err, "filename") {
 			return
 		}
-		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, DeleteResponse{
-		Message:  "File deleted successfuly!",
-		Filename: filename,
-	})
+	html, err := render.HTML(data)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to render file: " + err.Error()})
+		return
+	}
+
+	setETag(c, data)
+	c.JSON(http.StatusOK, RenderResponse{Filename: filename, HTML: string(html)})
 }
 
-// @Summary User files
-// @Tags files
-// @Description Get all user files from server
+// MAX_RENDER_SIZE limits the request body of ad-hoc rendering.
+const MAX_RENDER_SIZE = 1 << 20
+
+// @Summary Render text
+// @Tags render
+// @Description Render Markdown text to sanitized HTML, like files are rendered
+// @Param text body RenderRequest true "Markdown text"
+// @Accept json
 // @Produce json
-// @Success 200 {object} ErrorResponse "Error response"
+// @Success 200 {object} RenderResponse "Render response"
 // @Failure 400 {object} ErrorResponse "Error response"
 // @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 413 {object} ErrorResponse "Error response"
 // @Failure 500 {object} ErrorResponse "Error response"
-// @Router /api/files [get]
-func getAllFilesHandler(c *gin.Context, repo repodb.FileRepository) {
-	userId := getUserId(c)
-	if userId == nil {
+// @Router /api/render [post]
+func renderTextHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MAX_RENDER_SIZE)
+
+	var req RenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			abortRich(c, http.StatusRequestEntityTooLarge, "TEXT_TOO_LARGE",
+				"Слишком большой текст.", "markdown", map[string]any{"maxBytes": MAX_RENDER_SIZE})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request body: " + err.Error()})
 		return
 	}
 
-	fileNames, err := repo.GetList(*userId)
+	html, err := render.HTML([]byte(req.Markdown))
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load file list: " + err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to render text: " + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, GetAllFilesResponse{
-		Files: fileNames,
-	})
+	c.JSON(http.StatusOK, RenderResponse{HTML: string(html)})
 }
 
-// @Summary User files
-// @Tags files
-// @Description Get all user files from server
-// @Produce json
-// @Success 200 {object} ErrorResponse "Error response"
+const (
+	EXPORT_FORMAT_HTML     = "html"
+	EXPORT_FORMAT_MARKDOWN = "md"
+	EXPORT_FORMAT_EPUB     = "epub"
+	EXPORT_FORMAT_DOCX     = "docx"
+)
+
+var exportContentTypes = map[string]string{
+	EXPORT_FORMAT_HTML:     "text/html; charset=utf-8",
+	EXPORT_FORMAT_MARKDOWN: "text/markdown; charset=utf-8",
+	EXPORT_FORMAT_EPUB:     "application/epub+zip",
+	EXPORT_FORMAT_DOCX:     "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+}
+
+// documentTitle is the title of exported documents: the file name without
+// folders and extension.
+func documentTitle(filename string) string {
+	return strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+}
+
+// sendExport sends an exported file as a download named after title.
+func sendExport(c *gin.Context, title string, format string, data []byte) {
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": title + "." + format}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(http.StatusOK, exportContentTypes[format], data)
+}
+
+// @Summary Export file
+// @Tags export
+// @Description Download a file as a standalone HTML page with embedded styles, Markdown, an EPUB book or a DOCX document. Shared files are exported with the owner parameter
+// @Param filename path string true "Filename"
+// @Param format query string false "html (default), md, epub or docx"
+// @Param owner query string false "Owner of a shared file"
+// @Produce html
+// @Produce octet-stream
+// @Success 200 {file} file "Exported file"
 // @Failure 400 {object} ErrorResponse "Error response"
 // @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
 // @Failure 500 {object} ErrorResponse "Error response"
-// @Router /api/files [get]
-func renameFileHandler(c *gin.Context, repo repodb.FileRepository) {
-	oldFilename := c.Param("oldName")
-	if oldFilename == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Filename not provided"})
-		return
-	}
-	newFilename := c.Param("newName")
-	if newFilename == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Filename not provided"})
+// @Router /api/file/{filename}/export [get]
+func exportFileHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+	format := c.DefaultQuery("format", EXPORT_FORMAT_HTML)
+	if _, ok := exportContentTypes[format]; !ok {
+		abortRich(c, http.StatusBadRequest, "FORMAT_INVALID",
+			"Поддерживаются форматы html, md, epub и docx.", "format", nil)
 		return
 	}
 
@@ -349,99 +654,2568 @@ func renameFileHandler(c *gin.Context, repo repodb.FileRepository) {
 		return
 	}
 
-	err := repo.Rename(oldFilename, newFilename, *userId)
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_VIEWER)
+	if !ok {
+		return
+	}
+
+	data, err := repo.Get(filename, owner)
 	if err != nil {
-		if mapRepoErr(c, err, "newName") {
+		if mapRepoErr(c, err, "filename") {
 			return
 		}
-		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, MessageReponse{
-		Message: "File renamed successfully!",
-	})
+	title := documentTitle(filename)
+	var result []byte
+	switch format {
+	case EXPORT_FORMAT_HTML:
+		result, err = render.Page(title, data)
+	case EXPORT_FORMAT_MARKDOWN:
+		result = data
+	case EXPORT_FORMAT_EPUB:
+		result, err = export.EPUB(title, []export.Chapter{{Title: title, Markdown: data}}, time.Now())
+	case EXPORT_FORMAT_DOCX:
+		result, err = export.DOCX(title, data, time.Now())
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export file: " + err.Error()})
+		return
+	}
+
+	sendExport(c, title, format, result)
 }
 
-//
+// findTreeNode returns the node of the tree with the path, nil if there is
+// none.
+func findTreeNode(nodes []repodb.FileTreeNode, nodePath string) *repodb.FileTreeNode {
+	for i := range nodes {
+		if nodes[i].Path == nodePath {
+			return &nodes[i]
+		}
+		if nodes[i].IsFolder && strings.HasPrefix(nodePath, nodes[i].Path+"/") {
+			return findTreeNode(nodes[i].Children, nodePath)
+		}
+	}
 
-func abortRich(c *gin.Context, status int, code, msg, field string, details any) {
-	c.AbortWithStatusJSON(status, ErrorResponse{
-		Error: APIError{Code: code, Message: msg, Field: field, Details: details},
-	})
+	return nil
 }
 
-func mapRepoErr(c *gin.Context, err error, field string) bool {
-	if err == nil {
-		return false
+// treeFiles returns paths of files under the nodes, in tree order.
+func treeFiles(nodes []repodb.FileTreeNode) []string {
+	var files []string
+	for _, node := range nodes {
+		if node.IsFolder {
+			files = append(files, treeFiles(node.Children)...)
+		} else {
+			files = append(files, node.Path)
+		}
 	}
 
-	if errors.Is(err, repodb.ErrUserSpaceIsFull) {
-		abortRich(c, http.StatusConflict, "USER_SPACE_FULL",
-			"Недостаточно места в хранилище пользователя.", "", nil)
-		return true
+	return files
+}
+
+// @Summary Export folder
+// @Tags export
+// @Description Download all files of a folder, including subfolders, as one EPUB book with a chapter per file
+// @Param path path string true "Folder path"
+// @Param format query string false "epub (default)"
+// @Produce octet-stream
+// @Success 200 {file} file "Exported book"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/folder/{path}/export [get]
+func exportFolderHandler(c *gin.Context, repo repodb.FileRepository) {
+	folder := c.Param("path")
+	format := c.DefaultQuery("format", EXPORT_FORMAT_EPUB)
+	if format != EXPORT_FORMAT_EPUB {
+		abortRich(c, http.StatusBadRequest, "FORMAT_INVALID",
+			"Папку можно экспортировать только в epub.", "format", nil)
+		return
 	}
-	if errors.Is(err, repodb.ErrFileNumberLimitReached) {
-		abortRich(c, http.StatusConflict, "FILE_COUNT_LIMIT",
-			"Превышен лимит количества файлов.", "", map[string]int{"max": repodb.MAX_USER_FILES})
-		return true
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
 	}
-	if errors.Is(err, repodb.ErrFileExists) {
-		abortRich(c, http.StatusConflict, "FILE_ALREADY_EXISTS",
-			"Файл с таким именем уже существует.", field, nil)
-		return true
+
+	tree, err := repo.GetTree(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
 	}
-	if errors.Is(err, repodb.ErrFileNotFound) {
-		abortRich(c, http.StatusNotFound, "FILE_NOT_FOUND",
-			"Файл не найден.", field, nil)
-		return true
+
+	node := findTreeNode(tree, folder)
+	if node == nil || !node.IsFolder {
+		mapRepoErr(c, repodb.ErrFolderNotFound, "path")
+		return
 	}
-	var inv *repodb.ErrInvalidFilename
-	if errors.As(err, &inv) {
-		code := "FILE_NAME_INVALID"
-		msg := "Недопустимое имя файла."
-		det := map[string]any{}
 
-		switch inv.Reason {
-		case repodb.ERR_EMPTY_FILENAME:
-			code, msg = "FILE_NAME_EMPTY", "Имя файла не может быть пустым."
-		case repodb.ERR_PATH_IN_FILENAME:
-			code, msg = "FILE_NAME_PATH", "Имя файла не должно содержать путь или разделители каталогов."
-		case repodb.ERR_BAD_EXTENSION:
-			code, msg = "FILE_EXTENSION_INVALID", "Разрешены только расширения: .md ."
-			det["allowedExtensions"] = []string{".md", ".markdown"}
-		case repodb.ERR_TRAILING_DOT_SPACE:
-			code, msg = "FILE_NAME_TRAILING", "Имя файла не должно заканчиваться точкой или пробелом."
-		case repodb.ERR_TOO_LONG:
-			code, msg = "FILE_NAME_TOO_LONG", "Слишком длинное имя файла."
-			det["maxLen"] = 255
-		case repodb.ERR_RESERVED:
-			code, msg = "FILE_NAME_RESERVED", "Это имя зарезервировано системой."
-			if inv.ReservedAs != "" {
-				det["reserved"] = inv.ReservedAs
-			}
-		case repodb.ERR_ONLY_DOTS:
-			code, msg = "FILE_NAME_ONLY_DOTS", "Имя файла не может состоять только из точек."
-		case repodb.ERR_ONLY_SPACES:
-			code, msg = "FILE_NAME_ONLY_SPACES", "Имя файла не может состоять только из пробелов."
-		case repodb.ERR_INVALID_CHARACTERS:
-			code, msg = "FILE_NAME_INVALID_CHARS", "Имя файла содержит недопустимые символы."
-			if len(inv.InvalidRunes) > 0 {
-				var chars []string
-				for _, r := range inv.InvalidRunes {
-					if r <= 0x1F || r == 0x7F {
-						chars = append(chars, fmt.Sprintf("U+%02X", r))
-					} else {
-						chars = append(chars, string(r))
-					}
-				}
-				det["invalid"] = chars
-			}
+	files := treeFiles(node.Children)
+	if len(files) == 0 {
+		abortRich(c, http.StatusBadRequest, "FOLDER_EMPTY",
+			"В папке нет файлов для экспорта.", "path", nil)
+		return
+	}
+
+	var chapters []export.Chapter
+	for _, file := range files {
+		data, err := repo.Get(file, *userId)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+			return
 		}
+		chapters = append(chapters, export.Chapter{Title: documentTitle(file), Markdown: data})
+	}
 
-		abortRich(c, http.StatusBadRequest, code, msg, field, det)
-		return true
+	title := path.Base(folder)
+	book, err := export.EPUB(title, chapters, time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export folder: " + err.Error()})
+		return
 	}
 
-	return false
+	sendExport(c, title, format, book)
+}
+
+// Archives of all user files contain files and folders under their paths and
+// a manifest with metadata. Entries under ARCHIVE_IGNORED_DIR, added by macOS,
+// are ignored on import like the manifest.
+const (
+	EXPORT_MANIFEST         = "manifest.json"
+	EXPORT_MANIFEST_VERSION = 1
+	ARCHIVE_IGNORED_DIR     = "__MACOSX/"
+)
+
+// MAX_IMPORT_SIZE and MAX_IMPORT_ENTRIES limit uploaded archives, the size of
+// unpacked files is limited by the quota.
+const (
+	MAX_IMPORT_SIZE    = 32 << 20
+	MAX_IMPORT_ENTRIES = 1000
+)
+
+const (
+	IMPORT_STATUS_IMPORTED = "imported"
+	IMPORT_STATUS_FAILED   = "failed"
+	IMPORT_STATUS_SKIPPED  = "skipped"
+)
+
+// treeFolders returns paths of all folders of the tree, parents first.
+func treeFolders(nodes []repodb.FileTreeNode) []string {
+	var folders []string
+	for _, node := range nodes {
+		if node.IsFolder {
+			folders = append(folders, node.Path)
+			folders = append(folders, treeFolders(node.Children)...)
+		}
+	}
+
+	return folders
+}
+
+// @Summary Export all files
+// @Tags export
+// @Description Download all files and folders of the user as a ZIP archive with a manifest.json of file metadata. The archive is streamed, a failure while streaming leaves it truncated
+// @Produce octet-stream
+// @Success 200 {file} file "ZIP archive"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/export [get]
+func exportAllHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	infos, err := repo.GetFileInfos(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+	tree, err := repo.GetTree(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	manifest := ExportManifest{
+		Version:    EXPORT_MANIFEST_VERSION,
+		ExportedAt: time.Now().UTC(),
+		Folders:    treeFolders(tree),
+		Files:      []repodb.FileInfo{},
+	}
+
+	name := "markdown-export-" + manifest.ExportedAt.Format("2006-01-02") + ".zip"
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	// The status is sent with the first entry, later failures can only cut
+	// the archive short.
+	fail := func(err error) {
+		Logger.Error("Failed to export files", slog.String("user_id", userId.String()), slog.String("error", err.Error()))
+		c.Abort()
+	}
+
+	archive := zip.NewWriter(c.Writer)
+	for _, folder := range manifest.Folders {
+		if _, err := archive.CreateHeader(&zip.FileHeader{Name: folder + "/", Method: zip.Store}); err != nil {
+			fail(err)
+			return
+		}
+	}
+	for _, info := range infos {
+		data, err := repo.Get(info.Path, *userId)
+		if errors.Is(err, repodb.ErrFileNotFound) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: info.Path, Method: zip.Deflate, Modified: info.ModifiedAt})
+		if err != nil {
+			fail(err)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			fail(err)
+			return
+		}
+
+		info.Size = int64(len(data))
+		info.ETag = repodb.ETag(data)
+		manifest.Files = append(manifest.Files, info)
+	}
+
+	w, err := archive.Create(EXPORT_MANIFEST)
+	if err != nil {
+		fail(err)
+		return
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		fail(err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		fail(err)
+	}
+}
+
+// importEntry is a file or folder of an imported archive.
+type importEntry struct {
+	result *ImportEntryResult
+	data   []byte
+	exists bool
+}
+
+// entryError returns the error reported for an archive entry.
+func entryError(err error) *APIError {
+	var apiErr *APIError
+	known := reportRepoErr(err, "path", func(_ int, code, msg, field string, details any) {
+		apiErr = &APIError{Code: code, Message: msg, Field: field, Details: details}
+	})
+	if !known {
+		apiErr = &APIError{Code: "IMPORT_WRITE_FAILED", Message: "Не удалось сохранить файл.", Field: "path", Details: map[string]any{"error": err.Error()}}
+	}
+
+	return apiErr
+}
+
+// ensureFolder creates the folder with its missing parents.
+func ensureFolder(repo repodb.FileRepository, userId uuid.UUID, folder string) error {
+	segments := strings.Split(folder, "/")
+	for i := range segments {
+		err := repo.CreateFolder(strings.Join(segments[:i+1], "/"), userId)
+		if err != nil && !errors.Is(err, repodb.ErrFolderExists) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// @Summary Import files
+// @Tags export
+// @Description Import files and folders from a ZIP archive, like the one of /api/export. All entries are validated and checked against the quota first: if any of them fails, nothing is imported and the error details list the entries. With partial=true valid entries are imported anyway. Existing files are only replaced with overwrite=true
+// @Param file formData file true "ZIP archive"
+// @Param partial query bool false "Import valid entries if some fail"
+// @Param overwrite query bool false "Replace existing files"
+// @Accept multipart/form-data
+// @Produce json
+// @Success 200 {object} ImportResponse "Import response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 413 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/import [post]
+func importHandler(c *gin.Context, repo repodb.FileRepository) {
+	partial := c.Query("partial") == "true"
+	overwrite := c.Query("overwrite") == "true"
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MAX_IMPORT_SIZE)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			abortRich(c, http.StatusRequestEntityTooLarge, "ARCHIVE_TOO_LARGE",
+				"Слишком большой архив.", "file", map[string]any{"maxBytes": MAX_IMPORT_SIZE})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "File not provided"})
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			Logger.Error("Error occured", slog.String("error", err.Error()))
+		}
+	}()
+
+	archive, err := zip.NewReader(file, header.Size)
+	if err != nil {
+		abortRich(c, http.StatusBadRequest, "ARCHIVE_INVALID",
+			"Файл не является ZIP-архивом.", "file", nil)
+		return
+	}
+	if len(archive.File) > MAX_IMPORT_ENTRIES {
+		abortRich(c, http.StatusBadRequest, "ARCHIVE_TOO_MANY_ENTRIES",
+			"Слишком много файлов в архиве.", "file", map[string]any{"max": MAX_IMPORT_ENTRIES})
+		return
+	}
+
+	quota, err := repo.GetQuota(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+	existing, err := repo.GetList(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	// Validate all entries, reading files while they fit into the quota.
+	var folders, files []importEntry
+	var replaced []string
+	seen := map[string]bool{}
+	newFiles, size := 0, 0
+	// Entries keep pointers to their results, results never grow beyond
+	// the capacity.
+	results := make([]ImportEntryResult, 0, len(archive.File))
+	for _, f := range archive.File {
+		if f.Name == EXPORT_MANIFEST || strings.HasPrefix(f.Name, ARCHIVE_IGNORED_DIR) {
+			continue
+		}
+
+		results = append(results, ImportEntryResult{Path: f.Name, Status: IMPORT_STATUS_IMPORTED})
+		result := &results[len(results)-1]
+		failed := func(err *APIError) {
+			result.Status = IMPORT_STATUS_FAILED
+			result.Error = err
+		}
+
+		if strings.HasSuffix(f.Name, "/") {
+			result.Path = strings.TrimSuffix(f.Name, "/")
+			result.Folder = true
+			if err := repodb.ValidateFolder(result.Path); err != nil {
+				failed(entryError(err))
+				continue
+			}
+			folders = append(folders, importEntry{result: result})
+			continue
+		}
+
+		if err := repodb.ValidateFile(f.Name); err != nil {
+			failed(entryError(err))
+			continue
+		}
+		if seen[f.Name] {
+			failed(&APIError{Code: "ARCHIVE_DUPLICATE_ENTRY", Message: "Файл встречается в архиве несколько раз.", Field: "path"})
+			continue
+		}
+		seen[f.Name] = true
+
+		exists := slices.Contains(existing, f.Name)
+		if exists && !overwrite {
+			failed(entryError(repodb.ErrFileExists))
+			continue
+		}
+		if !exists && newFiles >= quota.MaxFiles {
+			failed(entryError(&repodb.QuotaError{Err: repodb.ErrFileNumberLimitReached, Quota: quota}))
+			continue
+		}
+		// The declared size may lie, reading stops after the quota.
+		if f.UncompressedSize64 > uint64(quota.SpaceSize-size) {
+			failed(entryError(&repodb.QuotaError{Err: repodb.ErrUserSpaceIsFull, Quota: quota}))
+			continue
+		}
+		data, err := readArchiveFile(f, quota.SpaceSize-size)
+		if errors.Is(err, repodb.ErrUserSpaceIsFull) {
+			failed(entryError(&repodb.QuotaError{Err: repodb.ErrUserSpaceIsFull, Quota: quota}))
+			continue
+		}
+		if err != nil {
+			failed(&APIError{Code: "ARCHIVE_ENTRY_INVALID", Message: "Не удалось прочитать файл из архива.", Field: "path"})
+			continue
+		}
+
+		size += len(data)
+		if exists {
+			replaced = append(replaced, f.Name)
+		} else {
+			newFiles++
+		}
+		files = append(files, importEntry{result: result, data: data, exists: exists})
+	}
+
+	// Imported files must fit next to the files they don't replace.
+	occupied, count, err := repo.GetUserOccupiedSpaceAndFileCount(*userId, replaced)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+	occupied += size
+	count += newFiles
+	for i := len(files) - 1; i >= 0; i-- {
+		entry := files[i]
+		var err error
+		switch {
+		case count > quota.MaxFiles && !entry.exists:
+			err = repodb.ErrFileNumberLimitReached
+		case occupied > quota.SpaceSize:
+			err = repodb.ErrUserSpaceIsFull
+		default:
+			continue
+		}
+
+		entry.result.Status = IMPORT_STATUS_FAILED
+		entry.result.Error = entryError(&repodb.QuotaError{Err: err, Quota: quota})
+		occupied -= len(entry.data)
+		if !entry.exists {
+			count--
+		}
+		files = slices.Delete(files, i, i+1)
+	}
+
+	response := ImportResponse{Entries: results}
+	for _, result := range results {
+		if result.Status == IMPORT_STATUS_FAILED {
+			response.Failed++
+		}
+	}
+	if response.Failed > 0 && !partial {
+		for i := range results {
+			if results[i].Status != IMPORT_STATUS_FAILED {
+				results[i].Status = IMPORT_STATUS_SKIPPED
+			}
+		}
+		abortRich(c, http.StatusBadRequest, "IMPORT_REJECTED",
+			"Архив не импортирован: некоторые файлы не прошли проверку.", "file", response)
+		return
+	}
+
+	// Storage failures while writing are reported per entry, files written
+	// before them are kept.
+	for _, entry := range folders {
+		if err := ensureFolder(repo, *userId, entry.result.Path); err != nil {
+			entry.result.Status = IMPORT_STATUS_FAILED
+			entry.result.Error = entryError(err)
+		}
+	}
+	for _, entry := range files {
+		var err error
+		if folder := path.Dir(entry.result.Path); folder != "." {
+			err = ensureFolder(repo, *userId, folder)
+		}
+		if err == nil && entry.exists {
+			err = repo.Save(entry.result.Path, *userId, entry.data)
+		} else if err == nil {
+			err = repo.Create(entry.result.Path, *userId, entry.data)
+		}
+		if err != nil {
+			entry.result.Status = IMPORT_STATUS_FAILED
+			entry.result.Error = entryError(err)
+		}
+	}
+
+	response.Failed = 0
+	for _, result := range results {
+		switch result.Status {
+		case IMPORT_STATUS_IMPORTED:
+			response.Imported++
+		case IMPORT_STATUS_FAILED:
+			response.Failed++
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// readArchiveFile reads an archive file of at most limit bytes, larger ones
+// give ErrUserSpaceIsFull. Corrupted data gives an error of the archive.
+func readArchiveFile(f *zip.File, limit int) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, repodb.ErrUserSpaceIsFull
+	}
+
+	return data, nil
+}
+
+// @Summary Delete file
+// @Tags files
+// @Description Move file to the trash, its history is dropped
+// @Produce json
+// @Param filename path string true "Filename to delete"
+// @Param If-Match header string false "ETag of the deleted revision"
+// @Param owner query string false "Owner of the file, only owners can delete files"
+// @Success 200 {object} DeleteResponse "Delete response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 412 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename} [delete]
+func deleteFileHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if _, _, ok := getFileOwner(c, repo, *userId, filename, ROLE_OWNER); !ok {
+		return
+	}
+
+	if err := repo.DeleteIfMatch(filename, *userId, getIfMatch(c)); err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, DeleteResponse{
+		Message:  "File deleted successfuly!",
+		Filename: filename,
+	})
+}
+
+// @Summary User files
+// @Tags files
+// @Description Get all user files from server. Files contains paths of all files, tree contains files and folders. With details=true items contain metadata of files. Filtering, sorting and pagination apply to files and items, the tree always contains everything
+// @Produce json
+// @Param details query bool false "Return metadata of files in items"
+// @Param folder query string false "Only files in the folder and its subfolders"
+// @Param q query string false "Only files with the path or title containing the text"
+// @Param sort query string false "Sort by name (default), title, size, createdAt, modifiedAt or wordCount"
+// @Param order query string false "asc (default) or desc"
+// @Param offset query int false "Number of files to skip"
+// @Param limit query int false "Maximum number of files"
+// @Success 200 {object} GetAllFilesResponse "Files response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/files [get]
+func getAllFilesHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	query, ok := getFileQuery(c)
+	if !ok {
+		return
+	}
+	details := c.Query("details") == "true"
+
+	var resp GetAllFilesResponse
+	if query == (repodb.FileQuery{}) && !details {
+		fileNames, err := repo.GetList(*userId)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load file list: " + err.Error()})
+			return
+		}
+		resp.Files = fileNames
+	} else {
+		infos, err := repo.GetFileInfos(*userId)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load file list: " + err.Error()})
+			return
+		}
+
+		page, total, err := repodb.QueryFiles(infos, query)
+		if err != nil {
+			abortRich(c, http.StatusBadRequest, "QUERY_INVALID", "Недопустимое поле сортировки.", "sort", nil)
+			return
+		}
+
+		resp.Files = make([]string, 0, len(page))
+		for _, info := range page {
+			resp.Files = append(resp.Files, info.Path)
+		}
+		resp.Total = &total
+		if details {
+			resp.Items = page
+		}
+	}
+
+	tree, err := repo.GetTree(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load file tree: " + err.Error()})
+		return
+	}
+	resp.Tree = tree
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// getFileQuery parses listing parameters of GET /api/files.
+func getFileQuery(c *gin.Context) (repodb.FileQuery, bool) {
+	query := repodb.FileQuery{
+		Folder: strings.Trim(c.Query("folder"), "/"),
+		Search: c.Query("q"),
+		SortBy: c.Query("sort"),
+	}
+
+	switch c.Query("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		abortRich(c, http.StatusBadRequest, "QUERY_INVALID", "Порядок сортировки должен быть asc или desc.", "order", nil)
+		return query, false
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"offset", &query.Offset}, {"limit", &query.Limit}} {
+		str := c.Query(param.name)
+		if str == "" {
+			continue
+		}
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			abortRich(c, http.StatusBadRequest, "QUERY_INVALID", "Параметр должен быть неотрицательным числом.", param.name, nil)
+			return query, false
+		}
+		*param.value = n
+	}
+
+	return query, true
+}
+
+// @Summary Rename file
+// @Tags files
+// @Description Rename user file. Wiki links and relative Markdown links to the file in other documents are updated to the new name, as are relative links of a file moved to another folder. Documents changed since the rename started are left as they are and listed in failed
+// @Produce json
+// @Param oldName path string true "Current filename"
+// @Param newName path string true "New filename"
+// @Param If-Match header string false "ETag of the renamed revision"
+// @Param owner query string false "Owner of the file, only owners can rename files"
+// @Param updateLinks query bool false "Update links to the file, true by default"
+// @Success 200 {object} RenameResponse "Rename response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 412 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/rename/{oldName}/{newName} [put]
+func renameFileHandler(c *gin.Context, repo repodb.FileRepository, index *search.Index) {
+	oldFilename := c.Param("oldName")
+	if oldFilename == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Filename not provided"})
+		return
+	}
+	newFilename := c.Param("newName")
+	if newFilename == "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Filename not provided"})
+		return
+	}
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if _, _, ok := getFileOwner(c, repo, *userId, oldFilename, ROLE_OWNER); !ok {
+		return
+	}
+
+	// Links are read before the rename, names in them resolve to the old file.
+	var rewrites []search.Rewrite
+	if c.Query("updateLinks") != "false" {
+		var err error
+		rewrites, err = index.RenameRewrites(*userId, oldFilename, newFilename)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to read links: " + err.Error()})
+			return
+		}
+	}
+
+	err := repo.RenameIfMatch(oldFilename, newFilename, *userId, getIfMatch(c))
+	if err != nil {
+		if mapRepoErr(c, err, "newName") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	response := RenameResponse{
+		Message:  "File renamed successfully!",
+		Filename: newFilename,
+		Updated:  []string{},
+	}
+	for _, rw := range rewrites {
+		if err := repo.SaveIfMatch(rw.Path, *userId, rw.Data, []string{rw.ETag}); err != nil {
+			Logger.Warn("Failed to update links", slog.String("filename", rw.Path), slog.String("error", err.Error()))
+			response.Failed = append(response.Failed, rw.Path)
+			continue
+		}
+		response.Updated = append(response.Updated, rw.Path)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Create folder
+// @Tags folders
+// @Description Create a folder. Nested folders are separated by "/", which must be URL encoded
+// @Param path path string true "Folder path"
+// @Produce json
+// @Success 200 {object} FolderResponse "Folder response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/folder/{path} [post]
+func createFolderHandler(c *gin.Context, repo repodb.FileRepository) {
+	folder := c.Param("path")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.CreateFolder(folder, *userId); err != nil {
+		if mapRepoErr(c, err, "path") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, FolderResponse{
+		Message: "Folder created successfully",
+		Path:    folder,
+	})
+}
+
+// @Summary Delete folder
+// @Tags folders
+// @Description Delete a folder. A non-empty folder is only deleted with recursive=true, its files are moved to the trash
+// @Param path path string true "Folder path"
+// @Param recursive query bool false "Delete folder content"
+// @Produce json
+// @Success 200 {object} FolderResponse "Folder response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/folder/{path} [delete]
+func deleteFolderHandler(c *gin.Context, repo repodb.FileRepository) {
+	folder := c.Param("path")
+	recursive := c.Query("recursive") == "true"
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.DeleteFolder(folder, *userId, recursive); err != nil {
+		if mapRepoErr(c, err, "path") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, FolderResponse{
+		Message: "Folder deleted successfully",
+		Path:    folder,
+	})
+}
+
+// @Summary Rename folder
+// @Tags folders
+// @Description Rename or move a folder with all its content
+// @Param oldName path string true "Current folder path"
+// @Param newName path string true "New folder path"
+// @Produce json
+// @Success 200 {object} FolderResponse "Folder response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/rename-folder/{oldName}/{newName} [put]
+func renameFolderHandler(c *gin.Context, repo repodb.FileRepository) {
+	oldName := c.Param("oldName")
+	newName := c.Param("newName")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.RenameFolder(oldName, newName, *userId); err != nil {
+		if mapRepoErr(c, err, "newName") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, FolderResponse{
+		Message: "Folder renamed successfully",
+		Path:    newName,
+	})
+}
+
+func getVersionId(c *gin.Context) (int, bool) {
+	versionId, err := strconv.Atoi(c.Param("id"))
+	if err != nil || versionId < 1 {
+		abortRich(c, http.StatusBadRequest, "VERSION_ID_INVALID",
+			"Недопустимый номер версии.", "id", nil)
+		return 0, false
+	}
+
+	return versionId, true
+}
+
+// @Summary File versions
+// @Tags versions
+// @Description Get stored revisions of a file, newest first
+// @Param filename path string true "Filename"
+// @Param owner query string false "Owner of a file shared with the user"
+// @Produce json
+// @Success 200 {object} GetVersionsResponse "Versions response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/versions [get]
+func getVersionsHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_VIEWER)
+	if !ok {
+		return
+	}
+
+	versions, err := repo.GetVersions(filename, owner)
+	if err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, GetVersionsResponse{
+		Filename: filename,
+		Versions: versions,
+	})
+}
+
+// @Summary Download file version
+// @Tags versions
+// @Description Download a stored revision of a file
+// @Param filename path string true "Filename"
+// @Param id path int true "Version id"
+// @Param owner query string false "Owner of a file shared with the user"
+// @Produce octet-stream
+// @Success 200 {file} file "Version content"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/versions/{id} [get]
+func downloadVersionHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+
+	versionId, ok := getVersionId(c)
+	if !ok {
+		return
+	}
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_VIEWER)
+	if !ok {
+		return
+	}
+
+	bytes, err := repo.GetVersion(filename, owner, versionId)
+	if err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename="+path.Base(filename))
+	c.Data(http.StatusOK, "application/octet-stream", bytes)
+}
+
+// @Summary Restore file version
+// @Tags versions
+// @Description Make a stored revision the current file content. The replaced content is kept in history
+// @Param filename path string true "Filename"
+// @Param id path int true "Version id"
+// @Param owner query string false "Owner of a file shared with the user as editor"
+// @Produce json
+// @Success 200 {object} RestoreVersionResponse "Restore response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/versions/{id}/restore [post]
+func restoreVersionHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+
+	versionId, ok := getVersionId(c)
+	if !ok {
+		return
+	}
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_EDITOR)
+	if !ok {
+		return
+	}
+
+	if err := repo.RestoreVersion(filename, owner, versionId); err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, RestoreVersionResponse{
+		Message:  "File version restored successfully",
+		Filename: filename,
+		Version:  versionId,
+	})
+}
+
+// @Summary Trash
+// @Tags trash
+// @Description Get deleted files of the user, most recently deleted first
+// @Produce json
+// @Success 200 {object} GetTrashResponse "Trash response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/trash [get]
+func getTrashHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	items, err := repo.ListTrash(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load trash: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, GetTrashResponse{Items: items})
+}
+
+// @Summary Restore file from trash
+// @Tags trash
+// @Description Move a deleted file back to its path, missing folders are recreated. If the path is taken, FILE_ALREADY_EXISTS is returned, or with autoRename=true the file gets a free name like "note (1).md"
+// @Param id path string true "Trash item id"
+// @Param autoRename query bool false "Pick a free name if the path is taken"
+// @Produce json
+// @Success 200 {object} RestoreTrashResponse "Restore response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/trash/{id}/restore [post]
+func restoreTrashHandler(c *gin.Context, repo repodb.FileRepository) {
+	id := c.Param("id")
+	autoRename := c.Query("autoRename") == "true"
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	filename, err := repo.RestoreFromTrash(id, *userId, autoRename)
+	if err != nil {
+		if mapRepoErr(c, err, "id") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, RestoreTrashResponse{
+		Message:  "File restored successfully",
+		Filename: filename,
+	})
+}
+
+// @Summary Purge file from trash
+// @Tags trash
+// @Description Permanently delete a file from the trash
+// @Param id path string true "Trash item id"
+// @Produce json
+// @Success 200 {object} MessageReponse "Purge response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/trash/{id} [delete]
+func purgeTrashItemHandler(c *gin.Context, repo repodb.FileRepository) {
+	id := c.Param("id")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.DeleteFromTrash(id, *userId); err != nil {
+		if mapRepoErr(c, err, "id") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageReponse{Message: "File purged successfully"})
+}
+
+// @Summary Empty trash
+// @Tags trash
+// @Description Permanently delete all files in the trash
+// @Produce json
+// @Success 200 {object} MessageReponse "Purge response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/trash [delete]
+func emptyTrashHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.EmptyTrash(*userId); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageReponse{Message: "Trash emptied successfully"})
+}
+
+// Limits of the number of results returned by GET /api/search.
+const (
+	DEFAULT_SEARCH_LIMIT = 20
+	MAX_SEARCH_LIMIT     = 100
+)
+
+// @Summary Search
+// @Tags files
+// @Description Full-text search in user files. All words of the query must occur in the file text or path, "quoted words" match a phrase and word* matches a prefix. Results are ranked by relevance, snippets contain the text around the first match with highlighted matches, offsets are in Unicode code points
+// @Produce json
+// @Param q query string true "Search query"
+// @Param limit query int false "Maximum number of results, 20 by default, at most 100"
+// @Success 200 {object} SearchResponse "Search response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/search [get]
+func searchHandler(c *gin.Context, index *search.Index) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	q := c.Query("q")
+	limit := DEFAULT_SEARCH_LIMIT
+	if str := c.Query("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 || n > MAX_SEARCH_LIMIT {
+			abortRich(c, http.StatusBadRequest, "QUERY_INVALID",
+				fmt.Sprintf("Параметр должен быть числом от 1 до %d.", MAX_SEARCH_LIMIT), "limit", nil)
+			return
+		}
+		limit = n
+	}
+
+	results, total, err := index.Search(*userId, q, limit)
+	if err != nil {
+		if errors.Is(err, search.ErrEmptyQuery) {
+			abortRich(c, http.StatusBadRequest, "QUERY_INVALID", "Поисковый запрос не содержит слов.", "q", nil)
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to search: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, SearchResponse{Query: q, Total: total, Results: results})
+}
+
+// @Summary Get backlinks
+// @Tags files
+// @Description Documents linking to the file with wiki links or relative Markdown links, sorted by path. Snippets contain the text around the links with highlighted link targets
+// @Produce json
+// @Param filename path string true "Filename"
+// @Success 200 {object} BacklinksResponse "Backlinks response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/backlinks [get]
+func backlinksHandler(c *gin.Context, index *search.Index) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	backlinks, err := index.Backlinks(*userId, filename)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to read links: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, BacklinksResponse{Filename: filename, Backlinks: backlinks})
+}
+
+// @Summary Get link graph
+// @Tags files
+// @Description Documents of the user and links between them. Targets of links to missing documents are nodes with missing=true
+// @Produce json
+// @Success 200 {object} search.Graph "Graph response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/graph [get]
+func graphHandler(c *gin.Context, index *search.Index) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	graph, err := index.Graph(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to read links: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, graph)
+}
+
+// Collaborative editing connections are pinged every COLLAB_PING_INTERVAL
+// and dropped if no pong arrives within COLLAB_PONG_WAIT. Messages are
+// limited to COLLAB_MAX_MESSAGE_SIZE bytes.
+const (
+	COLLAB_PING_INTERVAL    = 30 * time.Second
+	COLLAB_PONG_WAIT        = 60 * time.Second
+	COLLAB_MAX_MESSAGE_SIZE = 1 << 20
+)
+
+// newUpgrader accepts WebSocket connections from the allowed origins and from
+// clients that don't send an origin.
+func newUpgrader(allowedOrigins []string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || slices.Contains(allowedOrigins, origin)
+		},
+	}
+}
+
+// @Summary Collaborative editing
+// @Tags files
+// @Description WebSocket for editing a file together with other sessions. Messages are JSON objects with a type: the server sends init with the text and the revision, then clients send op (an ot.js style operation based on a revision) and cursor, and receive ack, op, cursor, join, leave and error. The merged document is saved periodically and when the last session leaves, changes saved in between by other requests are merged
+// @Param filename path string true "Filename to edit"
+// @Param owner query string false "Owner of a file shared with the user, viewers join read-only"
+// @Success 101 "Switching protocols"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/collab/{filename} [get]
+func collabHandler(c *gin.Context, repo repodb.FileRepository, hub *collab.Hub, upgrader *websocket.Upgrader) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	owner, role, ok := getFileOwner(c, repo, *userId, filename, repodb.ROLE_VIEWER)
+	if !ok {
+		return
+	}
+
+	session, err := hub.Join(owner, filename, *userId, role == repodb.ROLE_VIEWER)
+	if err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to open file: " + err.Error()})
+		return
+	}
+
+	// Upgrade replies with an error itself.
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		hub.Leave(session)
+		return
+	}
+
+	conn.SetReadLimit(COLLAB_MAX_MESSAGE_SIZE)
+	conn.SetReadDeadline(time.Now().Add(COLLAB_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(COLLAB_PONG_WAIT))
+	})
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(COLLAB_PING_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(COLLAB_PONG_WAIT)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	hub.Serve(conn, session)
+}
+
+// getUsernames resolves usernames of ids. Users missing in the directory
+// are skipped, all usernames are empty when sharing isn't configured.
+func getUsernames(c *gin.Context, directory users.Directory, ids []uuid.UUID) (map[uuid.UUID]string, bool) {
+	names := make(map[uuid.UUID]string)
+	if directory == nil {
+		return names, true
+	}
+
+	for _, id := range ids {
+		if _, ok := names[id]; ok {
+			continue
+		}
+		user, err := directory.LookupId(c.Request.Context(), id)
+		if errors.Is(err, users.ErrUserNotFound) {
+			continue
+		}
+		if err != nil {
+			abortRich(c, http.StatusBadGateway, "USER_DIRECTORY_UNAVAILABLE",
+				"Сервис пользователей недоступен.", "", nil)
+			return nil, false
+		}
+		names[id] = user.Username
+	}
+
+	return names, true
+}
+
+func sharesResponse(c *gin.Context, repo repodb.FileRepository, directory users.Directory, owner uuid.UUID, filename string) {
+	shares, err := repo.GetShares(owner, filename)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load shares: " + err.Error()})
+		return
+	}
+
+	ids := make([]uuid.UUID, 0, len(shares))
+	for _, share := range shares {
+		ids = append(ids, share.UserId)
+	}
+	names, ok := getUsernames(c, directory, ids)
+	if !ok {
+		return
+	}
+
+	resp := GetSharesResponse{Filename: filename, Shares: []ShareResponse{}}
+	for _, share := range shares {
+		resp.Shares = append(resp.Shares, ShareResponse{
+			UserId:    share.UserId.String(),
+			Username:  names[share.UserId],
+			Role:      share.Role,
+			CreatedAt: share.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// @Summary File shares
+// @Tags shares
+// @Description Get users the file is shared with
+// @Param filename path string true "Filename"
+// @Produce json
+// @Success 200 {object} GetSharesResponse "Shares response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Failure 502 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/shares [get]
+func getSharesHandler(c *gin.Context, repo repodb.FileRepository, directory users.Directory) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if _, err := repo.Get(filename, *userId); err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	sharesResponse(c, repo, directory, *userId, filename)
+}
+
+// @Summary Share file
+// @Tags shares
+// @Description Share the file with a registered user as viewer (download, history, read-only collaborative sessions) or editor (also edit and restore versions). Sharing again changes the role
+// @Param filename path string true "Filename"
+// @Param share body ShareRequest true "Username and role"
+// @Accept json
+// @Produce json
+// @Success 200 {object} GetSharesResponse "Shares response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Failure 502 {object} ErrorResponse "Error response"
+// @Failure 503 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/shares [put]
+func shareFileHandler(c *gin.Context, repo repodb.FileRepository, directory users.Directory) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	var req ShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid share: " + err.Error()})
+		return
+	}
+
+	if directory == nil {
+		abortRich(c, http.StatusServiceUnavailable, "SHARING_DISABLED",
+			"Совместный доступ не настроен.", "", nil)
+		return
+	}
+	user, err := directory.LookupUsername(c.Request.Context(), req.Username)
+	if errors.Is(err, users.ErrUserNotFound) {
+		abortRich(c, http.StatusNotFound, "USER_NOT_FOUND",
+			"Пользователь не найден.", "username", nil)
+		return
+	}
+	if err != nil {
+		abortRich(c, http.StatusBadGateway, "USER_DIRECTORY_UNAVAILABLE",
+			"Сервис пользователей недоступен.", "", nil)
+		return
+	}
+
+	if err := repo.ShareFile(filename, *userId, user.Id, req.Role); err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	sharesResponse(c, repo, directory, *userId, filename)
+}
+
+// @Summary Unshare file
+// @Tags shares
+// @Description Revoke access of a user to the file
+// @Param filename path string true "Filename"
+// @Param userId path string true "User id"
+// @Produce json
+// @Success 200 {object} GetSharesResponse "Shares response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Failure 502 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/shares/{userId} [delete]
+func unshareFileHandler(c *gin.Context, repo repodb.FileRepository, directory users.Directory) {
+	filename := c.Param("filename")
+
+	shareUserId, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		abortRich(c, http.StatusBadRequest, "USER_ID_INVALID",
+			"Некорректный идентификатор пользователя.", "userId", nil)
+		return
+	}
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.UnshareFile(filename, *userId, shareUserId); err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	sharesResponse(c, repo, directory, *userId, filename)
+}
+
+// @Summary Shared with me
+// @Tags shares
+// @Description Get files of other users shared with the user. They are accessed by file endpoints with the owner query parameter
+// @Produce json
+// @Success 200 {object} GetSharedResponse "Shared files response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Failure 502 {object} ErrorResponse "Error response"
+// @Router /api/shared [get]
+func getSharedHandler(c *gin.Context, repo repodb.FileRepository, directory users.Directory) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	shares, err := repo.GetSharedWith(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load shared files: " + err.Error()})
+		return
+	}
+
+	owners := make([]uuid.UUID, 0, len(shares))
+	for _, share := range shares {
+		owners = append(owners, share.Owner)
+	}
+	names, ok := getUsernames(c, directory, owners)
+	if !ok {
+		return
+	}
+
+	resp := GetSharedResponse{Files: []SharedFile{}}
+	for _, share := range shares {
+		resp.Files = append(resp.Files, SharedFile{
+			Filename:      share.Filename,
+			OwnerId:       share.Owner.String(),
+			OwnerUsername: names[share.Owner],
+			Role:          share.Role,
+			CreatedAt:     share.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Formats of documents served by share links and the result label of
+// shareLinkAccessesTotal.
+const (
+	LINK_FORMAT_HTML     = "html"
+	LINK_FORMAT_MARKDOWN = "md"
+	// LINK_FORMAT_ATTACHMENT labels attachments of documents read by link.
+	LINK_FORMAT_ATTACHMENT = "attachment"
+
+	LINK_RESULT_SERVED       = "served"
+	LINK_RESULT_NOT_FOUND    = "not_found"
+	LINK_RESULT_EXPIRED      = "expired"
+	LINK_RESULT_UNAUTHORIZED = "unauthorized"
+	LINK_RESULT_LOCKED       = "locked"
+)
+
+// Wrong passwords of a share link in a row lock it for LINK_LOCKOUT, doubling
+// with every further one up to MAX_LINK_LOCKOUT.
+const (
+	LINK_PASSWORD_FAILURES = 5
+	LINK_LOCKOUT           = time.Minute
+	MAX_LINK_LOCKOUT       = time.Hour
+)
+
+// MAX_LINK_PASSWORD_LEN is the longest password bcrypt hashes.
+const MAX_LINK_PASSWORD_LEN = 72
+
+func shareLinkResponse(link repodb.ShareLink) ShareLinkResponse {
+	return ShareLinkResponse{
+		Token:          link.Token,
+		Path:           "/s/" + link.Token,
+		Filename:       link.Filename,
+		Protected:      link.PasswordHash != "",
+		CreatedAt:      link.CreatedAt,
+		ExpiresAt:      link.ExpiresAt,
+		Expired:        link.Expired(time.Now()),
+		Accesses:       link.Accesses,
+		LastAccessedAt: link.LastAccessedAt,
+	}
+}
+
+// @Summary Create share link
+// @Tags links
+// @Description Create a public read-only link to the file. Anyone knowing the link can read the file until it expires or is revoked. Password protected links require HTTP basic authentication with the password, the username is ignored
+// @Param filename path string true "Filename"
+// @Param link body CreateShareLinkRequest false "Expiry and password"
+// @Accept json
+// @Produce json
+// @Success 200 {object} ShareLinkResponse "Link response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/links [post]
+func createShareLinkHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	var req CreateShareLinkRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid share link: " + err.Error()})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		abortRich(c, http.StatusBadRequest, "SHARE_LINK_INVALID",
+			"Срок действия ссылки должен быть в будущем.", "expiresAt", nil)
+		return
+	}
+	if len(req.Password) > MAX_LINK_PASSWORD_LEN {
+		abortRich(c, http.StatusBadRequest, "SHARE_LINK_INVALID",
+			"Слишком длинный пароль.", "password", map[string]any{"maxLen": MAX_LINK_PASSWORD_LEN})
+		return
+	}
+
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, ROLE_OWNER)
+	if !ok {
+		return
+	}
+
+	token, err := repodb.NewShareLinkToken(owner)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token: " + err.Error()})
+		return
+	}
+	link := repodb.ShareLink{Token: token, Owner: owner, Filename: filename, CreatedAt: now}
+	if req.ExpiresAt != nil {
+		expiresAt := req.ExpiresAt.UTC()
+		link.ExpiresAt = &expiresAt
+	}
+	if req.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to hash password: " + err.Error()})
+			return
+		}
+		link.PasswordHash = string(hash)
+	}
+
+	if err := repo.CreateShareLink(link); err != nil {
+		if mapRepoErr(c, err, "filename") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, shareLinkResponse(link))
+}
+
+// @Summary Share links
+// @Tags links
+// @Description Get public links to the file, or to all files of the user at /api/links, with the number of accesses
+// @Param filename path string true "Filename"
+// @Produce json
+// @Success 200 {object} GetShareLinksResponse "Links response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/file/{filename}/links [get]
+func getShareLinksHandler(c *gin.Context, repo repodb.FileRepository) {
+	filename := c.Param("filename")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	owner, _, ok := getFileOwner(c, repo, *userId, filename, ROLE_OWNER)
+	if !ok {
+		return
+	}
+
+	links, err := repo.GetShareLinks(owner, filename)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load share links: " + err.Error()})
+		return
+	}
+
+	resp := GetShareLinksResponse{Links: []ShareLinkResponse{}}
+	for _, link := range links {
+		resp.Links = append(resp.Links, shareLinkResponse(link))
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// @Summary Revoke share link
+// @Tags links
+// @Description Delete a public link, it stops working immediately
+// @Param token path string true "Link token"
+// @Produce json
+// @Success 200 {object} MessageReponse "Revoke response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/links/{token} [delete]
+func deleteShareLinkHandler(c *gin.Context, repo repodb.FileRepository) {
+	token := c.Param("token")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	if err := repo.DeleteShareLink(*userId, token); err != nil {
+		if mapRepoErr(c, err, "token") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageReponse{Message: "Share link revoked"})
+}
+
+// @Summary Shared document
+// @Tags links
+// @Description Read a document by a public link, without an account. Password protected links require HTTP basic authentication with the password
+// @Param token path string true "Link token"
+// @Param format query string false "html (default) renders the document, md returns Markdown"
+// @Produce html
+// @Produce plain
+// @Success 200 {file} file "Document"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 410 {object} ErrorResponse "Error response"
+// @Failure 429 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /s/{token} [get]
+func publicShareLinkHandler(c *gin.Context, repo repodb.FileRepository, lockout *utils.Lockout) {
+	token := c.Param("token")
+	format := c.DefaultQuery("format", LINK_FORMAT_HTML)
+	if format != LINK_FORMAT_HTML && format != LINK_FORMAT_MARKDOWN {
+		abortRich(c, http.StatusBadRequest, "FORMAT_INVALID",
+			"Поддерживаются форматы html и md.", "format", nil)
+		return
+	}
+
+	// Links are secrets, they must not leak to other sites or caches.
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	link, ok := openShareLink(c, repo, lockout, format)
+	if !ok {
+		return
+	}
+
+	data, err := repo.Get(link.Filename, link.Owner)
+	if err != nil {
+		if errors.Is(err, repodb.ErrFileNotFound) {
+			shareLinkAccessesTotal.WithLabelValues(format, LINK_RESULT_NOT_FOUND).Inc()
+		}
+		if mapRepoErr(c, err, "token") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	shareLinkAccessesTotal.WithLabelValues(format, LINK_RESULT_SERVED).Inc()
+	if err := repo.RecordShareLinkAccess(token, time.Now()); err != nil {
+		Logger.Error("Failed to record share link access", slog.String("error", err.Error()))
+	}
+
+	if format == LINK_FORMAT_MARKDOWN {
+		c.Data(http.StatusOK, "text/markdown; charset=utf-8", data)
+		return
+	}
+
+	page, err := render.Page(strings.TrimSuffix(path.Base(link.Filename), path.Ext(link.Filename)), publicAttachmentURLs(data, token))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to render document: " + err.Error()})
+		return
+	}
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' https: data:")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
+
+// openShareLink returns the link of the token in the request, once it is
+// checked to be live and the password, if any, is right. Otherwise the
+// request is aborted. format labels the accesses in shareLinkAccessesTotal.
+func openShareLink(c *gin.Context, repo repodb.FileRepository, lockout *utils.Lockout, format string) (repodb.ShareLink, bool) {
+	token := c.Param("token")
+	link, err := repo.GetShareLink(token)
+	if err != nil {
+		if errors.Is(err, repodb.ErrShareLinkNotFound) {
+			shareLinkAccessesTotal.WithLabelValues(format, LINK_RESULT_NOT_FOUND).Inc()
+		}
+		if mapRepoErr(c, err, "token") {
+			return repodb.ShareLink{}, false
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return repodb.ShareLink{}, false
+	}
+
+	if link.Expired(time.Now()) {
+		shareLinkAccessesTotal.WithLabelValues(format, LINK_RESULT_EXPIRED).Inc()
+		abortRich(c, http.StatusGone, "SHARE_LINK_EXPIRED",
+			"Срок действия ссылки истёк.", "token", nil)
+		return repodb.ShareLink{}, false
+	}
+
+	if link.PasswordHash != "" {
+		if locked := lockout.Locked(token); locked > 0 {
+			abortLinkLocked(c, format, locked)
+			return repodb.ShareLink{}, false
+		}
+
+		_, password, ok := c.Request.BasicAuth()
+		if !ok || bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+			// Requests without a password only ask for one, they aren't
+			// guesses.
+			if ok {
+				if locked := lockout.Fail(token); locked > 0 {
+					abortLinkLocked(c, format, locked)
+					return repodb.ShareLink{}, false
+				}
+			}
+			shareLinkAccessesTotal.WithLabelValues(format, LINK_RESULT_UNAUTHORIZED).Inc()
+			c.Header("WWW-Authenticate", `Basic realm="Shared document", charset="UTF-8"`)
+			abortRich(c, http.StatusUnauthorized, "SHARE_LINK_PASSWORD_REQUIRED",
+				"Для доступа по ссылке нужен пароль.", "password", nil)
+			return repodb.ShareLink{}, false
+		}
+		lockout.Succeed(token)
+	}
+
+	return link, true
+}
+
+func abortLinkLocked(c *gin.Context, format string, locked time.Duration) {
+	retryAfter := ceilSeconds(locked)
+	shareLinkAccessesTotal.WithLabelValues(format, LINK_RESULT_LOCKED).Inc()
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	abortRich(c, http.StatusTooManyRequests, "SHARE_LINK_LOCKED",
+		"Слишком много неверных паролей, повторите попытку позже.", "password", map[string]any{
+			"retryAfterSeconds": retryAfter,
+		})
+}
+
+// Attachments are immutable, their ids are hashes of the content. So they are
+// cached for a year and revalidated by ETag only if the cache is cleared.
+const (
+	ATTACHMENT_CACHE_CONTROL = "private, max-age=31536000, immutable"
+	// ATTACHMENT_FORM_OVERHEAD is allowed on top of MAX_ATTACHMENT_SIZE for
+	// multipart headers.
+	ATTACHMENT_FORM_OVERHEAD = 64 << 10
+)
+
+// attachmentURL is where the attachment is served, documents embed it.
+func attachmentURL(owner uuid.UUID, id string) string {
+	return "/api/attachments/" + owner.String() + "/" + id
+}
+
+// publicAttachmentURLs points the attachment URLs of a document read by the
+// share link token to the link, its readers aren't logged in.
+func publicAttachmentURLs(data []byte, token string) []byte {
+	return bytes.ReplaceAll(data, []byte("/api/attachments/"), []byte("/s/"+token+"/attachments/"))
+}
+
+var markdownLinkTextEscaper = strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`)
+
+func attachmentResponse(attachment repodb.Attachment) AttachmentResponse {
+	url := attachmentURL(attachment.Owner, attachment.Id)
+	snippet := "[" + markdownLinkTextEscaper.Replace(attachment.Name) + "](" + url + ")"
+	if attachment.IsImage() {
+		snippet = "!" + snippet
+	}
+
+	return AttachmentResponse{Attachment: attachment, URL: url, Markdown: snippet}
+}
+
+// canReadAttachment reports whether the user may read the attachment of
+// owner. Besides the owner, these are users reading a shared document that
+// refers to it, when the owner can access that document too: editors upload
+// images into their own attachments, and a URL pasted into a document of
+// another user doesn't disclose anything. References are looked up in the
+// index, documents aren't read.
+func canReadAttachment(repo repodb.FileRepository, index *search.Index, userId uuid.UUID, owner uuid.UUID, id string) (bool, error) {
+	if userId == owner {
+		return true, nil
+	}
+
+	type document struct {
+		owner    uuid.UUID
+		filename string
+	}
+	var documents []document
+
+	shared, err := repo.GetSharedWith(userId)
+	if err != nil {
+		return false, err
+	}
+	for _, share := range shared {
+		documents = append(documents, document{owner: share.Owner, filename: share.Filename})
+	}
+	own, err := repo.GetShares(userId, "")
+	if err != nil {
+		return false, err
+	}
+	for _, share := range own {
+		if share.UserId == owner {
+			documents = append(documents, document{owner: userId, filename: share.Filename})
+		}
+	}
+
+	for _, doc := range documents {
+		ok, err := documentEmbedsAttachment(repo, index, doc.owner, doc.filename, owner, id)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// documentEmbedsAttachment reports whether the document refers to the
+// attachment of owner and owner can access the document.
+func documentEmbedsAttachment(repo repodb.FileRepository, index *search.Index, docOwner uuid.UUID, filename string, owner uuid.UUID, id string) (bool, error) {
+	ok, err := index.ReferencesAttachment(docOwner, filename, owner, id)
+	if err != nil || !ok || docOwner == owner {
+		return ok, err
+	}
+
+	shares, err := repo.GetShares(docOwner, filename)
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(shares, func(s repodb.Share) bool { return s.UserId == owner }), nil
+}
+
+// @Summary Upload attachment
+// @Tags attachments
+// @Description Upload an image or another file to embed into documents. The type is detected from the content: PNG, JPEG, GIF, WebP, BMP, PDF and plain text are accepted. Attachments count against the storage quota, the same content is stored once. Attachments no longer referenced by any document, its history or trashed files are deleted after a grace period
+// @Param file formData file true "File to upload"
+// @Accept mpfd
+// @Produce json
+// @Success 200 {object} AttachmentResponse "Attachment response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 409 {object} ErrorResponse "Error response"
+// @Failure 413 {object} ErrorResponse "Error response"
+// @Failure 415 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/attachments [post]
+func uploadAttachmentHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, repodb.MAX_ATTACHMENT_SIZE+ATTACHMENT_FORM_OVERHEAD)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			mapRepoErr(c, repodb.ErrAttachmentTooLarge, "file")
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "File not provided"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, repodb.MAX_ATTACHMENT_SIZE+1))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to read file: " + err.Error()})
+		return
+	}
+
+	attachment, err := repodb.NewAttachment(*userId, header.Filename, data)
+	if err == nil {
+		err = repo.CreateAttachment(attachment, data)
+	}
+	if err != nil {
+		if mapRepoErr(c, err, "file") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	// The content may have been stored before, under another name.
+	attachment, _, err = repo.GetAttachment(*userId, attachment.Id)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, attachmentResponse(attachment))
+}
+
+// @Summary List attachments
+// @Tags attachments
+// @Description Get attachments of the user, most recently uploaded first
+// @Produce json
+// @Success 200 {object} GetAttachmentsResponse "Attachments response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/attachments [get]
+func getAttachmentsHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	attachments, err := repo.GetAttachments(*userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load attachments: " + err.Error()})
+		return
+	}
+
+	resp := GetAttachmentsResponse{Attachments: make([]AttachmentResponse, 0, len(attachments))}
+	for _, attachment := range attachments {
+		resp.Attachments = append(resp.Attachments, attachmentResponse(attachment))
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func getAttachmentOwner(c *gin.Context) (uuid.UUID, bool) {
+	owner, err := uuid.Parse(c.Param("owner"))
+	if err != nil {
+		abortRich(c, http.StatusBadRequest, "USER_ID_INVALID",
+			"Некорректный идентификатор пользователя.", "owner", nil)
+		return uuid.UUID{}, false
+	}
+
+	return owner, true
+}
+
+// @Summary Download attachment
+// @Tags attachments
+// @Description Get attachment content. Besides the owner, users reading a shared document that embeds the attachment may get it. Responses are cacheable, the content behind a URL never changes
+// @Param owner path string true "Owner id"
+// @Param id path string true "Attachment id"
+// @Produce octet-stream
+// @Success 200 {file} file "Attachment content"
+// @Success 304 "Not modified"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/attachments/{owner}/{id} [get]
+func downloadAttachmentHandler(c *gin.Context, repo repodb.FileRepository, index *search.Index) {
+	id := c.Param("id")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+	owner, ok := getAttachmentOwner(c)
+	if !ok {
+		return
+	}
+
+	allowed, err := canReadAttachment(repo, index, *userId, owner, id)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check access: " + err.Error()})
+		return
+	}
+	if !allowed {
+		mapRepoErr(c, repodb.ErrAttachmentNotFound, "id")
+		return
+	}
+
+	serveAttachment(c, repo, owner, id)
+}
+
+// serveAttachment writes the attachment, or 304 if the client has it.
+func serveAttachment(c *gin.Context, repo repodb.FileRepository, owner uuid.UUID, id string) {
+	attachment, data, err := repo.GetAttachment(owner, id)
+	if err != nil {
+		if mapRepoErr(c, err, "id") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	etag := `"` + attachment.Id + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", ATTACHMENT_CACHE_CONTROL)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+	if slices.ContainsFunc(strings.Split(c.GetHeader("If-None-Match"), ","), func(tag string) bool {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		return tag == etag || tag == "*"
+	}) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	disposition := "attachment"
+	if attachment.IsImage() {
+		disposition = "inline"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+
+	contentType := attachment.ContentType
+	if strings.HasPrefix(contentType, "text/") {
+		contentType += "; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// @Summary Shared document attachment
+// @Tags links
+// @Description Get an attachment embedded in a document read by a public link. Links to documents rendered as HTML point here. Password protected links require HTTP basic authentication with the password
+// @Param token path string true "Link token"
+// @Param owner path string true "Owner id"
+// @Param id path string true "Attachment id"
+// @Produce octet-stream
+// @Success 200 {file} file "Attachment content"
+// @Success 304 "Not modified"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 410 {object} ErrorResponse "Error response"
+// @Failure 429 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /s/{token}/attachments/{owner}/{id} [get]
+func publicShareLinkAttachmentHandler(c *gin.Context, repo repodb.FileRepository, index *search.Index, lockout *utils.Lockout) {
+	id := c.Param("id")
+
+	c.Header("Referrer-Policy", "no-referrer")
+	link, ok := openShareLink(c, repo, lockout, LINK_FORMAT_ATTACHMENT)
+	if !ok {
+		return
+	}
+	owner, ok := getAttachmentOwner(c)
+	if !ok {
+		return
+	}
+
+	// Only attachments the document embeds are served, with the same rules
+	// as for users reading it.
+	allowed, err := documentEmbedsAttachment(repo, index, link.Owner, link.Filename, owner, id)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check access: " + err.Error()})
+		return
+	}
+	if !allowed {
+		shareLinkAccessesTotal.WithLabelValues(LINK_FORMAT_ATTACHMENT, LINK_RESULT_NOT_FOUND).Inc()
+		mapRepoErr(c, repodb.ErrAttachmentNotFound, "id")
+		return
+	}
+
+	shareLinkAccessesTotal.WithLabelValues(LINK_FORMAT_ATTACHMENT, LINK_RESULT_SERVED).Inc()
+	serveAttachment(c, repo, owner, id)
+}
+
+// @Summary Delete attachment
+// @Tags attachments
+// @Description Permanently delete an attachment of the user. Documents embedding it show a broken image
+// @Param owner path string true "Owner id, must be the user"
+// @Param id path string true "Attachment id"
+// @Produce json
+// @Success 200 {object} MessageReponse "Delete response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 404 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/attachments/{owner}/{id} [delete]
+func deleteAttachmentHandler(c *gin.Context, repo repodb.FileRepository) {
+	id := c.Param("id")
+
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+	owner, ok := getAttachmentOwner(c)
+	if !ok {
+		return
+	}
+	if owner != *userId {
+		abortRich(c, http.StatusForbidden, "ACCESS_DENIED",
+			"Недостаточно прав для этого действия.", "", nil)
+		return
+	}
+
+	if err := repo.DeleteAttachment(owner, id); err != nil {
+		if mapRepoErr(c, err, "id") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageReponse{Message: "Attachment deleted"})
+}
+
+// adminMiddleware lets through only users listed in admins, it must follow
+// authMiddleware.
+func adminMiddleware(admins []uuid.UUID) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := getUserId(c)
+		if userId == nil {
+			return
+		}
+
+		for _, admin := range admins {
+			if admin == *userId {
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: "Admin rights required"})
+	}
+}
+
+func getQuotaResponse(c *gin.Context, repo repodb.FileRepository, userId uuid.UUID) (QuotaResponse, bool) {
+	quota, err := repo.GetQuota(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load quota: " + err.Error()})
+		return QuotaResponse{}, false
+	}
+
+	used, cnt, err := repo.GetUserOccupiedSpaceAndFileCount(userId, []string{})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load used space: " + err.Error()})
+		return QuotaResponse{}, false
+	}
+	history, err := repo.GetUserHistorySize(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load history size: " + err.Error()})
+		return QuotaResponse{}, false
+	}
+
+	return QuotaResponse{
+		Plan:         quota.Plan,
+		UsedBytes:    used,
+		LimitBytes:   quota.SpaceSize,
+		FileCount:    cnt,
+		MaxFiles:     quota.MaxFiles,
+		HistoryBytes: history,
+	}, true
+}
+
+// @Summary User quota
+// @Tags quota
+// @Description Get storage usage and limits of the user. Used bytes are live files and attachments, file history is reported separately
+// @Produce json
+// @Success 200 {object} QuotaResponse "Quota response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/quota [get]
+func getQuotaHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId := getUserId(c)
+	if userId == nil {
+		return
+	}
+
+	resp, ok := getQuotaResponse(c, repo, *userId)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func getQuotaUserId(c *gin.Context) (uuid.UUID, bool) {
+	userId, err := uuid.Parse(c.Param("userId"))
+	if err != nil {
+		abortRich(c, http.StatusBadRequest, "USER_ID_INVALID",
+			"Некорректный идентификатор пользователя.", "userId", nil)
+		return uuid.UUID{}, false
+	}
+
+	return userId, true
+}
+
+func userQuotaResponse(c *gin.Context, repo repodb.FileRepository, userId uuid.UUID) {
+	resp, ok := getQuotaResponse(c, repo, userId)
+	if !ok {
+		return
+	}
+
+	override, err := repo.GetQuotaOverride(userId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load quota: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, UserQuotaResponse{
+		UserId:        userId.String(),
+		QuotaResponse: resp,
+		Override:      override,
+	})
+}
+
+// @Summary Get user quota
+// @Tags admin
+// @Description Get storage usage, limits and quota override of any user
+// @Param userId path string true "User id"
+// @Produce json
+// @Success 200 {object} UserQuotaResponse "Quota response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/admin/quota/{userId} [get]
+func getUserQuotaHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId, ok := getQuotaUserId(c)
+	if !ok {
+		return
+	}
+
+	userQuotaResponse(c, repo, userId)
+}
+
+// @Summary Set user quota
+// @Tags admin
+// @Description Set quota override of a user: a plan and/or limits replacing the limits of the plan. Existing files are kept when the quota shrinks
+// @Param userId path string true "User id"
+// @Param override body repodb.QuotaOverride true "Quota override"
+// @Accept json
+// @Produce json
+// @Success 200 {object} UserQuotaResponse "Quota response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/admin/quota/{userId} [put]
+func setUserQuotaHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId, ok := getQuotaUserId(c)
+	if !ok {
+		return
+	}
+
+	var override repodb.QuotaOverride
+	if err := c.ShouldBindJSON(&override); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid quota: " + err.Error()})
+		return
+	}
+
+	if err := repo.SetQuotaOverride(userId, &override); err != nil {
+		if mapRepoErr(c, err, "") {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	userQuotaResponse(c, repo, userId)
+}
+
+// @Summary Reset user quota
+// @Tags admin
+// @Description Remove quota override of a user, the default plan applies again
+// @Param userId path string true "User id"
+// @Produce json
+// @Success 200 {object} UserQuotaResponse "Quota response"
+// @Failure 400 {object} ErrorResponse "Error response"
+// @Failure 401 {object} ErrorResponse "Error response"
+// @Failure 403 {object} ErrorResponse "Error response"
+// @Failure 500 {object} ErrorResponse "Error response"
+// @Router /api/admin/quota/{userId} [delete]
+func deleteUserQuotaHandler(c *gin.Context, repo repodb.FileRepository) {
+	userId, ok := getQuotaUserId(c)
+	if !ok {
+		return
+	}
+
+	if err := repo.SetQuotaOverride(userId, nil); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Unexpected error: " + err.Error()})
+		return
+	}
+
+	userQuotaResponse(c, repo, userId)
+}
+
+//
+
+func abortRich(c *gin.Context, status int, code, msg, field string, details any) {
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Error: APIError{Code: code, Message: msg, Field: field, Details: details},
+	})
+}
+
+// reportRepoErr reports a known repository error with report, which gets
+// arguments of abortRich. It returns false if the error isn't known.
+func reportRepoErr(err error, field string, report func(status int, code, msg, field string, details any)) bool {
+	if err == nil {
+		return false
+	}
+
+	quota := repodb.Plans[repodb.DEFAULT_PLAN]
+	var quotaErr *repodb.QuotaError
+	if errors.As(err, &quotaErr) {
+		quota = quotaErr.Quota
+	}
+	if errors.Is(err, repodb.ErrUserSpaceIsFull) {
+		report(http.StatusConflict, "USER_SPACE_FULL",
+			"Недостаточно места в хранилище пользователя.", "", map[string]any{"plan": quota.Plan, "maxBytes": quota.SpaceSize})
+		return true
+	}
+	if errors.Is(err, repodb.ErrFileNumberLimitReached) {
+		report(http.StatusConflict, "FILE_COUNT_LIMIT",
+			"Превышен лимит количества файлов.", "", map[string]any{"plan": quota.Plan, "max": quota.MaxFiles})
+		return true
+	}
+	if errors.Is(err, repodb.ErrPlanNotFound) {
+		report(http.StatusBadRequest, "QUOTA_PLAN_NOT_FOUND",
+			"Тарифный план не найден.", "plan", nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrInvalidQuota) {
+		report(http.StatusBadRequest, "QUOTA_INVALID",
+			"Лимиты не могут быть отрицательными.", "", nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrFileExists) {
+		report(http.StatusConflict, "FILE_ALREADY_EXISTS",
+			"Файл с таким именем уже существует.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrFileNotFound) {
+		report(http.StatusNotFound, "FILE_NOT_FOUND",
+			"Файл не найден.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrFileModified) {
+		report(http.StatusPreconditionFailed, "FILE_MODIFIED",
+			"Файл был изменён с момента последней загрузки.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrFolderExists) {
+		report(http.StatusConflict, "FOLDER_ALREADY_EXISTS",
+			"Папка с таким именем уже существует.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrFolderNotFound) {
+		report(http.StatusNotFound, "FOLDER_NOT_FOUND",
+			"Папка не найдена.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrFolderNotEmpty) {
+		report(http.StatusConflict, "FOLDER_NOT_EMPTY",
+			"Папка не пуста.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrMoveIntoItself) {
+		report(http.StatusBadRequest, "FOLDER_MOVE_INTO_ITSELF",
+			"Папку нельзя переместить внутрь самой себя.", field, nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrTrashItemNotFound) {
+		report(http.StatusNotFound, "TRASH_ITEM_NOT_FOUND",
+			"Файл не найден в корзине.", "id", nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrShareNotFound) {
+		report(http.StatusNotFound, "SHARE_NOT_FOUND",
+			"Файл не предоставлен этому пользователю.", "userId", nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrInvalidShare) {
+		report(http.StatusBadRequest, "SHARE_INVALID",
+			"Файл можно предоставить другому пользователю с ролью viewer или editor.", "", map[string]any{"roles": []string{repodb.ROLE_VIEWER, repodb.ROLE_EDITOR}})
+		return true
+	}
+	if errors.Is(err, repodb.ErrShareLinkNotFound) {
+		report(http.StatusNotFound, "SHARE_LINK_NOT_FOUND",
+			"Ссылка не найдена.", "token", nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrAttachmentNotFound) {
+		report(http.StatusNotFound, "ATTACHMENT_NOT_FOUND",
+			"Вложение не найдено.", "id", nil)
+		return true
+	}
+	if errors.Is(err, repodb.ErrAttachmentTooLarge) {
+		report(http.StatusRequestEntityTooLarge, "ATTACHMENT_TOO_LARGE",
+			"Слишком большой файл.", field, map[string]any{"maxBytes": repodb.MAX_ATTACHMENT_SIZE})
+		return true
+	}
+	if errors.Is(err, repodb.ErrAttachmentType) {
+		types := make([]string, 0, len(repodb.AttachmentTypes))
+		for t := range repodb.AttachmentTypes {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		report(http.StatusUnsupportedMediaType, "ATTACHMENT_TYPE_INVALID",
+			"Недопустимый тип файла.", field, map[string]any{"allowedTypes": types})
+		return true
+	}
+	if errors.Is(err, repodb.ErrVersionNotFound) {
+		report(http.StatusNotFound, "VERSION_NOT_FOUND",
+			"Версия файла не найдена.", "id", nil)
+		return true
+	}
+	var inv *repodb.ErrInvalidFilename
+	if errors.As(err, &inv) {
+		code := "FILE_NAME_INVALID"
+		msg := "Недопустимое имя файла."
+		det := map[string]any{}
+
+		switch inv.Reason {
+		case repodb.ERR_EMPTY_FILENAME:
+			code, msg = "FILE_NAME_EMPTY", "Имя файла не может быть пустым."
+		case repodb.ERR_PATH_TRAVERSAL:
+			code, msg = "FILE_PATH_TRAVERSAL", "Путь не должен выходить за пределы хранилища пользователя."
+		case repodb.ERR_EMPTY_SEGMENT:
+			code, msg = "FILE_PATH_EMPTY_SEGMENT", "Путь не должен содержать пустых имён папок."
+		case repodb.ERR_HIDDEN_FOLDER:
+			code, msg = "FOLDER_NAME_HIDDEN", "Имя папки не должно начинаться с точки."
+		case repodb.ERR_TOO_DEEP:
+			code, msg = "FILE_PATH_TOO_DEEP", "Слишком большая вложенность папок."
+			det["maxDepth"] = repodb.MAX_FOLDER_DEPTH
+		case repodb.ERR_PATH_TOO_LONG:
+			code, msg = "FILE_PATH_TOO_LONG", "Слишком длинный путь к файлу."
+			det["maxLen"] = repodb.MAX_PATH_LEN
+		case repodb.ERR_BAD_EXTENSION:
+			code, msg = "FILE_EXTENSION_INVALID", "Разрешены только расширения: .md ."
+			det["allowedExtensions"] = []string{".md", ".markdown"}
+		case repodb.ERR_TRAILING_DOT_SPACE:
+			code, msg = "FILE_NAME_TRAILING", "Имя файла не должно заканчиваться точкой или пробелом."
+		case repodb.ERR_TOO_LONG:
+			code, msg = "FILE_NAME_TOO_LONG", "Слишком длинное имя файла."
+			det["maxLen"] = 255
+		case repodb.ERR_RESERVED:
+			code, msg = "FILE_NAME_RESERVED", "Это имя зарезервировано системой."
+			if inv.ReservedAs != "" {
+				det["reserved"] = inv.ReservedAs
+			}
+		case repodb.ERR_ONLY_DOTS:
+			code, msg = "FILE_NAME_ONLY_DOTS", "Имя файла не может состоять только из точек."
+		case repodb.ERR_ONLY_SPACES:
+			code, msg = "FILE_NAME_ONLY_SPACES", "Имя файла не может состоять только из пробелов."
+		case repodb.ERR_INVALID_CHARACTERS:
+			code, msg = "FILE_NAME_INVALID_CHARS", "Имя файла содержит недопустимые символы."
+			if len(inv.InvalidRunes) > 0 {
+				var chars []string
+				for _, r := range inv.InvalidRunes {
+					if r <= 0x1F || r == 0x7F {
+						chars = append(chars, fmt.Sprintf("U+%02X", r))
+					} else {
+						chars = append(chars, string(r))
+					}
+				}
+				det["invalid"] = chars
+			}
+		}
+
+		report(http.StatusBadRequest, code, msg, field, det)
+		return true
+	}
+
+	return false
+}
+
+func mapRepoErr(c *gin.Context, err error, field string) bool {
+	return reportRepoErr(err, field, func(status int, code, msg, field string, details any) {
+		abortRich(c, status, code, msg, field, details)
+	})
 }
@@ -1,13 +0,0 @@
-package main
-
-import (
-	"os"
-
-	"github.com/golang-jwt/jwt"
-)
-
-func parseToken(tokenString string) (*jwt.Token, error) {
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(os.Getenv("JWT_SECRET")), nil
-	})
-}
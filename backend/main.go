@@ -1,19 +1,31 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 
+	"backend/collab"
 	"backend/db/repodb"
+	"backend/db/search"
+	"backend/db/utils"
+	"backend/users"
 
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -25,6 +37,34 @@ const (
 	TLS_KEY_FILE  = "tls/key.crt"
 )
 
+// Trashed files are purged after TRASH_RETENTION (a Go duration, e.g.
+// "720h"), the trash is checked every TRASH_SWEEP_INTERVAL.
+const (
+	DEFAULT_TRASH_RETENTION = 30 * 24 * time.Hour
+	TRASH_SWEEP_INTERVAL    = time.Hour
+)
+
+// Attachments no document refers to are deleted once they are older than
+// ATTACHMENT_GRACE_PERIOD, checked every ATTACHMENT_SWEEP_INTERVAL. The grace
+// period covers uploads whose document isn't saved yet.
+const (
+	ATTACHMENT_GRACE_PERIOD   = 24 * time.Hour
+	ATTACHMENT_SWEEP_INTERVAL = 6 * time.Hour
+)
+
+// SESSION_CHECK_TTL is how long the auth service answer about a session is
+// trusted, the longest a revoked session keeps working. While the auth
+// service fails, answers up to SESSION_MAX_STALENESS old are used, then
+// requests are refused.
+const (
+	SESSION_CHECK_TTL     = 30 * time.Second
+	SESSION_MAX_STALENESS = 5 * time.Minute
+)
+
+// COLLAB_SAVE_INTERVAL is how often documents edited collaboratively are
+// saved.
+const COLLAB_SAVE_INTERVAL = 5 * time.Second
+
 var (
 	ErrUserIdNotFound    = errors.New("user_id not found in claims")
 	ErrInvalidUserIdType = errors.New("invalid user_id type")
@@ -52,6 +92,162 @@ func validatePort(portStr string) error {
 	return nil
 }
 
+// newFileRepository creates the storage selected by STORAGE_BACKEND:
+// "local" (default) keeps files in DB_PATH, "postgres" connects to
+// STORAGE_DATABASE_URL, "s3" stores DB_PATH/<userId>/<filename> objects in
+// S3_BUCKET at S3_ENDPOINT.
+func newFileRepository() (repodb.FileRepository, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return repodb.NewLocalFileRepo(DB_PATH)
+	case "postgres":
+		url := os.Getenv("STORAGE_DATABASE_URL")
+		if url == "" {
+			return nil, errors.New("STORAGE_DATABASE_URL not provided")
+		}
+
+		db, err := pgxpool.New(context.Background(), url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to database: %w", err)
+		}
+
+		return repodb.NewPgFileRepo(db)
+	case "s3":
+		endpoint, bucket := os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET")
+		if endpoint == "" || bucket == "" {
+			return nil, errors.New("S3_ENDPOINT or S3_BUCKET not provided")
+		}
+
+		client, err := minio.New(endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), ""),
+			Secure: os.Getenv("S3_USE_SSL") != "false",
+			Region: os.Getenv("S3_REGION"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 client: %w", err)
+		}
+
+		return repodb.NewS3FileRepo(client, bucket, DB_PATH)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// newUserDirectory connects to the auth service at AUTH_URL to resolve
+// usernames and check sessions, authenticated with INTERNAL_API_TOKEN. Both
+// are required, without them revoked sessions would stay valid until their
+// access tokens expire.
+func newUserDirectory(httpClient *http.Client) (*users.Client, error) {
+	url := os.Getenv("AUTH_URL")
+	if url == "" {
+		return nil, errors.New("AUTH_URL not provided")
+	}
+
+	token := os.Getenv("INTERNAL_API_TOKEN")
+	if token == "" {
+		return nil, errors.New("INTERNAL_API_TOKEN not provided")
+	}
+
+	return users.NewClient(url, token, httpClient), nil
+}
+
+// parseAdminIds parses ADMIN_USER_IDS, a comma separated list of user ids
+// allowed to manage quotas.
+func parseAdminIds(s string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		id, err := uuid.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin user id %q: %w", item, err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func parseTrashRetention(s string) (time.Duration, error) {
+	if s == "" {
+		return DEFAULT_TRASH_RETENTION, nil
+	}
+
+	retention, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if retention <= 0 {
+		return 0, errors.New("retention must be positive")
+	}
+
+	return retention, nil
+}
+
+// runTrashSweeper purges files trashed more than retention ago, right away
+// and then every interval until ctx is done.
+func runTrashSweeper(ctx context.Context, repo repodb.FileRepository, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := repo.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			Logger.Error("Failed to purge trash", slog.String("error", err.Error()))
+		} else if purged > 0 {
+			Logger.Info("Trash purged", slog.Int("files", purged))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runAttachmentCollector deletes unreferenced attachments older than grace,
+// right away and then every interval until ctx is done.
+func runAttachmentCollector(ctx context.Context, repo repodb.FileRepository, grace time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		owners, err := repo.GetAttachmentOwners()
+		if err != nil {
+			Logger.Error("Failed to list attachment owners", slog.String("error", err.Error()))
+		}
+		for _, owner := range owners {
+			deleted, err := repodb.CollectAttachments(repo, owner, time.Now().Add(-grace))
+			if err != nil {
+				Logger.Error("Failed to collect attachments", slog.String("user_id", owner.String()), slog.String("error", err.Error()))
+			} else if deleted > 0 {
+				Logger.Info("Attachments collected", slog.String("user_id", owner.String()), slog.Int("attachments", deleted))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildSearchIndex builds the search index of all users, so the first search
+// of a user after a start doesn't read all their files.
+func buildSearchIndex(index *search.Index) {
+	start := time.Now()
+	built, err := index.BuildAll()
+	if err != nil {
+		Logger.Error("Failed to build search index", slog.String("error", err.Error()))
+	}
+	Logger.Info("Search index built", slog.Int("users", built), slog.Duration("duration", time.Since(start)))
+}
+
 // @title           Markdown backend
 // @version         1.0
 // @description     Backend for Markdown-editor
@@ -79,17 +275,66 @@ func main() {
 		panic("Host not provided")
 	}
 
-	repo, err := repodb.NewLocalFileRepo(DB_PATH)
+	plans, err := repodb.ParsePlans(os.Getenv("QUOTA_PLANS"))
+	if err != nil {
+		panic(fmt.Sprintf("Invalid QUOTA_PLANS: %v", err))
+	}
+	repodb.Plans = plans
+
+	admins, err := parseAdminIds(os.Getenv("ADMIN_USER_IDS"))
+	if err != nil {
+		panic(fmt.Sprintf("Invalid ADMIN_USER_IDS: %v", err))
+	}
+
+	retention, err := parseTrashRetention(os.Getenv("TRASH_RETENTION"))
+	if err != nil {
+		panic(fmt.Sprintf("Invalid TRASH_RETENTION: %v", err))
+	}
+
+	rates, err := utils.ParseRates(os.Getenv("RATE_LIMITS"), defaultRateLimits)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid RATE_LIMITS: %v", err))
+	}
+	uploadLimit := rateLimitMiddleware(RATE_LIMIT_UPLOAD, utils.NewRateLimiterWithRate(rates[RATE_LIMIT_UPLOAD]))
+
+	authClient, err := jwks.NewClientFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create auth client: %v", err))
+	}
+	tokenKeys, err := jwks.NewFetcherFromEnv(authClient)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to set up token verification: %v", err))
+	}
+	directory, err := newUserDirectory(authClient)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create user directory: %v", err))
+	}
+	sessions := users.NewSessionCache(directory, SESSION_CHECK_TTL, SESSION_MAX_STALENESS)
+
+	repo, err := newFileRepository()
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create file repository: %v", err))
 	}
+	// The search index lives in memory, it is built in the background. Users
+	// searching before their index is built wait for it.
+	index := search.NewIndex(repo)
+	repo = search.NewIndexedRepository(repo, index)
+	go buildSearchIndex(index)
+	hub := collab.NewHub(repo, COLLAB_SAVE_INTERVAL, Logger)
+	go runTrashSweeper(context.Background(), repo, retention, TRASH_SWEEP_INTERVAL)
+	go runAttachmentCollector(context.Background(), repo, ATTACHMENT_GRACE_PERIOD, ATTACHMENT_SWEEP_INTERVAL)
 
 	r := gin.New()
+	// Paths of nested files are passed as a single URL encoded parameter,
+	// e.g. /api/file/notes%2Fmeeting.md.
+	r.UseRawPath = true
+	allowedOrigins := []string{"https://localhost:5173", "http://localhost:5173", fmt.Sprintf("https://%s:%s", os.Getenv("REMOTE_HOST"), os.Getenv("FRONTEND_PORT"))}
+	upgrader := newUpgrader(allowedOrigins)
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"https://localhost:5173", "http://localhost:5173", fmt.Sprintf("https://%s:%s", os.Getenv("REMOTE_HOST"), os.Getenv("FRONTEND_PORT"))},
+		AllowOrigins:     allowedOrigins,
 		AllowMethods:     []string{"POST", "GET", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "If-Match"},
+		ExposeHeaders:    []string{"Content-Length", "ETag", "Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -100,27 +345,152 @@ func main() {
 	r.Static("/docs", "./docs")
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.URL("/docs/swagger.json")))
 	r.GET("/health", healthHandler)
+	// Public share links are read without authentication.
+	linkLockout := utils.NewLockout(LINK_PASSWORD_FAILURES, LINK_LOCKOUT, MAX_LINK_LOCKOUT)
+	links := r.Group("/s/:token",
+		keyedRateLimitMiddleware(RATE_LIMIT_LINK, utils.NewRateLimiterWithRate(rates[RATE_LIMIT_LINK]), func(c *gin.Context) (string, bool) {
+			return c.ClientIP(), true
+		}),
+		keyedRateLimitMiddleware(RATE_LIMIT_LINK_TOKEN, utils.NewRateLimiterWithRate(rates[RATE_LIMIT_LINK_TOKEN]), func(c *gin.Context) (string, bool) {
+			return c.Param("token"), true
+		}))
+	links.GET("", func(c *gin.Context) {
+		publicShareLinkHandler(c, repo, linkLockout)
+	})
+	links.GET("/attachments/:owner/:id", func(c *gin.Context) {
+		publicShareLinkAttachmentHandler(c, repo, index, linkLockout)
+	})
 
 	authorized := r.Group("/api")
-	authorized.Use(authMiddleware())
+	authorized.Use(authMiddleware(tokenKeys, sessions))
+	authorized.Use(rateLimitMiddleware(RATE_LIMIT_API, utils.NewRateLimiterWithRate(rates[RATE_LIMIT_API])))
 	authorized.GET("/files", func(c *gin.Context) {
 		getAllFilesHandler(c, repo)
 	})
 	authorized.GET("/file/:filename", func(c *gin.Context) {
 		downloadFileHandler(c, repo)
 	})
-	authorized.POST("/file/:filename", func(c *gin.Context) {
+	authorized.POST("/file/:filename", uploadLimit, func(c *gin.Context) {
 		uploadFileHandler(c, repo)
 	})
 	authorized.PUT("/file/:filename", func(c *gin.Context) {
 		editFileHandler(c, repo)
 	})
 	authorized.PUT("/rename/:oldName/:newName", func(c *gin.Context) {
-		renameFileHandler(c, repo)
+		renameFileHandler(c, repo, index)
 	})
 	authorized.DELETE("/file/:filename", func(c *gin.Context) {
 		deleteFileHandler(c, repo)
 	})
+	authorized.POST("/folder/:path", func(c *gin.Context) {
+		createFolderHandler(c, repo)
+	})
+	authorized.DELETE("/folder/:path", func(c *gin.Context) {
+		deleteFolderHandler(c, repo)
+	})
+	authorized.PUT("/rename-folder/:oldName/:newName", func(c *gin.Context) {
+		renameFolderHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/render", func(c *gin.Context) {
+		renderFileHandler(c, repo)
+	})
+	authorized.POST("/render", renderTextHandler)
+	authorized.GET("/file/:filename/export", func(c *gin.Context) {
+		exportFileHandler(c, repo)
+	})
+	authorized.GET("/folder/:path/export", func(c *gin.Context) {
+		exportFolderHandler(c, repo)
+	})
+	authorized.GET("/export", func(c *gin.Context) {
+		exportAllHandler(c, repo)
+	})
+	authorized.POST("/import", uploadLimit, func(c *gin.Context) {
+		importHandler(c, repo)
+	})
+	authorized.POST("/attachments", uploadLimit, func(c *gin.Context) {
+		uploadAttachmentHandler(c, repo)
+	})
+	authorized.GET("/attachments", func(c *gin.Context) {
+		getAttachmentsHandler(c, repo)
+	})
+	authorized.GET("/attachments/:owner/:id", func(c *gin.Context) {
+		downloadAttachmentHandler(c, repo, index)
+	})
+	authorized.DELETE("/attachments/:owner/:id", func(c *gin.Context) {
+		deleteAttachmentHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/versions", func(c *gin.Context) {
+		getVersionsHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/versions/:id", func(c *gin.Context) {
+		downloadVersionHandler(c, repo)
+	})
+	authorized.POST("/file/:filename/versions/:id/restore", func(c *gin.Context) {
+		restoreVersionHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/shares", func(c *gin.Context) {
+		getSharesHandler(c, repo, directory)
+	})
+	authorized.PUT("/file/:filename/shares", func(c *gin.Context) {
+		shareFileHandler(c, repo, directory)
+	})
+	authorized.DELETE("/file/:filename/shares/:userId", func(c *gin.Context) {
+		unshareFileHandler(c, repo, directory)
+	})
+	authorized.POST("/file/:filename/links", func(c *gin.Context) {
+		createShareLinkHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/links", func(c *gin.Context) {
+		getShareLinksHandler(c, repo)
+	})
+	authorized.GET("/links", func(c *gin.Context) {
+		getShareLinksHandler(c, repo)
+	})
+	authorized.DELETE("/links/:token", func(c *gin.Context) {
+		deleteShareLinkHandler(c, repo)
+	})
+	authorized.GET("/shared", func(c *gin.Context) {
+		getSharedHandler(c, repo, directory)
+	})
+	authorized.GET("/trash", func(c *gin.Context) {
+		getTrashHandler(c, repo)
+	})
+	authorized.POST("/trash/:id/restore", func(c *gin.Context) {
+		restoreTrashHandler(c, repo)
+	})
+	authorized.DELETE("/trash/:id", func(c *gin.Context) {
+		purgeTrashItemHandler(c, repo)
+	})
+	authorized.DELETE("/trash", func(c *gin.Context) {
+		emptyTrashHandler(c, repo)
+	})
+	authorized.GET("/search", func(c *gin.Context) {
+		searchHandler(c, index)
+	})
+	authorized.GET("/file/:filename/backlinks", func(c *gin.Context) {
+		backlinksHandler(c, index)
+	})
+	authorized.GET("/graph", func(c *gin.Context) {
+		graphHandler(c, index)
+	})
+	authorized.GET("/collab/:filename", func(c *gin.Context) {
+		collabHandler(c, repo, hub, upgrader)
+	})
+	authorized.GET("/quota", func(c *gin.Context) {
+		getQuotaHandler(c, repo)
+	})
+
+	admin := authorized.Group("/admin")
+	admin.Use(adminMiddleware(admins))
+	admin.GET("/quota/:userId", func(c *gin.Context) {
+		getUserQuotaHandler(c, repo)
+	})
+	admin.PUT("/quota/:userId", func(c *gin.Context) {
+		setUserQuotaHandler(c, repo)
+	})
+	admin.DELETE("/quota/:userId", func(c *gin.Context) {
+		deleteUserQuotaHandler(c, repo)
+	})
 
 	serverAddr := fmt.Sprintf("%s:%s", host, port)
 	Logger.Info("Server started on", slog.String("address", serverAddr))
@@ -1,38 +1,90 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"backend/collab"
 	"backend/db/repodb"
+	"backend/db/search"
 	"backend/db/utils"
+	"backend/users"
 
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var testToken string
 var testUUID uuid.UUID
+var testAdminUUID = uuid.New()
+
+// fakeDirectory stands in for the auth service, it maps usernames to ids.
+type fakeDirectory map[string]uuid.UUID
+
+func (d fakeDirectory) LookupUsername(ctx context.Context, username string) (users.User, error) {
+	id, ok := d[username]
+	if !ok {
+		return users.User{}, users.ErrUserNotFound
+	}
+	return users.User{Id: id, Username: username}, nil
+}
+
+func (d fakeDirectory) LookupId(ctx context.Context, id uuid.UUID) (users.User, error) {
+	for username, userId := range d {
+		if userId == id {
+			return users.User{Id: id, Username: username}, nil
+		}
+	}
+	return users.User{}, users.ErrUserNotFound
+}
 
 func setupTestRouter(repo repodb.FileRepository) *gin.Engine {
+	index := search.NewIndex(repo)
+	return setupIndexedTestRouter(search.NewIndexedRepository(repo, index), index)
+}
+
+// setupIndexedTestRouter serves repo, which must keep index up to date. Tests
+// writing files directly use it to have the writes indexed.
+func setupIndexedTestRouter(repo repodb.FileRepository, index *search.Index) *gin.Engine {
 	fmt.Printf("LOGGER: %v\n", Logger)
 	gin.SetMode(gin.TestMode)
 	router := gin.Default()
+	router.UseRawPath = true
+
+	hub := collab.NewHub(repo, time.Hour, Logger)
+	upgrader := newUpgrader(nil)
+	directory := fakeDirectory{"owner": testUUID, "admin": testAdminUUID}
+
+	linkLockout := utils.NewLockout(LINK_PASSWORD_FAILURES, LINK_LOCKOUT, MAX_LINK_LOCKOUT)
+	router.GET("/s/:token", func(c *gin.Context) {
+		publicShareLinkHandler(c, repo, linkLockout)
+	})
+	router.GET("/s/:token/attachments/:owner/:id", func(c *gin.Context) {
+		publicShareLinkAttachmentHandler(c, repo, index, linkLockout)
+	})
 
 	authorized := router.Group("/api")
-	authorized.Use(authMiddleware())
+	authorized.Use(authMiddleware(testKeys, nil))
 	authorized.GET("/files", func(c *gin.Context) {
 		getAllFilesHandler(c, repo)
 	})
@@ -48,24 +100,150 @@ func setupTestRouter(repo repodb.FileRepository) *gin.Engine {
 	authorized.DELETE("/file/:filename", func(c *gin.Context) {
 		deleteFileHandler(c, repo)
 	})
+	authorized.PUT("/rename/:oldName/:newName", func(c *gin.Context) {
+		renameFileHandler(c, repo, index)
+	})
+	authorized.POST("/folder/:path", func(c *gin.Context) {
+		createFolderHandler(c, repo)
+	})
+	authorized.DELETE("/folder/:path", func(c *gin.Context) {
+		deleteFolderHandler(c, repo)
+	})
+	authorized.PUT("/rename-folder/:oldName/:newName", func(c *gin.Context) {
+		renameFolderHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/render", func(c *gin.Context) {
+		renderFileHandler(c, repo)
+	})
+	authorized.POST("/render", renderTextHandler)
+	authorized.GET("/file/:filename/export", func(c *gin.Context) {
+		exportFileHandler(c, repo)
+	})
+	authorized.GET("/folder/:path/export", func(c *gin.Context) {
+		exportFolderHandler(c, repo)
+	})
+	authorized.GET("/export", func(c *gin.Context) {
+		exportAllHandler(c, repo)
+	})
+	authorized.POST("/import", func(c *gin.Context) {
+		importHandler(c, repo)
+	})
+	authorized.POST("/attachments", func(c *gin.Context) {
+		uploadAttachmentHandler(c, repo)
+	})
+	authorized.GET("/attachments", func(c *gin.Context) {
+		getAttachmentsHandler(c, repo)
+	})
+	authorized.GET("/attachments/:owner/:id", func(c *gin.Context) {
+		downloadAttachmentHandler(c, repo, index)
+	})
+	authorized.DELETE("/attachments/:owner/:id", func(c *gin.Context) {
+		deleteAttachmentHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/versions", func(c *gin.Context) {
+		getVersionsHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/versions/:id", func(c *gin.Context) {
+		downloadVersionHandler(c, repo)
+	})
+	authorized.POST("/file/:filename/versions/:id/restore", func(c *gin.Context) {
+		restoreVersionHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/shares", func(c *gin.Context) {
+		getSharesHandler(c, repo, directory)
+	})
+	authorized.PUT("/file/:filename/shares", func(c *gin.Context) {
+		shareFileHandler(c, repo, directory)
+	})
+	authorized.DELETE("/file/:filename/shares/:userId", func(c *gin.Context) {
+		unshareFileHandler(c, repo, directory)
+	})
+	authorized.POST("/file/:filename/links", func(c *gin.Context) {
+		createShareLinkHandler(c, repo)
+	})
+	authorized.GET("/file/:filename/links", func(c *gin.Context) {
+		getShareLinksHandler(c, repo)
+	})
+	authorized.GET("/links", func(c *gin.Context) {
+		getShareLinksHandler(c, repo)
+	})
+	authorized.DELETE("/links/:token", func(c *gin.Context) {
+		deleteShareLinkHandler(c, repo)
+	})
+	authorized.GET("/shared", func(c *gin.Context) {
+		getSharedHandler(c, repo, directory)
+	})
+	authorized.GET("/trash", func(c *gin.Context) {
+		getTrashHandler(c, repo)
+	})
+	authorized.POST("/trash/:id/restore", func(c *gin.Context) {
+		restoreTrashHandler(c, repo)
+	})
+	authorized.DELETE("/trash/:id", func(c *gin.Context) {
+		purgeTrashItemHandler(c, repo)
+	})
+	authorized.DELETE("/trash", func(c *gin.Context) {
+		emptyTrashHandler(c, repo)
+	})
+	authorized.GET("/search", func(c *gin.Context) {
+		searchHandler(c, index)
+	})
+	authorized.GET("/file/:filename/backlinks", func(c *gin.Context) {
+		backlinksHandler(c, index)
+	})
+	authorized.GET("/graph", func(c *gin.Context) {
+		graphHandler(c, index)
+	})
+	authorized.GET("/collab/:filename", func(c *gin.Context) {
+		collabHandler(c, repo, hub, upgrader)
+	})
+	authorized.GET("/quota", func(c *gin.Context) {
+		getQuotaHandler(c, repo)
+	})
+
+	admin := authorized.Group("/admin")
+	admin.Use(adminMiddleware([]uuid.UUID{testAdminUUID}))
+	admin.GET("/quota/:userId", func(c *gin.Context) {
+		getUserQuotaHandler(c, repo)
+	})
+	admin.PUT("/quota/:userId", func(c *gin.Context) {
+		setUserQuotaHandler(c, repo)
+	})
+	admin.DELETE("/quota/:userId", func(c *gin.Context) {
+		deleteUserQuotaHandler(c, repo)
+	})
 
 	return router
 }
 
 type CleanupFunc func()
 
+// testKeys stand in for the key set of the auth service, test tokens are
+// signed with testSigningKey.
+var testSigningKey, testKeys = newTestKeys()
+
+const TEST_KEY_ID = "test"
+
+func newTestKeys() (ed25519.PrivateKey, jwks.StaticKeys) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return private, jwks.NewStaticKeys(jwks.Key{Id: TEST_KEY_ID, Alg: jwks.ALG_EDDSA, Public: public})
+}
+
+func signToken(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = TEST_KEY_ID
+	return token.SignedString(testSigningKey)
+}
+
 func generateToken(userID uuid.UUID) (string, error) {
-	claims := jwt.MapClaims{
+	return signToken(jwt.MapClaims{
 		"user_id": userID.String(),
+		"sid":     uuid.NewString(),
 		"exp":     time.Now().Add(24 * time.Hour).Unix(),
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		return "", errors.New("JWT_SECRET environment variable not set")
-	}
-	return token.SignedString([]byte(secret))
+	})
 }
 
 func getNewLocalFileTestRepo() (repodb.FileRepository, CleanupFunc, error) {
@@ -110,6 +288,37 @@ func LoadFile(t *testing.T, r *gin.Engine, repo repodb.FileRepository, testFilen
 	return w
 }
 
+func EditFile(t *testing.T, r *gin.Engine, testFilename string, testContent string, ifMatch string) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", testFilename)
+	assert.NoError(t, err)
+	_, err = part.Write([]byte(testContent))
+	assert.NoError(t, err)
+
+	err = writer.Close()
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest("PUT", "/api/file/"+testFilename, body)
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	req.AddCookie(&http.Cookie{
+		Name:  "access_token",
+		Value: testToken,
+		Path:  "/",
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	return w
+}
+
 func TestMain(m *testing.M) {
 	err := godotenv.Load()
 	if err != nil {
@@ -557,3 +766,1702 @@ func TestFileCreationLimit(t *testing.T) {
 	res := r.Allow(testUUID)
 	assert.False(t, res, "action denied for overlimit")
 }
+
+func TestRateLimiterEviction(t *testing.T) {
+	r := utils.NewRateLimiterWithRate(utils.Rate{Limit: 2, Window: 20 * time.Millisecond})
+	first, second := uuid.New(), uuid.New()
+
+	decision := r.Take(first)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining)
+	assert.True(t, r.Take(first).Allowed)
+	decision = r.Take(first)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 0, decision.Remaining)
+	assert.Positive(t, decision.RetryAfter)
+	assert.LessOrEqual(t, decision.RetryAfter, 20*time.Millisecond)
+	assert.Equal(t, 1, r.Len())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, r.Take(second).Allowed)
+	assert.Equal(t, 1, r.Len(), "idle users are forgotten")
+	assert.True(t, r.Take(first).Allowed)
+}
+
+func TestNewUserDirectory(t *testing.T) {
+	// Without the auth service revoked sessions couldn't be rejected.
+	t.Setenv("AUTH_URL", "")
+	t.Setenv("INTERNAL_API_TOKEN", "secret")
+	_, err := newUserDirectory(nil)
+	assert.Error(t, err)
+
+	t.Setenv("AUTH_URL", "https://auth:8080")
+	t.Setenv("INTERNAL_API_TOKEN", "")
+	_, err = newUserDirectory(nil)
+	assert.Error(t, err)
+
+	t.Setenv("INTERNAL_API_TOKEN", "secret")
+	directory, err := newUserDirectory(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, directory)
+}
+
+func TestParseRates(t *testing.T) {
+	rates, err := utils.ParseRates("", defaultRateLimits)
+	require.NoError(t, err)
+	assert.Equal(t, defaultRateLimits, rates)
+
+	rates, err = utils.ParseRates(" upload=2/1m ", defaultRateLimits)
+	require.NoError(t, err)
+	assert.Equal(t, utils.Rate{Limit: 2, Window: time.Minute}, rates[RATE_LIMIT_UPLOAD])
+	assert.Equal(t, defaultRateLimits[RATE_LIMIT_API], rates[RATE_LIMIT_API])
+
+	for _, s := range []string{"upload", "other=1/1s", "upload=0/1s", "upload=1/0s", "upload=1/x", "upload=1"} {
+		_, err := utils.ParseRates(s, defaultRateLimits)
+		assert.Error(t, err, s)
+	}
+}
+
+// revokedSessions reports every session active but those in the map, and
+// fails for sessions mapped to false.
+type revokedSessions map[uuid.UUID]bool
+
+func (r revokedSessions) SessionActive(_ context.Context, sessionId, _ uuid.UUID) (bool, error) {
+	revoked, ok := r[sessionId]
+	if ok && !revoked {
+		return false, users.ErrUnavailable
+	}
+	return !revoked, nil
+}
+
+func TestAuthMiddlewareSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	active, revoked, unknown := uuid.New(), uuid.New(), uuid.New()
+	sessions := users.NewSessionCache(revokedSessions{revoked: true, unknown: false}, time.Minute, time.Minute)
+
+	router := gin.New()
+	api := router.Group("/api")
+	api.Use(authMiddleware(testKeys, sessions))
+	api.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	send := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+		claims["user_id"] = testUUID.String()
+		claims["exp"] = time.Now().Add(time.Minute).Unix()
+		token, err := signToken(claims)
+		require.NoError(t, err)
+
+		req, err := http.NewRequest("GET", "/api/ping", nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send(jwt.MapClaims{"sid": active.String()}).Code)
+	assert.Equal(t, http.StatusUnauthorized, send(jwt.MapClaims{}).Code, "token without a session")
+
+	w := send(jwt.MapClaims{"sid": revoked.String()})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Session has been revoked")
+
+	w = send(jwt.MapClaims{"sid": "nope"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = send(jwt.MapClaims{"sid": unknown.String()})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "sessions that can't be checked are refused")
+}
+
+// unavailableKeys stands in for a key set that can't be downloaded.
+type unavailableKeys struct{}
+
+func (unavailableKeys) Lookup(context.Context, string) (jwks.Key, error) {
+	return jwks.Key{}, jwks.ErrUnavailable
+}
+
+func TestAuthMiddlewareKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	send := func(keys jwks.Keys, token string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.GET("/api/ping", authMiddleware(keys, nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+		req, err := http.NewRequest("GET", "/api/ping", nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	claims := jwt.MapClaims{"user_id": testUUID.String(), "sid": uuid.NewString(), "exp": time.Now().Add(time.Minute).Unix()}
+
+	assert.Equal(t, http.StatusOK, send(testKeys, testToken).Code)
+
+	expired, err := signToken(jwt.MapClaims{"user_id": testUUID.String(), "sid": uuid.NewString(), "exp": time.Now().Add(-time.Minute).Unix()})
+	require.NoError(t, err)
+	w := send(testKeys, expired)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Token has expired")
+
+	// Tokens must name a known key and use its algorithm.
+	symmetric := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	symmetric.Header["kid"] = TEST_KEY_ID
+	forged, err := symmetric.SignedString([]byte("secret"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, send(testKeys, forged).Code)
+
+	unnamed, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(testSigningKey)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, send(testKeys, unnamed).Code)
+
+	w = send(unavailableKeys{}, testToken)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api")
+	api.Use(authMiddleware(testKeys, nil))
+	api.Use(rateLimitMiddleware(RATE_LIMIT_API, utils.NewRateLimiterWithRate(utils.Rate{Limit: 3, Window: time.Minute})))
+	upload := rateLimitMiddleware(RATE_LIMIT_UPLOAD, utils.NewRateLimiterWithRate(utils.Rate{Limit: 1, Window: time.Minute}))
+	api.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+	api.POST("/upload", upload, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	otherToken, err := generateToken(uuid.New())
+	require.NoError(t, err)
+	send := func(method string, url string, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	rejected := func(before float64) float64 {
+		return testutil.ToFloat64(rateLimitedRequestsTotal.WithLabelValues(RATE_LIMIT_UPLOAD)) - before
+	}
+	uploadsRejected := rejected(0)
+
+	w := send("GET", "/api/ping", testToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", w.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "3;w=60", w.Header().Get("RateLimit-Policy"))
+
+	// The stricter limit of the route is reported.
+	w = send("POST", "/api/upload", testToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+
+	w = send("POST", "/api/upload", testToken)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	var resp struct {
+		Error APIError `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "RATE_LIMITED", resp.Error.Code)
+	assert.Equal(t, map[string]any{"limit": "upload", "max": 1.0, "windowSeconds": 60.0, "retryAfterSeconds": 60.0}, resp.Error.Details)
+	assert.Equal(t, 1.0, rejected(uploadsRejected))
+
+	w = send("GET", "/api/ping", testToken)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "rejected requests count too")
+	assert.Equal(t, "RATE_LIMITED", resp.Error.Code)
+
+	// Limits are per user.
+	w = send("GET", "/api/ping", otherToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestFileVersions(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	testFilename := "test.md"
+	err = repo.Create(testFilename, testUUID, []byte("first"))
+	assert.NoError(t, err)
+	err = repo.Save(testFilename, testUUID, []byte("second"))
+	assert.NoError(t, err)
+
+	router := setupTestRouter(repo)
+
+	req, err := http.NewRequest("GET", "/api/file/"+testFilename+"/versions", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var versions GetVersionsResponse
+	err = json.Unmarshal(w.Body.Bytes(), &versions)
+	assert.NoError(t, err)
+	assert.Equal(t, testFilename, versions.Filename)
+	require.Len(t, versions.Versions, 1)
+
+	versionUrl := fmt.Sprintf("/api/file/%s/versions/%d", testFilename, versions.Versions[0].Id)
+	req, err = http.NewRequest("GET", versionUrl, nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "first", w.Body.String())
+
+	req, err = http.NewRequest("POST", versionUrl+"/restore", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	savedContent, err := repo.Get(testFilename, testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(savedContent))
+}
+
+func TestFileVersionNotFound(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	testFilename := "test.md"
+	err = repo.Create(testFilename, testUUID, []byte("content"))
+	assert.NoError(t, err)
+
+	router := setupTestRouter(repo)
+
+	for url, code := range map[string]string{
+		"/api/file/" + testFilename + "/versions/7":   "VERSION_NOT_FOUND",
+		"/api/file/" + testFilename + "/versions/abc": "VERSION_ID_INVALID",
+	} {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var response map[string]interface{}
+		err = json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+
+		errObj, ok := response["error"].(map[string]interface{})
+		require.True(t, ok, "error field should be an object")
+		assert.Equal(t, code, errObj["code"])
+	}
+}
+
+func TestEditFileIfMatch(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	testFilename := "test.md"
+	err = repo.Create(testFilename, testUUID, []byte("first"))
+	assert.NoError(t, err)
+
+	router := setupTestRouter(repo)
+
+	req, err := http.NewRequest("GET", "/api/file/"+testFilename, nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"`+repodb.ETag([]byte("first"))+`"`, etag)
+
+	w = EditFile(t, router, testFilename, "second", etag)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"`+repodb.ETag([]byte("second"))+`"`, w.Header().Get("ETag"))
+
+	w = EditFile(t, router, testFilename, "third", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	errObj, ok := response["error"].(map[string]interface{})
+	require.True(t, ok, "error field should be an object")
+	assert.Equal(t, "FILE_MODIFIED", errObj["code"])
+
+	savedContent, err := repo.Get(testFilename, testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(savedContent))
+}
+
+func TestDeleteAndRenameIfMatch(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	testFilename := "test.md"
+	err = repo.Create(testFilename, testUUID, []byte("content"))
+	assert.NoError(t, err)
+
+	router := setupTestRouter(repo)
+	stale := `"` + repodb.ETag([]byte("stale")) + `"`
+
+	for _, tc := range []struct {
+		method string
+		url    string
+	}{
+		{"PUT", "/api/rename/" + testFilename + "/renamed.md"},
+		{"DELETE", "/api/file/" + testFilename},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		assert.NoError(t, err)
+		req.Header.Set("If-Match", stale)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	}
+
+	savedContent, err := repo.Get(testFilename, testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(savedContent))
+}
+
+func TestFolders(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	send := func(method string, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := send("POST", "/api/folder/notes")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = LoadFile(t, router, repo, "notes%2Ftest.md", "nested")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	savedContent, err := repo.Get("notes/test.md", testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "nested", string(savedContent))
+
+	w = send("GET", "/api/files")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var files GetAllFilesResponse
+	err = json.Unmarshal(w.Body.Bytes(), &files)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"notes/test.md"}, files.Files)
+	require.Len(t, files.Tree, 1)
+	assert.True(t, files.Tree[0].IsFolder)
+	assert.Equal(t, "notes/test.md", files.Tree[0].Children[0].Path)
+
+	w = send("PUT", "/api/rename-folder/notes/archive")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = send("DELETE", "/api/folder/archive")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = send("DELETE", "/api/folder/archive?recursive=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = send("GET", "/api/file/..%2Ftest.md")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	errObj, ok := response["error"].(map[string]interface{})
+	require.True(t, ok, "error field should be an object")
+	assert.Equal(t, "FILE_PATH_TRAVERSAL", errObj["code"])
+}
+
+func TestQuota(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	adminToken, err := generateToken(testAdminUUID)
+	require.NoError(t, err)
+
+	send := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := LoadFile(t, router, repo, "test.md", "content")
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, repo.Save("test.md", testUUID, []byte("new content")))
+
+	w = send("GET", "/api/quota", testToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var quota QuotaResponse
+	err = json.Unmarshal(w.Body.Bytes(), &quota)
+	assert.NoError(t, err)
+	assert.Equal(t, QuotaResponse{
+		Plan:         repodb.DEFAULT_PLAN,
+		UsedBytes:    len("new content"),
+		LimitBytes:   repodb.USER_SPACE_SIZE,
+		FileCount:    1,
+		MaxFiles:     repodb.MAX_USER_FILES,
+		HistoryBytes: len("content"),
+	}, quota)
+
+	quotaUrl := "/api/admin/quota/" + testUUID.String()
+	w = send("PUT", quotaUrl, testToken, `{"maxFiles": 1}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = send("PUT", quotaUrl, adminToken, `{"plan": "unknown"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = send("PUT", "/api/admin/quota/not-a-uuid", adminToken, `{"maxFiles": 1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = send("PUT", quotaUrl, adminToken, `{"maxFiles": 1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var userQuota UserQuotaResponse
+	err = json.Unmarshal(w.Body.Bytes(), &userQuota)
+	assert.NoError(t, err)
+	assert.Equal(t, testUUID.String(), userQuota.UserId)
+	assert.Equal(t, 1, userQuota.MaxFiles)
+	assert.Equal(t, &repodb.QuotaOverride{MaxFiles: 1}, userQuota.Override)
+
+	w = LoadFile(t, router, repo, "other.md", "content")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	errObj, ok := response["error"].(map[string]interface{})
+	require.True(t, ok, "error field should be an object")
+	assert.Equal(t, "FILE_COUNT_LIMIT", errObj["code"])
+	assert.Equal(t, map[string]interface{}{"plan": repodb.DEFAULT_PLAN, "max": float64(1)}, errObj["details"])
+
+	w = send("DELETE", quotaUrl, adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = LoadFile(t, router, repo, "other.md", "content")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestTrash(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	send := func(method string, url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := LoadFile(t, router, repo, "test.md", "old")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("DELETE", "/api/file/test.md")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = LoadFile(t, router, repo, "test.md", "new")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = send("GET", "/api/trash")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var trash GetTrashResponse
+	err = json.Unmarshal(w.Body.Bytes(), &trash)
+	assert.NoError(t, err)
+	require.Len(t, trash.Items, 1)
+	assert.Equal(t, "test.md", trash.Items[0].Filename)
+
+	restoreUrl := "/api/trash/" + trash.Items[0].Id + "/restore"
+	w = send("POST", restoreUrl)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+
+	errObj, ok := response["error"].(map[string]interface{})
+	require.True(t, ok, "error field should be an object")
+	assert.Equal(t, "FILE_ALREADY_EXISTS", errObj["code"])
+
+	w = send("POST", restoreUrl+"?autoRename=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var restored RestoreTrashResponse
+	err = json.Unmarshal(w.Body.Bytes(), &restored)
+	assert.NoError(t, err)
+	assert.Equal(t, "test (1).md", restored.Filename)
+
+	savedContent, err := repo.Get("test (1).md", testUUID)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(savedContent))
+
+	w = send("DELETE", "/api/trash/"+trash.Items[0].Id)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("DELETE", "/api/file/test.md")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("DELETE", "/api/trash")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	items, err := repo.ListTrash(testUUID)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+func TestTrashSweeper(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	require.NoError(t, repo.Create("test.md", testUUID, []byte("content")))
+	require.NoError(t, repo.Delete("test.md", testUUID))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runTrashSweeper(ctx, repo, time.Hour, time.Millisecond)
+		close(done)
+	}()
+
+	items, err := repo.ListTrash(testUUID)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	cancel()
+	<-done
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	runTrashSweeper(ctx, repo, time.Nanosecond, time.Hour)
+
+	items, err = repo.ListTrash(testUUID)
+	assert.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+func TestGetAllFilesDetails(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	send := func(url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	for _, file := range []struct{ name, content string }{
+		{"a.md", "# Alpha\nshort"},
+		{"b.md", "# Beta\nsome longer text here"},
+		{"c.md", "no title at all"},
+	} {
+		w := LoadFile(t, router, repo, file.name, file.content)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w := send("/api/files")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a.md", "b.md", "c.md"}, response["files"])
+	assert.NotContains(t, response, "items")
+	assert.NotContains(t, response, "total")
+
+	w = send("/api/files?details=true&sort=wordCount&order=desc&limit=2")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var files GetAllFilesResponse
+	err = json.Unmarshal(w.Body.Bytes(), &files)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.md", "c.md"}, files.Files)
+	require.NotNil(t, files.Total)
+	assert.Equal(t, 3, *files.Total)
+	require.Len(t, files.Items, 2)
+	assert.Equal(t, "Beta", files.Items[0].Title)
+	assert.Equal(t, 5, files.Items[0].WordCount)
+	assert.Len(t, files.Tree, 3)
+
+	w = send("/api/files?q=alpha")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	files = GetAllFilesResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &files)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.md"}, files.Files)
+	assert.Empty(t, files.Items)
+
+	for _, url := range []string{"/api/files?sort=owner", "/api/files?order=up", "/api/files?limit=-1"} {
+		w = send(url)
+		assert.Equal(t, http.StatusBadRequest, w.Code, url)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	find := func(query string) (*httptest.ResponseRecorder, SearchResponse) {
+		req, err := http.NewRequest("GET", "/api/search?"+query, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var resp SearchResponse
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w, resp
+	}
+
+	w := LoadFile(t, router, repo, "a.md", "Meeting notes about the release")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = LoadFile(t, router, repo, "b.md", "Shopping list")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, resp := find("q=releas*")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, resp.Total)
+	require.Len(t, resp.Results, 1)
+	assert.Equal(t, "a.md", resp.Results[0].Path)
+	assert.Equal(t, []search.Highlight{{Start: 24, End: 31}}, resp.Results[0].Snippet.Highlights)
+
+	w = EditFile(t, router, "a.md", "Nothing here", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, resp = find("q=release")
+	assert.Equal(t, 0, resp.Total)
+	assert.Empty(t, resp.Results)
+
+	w, _ = find("q=%22%22")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w, _ = find("q=list&limit=0")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLinks(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	get := func(url string, resp any) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		}
+		return w
+	}
+	rename := func(url string) (*httptest.ResponseRecorder, RenameResponse) {
+		req, err := http.NewRequest("PUT", url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var resp RenameResponse
+		if w.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w, resp
+	}
+
+	w := LoadFile(t, router, repo, "ideas.md", "Ideas for the [[Plan]]")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = LoadFile(t, router, repo, "plan.md", "The plan, see [ideas](ideas.md)")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = LoadFile(t, router, repo, "todo.md", "[[plan|The plan]] first")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var backlinks BacklinksResponse
+	w = get("/api/file/plan.md/backlinks", &backlinks)
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, backlinks.Backlinks, 2)
+	assert.Equal(t, "ideas.md", backlinks.Backlinks[0].Path)
+	assert.Equal(t, "todo.md", backlinks.Backlinks[1].Path)
+	assert.Equal(t, []search.Highlight{{Start: 2, End: 6}}, backlinks.Backlinks[1].Snippet.Highlights)
+
+	var graph search.Graph
+	w = get("/api/graph", &graph)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, graph.Nodes, 3)
+	assert.Len(t, graph.Edges, 3)
+
+	w, resp := rename("/api/rename/plan.md/roadmap.md")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"ideas.md", "todo.md"}, resp.Updated)
+	assert.Empty(t, resp.Failed)
+
+	data, err := repo.Get("todo.md", testUUID)
+	require.NoError(t, err)
+	assert.Equal(t, "[[roadmap|The plan]] first", string(data))
+
+	w = get("/api/file/roadmap.md/backlinks", &backlinks)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, backlinks.Backlinks, 2)
+	w = get("/api/file/plan.md/backlinks", &backlinks)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, backlinks.Backlinks)
+
+	// Links are kept as they are on request.
+	w, resp = rename("/api/rename/ideas.md/thoughts.md?updateLinks=false")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, resp.Updated)
+	data, err = repo.Get("roadmap.md", testUUID)
+	require.NoError(t, err)
+	assert.Equal(t, "The plan, see [ideas](ideas.md)", string(data))
+}
+
+func TestCollab(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := LoadFile(t, router, repo, "notes.md", "Agenda")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	dial := func(filename string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{}
+		header.Set("Cookie", "access_token="+testToken)
+		return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/collab/"+filename, header)
+	}
+	read := func(conn *websocket.Conn) collab.ServerMessage {
+		var msg collab.ServerMessage
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.NoError(t, conn.ReadJSON(&msg))
+		return msg
+	}
+
+	_, resp, err := dial("missing.md")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	first, _, err := dial("notes.md")
+	require.NoError(t, err)
+	defer first.Close()
+	init := read(first)
+	assert.Equal(t, collab.MSG_INIT, init.Type)
+	assert.Equal(t, "Agenda", *init.Text)
+
+	second, _, err := dial("notes.md")
+	require.NoError(t, err)
+	defer second.Close()
+	assert.Equal(t, collab.MSG_INIT, read(second).Type)
+	assert.Equal(t, collab.MSG_JOIN, read(first).Type)
+
+	require.NoError(t, first.WriteMessage(websocket.TextMessage, []byte(`{"type":"op","revision":0,"op":[6,": release"]}`)))
+	assert.Equal(t, collab.MSG_ACK, read(first).Type)
+	msg := read(second)
+	assert.Equal(t, collab.MSG_OP, msg.Type)
+	assert.Equal(t, 1, msg.Revision)
+	assert.Equal(t, init.SessionId, msg.SessionId)
+
+	require.NoError(t, second.WriteMessage(websocket.TextMessage, []byte(`{"type":"op","revision":1,"op":[0]}`)))
+	msg = read(second)
+	assert.Equal(t, collab.MSG_ERROR, msg.Type)
+	assert.Equal(t, collab.ERR_MESSAGE_INVALID, msg.Code)
+
+	// The document is saved when the last session leaves.
+	first.Close()
+	assert.Equal(t, collab.MSG_LEAVE, read(second).Type)
+	second.Close()
+	assert.Eventually(t, func() bool {
+		data, err := repo.Get("notes.md", testUUID)
+		return err == nil && string(data) == "Agenda: release"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestShares(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	// The admin is just another registered user here.
+	otherToken, err := generateToken(testAdminUUID)
+	require.NoError(t, err)
+	strangerToken, err := generateToken(uuid.New())
+	require.NoError(t, err)
+
+	send := func(method string, url string, token string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+	edit := func(token string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "notes.md")
+		require.NoError(t, err)
+		_, err = part.Write([]byte("edited"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req, err := http.NewRequest("PUT", "/api/file/notes.md?owner="+testUUID.String(), body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	errorCode := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Error APIError `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Error.Code
+	}
+	shared := "/api/file/notes.md?owner=" + testUUID.String()
+
+	w := LoadFile(t, router, repo, "notes.md", "content")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Files that aren't shared look missing.
+	w = send("GET", shared, otherToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "FILE_NOT_FOUND", errorCode(w))
+
+	w = send("PUT", "/api/file/notes.md/shares", testToken, `{"username":"nobody","role":"viewer"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "USER_NOT_FOUND", errorCode(w))
+
+	w = send("PUT", "/api/file/notes.md/shares", testToken, `{"username":"admin","role":"owner"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "SHARE_INVALID", errorCode(w))
+
+	w = send("PUT", "/api/file/missing.md/shares", testToken, `{"username":"admin","role":"viewer"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("PUT", "/api/file/notes.md/shares", testToken, `{"username":"admin","role":"viewer"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var shares GetSharesResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &shares))
+	require.Len(t, shares.Shares, 1)
+	assert.Equal(t, "admin", shares.Shares[0].Username)
+	assert.Equal(t, repodb.ROLE_VIEWER, shares.Shares[0].Role)
+
+	w = send("GET", "/api/shared", otherToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var sharedFiles GetSharedResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sharedFiles))
+	require.Len(t, sharedFiles.Files, 1)
+	assert.Equal(t, SharedFile{
+		Filename:      "notes.md",
+		OwnerId:       testUUID.String(),
+		OwnerUsername: "owner",
+		Role:          repodb.ROLE_VIEWER,
+		CreatedAt:     sharedFiles.Files[0].CreatedAt,
+	}, sharedFiles.Files[0])
+
+	// Viewers can read, but not change the file.
+	w = send("GET", shared, otherToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "content", w.Body.String())
+	w = send("GET", "/api/file/notes.md/versions?owner="+testUUID.String(), otherToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = edit(otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "ACCESS_DENIED", errorCode(w))
+	w = send("GET", shared, strangerToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Editors can change it, only the owner deletes, renames and shares it.
+	w = send("PUT", "/api/file/notes.md/shares", testToken, `{"username":"admin","role":"editor"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = edit(otherToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	data, err := repo.Get("notes.md", testUUID)
+	require.NoError(t, err)
+	assert.Equal(t, "edited", string(data))
+
+	w = send("DELETE", shared, otherToken, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = send("PUT", "/api/rename/notes.md/other.md?owner="+testUUID.String(), otherToken, "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = send("GET", "/api/file/notes.md/shares", otherToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("DELETE", "/api/file/notes.md/shares/"+testAdminUUID.String(), testToken, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &shares))
+	assert.Empty(t, shares.Shares)
+	w = send("DELETE", "/api/file/notes.md/shares/"+testAdminUUID.String(), testToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "SHARE_NOT_FOUND", errorCode(w))
+	w = send("GET", shared, otherToken, "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestShareLinks(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	send := func(method string, url string, body string, auth func(*http.Request)) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if auth != nil {
+			auth(req)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+	user := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+	}
+	password := func(p string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth("", p) }
+	}
+	create := func(body string) ShareLinkResponse {
+		w := send("POST", "/api/file/notes.md/links", body, user)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var link ShareLinkResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &link))
+		return link
+	}
+	served := func() float64 {
+		return testutil.ToFloat64(shareLinkAccessesTotal.WithLabelValues(LINK_FORMAT_HTML, LINK_RESULT_SERVED))
+	}
+
+	w := LoadFile(t, router, repo, "notes.md", "# Notes\n\n<script>alert(1)</script>")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = send("POST", "/api/file/missing.md/links", "", user)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = send("POST", "/api/file/notes.md/links", `{"expiresAt":"2000-01-01T00:00:00Z"}`, user)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	link := create("")
+	assert.Equal(t, "/s/"+link.Token, link.Path)
+	assert.False(t, link.Protected)
+
+	before := served()
+	w = send("GET", link.Path, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-referrer", w.Header().Get("Referrer-Policy"))
+	assert.Contains(t, w.Body.String(), `<h1 id="notes">Notes</h1>`)
+	assert.NotContains(t, w.Body.String(), "<script>")
+	assert.Equal(t, before+1, served())
+
+	w = send("GET", link.Path+"?format=md", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/markdown; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<script>")
+	w = send("GET", link.Path+"?format=pdf", "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	protected := create(`{"password":"secret","expiresAt":"` + time.Now().Add(time.Hour).Format(time.RFC3339) + `"}`)
+	assert.True(t, protected.Protected)
+	assert.NotNil(t, protected.ExpiresAt)
+	w = send("GET", protected.Path, "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	w = send("GET", protected.Path, "", password("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = send("GET", protected.Path, "", password("secret"))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Expired links are kept for the owner but don't work.
+	expired := time.Now().Add(-time.Minute)
+	require.NoError(t, repo.CreateShareLink(repodb.ShareLink{Token: "expired", Owner: testUUID, Filename: "notes.md", CreatedAt: time.Now(), ExpiresAt: &expired}))
+
+	w = send("GET", "/api/links", "", user)
+	require.Equal(t, http.StatusOK, w.Code)
+	var links GetShareLinksResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	require.Len(t, links.Links, 3)
+	assert.Equal(t, 2, links.Links[0].Accesses)
+	assert.NotNil(t, links.Links[0].LastAccessedAt)
+	assert.Equal(t, 1, links.Links[1].Accesses)
+	assert.True(t, links.Links[2].Expired)
+
+	w = send("DELETE", "/api/links/"+link.Token, "", user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("GET", link.Path, "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = send("DELETE", "/api/links/"+link.Token, "", user)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Links go away with the file.
+	w = send("DELETE", "/api/file/notes.md", "", user)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("GET", "/api/file/notes.md/links", "", user)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &links))
+	assert.Empty(t, links.Links)
+}
+
+func TestShareLinkLockout(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+	require.NoError(t, repo.Create("notes.md", testUUID, []byte("# Notes")))
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	token, err := repodb.NewShareLinkToken(testUUID)
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateShareLink(repodb.ShareLink{Token: token, Owner: testUUID, Filename: "notes.md", PasswordHash: string(hash), CreatedAt: time.Now()}))
+
+	send := func(password string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/s/"+token, nil)
+		require.NoError(t, err)
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Asking for the password isn't a guess.
+	for range LINK_PASSWORD_FAILURES {
+		assert.Equal(t, http.StatusUnauthorized, send("").Code)
+	}
+	for range LINK_PASSWORD_FAILURES - 1 {
+		assert.Equal(t, http.StatusUnauthorized, send("wrong").Code)
+	}
+	assert.Equal(t, http.StatusOK, send("secret").Code, "success resets the failures")
+
+	for range LINK_PASSWORD_FAILURES - 1 {
+		assert.Equal(t, http.StatusUnauthorized, send("wrong").Code)
+	}
+	w := send("wrong")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	var resp struct {
+		Error APIError `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "SHARE_LINK_LOCKED", resp.Error.Code)
+
+	w = send("secret")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code, "the right password is refused while locked")
+}
+
+func TestLockout(t *testing.T) {
+	l := utils.NewLockout(2, 10*time.Millisecond, 40*time.Millisecond)
+
+	assert.Zero(t, l.Fail("a"))
+	assert.Zero(t, l.Locked("a"))
+	assert.Equal(t, 10*time.Millisecond, l.Fail("a"))
+	assert.Positive(t, l.Locked("a"))
+	assert.Zero(t, l.Locked("b"), "keys are locked separately")
+	assert.Equal(t, 20*time.Millisecond, l.Fail("a"))
+	assert.Equal(t, 40*time.Millisecond, l.Fail("a"))
+	assert.Equal(t, 40*time.Millisecond, l.Fail("a"), "locks are capped")
+
+	l.Succeed("a")
+	assert.Zero(t, l.Locked("a"))
+	assert.Zero(t, l.Fail("a"))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, l.Fail("b"))
+	assert.Equal(t, 1, l.Len(), "keys without recent failures are forgotten")
+}
+
+func TestKeyedRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	limiter := utils.NewRateLimiterWithRate(utils.Rate{Limit: 1, Window: time.Minute})
+	router.GET("/s/:token", keyedRateLimitMiddleware(RATE_LIMIT_LINK_TOKEN, limiter, func(c *gin.Context) (string, bool) {
+		return c.Param("token"), true
+	}), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	send := func(url string) int {
+		req, err := http.NewRequest("GET", url, nil)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, send("/s/first"))
+	assert.Equal(t, http.StatusTooManyRequests, send("/s/first"))
+	assert.Equal(t, http.StatusOK, send("/s/second"), "limits are per key")
+}
+
+func TestRender(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	send := func(method string, url string, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	w := LoadFile(t, router, repo, "notes.md", "# Notes\n\n- [x] done\n\n<img src=x onerror=alert(1)>")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = send("GET", "/api/file/notes.md/render", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	var resp RenderResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "notes.md", resp.Filename)
+	assert.Equal(t, "<h1 id=\"notes\">Notes</h1>\n<ul>\n<li><input checked=\"\" disabled=\"\" type=\"checkbox\"> done</li>\n</ul>\n<img src=\"x\">", resp.HTML)
+
+	w = send("GET", "/api/file/missing.md/render", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("POST", "/api/render", `{"markdown":"~~old~~ <b onclick=\"x()\">new</b>"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "<p><del>old</del> <b>new</b></p>\n", resp.HTML)
+
+	w = send("POST", "/api/render", `{"markdown":"`+strings.Repeat("a", MAX_RENDER_SIZE)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = send("POST", "/api/render", "not json")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExport(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+
+	assert.NoError(t, repo.CreateFolder("book", testUUID))
+	assert.NoError(t, repo.CreateFolder("book/part", testUUID))
+	assert.NoError(t, repo.CreateFolder("empty", testUUID))
+	assert.NoError(t, repo.Create("book/заметки.md", testUUID, []byte("# Notes\n\n**bold**")))
+	assert.NoError(t, repo.Create("book/part/more.md", testUUID, []byte("More")))
+
+	w := get("/api/file/book%2F%D0%B7%D0%B0%D0%BC%D0%B5%D1%82%D0%BA%D0%B8.md/export")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment; filename*=utf-8''%D0%B7%D0%B0%D0%BC%D0%B5%D1%82%D0%BA%D0%B8.html", w.Header().Get("Content-Disposition"))
+	assert.Contains(t, w.Body.String(), "<style>")
+	assert.Contains(t, w.Body.String(), "<p><strong>bold</strong></p>")
+
+	w = get("/api/file/book%2Fpart%2Fmore.md/export?format=md")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "More", w.Body.String())
+
+	for format, contentType := range map[string]string{
+		"epub": "application/epub+zip",
+		"docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	} {
+		w = get("/api/file/book%2Fpart%2Fmore.md/export?format=" + format)
+		require.Equal(t, http.StatusOK, w.Code, format)
+		assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+		assert.Equal(t, "attachment; filename=more."+format, w.Header().Get("Content-Disposition"))
+		_, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		assert.NoError(t, err, format)
+	}
+
+	w = get("/api/file/book%2Fpart%2Fmore.md/export?format=pdf")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = get("/api/file/missing.md/export")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = get("/api/folder/book/export")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "attachment; filename=book.epub", w.Header().Get("Content-Disposition"))
+	book, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range book.File {
+		names = append(names, f.Name)
+	}
+	assert.Contains(t, names, "OEBPS/chapter-1.xhtml")
+	assert.Contains(t, names, "OEBPS/chapter-2.xhtml")
+
+	w = get("/api/folder/book/export?format=docx")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = get("/api/folder/empty/export")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = get("/api/folder/missing/export")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// makeZip packs files in order, names ending with a slash are folders.
+func makeZip(t *testing.T, files [][2]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, file := range files {
+		f, err := w.Create(file[0])
+		require.NoError(t, err)
+		_, err = f.Write([]byte(file[1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func TestExportImport(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	router := setupTestRouter(repo)
+
+	send := func(router *gin.Engine, method string, url string, archive []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		contentType := ""
+		if archive != nil {
+			writer := multipart.NewWriter(body)
+			part, err := writer.CreateFormFile("file", "export.zip")
+			require.NoError(t, err)
+			_, err = part.Write(archive)
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+			contentType = writer.FormDataContentType()
+		}
+
+		req, err := http.NewRequest(method, url, body)
+		require.NoError(t, err)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: testToken, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		return w
+	}
+	importResponse := func(w *httptest.ResponseRecorder) ImportResponse {
+		var resp ImportResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+	rejected := func(w *httptest.ResponseRecorder) ImportResponse {
+		var resp struct {
+			Error struct {
+				Code    string         `json:"code"`
+				Details ImportResponse `json:"details"`
+			} `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "IMPORT_REJECTED", resp.Error.Code)
+		return resp.Error.Details
+	}
+
+	assert.NoError(t, repo.CreateFolder("notes", testUUID))
+	assert.NoError(t, repo.CreateFolder("notes/empty", testUUID))
+	assert.NoError(t, repo.Create("notes/a.md", testUUID, []byte("# A")))
+	assert.NoError(t, repo.Create("b.md", testUUID, []byte("B")))
+
+	w := send(router, "GET", "/api/export", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment; filename=markdown-export-")
+	archive := w.Body.Bytes()
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.NoError(t, err)
+	entries := map[string]*zip.File{}
+	for _, f := range r.File {
+		entries[f.Name] = f
+	}
+	assert.Contains(t, entries, "notes/")
+	assert.Contains(t, entries, "notes/empty/")
+	assert.Contains(t, entries, "notes/a.md")
+	assert.Contains(t, entries, "b.md")
+	require.Contains(t, entries, EXPORT_MANIFEST)
+	rc, err := entries[EXPORT_MANIFEST].Open()
+	require.NoError(t, err)
+	var manifest ExportManifest
+	require.NoError(t, json.NewDecoder(rc).Decode(&manifest))
+	rc.Close()
+	assert.Equal(t, EXPORT_MANIFEST_VERSION, manifest.Version)
+	assert.Equal(t, []string{"notes", "notes/empty"}, manifest.Folders)
+	require.Len(t, manifest.Files, 2)
+	for _, info := range manifest.Files {
+		data, err := repo.Get(info.Path, testUUID)
+		require.NoError(t, err)
+		assert.Equal(t, repodb.ETag(data), info.ETag)
+	}
+
+	t.Run("into empty storage", func(t *testing.T) {
+		other, cleanup, err := getNewLocalFileTestRepo()
+		require.NoError(t, err)
+		defer cleanup()
+
+		w := send(setupTestRouter(other), "POST", "/api/import", archive)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		resp := importResponse(w)
+		assert.Equal(t, 4, resp.Imported)
+		assert.Equal(t, 0, resp.Failed)
+
+		data, err := other.Get("notes/a.md", testUUID)
+		require.NoError(t, err)
+		assert.Equal(t, "# A", string(data))
+		tree, err := other.GetTree(testUUID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"notes", "notes/empty"}, treeFolders(tree))
+	})
+
+	t.Run("existing files", func(t *testing.T) {
+		w := send(router, "POST", "/api/import", archive)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		resp := rejected(w)
+		assert.Equal(t, 2, resp.Failed)
+		for _, entry := range resp.Entries {
+			if entry.Folder {
+				assert.Equal(t, IMPORT_STATUS_SKIPPED, entry.Status)
+				continue
+			}
+			assert.Equal(t, IMPORT_STATUS_FAILED, entry.Status)
+			assert.Equal(t, "FILE_ALREADY_EXISTS", entry.Error.Code)
+		}
+
+		require.NoError(t, repo.Save("b.md", testUUID, []byte("changed")))
+		w = send(router, "POST", "/api/import?overwrite=true", archive)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		data, err := repo.Get("b.md", testUUID)
+		require.NoError(t, err)
+		assert.Equal(t, "B", string(data))
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		bad := makeZip(t, [][2]string{{"new.md", "new"}, {"bad.txt", "x"}, {"../up.md", "x"}, {"new.md", "again"}})
+
+		w := send(router, "POST", "/api/import", bad)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		resp := rejected(w)
+		assert.Equal(t, 3, resp.Failed)
+		assert.Equal(t, IMPORT_STATUS_SKIPPED, resp.Entries[0].Status)
+		_, err := repo.Get("new.md", testUUID)
+		assert.ErrorIs(t, err, repodb.ErrFileNotFound)
+
+		w = send(router, "POST", "/api/import?partial=true", bad)
+		require.Equal(t, http.StatusOK, w.Code)
+		resp = importResponse(w)
+		assert.Equal(t, 1, resp.Imported)
+		assert.Equal(t, 3, resp.Failed)
+		assert.Equal(t, IMPORT_STATUS_IMPORTED, resp.Entries[0].Status)
+		assert.Equal(t, "FILE_EXTENSION_INVALID", resp.Entries[1].Error.Code)
+		assert.Equal(t, "FILE_PATH_TRAVERSAL", resp.Entries[2].Error.Code)
+		assert.Equal(t, "ARCHIVE_DUPLICATE_ENTRY", resp.Entries[3].Error.Code)
+		data, err := repo.Get("new.md", testUUID)
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(data))
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		// notes/a.md, b.md and new.md are stored, the plan allows 5 files.
+		many := makeZip(t, [][2]string{{"1.md", "1"}, {"2.md", "2"}, {"3.md", "3"}})
+		w := send(router, "POST", "/api/import?partial=true", many)
+		require.Equal(t, http.StatusOK, w.Code)
+		resp := importResponse(w)
+		assert.Equal(t, 2, resp.Imported)
+		assert.Equal(t, "FILE_COUNT_LIMIT", resp.Entries[2].Error.Code)
+
+		large := makeZip(t, [][2]string{{"1.md", strings.Repeat("a", repodb.USER_SPACE_SIZE)}})
+		w = send(router, "POST", "/api/import?overwrite=true", large)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		resp = rejected(w)
+		assert.Equal(t, "USER_SPACE_FULL", resp.Entries[0].Error.Code)
+	})
+
+	t.Run("history isn't counted", func(t *testing.T) {
+		other, cleanup, err := getNewLocalFileTestRepo()
+		require.NoError(t, err)
+		defer cleanup()
+
+		// The old revision of big.md takes half of the space, it is evicted
+		// for the import.
+		half := strings.Repeat("a", repodb.USER_SPACE_SIZE/2)
+		require.NoError(t, other.Create("big.md", testUUID, []byte(half)))
+		require.NoError(t, other.Save("big.md", testUUID, []byte("small")))
+
+		w := send(setupTestRouter(other), "POST", "/api/import", makeZip(t, [][2]string{{"new.md", half}}))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, 1, importResponse(w).Imported)
+	})
+
+	w = send(router, "POST", "/api/import", []byte("not a zip"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "ARCHIVE_INVALID")
+	w = send(router, "POST", "/api/import", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAttachments(t *testing.T) {
+	local, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	index := search.NewIndex(local)
+	repo := search.NewIndexedRepository(local, index)
+	router := setupIndexedTestRouter(repo, index)
+
+	otherToken, err := generateToken(testAdminUUID)
+	require.NoError(t, err)
+	strangerUUID := uuid.New()
+	strangerToken, err := generateToken(strangerUUID)
+	require.NoError(t, err)
+
+	upload := func(token string, name string, content []byte) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", name)
+		require.NoError(t, err)
+		_, err = part.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		req, err := http.NewRequest("POST", "/api/attachments", body)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	send := func(method string, url string, token string, header map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, nil)
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: token, Path: "/"})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	errorCode := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Error APIError `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Error.Code
+	}
+
+	image := append([]byte("\x89PNG\r\n\x1a\n"), "pixels"...)
+	w := upload(testToken, "my [cat].png", image)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var attachment AttachmentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &attachment))
+	assert.Equal(t, "image/png", attachment.ContentType)
+	assert.Equal(t, "/api/attachments/"+testUUID.String()+"/"+attachment.Id, attachment.URL)
+	assert.Equal(t, `![my \[cat\].png](`+attachment.URL+")", attachment.Markdown)
+
+	// The same content keeps its first name.
+	w = upload(testToken, "copy.png", image)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"my [cat].png"`)
+
+	w = upload(testToken, "page.png", []byte("<html><script></script></html>"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	assert.Equal(t, "ATTACHMENT_TYPE_INVALID", errorCode(w))
+	w = upload(testToken, "big.png", make([]byte, repodb.MAX_ATTACHMENT_SIZE+ATTACHMENT_FORM_OVERHEAD))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Equal(t, "ATTACHMENT_TOO_LARGE", errorCode(w))
+	huge := make([]byte, repodb.USER_SPACE_SIZE)
+	copy(huge, image)
+	w = upload(testToken, "huge.png", huge)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "USER_SPACE_FULL", errorCode(w))
+
+	w = send("GET", attachment.URL, testToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, image, w.Body.Bytes())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, ATTACHMENT_CACHE_CONTROL, w.Header().Get("Cache-Control"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Disposition"), "inline"))
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"`+attachment.Id+`"`, etag)
+
+	w = send("GET", attachment.URL, testToken, map[string]string{"If-None-Match": `"other", ` + etag})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+
+	w = send("GET", "/api/attachments", testToken, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list GetAttachmentsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Attachments, 1)
+	assert.Equal(t, attachment.URL, list.Attachments[0].URL)
+
+	// Other users read attachments through shared documents only.
+	w = send("GET", attachment.URL, otherToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "ATTACHMENT_NOT_FOUND", errorCode(w))
+
+	require.NoError(t, repo.Create("notes.md", testUUID, []byte("Look: "+attachment.Markdown)))
+	require.NoError(t, repo.ShareFile("notes.md", testUUID, testAdminUUID, repodb.ROLE_VIEWER))
+	w = send("GET", attachment.URL, otherToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	require.NoError(t, repo.Create("stolen.md", strangerUUID, []byte(attachment.Markdown)))
+	require.NoError(t, repo.ShareFile("stolen.md", strangerUUID, testAdminUUID, repodb.ROLE_EDITOR))
+	w = send("GET", attachment.URL, strangerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Images uploaded by an editor show up for the owner of the document.
+	editorImage := append([]byte("\x89PNG\r\n\x1a\n"), "editor"...)
+	w = upload(otherToken, "editor.png", editorImage)
+	require.Equal(t, http.StatusOK, w.Code)
+	var editorAttachment AttachmentResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &editorAttachment))
+	w = send("GET", editorAttachment.URL, strangerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	require.NoError(t, repo.Save("stolen.md", strangerUUID, []byte(editorAttachment.Markdown)))
+	w = send("GET", editorAttachment.URL, strangerToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Documents read by public links point their attachments to the link,
+	// which serves only those the document embeds.
+	token, err := repodb.NewShareLinkToken(testUUID)
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateShareLink(repodb.ShareLink{Token: token, Owner: testUUID, Filename: "notes.md", CreatedAt: time.Now()}))
+	linkURL := "/s/" + token + "/attachments/" + testUUID.String() + "/" + attachment.Id
+	w = send("GET", "/s/"+token, "", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `src="`+linkURL+`"`)
+	assert.NotContains(t, w.Body.String(), attachment.URL)
+	w = send("GET", linkURL, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, image, w.Body.Bytes())
+	w = send("GET", "/s/"+token+"/attachments/"+testAdminUUID.String()+"/"+editorAttachment.Id, "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = send("GET", "/s/unknown/attachments/"+testUUID.String()+"/"+attachment.Id, "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("GET", "/api/attachments/garbage/"+attachment.Id, testToken, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = send("DELETE", attachment.URL, otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = send("DELETE", attachment.URL, testToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("GET", attachment.URL, testToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "ATTACHMENT_NOT_FOUND", errorCode(w))
+}
+
+func TestAttachmentCollector(t *testing.T) {
+	repo, cleanup, err := getNewLocalFileTestRepo()
+	assert.NoError(t, err)
+	defer cleanup()
+
+	for _, content := range []string{"used", "unused"} {
+		data := append([]byte("\x89PNG\r\n\x1a\n"), content...)
+		attachment, err := repodb.NewAttachment(testUUID, content+".png", data)
+		require.NoError(t, err)
+		require.NoError(t, repo.CreateAttachment(attachment, data))
+		if content == "used" {
+			require.NoError(t, repo.Create("a.md", testUUID, []byte("![](/api/attachments/"+testUUID.String()+"/"+attachment.Id+")")))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runAttachmentCollector(ctx, repo, time.Hour, time.Hour)
+	attachments, err := repo.GetAttachments(testUUID)
+	require.NoError(t, err)
+	assert.Len(t, attachments, 2)
+
+	runAttachmentCollector(ctx, repo, -time.Hour, time.Hour)
+	attachments, err = repo.GetAttachments(testUUID)
+	require.NoError(t, err)
+	require.Len(t, attachments, 1)
+	assert.Equal(t, "used.png", attachments[0].Name)
+}
@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"backend/db/repodb"
+	"backend/db/search"
+)
 
 type HealthResponse struct {
 	Status string    `json:"status"`
@@ -23,7 +28,75 @@ type DeleteResponse struct {
 }
 
 type GetAllFilesResponse struct {
-	Files []string `json:"files"`
+	Files []string              `json:"files"`
+	Tree  []repodb.FileTreeNode `json:"tree"`
+	// Set when files are filtered or paginated, the number of matching files.
+	Total *int `json:"total,omitempty"`
+	// Set with details=true.
+	Items []repodb.FileInfo `json:"items,omitempty"`
+}
+
+type FolderResponse struct {
+	Message string `json:"message"`
+	Path    string `json:"path"`
+}
+
+type GetVersionsResponse struct {
+	Filename string               `json:"filename"`
+	Versions []repodb.FileVersion `json:"versions"`
+}
+
+type RestoreVersionResponse struct {
+	Message  string `json:"message"`
+	Filename string `json:"filename"`
+	Version  int    `json:"version"`
+}
+
+type GetTrashResponse struct {
+	Items []repodb.TrashItem `json:"items"`
+}
+
+type RestoreTrashResponse struct {
+	Message  string `json:"message"`
+	Filename string `json:"filename"`
+}
+
+// SearchResponse contains the best matches, Total is the number of all.
+type SearchResponse struct {
+	Query   string          `json:"query"`
+	Total   int             `json:"total"`
+	Results []search.Result `json:"results"`
+}
+
+// RenameResponse lists documents whose links to the renamed file were
+// updated, and those that changed meanwhile and were left as they are.
+type RenameResponse struct {
+	Message  string   `json:"message"`
+	Filename string   `json:"filename"`
+	Updated  []string `json:"updated"`
+	Failed   []string `json:"failed,omitempty"`
+}
+
+type BacklinksResponse struct {
+	Filename  string            `json:"filename"`
+	Backlinks []search.Backlink `json:"backlinks"`
+}
+
+type QuotaResponse struct {
+	Plan       string `json:"plan"`
+	UsedBytes  int    `json:"usedBytes"`
+	LimitBytes int    `json:"limitBytes"`
+	FileCount  int    `json:"fileCount"`
+	MaxFiles   int    `json:"maxFiles"`
+	// HistoryBytes is the size of stored revisions, which isn't part of
+	// UsedBytes.
+	HistoryBytes int `json:"historyBytes"`
+}
+
+type UserQuotaResponse struct {
+	UserId string `json:"userId"`
+	QuotaResponse
+	Override *repodb.QuotaOverride `json:"override"`
 }
 
 type ErrorResponse struct {
@@ -40,3 +113,106 @@ type APIError struct {
 	Field   string      `json:"field,omitempty"`
 	Details interface{} `json:"details,omitempty"`
 }
+
+type ShareRequest struct {
+	Username string `json:"username" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+}
+
+// ShareResponse is a user a file is shared with. Username is empty if the
+// user no longer exists.
+type ShareResponse struct {
+	UserId    string    `json:"userId"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type GetSharesResponse struct {
+	Filename string          `json:"filename"`
+	Shares   []ShareResponse `json:"shares"`
+}
+
+// SharedFile is a file of another user shared with the current one, it is
+// accessed with the owner query parameter.
+type SharedFile struct {
+	Filename      string    `json:"filename"`
+	OwnerId       string    `json:"ownerId"`
+	OwnerUsername string    `json:"ownerUsername"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+type GetSharedResponse struct {
+	Files []SharedFile `json:"files"`
+}
+
+// CreateShareLinkRequest sets the optional expiry and password of a new link.
+type CreateShareLinkRequest struct {
+	ExpiresAt *time.Time `json:"expiresAt"`
+	Password  string     `json:"password"`
+}
+
+// ShareLinkResponse describes a public link, the document is served at Path
+// without authentication.
+type ShareLinkResponse struct {
+	Token          string     `json:"token"`
+	Path           string     `json:"path"`
+	Filename       string     `json:"filename"`
+	Protected      bool       `json:"protected"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	ExpiresAt      *time.Time `json:"expiresAt,omitempty"`
+	Expired        bool       `json:"expired"`
+	Accesses       int        `json:"accesses"`
+	LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+}
+
+type GetShareLinksResponse struct {
+	Links []ShareLinkResponse `json:"links"`
+}
+
+// AttachmentResponse describes an attachment served at URL, Markdown embeds
+// it into a document.
+type AttachmentResponse struct {
+	repodb.Attachment
+	URL      string `json:"url"`
+	Markdown string `json:"markdown"`
+}
+
+type GetAttachmentsResponse struct {
+	Attachments []AttachmentResponse `json:"attachments"`
+}
+
+type RenderRequest struct {
+	Markdown string `json:"markdown"`
+}
+
+// RenderResponse contains sanitized HTML, Filename is empty for ad-hoc text.
+type RenderResponse struct {
+	Filename string `json:"filename,omitempty"`
+	HTML     string `json:"html"`
+}
+
+// ExportManifest describes an archive of all user files, it is stored in the
+// archive as EXPORT_MANIFEST.
+type ExportManifest struct {
+	Version    int               `json:"version"`
+	ExportedAt time.Time         `json:"exportedAt"`
+	Folders    []string          `json:"folders"`
+	Files      []repodb.FileInfo `json:"files"`
+}
+
+// ImportEntryResult is the outcome of an archive entry: imported, failed or
+// skipped when the import was rejected because of other entries.
+type ImportEntryResult struct {
+	Path   string    `json:"path"`
+	Folder bool      `json:"folder,omitempty"`
+	Status string    `json:"status"`
+	Error  *APIError `json:"error,omitempty"`
+}
+
+type ImportResponse struct {
+	Imported int                 `json:"imported"`
+	Failed   int                 `json:"failed"`
+	Entries  []ImportEntryResult `json:"entries"`
+}
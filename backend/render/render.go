@@ -0,0 +1,177 @@
+// Package render turns Markdown documents into sanitized HTML.
+package render
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// markdown renders CommonMark with GitHub extensions (tables, task lists,
+// strikethrough, autolinks) and footnotes. Headings get ids for anchors.
+// Raw HTML is kept and removed by policy if it isn't safe.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		// extension.GFM, with table alignment as attribute since styles are
+		// removed by the policy.
+		extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+		extension.Strikethrough,
+		extension.Linkify,
+		extension.TaskList,
+		extension.Footnote,
+	),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// policy allows user generated content and the markup of the extensions:
+// code block languages, task list checkboxes and footnote links.
+var policy = newPolicy()
+
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").Matching(regexp.MustCompile(`^$`)).OnElements("input")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^footnote-(ref|backref)$`)).OnElements("a")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^footnotes$`)).OnElements("div")
+	p.AllowAttrs("role").Matching(regexp.MustCompile(`^doc-(noteref|backlink|endnotes)$`)).OnElements("a", "div")
+	return p
+}
+
+// HTML renders the Markdown source as a sanitized HTML fragment. The output
+// only depends on the source.
+func HTML(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert(src, &buf); err != nil {
+		return nil, err
+	}
+
+	return policy.SanitizeBytes(buf.Bytes()), nil
+}
+
+// Stylesheet is the style of rendered documents, embedded in pages and
+// exports.
+const Stylesheet = `body { max-width: 48em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+pre { overflow-x: auto; padding: 1em; background: #f6f8fa; }
+code { font-family: monospace; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #d0d7de; padding: 0.3em 0.6em; }
+img { max-width: 100%; }
+`
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+{{.Style}}</style>
+</head>
+<body>
+{{.Body}}</body>
+</html>
+`))
+
+// Page renders the Markdown source as a standalone HTML page.
+func Page(title string, src []byte) ([]byte, error) {
+	body, err := HTML(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = pageTemplate.Execute(&buf, struct {
+		Title string
+		Style template.CSS
+		Body  template.HTML
+	}{title, template.CSS(Stylesheet), template.HTML(body)})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Parse returns the syntax tree of the Markdown source, as it is rendered by
+// HTML. Text of the nodes refers to src.
+func Parse(src []byte) ast.Node {
+	return markdown.Parser().Parse(text.NewReader(src))
+}
+
+// XHTML renders the Markdown source as a sanitized fragment of well-formed
+// XHTML, for formats embedding documents in XML.
+func XHTML(src []byte) ([]byte, error) {
+	body, err := HTML(src)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := xhtml.ParseFragment(bytes.NewReader(body), &xhtml.Node{Type: xhtml.ElementNode, Data: "body", DataAtom: atom.Body})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		writeXHTML(&buf, n)
+	}
+
+	return buf.Bytes(), nil
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;")
+
+// EscapeXML escapes s for XML text and attribute values. Unlike
+// xml.EscapeText it keeps line breaks, characters not allowed in XML are
+// removed.
+func EscapeXML(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '\t' || r == '\n' || r == '\r' || r >= 0x20 && r != 0xFFFE && r != 0xFFFF && (r < 0xD800 || r > 0xDFFF) {
+			return r
+		}
+		return -1
+	}, s)
+
+	return xmlEscaper.Replace(s)
+}
+
+// voidElements never have content, in XHTML they are closed immediately.
+var voidElements = map[string]bool{
+	"area": true, "br": true, "col": true, "hr": true, "img": true, "input": true, "wbr": true,
+}
+
+func writeXHTML(buf *bytes.Buffer, n *xhtml.Node) {
+	switch n.Type {
+	case xhtml.TextNode:
+		buf.WriteString(EscapeXML(n.Data))
+	case xhtml.ElementNode:
+		buf.WriteString("<" + n.Data)
+		for _, a := range n.Attr {
+			buf.WriteString(" " + a.Key + `="`)
+			buf.WriteString(EscapeXML(a.Val))
+			buf.WriteString(`"`)
+		}
+		if voidElements[n.Data] {
+			buf.WriteString("/>")
+			return
+		}
+		buf.WriteString(">")
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			writeXHTML(buf, child)
+		}
+		buf.WriteString("</" + n.Data + ">")
+	}
+}
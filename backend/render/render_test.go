@@ -0,0 +1,82 @@
+package render
+
+import (
+	"encoding/xml"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+// TestHTML renders testdata/*.md and compares the result with the .html
+// golden files next to them. Run with -update after intended changes.
+func TestHTML(t *testing.T) {
+	sources, err := filepath.Glob("testdata/*.md")
+	require.NoError(t, err)
+	require.NotEmpty(t, sources)
+
+	for _, source := range sources {
+		t.Run(filepath.Base(source), func(t *testing.T) {
+			src, err := os.ReadFile(source)
+			require.NoError(t, err)
+
+			html, err := HTML(src)
+			require.NoError(t, err)
+
+			golden := strings.TrimSuffix(source, ".md") + ".html"
+			if *update {
+				require.NoError(t, os.WriteFile(golden, html, 0644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), string(html))
+
+			again, err := HTML(src)
+			require.NoError(t, err)
+			assert.Equal(t, html, again, "output must be deterministic")
+		})
+	}
+}
+
+func TestPage(t *testing.T) {
+	page, err := Page("<Notes>", []byte("**bold**"))
+	require.NoError(t, err)
+	assert.Contains(t, string(page), "<title>&lt;Notes&gt;</title>")
+	assert.Contains(t, string(page), "<p><strong>bold</strong></p>")
+}
+
+// TestXHTML checks that every golden source renders to well-formed XML.
+func TestXHTML(t *testing.T) {
+	sources, err := filepath.Glob("testdata/*.md")
+	require.NoError(t, err)
+
+	for _, source := range sources {
+		t.Run(filepath.Base(source), func(t *testing.T) {
+			src, err := os.ReadFile(source)
+			require.NoError(t, err)
+
+			body, err := XHTML(src)
+			require.NoError(t, err)
+
+			decoder := xml.NewDecoder(strings.NewReader("<body>" + string(body) + "</body>"))
+			for {
+				_, err := decoder.Token()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	body, err := XHTML([]byte("a<br>b <img src=\"https://example.com/x.png\" alt=\"x\"> &amp; \"q\""))
+	require.NoError(t, err)
+	assert.Equal(t, `<p>a<br/>b <img src="https://example.com/x.png" alt="x"/> &amp; &#34;q&#34;</p>`+"\n", string(body))
+}
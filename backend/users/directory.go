@@ -0,0 +1,91 @@
+// Package users resolves usernames of the auth service to user ids and back.
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// REQUEST_TIMEOUT limits a lookup in the auth service.
+const REQUEST_TIMEOUT = 5 * time.Second
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUnavailable  = errors.New("user directory is unavailable")
+)
+
+type User struct {
+	Id       uuid.UUID `json:"id"`
+	Username string    `json:"username"`
+}
+
+// Directory finds registered users.
+type Directory interface {
+	LookupUsername(ctx context.Context, username string) (User, error)
+	LookupId(ctx context.Context, id uuid.UUID) (User, error)
+}
+
+// Client looks users up with the internal endpoint of the auth service,
+// authenticated with the shared internal token.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func NewClient(baseURL, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: REQUEST_TIMEOUT}
+	}
+
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		http:    httpClient,
+	}
+}
+
+func (c *Client) LookupUsername(ctx context.Context, username string) (User, error) {
+	return c.lookup(ctx, url.Values{"username": {username}})
+}
+
+func (c *Client) LookupId(ctx context.Context, id uuid.UUID) (User, error) {
+	return c.lookup(ctx, url.Values{"id": {id.String()}})
+}
+
+func (c *Client) lookup(ctx context.Context, query url.Values) (User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/internal/users?"+query.Encode(), nil)
+	if err != nil {
+		return User{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return User{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusBadRequest:
+		return User{}, ErrUserNotFound
+	default:
+		return User{}, fmt.Errorf("%w: status %d", ErrUnavailable, resp.StatusCode)
+	}
+
+	var user User
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return User{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	return user, nil
+}
@@ -0,0 +1,66 @@
+package users
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthServer(t *testing.T, token string, known User) *httptest.Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.GET("/v1/internal/users", func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "Bearer "+token {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid internal token"})
+			return
+		}
+		if c.Query("username") == known.Username || c.Query("id") == known.Id.String() {
+			c.JSON(http.StatusOK, known)
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	})
+
+	server := httptest.NewTLSServer(r)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient(t *testing.T) {
+	known := User{Id: uuid.New(), Username: "alice"}
+	server := newAuthServer(t, "secret", known)
+	ctx := context.Background()
+
+	certFile := filepath.Join(t.TempDir(), "cert.crt")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(certFile, cert, 0o644))
+	httpClient, err := jwks.NewPinnedClient(certFile)
+	require.NoError(t, err)
+
+	client := NewClient(server.URL+"/", "secret", httpClient)
+	user, err := client.LookupUsername(ctx, "alice")
+	require.NoError(t, err)
+	assert.Equal(t, known, user)
+
+	user, err = client.LookupId(ctx, known.Id)
+	require.NoError(t, err)
+	assert.Equal(t, known, user)
+
+	_, err = client.LookupUsername(ctx, "bob")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	_, err = NewClient(server.URL, "wrong", httpClient).LookupUsername(ctx, "alice")
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
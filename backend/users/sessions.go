@@ -0,0 +1,134 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SessionChecker reports whether a login session of the auth service can
+// still be used by the user.
+type SessionChecker interface {
+	SessionActive(ctx context.Context, sessionId, userId uuid.UUID) (bool, error)
+}
+
+type sessionStatus struct {
+	Id     uuid.UUID `json:"id"`
+	UserId uuid.UUID `json:"userId"`
+	Active bool      `json:"active"`
+}
+
+// SessionActive asks the auth service about the session. Unknown sessions and
+// sessions of other users are not active.
+func (c *Client) SessionActive(ctx context.Context, sessionId, userId uuid.UUID) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/v1/internal/sessions/"+url.PathEscape(sessionId.String()), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: status %d", ErrUnavailable, resp.StatusCode)
+	}
+
+	var status sessionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	return status.Active && status.UserId == userId, nil
+}
+
+// SessionCache remembers answers of a SessionChecker for ttl, so a revoked
+// session is rejected at most ttl after the revocation. While the checker
+// fails, answers are served up to maxStale old; without one the error is
+// returned and the session must not be trusted.
+type SessionCache struct {
+	checker   SessionChecker
+	ttl       time.Duration
+	maxStale  time.Duration
+	mu        sync.Mutex
+	entries   map[uuid.UUID]sessionEntry
+	lastEvict time.Time
+}
+
+type sessionEntry struct {
+	userId  uuid.UUID
+	active  bool
+	checked time.Time
+}
+
+// NewSessionCache returns a cache asking checker again after ttl and serving
+// answers up to maxStale old while it fails. maxStale is at least ttl.
+func NewSessionCache(checker SessionChecker, ttl time.Duration, maxStale time.Duration) *SessionCache {
+	return &SessionCache{
+		checker:  checker,
+		ttl:      ttl,
+		maxStale: max(maxStale, ttl),
+		entries:  make(map[uuid.UUID]sessionEntry),
+	}
+}
+
+func (s *SessionCache) SessionActive(ctx context.Context, sessionId, userId uuid.UUID) (bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	if now.Sub(s.lastEvict) > s.maxStale {
+		s.evict(now)
+	}
+	entry, ok := s.entries[sessionId]
+	s.mu.Unlock()
+	ok = ok && entry.userId == userId
+	if ok && now.Sub(entry.checked) < s.ttl {
+		return entry.active, nil
+	}
+
+	active, err := s.checker.SessionActive(ctx, sessionId, userId)
+	if err != nil {
+		if ok && now.Sub(entry.checked) < s.maxStale {
+			return entry.active, nil
+		}
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.entries[sessionId] = sessionEntry{userId: userId, active: active, checked: now}
+	s.mu.Unlock()
+
+	return active, nil
+}
+
+// evict forgets answers older than maxStale. Must be called with the lock
+// held.
+func (s *SessionCache) evict(now time.Time) {
+	for id, entry := range s.entries {
+		if now.Sub(entry.checked) >= s.maxStale {
+			delete(s.entries, id)
+		}
+	}
+	s.lastEvict = now
+}
+
+// Len returns the number of remembered sessions.
+func (s *SessionCache) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.entries)
+}
@@ -0,0 +1,129 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSessionActive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	userId, active, revoked := uuid.New(), uuid.New(), uuid.New()
+
+	r := gin.New()
+	r.GET("/v1/internal/sessions/:id", func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "Bearer secret" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid internal token"})
+			return
+		}
+		switch c.Param("id") {
+		case active.String():
+			c.JSON(http.StatusOK, sessionStatus{Id: active, UserId: userId, Active: true})
+		case revoked.String():
+			c.JSON(http.StatusOK, sessionStatus{Id: revoked, UserId: userId, Active: false})
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		}
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL, "secret", nil)
+
+	ok, err := client.SessionActive(ctx, active, userId)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = client.SessionActive(ctx, active, uuid.New())
+	require.NoError(t, err)
+	assert.False(t, ok, "session of another user")
+
+	ok, err = client.SessionActive(ctx, revoked, userId)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = client.SessionActive(ctx, uuid.New(), userId)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = NewClient(server.URL, "wrong", nil).SessionActive(ctx, active, userId)
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
+
+type fakeChecker struct {
+	active map[uuid.UUID]bool
+	err    error
+	calls  int
+}
+
+func (f *fakeChecker) SessionActive(_ context.Context, sessionId, _ uuid.UUID) (bool, error) {
+	f.calls++
+	return f.active[sessionId], f.err
+}
+
+func TestSessionCache(t *testing.T) {
+	ctx := context.Background()
+	userId, sessionId := uuid.New(), uuid.New()
+	checker := &fakeChecker{active: map[uuid.UUID]bool{sessionId: true}}
+	cache := NewSessionCache(checker, 50*time.Millisecond, 150*time.Millisecond)
+
+	for range 3 {
+		ok, err := cache.SessionActive(ctx, sessionId, userId)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 1, checker.calls)
+
+	// A revocation is seen once the answer expires.
+	checker.active[sessionId] = false
+	ok, _ := cache.SessionActive(ctx, sessionId, userId)
+	assert.True(t, ok)
+	time.Sleep(60 * time.Millisecond)
+	ok, err := cache.SessionActive(ctx, sessionId, userId)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 2, checker.calls)
+
+	// Another user never gets the cached answer.
+	_, err = cache.SessionActive(ctx, sessionId, uuid.New())
+	require.NoError(t, err)
+	assert.Equal(t, 3, checker.calls)
+
+	// Without an answer, failures reject sessions and aren't remembered.
+	checker.err = errors.New("down")
+	other := uuid.New()
+	ok, err = cache.SessionActive(ctx, other, userId)
+	assert.Error(t, err)
+	assert.False(t, ok)
+	_, _ = cache.SessionActive(ctx, other, userId)
+	assert.Equal(t, 5, checker.calls)
+
+	// Expired answers are served while the checker fails, up to maxStale.
+	checker.err = nil
+	checker.active[other] = true
+	_, err = cache.SessionActive(ctx, other, userId)
+	require.NoError(t, err)
+	checker.err = errors.New("down")
+	time.Sleep(60 * time.Millisecond)
+	ok, err = cache.SessionActive(ctx, other, userId)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	time.Sleep(100 * time.Millisecond)
+	ok, err = cache.SessionActive(ctx, other, userId)
+	assert.Error(t, err)
+	assert.False(t, ok)
+
+	// Old answers are evicted.
+	checker.err = nil
+	_, _ = cache.SessionActive(ctx, other, userId)
+	assert.Equal(t, 1, cache.Len())
+}
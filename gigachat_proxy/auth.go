@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
+	"github.com/gin-gonic/gin"
+)
+
+// authMiddleware lets through requests with an access token of the auth
+// service, so only users of the editor spend the Gigachat quota.
+func authMiddleware(keys jwks.Keys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, err := c.Cookie("access_token")
+		if err != nil || token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token not provided"})
+			return
+		}
+
+		claims, err := jwks.Parse(c.Request.Context(), keys, token)
+		switch {
+		case errors.Is(err, jwks.ErrTokenExpired):
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token has expired"})
+			return
+		case errors.Is(err, jwks.ErrUnavailable):
+			log.Println("Error fetching signing keys:", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "token can't be verified now"})
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+			return
+		}
+
+		userId, ok := claims["user_id"].(string)
+		if !ok || userId == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token claims"})
+			return
+		}
+
+		c.Set("user_id", userId)
+		c.Next()
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/Prekols-Inc/Markdown-editor/lib/jwks"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
@@ -27,8 +28,19 @@ func main() {
 	r := gin.Default()
 	r.Use(corsMiddleware())
 
+	// The certificate of the auth service is pinned when AUTH_CERT_FILE is
+	// set.
+	authClient, err := jwks.NewClientFromEnv()
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create auth client: %v", err))
+	}
+	keys, err := jwks.NewFetcherFromEnv(authClient)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to set up token verification: %v", err))
+	}
+
 	r.GET("/health", healthHandler)
-	r.POST("/api/gigachat/summarize", summarizeHandler)
+	r.POST("/api/gigachat/summarize", authMiddleware(keys), summarizeHandler)
 
 	host := os.Getenv("GIGACHAT_PROXY_HOST")
 	port := os.Getenv("GIGACHAT_PROXY_PORT")
@@ -0,0 +1,87 @@
+package jwks
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// CACHE_TTL is how long the signing keys of the auth service are used before
+// they are downloaded again. Tokens signed with unknown keys cause a download
+// earlier.
+const CACHE_TTL = 10 * time.Minute
+
+// NewFetcherFromEnv returns the keys access tokens of the auth service are
+// verified with, the key set at JWKS_URL or else the one published at
+// AUTH_URL. A nil httpClient uses a default one.
+func NewFetcherFromEnv(httpClient *http.Client) (*Fetcher, error) {
+	url := os.Getenv("JWKS_URL")
+	if url == "" {
+		authURL := os.Getenv("AUTH_URL")
+		if authURL == "" {
+			return nil, errors.New("JWKS_URL or AUTH_URL not provided")
+		}
+		url = strings.TrimSuffix(authURL, "/") + "/.well-known/jwks.json"
+	}
+	if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+		return nil, fmt.Errorf("invalid key set URL %q", url)
+	}
+
+	return NewFetcher(url, httpClient, CACHE_TTL), nil
+}
+
+// NewClientFromEnv returns the client for requests to the auth service,
+// pinning its certificate when AUTH_CERT_FILE is set, or nil for the default
+// one.
+func NewClientFromEnv() (*http.Client, error) {
+	certFile := os.Getenv("AUTH_CERT_FILE")
+	if certFile == "" {
+		return nil, nil
+	}
+
+	httpClient, err := NewPinnedClient(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load auth certificate: %w", err)
+	}
+	return httpClient, nil
+}
+
+// NewPinnedClient returns an HTTP client accepting only the server
+// certificate stored in certFile. The services use self-signed certificates,
+// which can't be verified against a host name.
+func NewPinnedClient(certFile string) (*http.Client, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in %s", certFile)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, err
+	}
+	pinned := block.Bytes
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		// The certificate is checked by VerifyPeerCertificate instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+				return errors.New("unexpected server certificate")
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{Timeout: REQUEST_TIMEOUT, Transport: transport}, nil
+}
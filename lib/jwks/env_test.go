@@ -0,0 +1,68 @@
+package jwks
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFetcherFromEnv(t *testing.T) {
+	t.Setenv("JWKS_URL", "")
+	t.Setenv("AUTH_URL", "")
+	_, err := NewFetcherFromEnv(nil)
+	assert.Error(t, err)
+
+	t.Setenv("AUTH_URL", "https://auth:8080/")
+	fetcher, err := NewFetcherFromEnv(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "https://auth:8080/.well-known/jwks.json", fetcher.url)
+	assert.Equal(t, CACHE_TTL, fetcher.ttl)
+
+	t.Setenv("JWKS_URL", "http://keys/jwks.json")
+	fetcher, err = NewFetcherFromEnv(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://keys/jwks.json", fetcher.url)
+
+	t.Setenv("JWKS_URL", "file:///etc/jwks.json")
+	_, err = NewFetcherFromEnv(nil)
+	assert.Error(t, err)
+}
+
+func TestNewPinnedClient(t *testing.T) {
+	key, _ := newEd25519Key(t, "first")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwk, err := NewJWK(key)
+		require.NoError(t, err)
+		require.NoError(t, json.NewEncoder(w).Encode(Set{Keys: []JWK{jwk}}))
+	}))
+	defer server.Close()
+
+	certFile := filepath.Join(t.TempDir(), "cert.crt")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(certFile, cert, 0o644))
+
+	t.Setenv("AUTH_CERT_FILE", certFile)
+	client, err := NewClientFromEnv()
+	require.NoError(t, err)
+
+	got, err := NewFetcher(server.URL, client, CACHE_TTL).Lookup(context.Background(), "first")
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	t.Setenv("AUTH_CERT_FILE", filepath.Join(t.TempDir(), "missing.crt"))
+	_, err = NewClientFromEnv()
+	assert.Error(t, err)
+
+	t.Setenv("AUTH_CERT_FILE", "")
+	client, err = NewClientFromEnv()
+	require.NoError(t, err)
+	assert.Nil(t, client)
+}
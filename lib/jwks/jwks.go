@@ -0,0 +1,279 @@
+// Package jwks publishes the public keys access tokens are signed with as a
+// JSON Web Key Set and verifies tokens against such a set.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms.
+const (
+	ALG_RS256 = "RS256"
+	ALG_EDDSA = "EdDSA"
+)
+
+const (
+	// REQUEST_TIMEOUT limits a download of the key set.
+	REQUEST_TIMEOUT = 5 * time.Second
+	// MIN_REFRESH_INTERVAL limits downloads caused by tokens with unknown
+	// key ids, which anyone can make up.
+	MIN_REFRESH_INTERVAL = 30 * time.Second
+)
+
+var (
+	ErrUnknownKey  = errors.New("unknown signing key")
+	ErrUnavailable = errors.New("key set is unavailable")
+	// ErrTokenExpired is returned by Parse for expired tokens.
+	ErrTokenExpired = jwt.ErrTokenExpired
+)
+
+// Key is a public key of a signer, identified by Id.
+type Key struct {
+	Id     string
+	Alg    string
+	Public crypto.PublicKey
+}
+
+// JWK is a public key in the JSON Web Key format, RSA or Ed25519.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Set is a JSON Web Key Set.
+type Set struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// NewJWK returns the key in the JSON Web Key format.
+func NewJWK(key Key) (JWK, error) {
+	jwk := JWK{Kid: key.Id, Use: "sig", Alg: key.Alg}
+
+	switch public := key.Public.(type) {
+	case *rsa.PublicKey:
+		if key.Alg != ALG_RS256 {
+			return JWK{}, fmt.Errorf("RSA key %s with algorithm %s", key.Id, key.Alg)
+		}
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(public.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		if key.Alg != ALG_EDDSA {
+			return JWK{}, fmt.Errorf("Ed25519 key %s with algorithm %s", key.Id, key.Alg)
+		}
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64.EncodeToString(public)
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", key.Public)
+	}
+
+	return jwk, nil
+}
+
+// Key parses the key. Only signing keys of the supported algorithms are
+// accepted.
+func (k JWK) Key() (Key, error) {
+	if k.Kid == "" {
+		return Key{}, errors.New("key without id")
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return Key{}, fmt.Errorf("key %s is not for signatures", k.Kid)
+	}
+
+	switch {
+	case k.Kty == "RSA" && k.Alg == ALG_RS256:
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return Key{}, fmt.Errorf("key %s: invalid modulus: %w", k.Kid, err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return Key{}, fmt.Errorf("key %s: invalid exponent: %w", k.Kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return Key{}, fmt.Errorf("key %s: weak or invalid RSA key", k.Kid)
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		return Key{Id: k.Kid, Alg: ALG_RS256, Public: public}, nil
+
+	case k.Kty == "OKP" && k.Crv == "Ed25519" && k.Alg == ALG_EDDSA:
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return Key{}, fmt.Errorf("key %s: invalid Ed25519 key", k.Kid)
+		}
+		return Key{Id: k.Kid, Alg: ALG_EDDSA, Public: ed25519.PublicKey(x)}, nil
+	}
+
+	return Key{}, fmt.Errorf("key %s: unsupported key type %s with algorithm %s", k.Kid, k.Kty, k.Alg)
+}
+
+// Keys finds the public key a token was signed with by its key id.
+type Keys interface {
+	Lookup(ctx context.Context, kid string) (Key, error)
+}
+
+// StaticKeys is a fixed set of keys by id.
+type StaticKeys map[string]Key
+
+func NewStaticKeys(keys ...Key) StaticKeys {
+	s := StaticKeys{}
+	for _, key := range keys {
+		s[key.Id] = key
+	}
+	return s
+}
+
+func (s StaticKeys) Lookup(_ context.Context, kid string) (Key, error) {
+	key, ok := s[kid]
+	if !ok {
+		return Key{}, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// Parse verifies the signature and the expiration of the token and returns
+// its claims. The token must name its key with kid and be signed with the
+// algorithm of that key, one of the supported ones.
+func Parse(ctx context.Context, keys Keys, tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("token without key id")
+		}
+		key, err := keys.Lookup(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Alg != token.Method.Alg() {
+			return nil, fmt.Errorf("key %s is not used with %s", kid, token.Method.Alg())
+		}
+		return key.Public, nil
+	}, jwt.WithValidMethods([]string{ALG_RS256, ALG_EDDSA}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// Fetcher downloads a key set from url and keeps it for ttl. Keys not in the
+// set are looked for in a fresh download, at most every MIN_REFRESH_INTERVAL,
+// so new keys are found right away. While downloads fail, the last
+// downloaded keys stay in use.
+type Fetcher struct {
+	url       string
+	http      *http.Client
+	ttl       time.Duration
+	mu        sync.Mutex
+	keys      map[string]Key
+	fetched   time.Time
+	attempted time.Time
+}
+
+func NewFetcher(url string, httpClient *http.Client, ttl time.Duration) *Fetcher {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: REQUEST_TIMEOUT}
+	}
+
+	return &Fetcher{url: url, http: httpClient, ttl: ttl}
+}
+
+func (f *Fetcher) Lookup(ctx context.Context, kid string) (Key, error) {
+	// Downloads happen with the lock held, so concurrent requests wait for
+	// one download instead of making their own.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	key, ok := f.keys[kid]
+	stale := now.Sub(f.fetched) >= f.ttl
+	if ok && !stale {
+		return key, nil
+	}
+	if now.Sub(f.attempted) < MIN_REFRESH_INTERVAL {
+		if ok {
+			return key, nil
+		}
+		if f.keys == nil {
+			return Key{}, ErrUnavailable
+		}
+		return Key{}, ErrUnknownKey
+	}
+
+	f.attempted = now
+	keys, err := f.fetch(ctx)
+	if err != nil {
+		if ok {
+			return key, nil
+		}
+		return Key{}, err
+	}
+	f.keys = keys
+	f.fetched = now
+
+	key, ok = keys[kid]
+	if !ok {
+		return Key{}, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (f *Fetcher) fetch(ctx context.Context) (map[string]Key, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrUnavailable, resp.StatusCode)
+	}
+
+	var set Set
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	// Keys of unsupported types are skipped, the signer may publish keys
+	// the verifiers don't use.
+	keys := map[string]Key{}
+	for _, jwk := range set.Keys {
+		if key, err := jwk.Key(); err == nil {
+			keys[key.Id] = key
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,156 @@
+package jwks
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEd25519Key(t *testing.T, id string) (Key, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return Key{Id: id, Alg: ALG_EDDSA, Public: public}, private
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, private any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(private)
+	require.NoError(t, err)
+	return s
+}
+
+func TestJWKRoundTrip(t *testing.T) {
+	edKey, _ := newEd25519Key(t, "ed")
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaKey := Key{Id: "rsa", Alg: ALG_RS256, Public: &rsaPrivate.PublicKey}
+
+	for _, key := range []Key{edKey, rsaKey} {
+		jwk, err := NewJWK(key)
+		require.NoError(t, err)
+		data, err := json.Marshal(jwk)
+		require.NoError(t, err)
+
+		var parsed JWK
+		require.NoError(t, json.Unmarshal(data, &parsed))
+		got, err := parsed.Key()
+		require.NoError(t, err)
+		assert.Equal(t, key, got)
+	}
+
+	_, err = NewJWK(Key{Id: "x", Alg: ALG_RS256, Public: edKey.Public})
+	assert.Error(t, err)
+	_, err = JWK{Kty: "oct", Kid: "x", Alg: "HS256"}.Key()
+	assert.Error(t, err)
+	_, err = JWK{Kty: "OKP", Kid: "x", Crv: "Ed25519", Alg: ALG_EDDSA, X: "c2hvcnQ"}.Key()
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	ctx := context.Background()
+	key, private := newEd25519Key(t, "current")
+	other, otherPrivate := newEd25519Key(t, "other")
+	keys := NewStaticKeys(key, other)
+	valid := jwt.MapClaims{"user_id": "u", "exp": time.Now().Add(time.Minute).Unix()}
+
+	claims, err := Parse(ctx, keys, sign(t, jwt.SigningMethodEdDSA, "current", private, valid))
+	require.NoError(t, err)
+	assert.Equal(t, "u", claims["user_id"])
+
+	_, err = Parse(ctx, keys, sign(t, jwt.SigningMethodEdDSA, "current", private,
+		jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}))
+	assert.ErrorIs(t, err, ErrTokenExpired)
+
+	rejected := map[string]string{
+		"without kid":       sign(t, jwt.SigningMethodEdDSA, "", private, valid),
+		"unknown kid":       sign(t, jwt.SigningMethodEdDSA, "missing", private, valid),
+		"key of another id": sign(t, jwt.SigningMethodEdDSA, "current", otherPrivate, valid),
+		"without exp":       sign(t, jwt.SigningMethodEdDSA, "current", private, jwt.MapClaims{"user_id": "u"}),
+		"symmetric":         sign(t, jwt.SigningMethodHS256, "current", []byte("secret"), valid),
+		"none":              sign(t, jwt.SigningMethodNone, "current", jwt.UnsafeAllowNoneSignatureType, valid),
+	}
+	for name, token := range rejected {
+		_, err := Parse(ctx, keys, token)
+		assert.Error(t, err, name)
+	}
+
+	// A key is only accepted with its own algorithm.
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keys["rsa"] = Key{Id: "rsa", Alg: ALG_EDDSA, Public: &rsaPrivate.PublicKey}
+	_, err = Parse(ctx, keys, sign(t, jwt.SigningMethodRS256, "rsa", rsaPrivate, valid))
+	assert.Error(t, err)
+}
+
+func TestFetcher(t *testing.T) {
+	ctx := context.Background()
+	first, _ := newEd25519Key(t, "first")
+	second, _ := newEd25519Key(t, "second")
+
+	published := []Key{first}
+	var requests atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		set := Set{Keys: []JWK{}}
+		for _, key := range published {
+			jwk, err := NewJWK(key)
+			require.NoError(t, err)
+			set.Keys = append(set.Keys, jwk)
+		}
+		set.Keys = append(set.Keys, JWK{Kty: "oct", Kid: "symmetric", Alg: "HS256"})
+		require.NoError(t, json.NewEncoder(w).Encode(set))
+	}))
+	defer server.Close()
+
+	fetcher := NewFetcher(server.URL, nil, time.Hour)
+	for range 3 {
+		key, err := fetcher.Lookup(ctx, "first")
+		require.NoError(t, err)
+		assert.Equal(t, first, key)
+	}
+	assert.EqualValues(t, 1, requests.Load())
+
+	_, err := fetcher.Lookup(ctx, "symmetric")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	// Unknown keys are looked for again, but not too often.
+	published = append(published, second)
+	_, err = fetcher.Lookup(ctx, "second")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.EqualValues(t, 1, requests.Load())
+	fetcher.attempted = time.Time{}
+	key, err := fetcher.Lookup(ctx, "second")
+	require.NoError(t, err)
+	assert.Equal(t, second, key)
+	assert.EqualValues(t, 2, requests.Load())
+
+	// Stale keys are kept while the key set can't be downloaded.
+	failing.Store(true)
+	fetcher.fetched, fetcher.attempted = time.Time{}, time.Time{}
+	key, err = fetcher.Lookup(ctx, "first")
+	require.NoError(t, err)
+	assert.Equal(t, first, key)
+	assert.EqualValues(t, 3, requests.Load())
+
+	_, err = NewFetcher(server.URL, nil, time.Hour).Lookup(ctx, "first")
+	assert.ErrorIs(t, err, ErrUnavailable)
+}